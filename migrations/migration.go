@@ -1,8 +1,10 @@
 package migrations
 
 import (
+	"context"
 	"database/sql"
 	"embed"
+	"fmt"
 
 	_ "github.com/jackc/pgx/v4/stdlib"
 	"github.com/pressly/goose/v3"
@@ -31,3 +33,42 @@ func ApplyMigrations(uri string) error {
 	}
 	return nil
 }
+
+// ExpectedVersion returns the version of the latest embedded migration.
+func ExpectedVersion() (int64, error) {
+	goose.SetBaseFS(embedMigrations)
+
+	migrations, err := goose.CollectMigrations("sql", 0, goose.MaxVersion)
+	if err != nil {
+		return 0, err
+	}
+	last, err := migrations.Last()
+	if err != nil {
+		return 0, err
+	}
+	return last.Version, nil
+}
+
+// DBVersion returns the latest migration applied to db. goose deletes the
+// row of a migration when it is rolled back, so the maximum is current.
+func DBVersion(ctx context.Context, db *sql.DB) (int64, error) {
+	var version int64
+	err := db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version_id), 0) FROM "+goose.TableName()).Scan(&version)
+	return version, err
+}
+
+// CheckVersion fails unless db is migrated to ExpectedVersion.
+func CheckVersion(ctx context.Context, db *sql.DB) error {
+	expected, err := ExpectedVersion()
+	if err != nil {
+		return err
+	}
+	current, err := DBVersion(ctx, db)
+	if err != nil {
+		return err
+	}
+	if current != expected {
+		return fmt.Errorf("database is at version %d, expected %d", current, expected)
+	}
+	return nil
+}
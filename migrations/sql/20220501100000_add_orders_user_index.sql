@@ -0,0 +1,7 @@
+-- +goose Up
+CREATE INDEX if not exists orders_user_uploaded_idx
+    ON public.orders (user_id, tx_type, uploaded_at, order_id);
+
+
+-- +goose Down
+DROP INDEX if exists public.orders_user_uploaded_idx;
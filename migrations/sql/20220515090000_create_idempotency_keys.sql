@@ -0,0 +1,19 @@
+-- +goose Up
+CREATE TABLE if not exists public.idempotency_keys
+(
+    user_id         BIGINT       NOT NULL,
+    idempotency_key VARCHAR(255) NOT NULL,
+    request_hash    TEXT         NOT NULL,
+    status          INT          NOT NULL DEFAULT 0,
+    content_type    TEXT         NOT NULL DEFAULT '',
+    body            BYTEA,
+    created_at      TIMESTAMP    NOT NULL,
+    PRIMARY KEY (user_id, idempotency_key),
+    CONSTRAINT fk_user
+        FOREIGN KEY (user_id)
+            REFERENCES users (user_id)
+);
+
+
+-- +goose Down
+DROP TABLE if exists public.idempotency_keys;
@@ -0,0 +1,21 @@
+-- +goose Up
+CREATE TABLE if not exists public.order_events
+(
+    event_id   BIGINT GENERATED ALWAYS AS IDENTITY,
+    order_id   BIGINT      NOT NULL,
+    user_id    BIGINT      NOT NULL,
+    status     VARCHAR(50) NOT NULL,
+    accrual    NUMERIC DEFAULT 0,
+    created_at TIMESTAMP   NOT NULL,
+    PRIMARY KEY (event_id),
+    CONSTRAINT fk_order
+        FOREIGN KEY (order_id)
+            REFERENCES orders (order_id)
+);
+
+CREATE INDEX if not exists order_events_user_idx
+    ON public.order_events (user_id, event_id);
+
+
+-- +goose Down
+DROP TABLE if exists public.order_events;
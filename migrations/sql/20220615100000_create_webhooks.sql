@@ -0,0 +1,45 @@
+-- +goose Up
+CREATE TABLE if not exists public.webhooks
+(
+    webhook_id  BIGINT GENERATED ALWAYS AS IDENTITY,
+    user_id     BIGINT    NOT NULL,
+    url         TEXT      NOT NULL,
+    secret      TEXT      NOT NULL,
+    event_types TEXT      NOT NULL DEFAULT '',
+    created_at  TIMESTAMP NOT NULL,
+    PRIMARY KEY (webhook_id),
+    CONSTRAINT fk_user
+        FOREIGN KEY (user_id)
+            REFERENCES users (user_id)
+);
+
+CREATE TABLE if not exists public.webhook_deliveries
+(
+    delivery_id      BIGINT GENERATED ALWAYS AS IDENTITY,
+    webhook_id       BIGINT      NOT NULL,
+    event_type       VARCHAR(50) NOT NULL,
+    payload          TEXT        NOT NULL,
+    status           VARCHAR(50) NOT NULL,
+    attempts         INT         NOT NULL DEFAULT 0,
+    next_attempt_at  TIMESTAMP   NOT NULL,
+    last_status_code INT,
+    last_error       TEXT,
+    created_at       TIMESTAMP   NOT NULL,
+    delivered_at     TIMESTAMP,
+    PRIMARY KEY (delivery_id),
+    CONSTRAINT fk_webhook
+        FOREIGN KEY (webhook_id)
+            REFERENCES webhooks (webhook_id)
+            ON DELETE CASCADE
+);
+
+CREATE INDEX if not exists webhook_deliveries_due_idx
+    ON public.webhook_deliveries (status, next_attempt_at);
+
+CREATE INDEX if not exists webhook_deliveries_webhook_idx
+    ON public.webhook_deliveries (webhook_id, delivery_id);
+
+
+-- +goose Down
+DROP TABLE if exists public.webhook_deliveries;
+DROP TABLE if exists public.webhooks;
@@ -0,0 +1,7 @@
+-- +goose Up
+CREATE INDEX if not exists orders_user_version_idx
+    ON public.orders (user_id) INCLUDE (uploaded_at, processed_at);
+
+
+-- +goose Down
+DROP INDEX if exists public.orders_user_version_idx;
@@ -0,0 +1,29 @@
+-- +goose Up
+ALTER TABLE public.users
+    ADD COLUMN if not exists is_admin BOOLEAN NOT NULL DEFAULT false;
+
+CREATE TABLE if not exists public.balance_adjustments
+(
+    adjustment_id BIGINT GENERATED ALWAYS AS IDENTITY,
+    user_id       BIGINT    NOT NULL,
+    admin_id      BIGINT    NOT NULL,
+    amount        NUMERIC   NOT NULL,
+    reason        TEXT      NOT NULL,
+    created_at    TIMESTAMP NOT NULL,
+    PRIMARY KEY (adjustment_id),
+    CONSTRAINT fk_user
+        FOREIGN KEY (user_id)
+            REFERENCES users (user_id),
+    CONSTRAINT fk_admin
+        FOREIGN KEY (admin_id)
+            REFERENCES users (user_id)
+);
+
+CREATE INDEX if not exists balance_adjustments_user_idx
+    ON public.balance_adjustments (user_id, created_at);
+
+
+-- +goose Down
+DROP TABLE if exists public.balance_adjustments;
+ALTER TABLE public.users
+    DROP COLUMN if exists is_admin;
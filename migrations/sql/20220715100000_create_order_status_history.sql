@@ -0,0 +1,26 @@
+-- +goose Up
+CREATE TABLE if not exists public.order_status_history
+(
+    history_id BIGINT GENERATED ALWAYS AS IDENTITY,
+    order_id   BIGINT      NOT NULL,
+    status     VARCHAR(50) NOT NULL,
+    accrual    NUMERIC DEFAULT 0,
+    changed_at TIMESTAMP   NOT NULL,
+    PRIMARY KEY (history_id),
+    CONSTRAINT fk_order
+        FOREIGN KEY (order_id)
+            REFERENCES orders (order_id)
+);
+
+CREATE INDEX if not exists order_status_history_order_idx
+    ON public.order_status_history (order_id, changed_at);
+
+-- order events hold every status change made before this migration
+INSERT INTO public.order_status_history (order_id, status, accrual, changed_at)
+SELECT order_id, status, accrual, created_at
+FROM public.order_events
+ORDER BY event_id;
+
+
+-- +goose Down
+DROP TABLE if exists public.order_status_history;
@@ -0,0 +1,23 @@
+-- +goose Up
+CREATE TABLE if not exists public.refresh_tokens
+(
+    token_id   BIGINT GENERATED ALWAYS AS IDENTITY,
+    token_hash TEXT        NOT NULL UNIQUE,
+    family_id  VARCHAR(64) NOT NULL,
+    user_id    BIGINT      NOT NULL,
+    created_at TIMESTAMP   NOT NULL,
+    expires_at TIMESTAMP   NOT NULL,
+    used_at    TIMESTAMP,
+    revoked_at TIMESTAMP,
+    PRIMARY KEY (token_id),
+    CONSTRAINT fk_user
+        FOREIGN KEY (user_id)
+            REFERENCES users (user_id)
+);
+
+CREATE INDEX if not exists refresh_tokens_family_idx
+    ON public.refresh_tokens (family_id);
+
+
+-- +goose Down
+DROP TABLE if exists public.refresh_tokens;
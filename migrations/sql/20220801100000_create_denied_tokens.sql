@@ -0,0 +1,11 @@
+-- +goose Up
+CREATE TABLE if not exists public.denied_tokens
+(
+    token_id   VARCHAR(64) NOT NULL,
+    expires_at TIMESTAMP   NOT NULL,
+    PRIMARY KEY (token_id)
+);
+
+
+-- +goose Down
+DROP TABLE if exists public.denied_tokens;
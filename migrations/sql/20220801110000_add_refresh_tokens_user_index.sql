@@ -0,0 +1,7 @@
+-- +goose Up
+CREATE INDEX if not exists refresh_tokens_user_idx
+    ON public.refresh_tokens (user_id, family_id);
+
+
+-- +goose Down
+DROP INDEX if exists public.refresh_tokens_user_idx;
@@ -0,0 +1,18 @@
+-- +goose Up
+-- statuses forced by an admin record who did it and why
+ALTER TABLE public.order_status_history
+    ADD COLUMN if not exists admin_id BIGINT,
+    ADD COLUMN if not exists reason   TEXT;
+
+ALTER TABLE public.order_status_history
+    DROP CONSTRAINT if exists fk_admin,
+    ADD CONSTRAINT fk_admin
+        FOREIGN KEY (admin_id)
+            REFERENCES users (user_id);
+
+
+-- +goose Down
+ALTER TABLE public.order_status_history
+    DROP CONSTRAINT if exists fk_admin,
+    DROP COLUMN if exists reason,
+    DROP COLUMN if exists admin_id;
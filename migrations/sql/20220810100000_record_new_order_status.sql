@@ -0,0 +1,23 @@
+-- +goose Up
+-- the status history starts with the upload, orders uploaded before it
+-- was recorded get their NEW entry backfilled
+INSERT INTO public.order_status_history (order_id, status, accrual, changed_at)
+SELECT order_id, 'NEW', 0, uploaded_at
+FROM public.orders o
+WHERE tx_type = 'deposit'
+  AND NOT EXISTS(SELECT 1
+                 FROM public.order_status_history h
+                 WHERE h.order_id = o.order_id
+                   AND h.status = 'NEW'
+                   AND h.changed_at = o.uploaded_at)
+ORDER BY uploaded_at, order_id;
+
+
+-- +goose Down
+DELETE
+FROM public.order_status_history h
+    USING public.orders o
+WHERE h.order_id = o.order_id
+  AND h.status = 'NEW'
+  AND h.admin_id IS NULL
+  AND h.changed_at = o.uploaded_at;
@@ -3,17 +3,27 @@ package bonussystem
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"sync/atomic"
 	"time"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 
 	"github.com/go-resty/resty/v2"
+	"github.com/shopspring/decimal"
 
 	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
 	"github.com/OmAsana/go-yapraktikum-final/pkg/repo"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/tracing"
 )
 
+var tracer = otel.Tracer("github.com/OmAsana/go-yapraktikum-final/pkg/bonussystem")
+
 type OrderStatus string
 
 var (
@@ -26,26 +36,59 @@ var (
 type AccrualResp struct {
 	Order   string
 	Status  OrderStatus
-	Accrual float64
+	Accrual decimal.Decimal
+}
+
+// Notifier is told about users whose orders were updated.
+type Notifier interface {
+	Notify(userID int)
 }
 
+// Metrics is told about the work of the poller.
+type Metrics interface {
+	PollCycle()
+	// AccrualCall gets 0 when the request failed without a response.
+	AccrualCall(code int)
+	OrderTransitioned(status models.OrderStatus)
+	QueueDepth(n int)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) PollCycle()                           {}
+func (noopMetrics) AccrualCall(int)                      {}
+func (noopMetrics) OrderTransitioned(models.OrderStatus) {}
+func (noopMetrics) QueueDepth(int)                       {}
+
+// readyWindow is how long a response from the accrual system keeps it
+// ready without probing it again.
+const readyWindow = time.Minute
+
 type BonusSystem struct {
 	endpoint       string
 	orderRepo      repo.OrderRepository
 	log            *zap.Logger
 	client         *resty.Client
 	updateInterval time.Duration
+	notifier       Notifier
+	metrics        Metrics
+
+	// lastResponse is the unix time in nanoseconds the accrual system
+	// last answered
+	lastResponse int64
 }
 
 func NewBonusSystem(endpoint string, orderRepo repo.OrderRepository, logger *zap.Logger, opts ...Option) *BonusSystem {
 	client := resty.New()
 	client.SetBaseURL(endpoint + "/api/orders")
+	client.SetTransport(tracing.NewTransport(http.DefaultTransport))
 
 	b := &BonusSystem{
 		orderRepo:      orderRepo,
 		log:            logger,
 		client:         client,
 		updateInterval: 1 * time.Second,
+		metrics:        noopMetrics{},
 	}
 
 	for _, v := range opts {
@@ -56,47 +99,150 @@ func NewBonusSystem(endpoint string, orderRepo repo.OrderRepository, logger *zap
 }
 
 func (s *BonusSystem) updateOrders(ctx context.Context, orders []*models.Order) {
-
 	for _, o := range orders {
-		resp, err := s.client.R().SetContext(ctx).Get(fmt.Sprintf("%d", o.OrderID))
-		if err != nil {
-			s.log.Error("Error quering remote api", zap.Error(err))
-			return
-		}
-		if resp.IsError() {
-			s.log.Error("Remote api return error", zap.Any("err", resp.Error()))
+		if !s.updateOrder(ctx, o) {
 			return
 		}
+	}
+}
 
-		var accrualResp AccrualResp
+// updateOrder asks the accrual system about a single order. It reports
+// false when the accrual system misbehaves and polling should stop until
+// the next cycle.
+func (s *BonusSystem) updateOrder(ctx context.Context, o *models.Order) bool {
+	ctx, span := tracer.Start(ctx, "bonussystem.updateOrder", trace.WithAttributes(attribute.Int("order.id", o.OrderID)))
+	defer span.End()
 
-		err = json.Unmarshal(resp.Body(), &accrualResp)
-		if err != nil {
-			s.log.Error("Error unmarshaling json", zap.Error(err))
-			return
-		}
+	if o.Status == models.NewStatus && !s.claimOrder(ctx, o) {
+		return true
+	}
 
-		switch accrualResp.Status {
-		case StatusInvalid:
-			o.Status = models.InvalidStatus
-		case StatusProcessed:
-			o.Status = models.ProcessedStatus
-			o.Accrual = accrualResp.Accrual
-		default:
-			// do no process other statuses
-			continue
-		}
+	resp, err := s.client.R().SetContext(ctx).Get(fmt.Sprintf("%d", o.OrderID))
+	if err != nil {
+		s.metrics.AccrualCall(0)
+		s.log.Error("Error quering remote api", zap.Error(err))
+		return false
+	}
+	s.observe(resp)
+	if resp.IsError() {
+		s.log.Error("Remote api return error", zap.Any("err", resp.Error()))
+		return false
+	}
+
+	var accrualResp AccrualResp
+
+	err = json.Unmarshal(resp.Body(), &accrualResp)
+	if err != nil {
+		s.log.Error("Error unmarshaling json", zap.Error(err))
+		return false
+	}
+
+	status, accrual := o.Status, o.Accrual
+	switch accrualResp.Status {
+	case StatusRegistered, StatusProcessing:
+		status = models.ProcessingStatus
+	case StatusInvalid:
+		status = models.InvalidStatus
+	case StatusProcessed:
+		status = models.ProcessedStatus
+		accrual = accrualResp.Accrual
+	default:
+		s.log.Warn("Unknown accrual status", zap.String("status", string(accrualResp.Status)), zap.Int("order", o.OrderID))
+		return true
+	}
+	if status == o.Status {
+		return true
+	}
 
+	// every change is stored, so the history tells when an order moved on
+	o.Status = status
+	o.Accrual = accrual
+	if status != models.ProcessingStatus {
 		o.ProcessedAt = time.Now()
+	}
 
-		err = s.orderRepo.UpdateOrder(ctx, *o)
-		if err != nil {
-			s.log.Error("Failed to update order", zap.Error(err))
-		}
+	err = s.orderRepo.UpdateOrder(ctx, *o)
+	if errors.Is(err, repo.ErrOrderNotFound) {
+		s.log.Info("Order was cancelled, skipping", zap.Int("order", o.OrderID))
+		return true
+	}
+	if err != nil {
+		s.log.Error("Failed to update order", zap.Error(err))
+		return true
+	}
+	s.metrics.OrderTransitioned(o.Status)
+
+	if s.notifier != nil {
+		s.notifier.Notify(o.UserID)
+	}
+	return true
+}
+
+// claimOrder moves a NEW order to PROCESSING before the accrual system is
+// asked about it, from then on the user can not cancel it. It reports
+// false when the order should be skipped.
+func (s *BonusSystem) claimOrder(ctx context.Context, o *models.Order) bool {
+	err := s.orderRepo.ClaimOrder(ctx, *o)
+	if errors.Is(err, repo.ErrOrderNotFound) {
+		s.log.Info("Order was cancelled or changed, skipping", zap.Int("order", o.OrderID))
+		return false
+	}
+	if err != nil {
+		s.log.Error("Failed to claim order", zap.Error(err))
+		return false
+	}
+	o.Status = models.ProcessingStatus
+	o.ProcessedAt = time.Time{}
+	s.metrics.OrderTransitioned(o.Status)
+
+	if s.notifier != nil {
+		s.notifier.Notify(o.UserID)
 	}
+	return true
+}
+
+// observe remembers that the accrual system is up. Server errors do not
+// count as a response.
+func (s *BonusSystem) observe(resp *resty.Response) {
+	s.metrics.AccrualCall(resp.StatusCode())
+	if resp.StatusCode() < http.StatusInternalServerError {
+		atomic.StoreInt64(&s.lastResponse, time.Now().UnixNano())
+	}
+}
+
+// Ready reports whether the accrual system responded recently. The poller
+// only calls it while there are unprocessed orders, so when it has been
+// quiet for a while the system is probed with an order that does not exist.
+func (s *BonusSystem) Ready(ctx context.Context) error {
+	last := time.Unix(0, atomic.LoadInt64(&s.lastResponse))
+	if time.Since(last) < readyWindow {
+		return nil
+	}
+
+	resp, err := s.client.R().SetContext(ctx).Get("0")
+	if err != nil {
+		s.metrics.AccrualCall(0)
+		return err
+	}
+	s.observe(resp)
+	if resp.StatusCode() >= http.StatusInternalServerError {
+		return fmt.Errorf("accrual system answered %s", resp.Status())
+	}
+	return nil
 }
 
 func (s *BonusSystem) processOrders(ctx context.Context) {
+	ctx, span := tracer.Start(ctx, "bonussystem.processOrders")
+	defer span.End()
+	s.metrics.PollCycle()
+
+	queued, err := s.orderRepo.CountUnprocessedOrders(ctx)
+	if err != nil {
+		s.log.Error("Error counting orders", zap.Error(err))
+	} else {
+		s.metrics.QueueDepth(queued)
+	}
+
 	limit := 10
 	offset := 0
 	for {
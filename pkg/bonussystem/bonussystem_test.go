@@ -0,0 +1,182 @@
+package bonussystem
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/logger"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/repo"
+)
+
+func newTestAccrual(t *testing.T, body string) (string, *int32) {
+	t.Helper()
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, &calls
+}
+
+// expectUpdate expects the status change of order 79927398713 of user 1 to
+// be stored along with its history and event.
+func expectUpdate(mock sqlmock.Sqlmock, status, from models.OrderStatus, accrual decimal.Decimal) {
+	var processedAt driver.Value
+	if status == models.ProcessedStatus || status == models.InvalidStatus {
+		processedAt = sqlmock.AnyArg()
+	}
+	args := []driver.Value{status, accrual, processedAt, 79927398713}
+	query := `UPDATE orders SET status = \$1, accrual = \$2, processed_at = \$3 WHERE order_id = \(\$4\) RETURNING user_id`
+	if from != "" {
+		args = append(args, from)
+		query = `UPDATE orders SET status = \$1, accrual = \$2, processed_at = \$3 WHERE order_id = \(\$4\) AND status = \$5 RETURNING user_id`
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(query).WithArgs(args...).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(1))
+	mock.ExpectExec(`INSERT INTO order_status_history`).
+		WithArgs(79927398713, status, accrual, sqlmock.AnyArg(), nil, nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO order_events`).
+		WithArgs(79927398713, 1, status, accrual, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	if processedAt != nil {
+		mock.ExpectExec(`INSERT INTO webhook_deliveries`).WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+}
+
+func TestBonusSystem_updateOrder(t *testing.T) {
+	tests := []struct {
+		name   string
+		stored models.OrderStatus
+		body   string
+		expect func(mock sqlmock.Sqlmock)
+		want   models.OrderStatus
+	}{
+		{
+			name:   "picked up when registered",
+			stored: models.NewStatus,
+			body:   `{"order":"79927398713","status":"REGISTERED"}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				expectUpdate(mock, models.ProcessingStatus, models.NewStatus, decimal.Zero)
+			},
+			want: models.ProcessingStatus,
+		},
+		{
+			name:   "picked up when processing",
+			stored: models.NewStatus,
+			body:   `{"order":"79927398713","status":"PROCESSING"}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				expectUpdate(mock, models.ProcessingStatus, models.NewStatus, decimal.Zero)
+			},
+			want: models.ProcessingStatus,
+		},
+		{
+			name:   "processed on first poll",
+			stored: models.NewStatus,
+			body:   `{"order":"79927398713","status":"PROCESSED","accrual":500}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				expectUpdate(mock, models.ProcessingStatus, models.NewStatus, decimal.Zero)
+				expectUpdate(mock, models.ProcessedStatus, "", decimal.NewFromInt(500))
+			},
+			want: models.ProcessedStatus,
+		},
+		{
+			name:   "still processing",
+			stored: models.ProcessingStatus,
+			body:   `{"order":"79927398713","status":"PROCESSING"}`,
+			expect: func(mock sqlmock.Sqlmock) {},
+			want:   models.ProcessingStatus,
+		},
+		{
+			name:   "invalid",
+			stored: models.ProcessingStatus,
+			body:   `{"order":"79927398713","status":"INVALID"}`,
+			expect: func(mock sqlmock.Sqlmock) {
+				expectUpdate(mock, models.InvalidStatus, "", decimal.Zero)
+			},
+			want: models.InvalidStatus,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			require.NoError(t, err)
+			defer db.Close()
+			tt.expect(mock)
+
+			orderRepo, err := repo.OrderRepo(db, logger.NewNoop())
+			require.NoError(t, err)
+			endpoint, _ := newTestAccrual(t, tt.body)
+			s := NewBonusSystem(endpoint, orderRepo, logger.NewNoop())
+
+			order := &models.Order{OrderID: 79927398713, UserID: 1, Status: tt.stored, TXType: models.DepositOrder, Accrual: decimal.Zero}
+			require.True(t, s.updateOrder(context.Background(), order))
+			require.Equal(t, tt.want, order.Status)
+			require.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+
+	t.Run("cancelled before pickup", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer db.Close()
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(`UPDATE orders SET status .* AND status = \$5 RETURNING user_id`).
+			WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+		mock.ExpectRollback()
+
+		orderRepo, err := repo.OrderRepo(db, logger.NewNoop())
+		require.NoError(t, err)
+		endpoint, calls := newTestAccrual(t, `{"order":"79927398713","status":"PROCESSING"}`)
+		s := NewBonusSystem(endpoint, orderRepo, logger.NewNoop())
+
+		order := &models.Order{OrderID: 79927398713, UserID: 1, Status: models.NewStatus, TXType: models.DepositOrder}
+		require.True(t, s.updateOrder(context.Background(), order))
+		require.Zero(t, atomic.LoadInt32(calls))
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+type queueMetrics struct {
+	noopMetrics
+	depths []int
+}
+
+func (m *queueMetrics) QueueDepth(n int) {
+	m.depths = append(m.depths, n)
+}
+
+func TestBonusSystem_processOrdersQueueDepth(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	// the gauge is set from the count even though the listing fails
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM orders`).WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectQuery(`SELECT order_id, status`).WillReturnError(errors.New("connection reset"))
+
+	orderRepo, err := repo.OrderRepo(db, logger.NewNoop())
+	require.NoError(t, err)
+	metrics := &queueMetrics{}
+	s := NewBonusSystem("http://accrual.invalid", orderRepo, logger.NewNoop(), WithMetrics(metrics))
+
+	s.processOrders(context.Background())
+	require.Equal(t, []int{3}, metrics.depths)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
@@ -9,3 +9,15 @@ func WithUpdateInterval(t time.Duration) Option {
 		s.updateInterval = t
 	}
 }
+
+func WithNotifier(n Notifier) Option {
+	return func(s *BonusSystem) {
+		s.notifier = n
+	}
+}
+
+func WithMetrics(m Metrics) Option {
+	return func(s *BonusSystem) {
+		s.metrics = m
+	}
+}
@@ -2,25 +2,84 @@ package cmd
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/caarlos0/env/v6"
 	"github.com/spf13/cobra"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/jwt"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/server"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/tlsconfig"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/tracing"
 )
 
+// defaultSalt is public, tokens signed with it can be forged by anyone.
+const defaultSalt = "some_salt"
+
 var Config = ConfigStruct{
 	DatabaseURI:          "",
 	RunAddress:           "localhost:8080",
+	GRPCAddress:          "localhost:3200",
 	AccrualSystemAddress: "",
 	LogLevel:             "info",
-	Salt:                 "some_salt",
+	Salt:                 defaultSalt,
+	DevMode:              false,
+	IdempotencyTTL:       24 * time.Hour,
+	RateLimitIP:          5,
+	RateLimitIPBurst:     20,
+	RateLimitUser:        10,
+	RateLimitUserBurst:   50,
+	ReadinessTimeout:     2 * time.Second,
+	TraceExporter:        tracing.ExporterNone,
+	TraceOTLPEndpoint:    "localhost:4317",
+	TraceFile:            "traces.jsonl",
+	TraceSampleRatio:     1,
+	TLSMinVersion:        "1.2",
+	AuthTransportsV1:     []string{"cookie", "bearer"},
+	AuthTransportsV2:     []string{"cookie", "bearer"},
+	AuthTransportsAdmin:  []string{"cookie", "bearer"},
+	AccessTokenTTL:       15 * time.Minute,
+	RefreshTokenTTL:      30 * 24 * time.Hour,
+	DenylistCacheTTL:     10 * time.Second,
+	JWTKeyGracePeriod:    24 * time.Hour,
 }
 
 type ConfigStruct struct {
-	DatabaseURI          string `env:"DATABASE_URI"`
-	RunAddress           string `env:"RUN_ADDRESS"`
-	AccrualSystemAddress string `env:"ACCRUAL_SYSTEM_ADDRESS"`
-	LogLevel             string `env:"LOG_LEVEL"`
-	Salt                 string `env:"SALT"`
+	DatabaseURI          string        `env:"DATABASE_URI"`
+	RunAddress           string        `env:"RUN_ADDRESS"`
+	GRPCAddress          string        `env:"GRPC_ADDRESS"`
+	AccrualSystemAddress string        `env:"ACCRUAL_SYSTEM_ADDRESS"`
+	LogLevel             string        `env:"LOG_LEVEL"`
+	Salt                 string        `env:"SALT"`
+	DevMode              bool          `env:"DEV_MODE"`
+	IdempotencyTTL       time.Duration `env:"IDEMPOTENCY_TTL"`
+	AdminLogins          []string      `env:"ADMIN_LOGINS" envSeparator:","`
+	RateLimitIP          float64       `env:"RATE_LIMIT_IP"`
+	RateLimitIPBurst     int           `env:"RATE_LIMIT_IP_BURST"`
+	RateLimitUser        float64       `env:"RATE_LIMIT_USER"`
+	RateLimitUserBurst   int           `env:"RATE_LIMIT_USER_BURST"`
+	ReadinessTimeout     time.Duration `env:"READINESS_TIMEOUT"`
+	TraceExporter        string        `env:"TRACE_EXPORTER"`
+	TraceOTLPEndpoint    string        `env:"TRACE_OTLP_ENDPOINT"`
+	TraceOTLPInsecure    bool          `env:"TRACE_OTLP_INSECURE"`
+	TraceFile            string        `env:"TRACE_FILE"`
+	TraceSampleRatio     float64       `env:"TRACE_SAMPLE_RATIO"`
+	TLSCertFile          string        `env:"TLS_CERT_FILE"`
+	TLSKeyFile           string        `env:"TLS_KEY_FILE"`
+	TLSMinVersion        string        `env:"TLS_MIN_VERSION"`
+	InternalAddress      string        `env:"INTERNAL_ADDRESS"`
+	InternalClientCAFile string        `env:"INTERNAL_CLIENT_CA_FILE"`
+	InternalOnPublic     bool          `env:"INTERNAL_ON_PUBLIC"`
+	AuthTransportsV1     []string      `env:"AUTH_TRANSPORTS_V1" envSeparator:","`
+	AuthTransportsV2     []string      `env:"AUTH_TRANSPORTS_V2" envSeparator:","`
+	AuthTransportsAdmin  []string      `env:"AUTH_TRANSPORTS_ADMIN" envSeparator:","`
+	AccessTokenTTL       time.Duration `env:"ACCESS_TOKEN_TTL"`
+	RefreshTokenTTL      time.Duration `env:"REFRESH_TOKEN_TTL"`
+	DenylistCacheTTL     time.Duration `env:"DENYLIST_CACHE_TTL"`
+	JWTSigningKeyFile    string        `env:"JWT_SIGNING_KEY_FILE"`
+	JWTVerificationKeys  []string      `env:"JWT_VERIFICATION_KEY_FILES" envSeparator:","`
+	JWTKeyGracePeriod    time.Duration `env:"JWT_KEY_GRACE_PERIOD"`
+	JWTLegacyHMAC        bool          `env:"JWT_LEGACY_HMAC"`
 }
 
 func (c *ConfigStruct) initEnvArgs() error {
@@ -41,17 +100,107 @@ func (c *ConfigStruct) validate() error {
 	if c.AccrualSystemAddress == "" {
 		return fmt.Errorf("accrual address uri can not be empty")
 	}
+	if c.IdempotencyTTL <= 0 {
+		return fmt.Errorf("idempotency ttl must be positive")
+	}
+	if c.RateLimitIP < 0 || c.RateLimitIPBurst < 0 || c.RateLimitUser < 0 || c.RateLimitUserBurst < 0 {
+		return fmt.Errorf("rate limits can not be negative")
+	}
+	if c.ReadinessTimeout <= 0 {
+		return fmt.Errorf("readiness timeout must be positive")
+	}
+	if c.TraceSampleRatio < 0 || c.TraceSampleRatio > 1 {
+		return fmt.Errorf("trace sample ratio must be between 0 and 1")
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return fmt.Errorf("tls certificate and key have to be set together")
+	}
+	if _, err := tlsconfig.ParseVersion(c.TLSMinVersion); err != nil {
+		return err
+	}
+	if c.InternalClientCAFile != "" && (c.TLSCertFile == "" || c.InternalAddress == "") {
+		return fmt.Errorf("client ca requires a tls certificate and an internal address")
+	}
+	if c.InternalOnPublic && c.InternalAddress != "" {
+		return fmt.Errorf("internal routes can only be served on the run address without an internal address")
+	}
+	if _, err := c.authTransports(); err != nil {
+		return err
+	}
+	if c.AccessTokenTTL <= 0 || c.RefreshTokenTTL <= 0 {
+		return fmt.Errorf("token ttls must be positive")
+	}
+	if c.RefreshTokenTTL < c.AccessTokenTTL {
+		return fmt.Errorf("refresh token ttl can not be shorter than access token ttl")
+	}
+	if c.DenylistCacheTTL < 0 {
+		return fmt.Errorf("denylist cache ttl can not be negative")
+	}
+	if c.JWTKeyGracePeriod < 0 {
+		return fmt.Errorf("jwt key grace period can not be negative")
+	}
+	if c.JWTLegacyHMAC && c.JWTSigningKeyFile == "" {
+		return fmt.Errorf("legacy hmac verification requires a jwt signing key")
+	}
+	if c.JWTLegacyHMAC && c.Salt == defaultSalt {
+		return fmt.Errorf("legacy hmac verification can not be used with the default salt")
+	}
 	return nil
 }
 
+func (c *ConfigStruct) authTransports() (server.AuthTransports, error) {
+	var t server.AuthTransports
+	var err error
+	if t.V1, err = jwt.ParseTransports(c.AuthTransportsV1); err != nil {
+		return t, fmt.Errorf("v1 api: %w", err)
+	}
+	if t.V2, err = jwt.ParseTransports(c.AuthTransportsV2); err != nil {
+		return t, fmt.Errorf("v2 api: %w", err)
+	}
+	if t.Admin, err = jwt.ParseTransports(c.AuthTransportsAdmin); err != nil {
+		return t, fmt.Errorf("admin api: %w", err)
+	}
+	return t, nil
+}
+
 func setupConfig(cmd *cobra.Command, args []string) error {
 	cmd.DisableFlagParsing = false
 
 	cmd.Flags().StringVarP(&Config.DatabaseURI, "database_uri", "d", Config.DatabaseURI, "Postgre URI")
 	cmd.Flags().StringVarP(&Config.RunAddress, "run_addr", "a", Config.RunAddress, "Run address")
+	cmd.Flags().StringVarP(&Config.GRPCAddress, "grpc_addr", "g", Config.GRPCAddress, "gRPC run address, empty disables the gRPC API")
 	cmd.Flags().StringVarP(&Config.AccrualSystemAddress, "accrual_addr", "r", Config.AccrualSystemAddress, "Accrual system address")
 	cmd.Flags().StringVarP(&Config.LogLevel, "log_level", "l", Config.LogLevel, "Log level")
 	cmd.Flags().StringVarP(&Config.Salt, "salt", "s", Config.Salt, "Salt for passwords")
+	cmd.Flags().DurationVar(&Config.IdempotencyTTL, "idempotency_ttl", Config.IdempotencyTTL, "How long responses to requests with Idempotency-Key are kept")
+	cmd.Flags().StringSliceVar(&Config.AdminLogins, "admin", Config.AdminLogins, "Logins holding the admin role, it is revoked from anyone else on start")
+	cmd.Flags().Float64Var(&Config.RateLimitIP, "rate_limit_ip", Config.RateLimitIP, "Requests per second per IP on login and register, 0 disables the limit")
+	cmd.Flags().IntVar(&Config.RateLimitIPBurst, "rate_limit_ip_burst", Config.RateLimitIPBurst, "Requests per IP allowed in a burst")
+	cmd.Flags().Float64Var(&Config.RateLimitUser, "rate_limit_user", Config.RateLimitUser, "Requests per second per user on authenticated routes, 0 disables the limit")
+	cmd.Flags().IntVar(&Config.RateLimitUserBurst, "rate_limit_user_burst", Config.RateLimitUserBurst, "Requests per user allowed in a burst")
+	cmd.Flags().DurationVar(&Config.ReadinessTimeout, "readiness_timeout", Config.ReadinessTimeout, "Time each /readyz check is given")
+	cmd.Flags().StringVar(&Config.TraceExporter, "trace_exporter", Config.TraceExporter, "Where to send traces: none, otlp, stdout or file")
+	cmd.Flags().StringVar(&Config.TraceOTLPEndpoint, "trace_otlp_endpoint", Config.TraceOTLPEndpoint, "OTLP gRPC collector address")
+	cmd.Flags().BoolVar(&Config.TraceOTLPInsecure, "trace_otlp_insecure", Config.TraceOTLPInsecure, "Connect to the OTLP collector without TLS")
+	cmd.Flags().StringVar(&Config.TraceFile, "trace_file", Config.TraceFile, "File the file trace exporter appends spans to")
+	cmd.Flags().Float64Var(&Config.TraceSampleRatio, "trace_sample_ratio", Config.TraceSampleRatio, "Share of traces started here that are sampled")
+	cmd.Flags().StringVar(&Config.TLSCertFile, "tls_cert", Config.TLSCertFile, "TLS certificate file, serves HTTPS when set")
+	cmd.Flags().StringVar(&Config.TLSKeyFile, "tls_key", Config.TLSKeyFile, "TLS private key file")
+	cmd.Flags().StringVar(&Config.TLSMinVersion, "tls_min_version", Config.TLSMinVersion, "Minimum TLS version: 1.0, 1.1, 1.2 or 1.3")
+	cmd.Flags().StringVar(&Config.InternalAddress, "internal_addr", Config.InternalAddress, "Address serving the admin API and metrics, they are not served when empty")
+	cmd.Flags().BoolVar(&Config.InternalOnPublic, "internal_on_public", Config.InternalOnPublic, "Serve the admin API and metrics on the run address when there is no internal address")
+	cmd.Flags().StringVar(&Config.InternalClientCAFile, "internal_client_ca", Config.InternalClientCAFile, "CA bundle client certificates on the internal address are checked against")
+	cmd.Flags().StringSliceVar(&Config.AuthTransportsV1, "auth_transports_v1", Config.AuthTransportsV1, "How /api/user clients may send their token: cookie, bearer")
+	cmd.Flags().StringSliceVar(&Config.AuthTransportsV2, "auth_transports_v2", Config.AuthTransportsV2, "How /api/v2/user clients may send their token: cookie, bearer")
+	cmd.Flags().StringSliceVar(&Config.AuthTransportsAdmin, "auth_transports_admin", Config.AuthTransportsAdmin, "How /api/admin clients may send their token: cookie, bearer")
+	cmd.Flags().DurationVar(&Config.AccessTokenTTL, "access_token_ttl", Config.AccessTokenTTL, "How long access tokens are valid")
+	cmd.Flags().DurationVar(&Config.RefreshTokenTTL, "refresh_token_ttl", Config.RefreshTokenTTL, "How long refresh tokens are valid")
+	cmd.Flags().DurationVar(&Config.DenylistCacheTTL, "denylist_cache_ttl", Config.DenylistCacheTTL, "How long a token is trusted before the denylist is checked again")
+	cmd.Flags().StringVar(&Config.JWTSigningKeyFile, "jwt_signing_key", Config.JWTSigningKeyFile, "PEM RSA or Ed25519 private key tokens are signed with, reloaded on change; empty signs with the salt")
+	cmd.Flags().StringSliceVar(&Config.JWTVerificationKeys, "jwt_verification_keys", Config.JWTVerificationKeys, "PEM key files tokens are additionally verified with")
+	cmd.Flags().DurationVar(&Config.JWTKeyGracePeriod, "jwt_key_grace_period", Config.JWTKeyGracePeriod, "How long a replaced signing key keeps verifying tokens")
+	cmd.Flags().BoolVar(&Config.JWTLegacyHMAC, "jwt_legacy_hmac", Config.JWTLegacyHMAC, "Keep verifying tokens signed with the salt for the grace period after start, when moving to a signing key")
+	cmd.Flags().BoolVar(&Config.DevMode, "dev", Config.DevMode, "Development mode, validates API traffic against the OpenAPI spec")
 
 	if err := cmd.ParseFlags(args); err != nil {
 		return err
@@ -2,23 +2,36 @@ package cmd
 
 import (
 	"context"
-	"database/sql"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/XSAM/otelsql"
 	_ "github.com/jackc/pgx/v4/stdlib"
 	"github.com/spf13/cobra"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
 	"go.uber.org/zap"
 	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 
 	"github.com/OmAsana/go-yapraktikum-final/migrations"
 	"github.com/OmAsana/go-yapraktikum-final/pkg/bonussystem"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/denylist"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/events"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/grpcserver"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/jwt"
 	"github.com/OmAsana/go-yapraktikum-final/pkg/logger"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/metrics"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/openapi"
 	"github.com/OmAsana/go-yapraktikum-final/pkg/repo"
 	"github.com/OmAsana/go-yapraktikum-final/pkg/server"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/tlsconfig"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/tracing"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/webhook"
 )
 
 var (
@@ -58,7 +71,23 @@ func run(cmd *cobra.Command, args []string) {
 		log.Sugar().Fatalf("migration: failed to apply migration: %v\n", err)
 	}
 
-	db, err := sql.Open("pgx", Config.DatabaseURI)
+	shutdownTracing, err := tracing.Setup(ctx, tracing.Config{
+		Exporter:     Config.TraceExporter,
+		OTLPEndpoint: Config.TraceOTLPEndpoint,
+		OTLPInsecure: Config.TraceOTLPInsecure,
+		File:         Config.TraceFile,
+		SampleRatio:  Config.TraceSampleRatio,
+	})
+	if err != nil {
+		log.Fatal("could not set up tracing", zap.Error(err))
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			log.Error("could not flush traces", zap.Error(err))
+		}
+	}()
+
+	db, err := otelsql.Open("pgx", Config.DatabaseURI, otelsql.WithAttributes(semconv.DBSystemPostgreSQL))
 	if err != nil {
 		log.Fatal("could not connect to db", zap.Error(err))
 	}
@@ -77,30 +106,297 @@ func run(cmd *cobra.Command, args []string) {
 		log.Fatal("could not connect to db", zap.Error(err))
 	}
 
-	handler := server.NewServer(log, userRepo, orderRepo, Config.Salt)
+	idempotencyRepo, err := repo.IdempotencyRepo(db, log)
+	if err != nil {
+		log.Fatal("could not connect to db", zap.Error(err))
+	}
+
+	webhookRepo, err := repo.WebhookRepo(db, log)
+	if err != nil {
+		log.Fatal("could not connect to db", zap.Error(err))
+	}
+
+	adminRepo, err := repo.AdminRepo(db, log)
+	if err != nil {
+		log.Fatal("could not connect to db", zap.Error(err))
+	}
+	syncAdmins(ctx, adminRepo, Config.AdminLogins, log)
+
+	tokenRepo, err := repo.TokenRepo(db, log)
+	if err != nil {
+		log.Fatal("could not connect to db", zap.Error(err))
+	}
+	denylistStore := denylist.NewStore(tokenRepo, Config.DenylistCacheTTL)
+
+	keyring, keyReloader, err := loadJWTKeys(log)
+	if err != nil {
+		log.Fatal("could not load jwt keys", zap.Error(err))
+	}
+
+	registry := metrics.NewRegistry()
+	metrics.RegisterDB(registry, db)
+
+	broker := events.NewBroker()
+	bonusSystem := bonussystem.NewBonusSystem(Config.AccrualSystemAddress, orderRepo, log,
+		bonussystem.WithNotifier(broker),
+		bonussystem.WithMetrics(metrics.NewBonusSystem(registry)))
+
+	// validated with the config
+	authTransports, _ := Config.authTransports()
+
+	serverOpts := []server.Option{
+		server.WithIdempotency(idempotencyRepo, Config.IdempotencyTTL),
+		server.WithOrderEvents(broker),
+		server.WithWebhooks(webhookRepo),
+		server.WithAdmin(adminRepo),
+		server.WithMetrics(registry),
+		server.WithTracing(),
+		server.WithRateLimits(
+			server.RateLimit{Rate: Config.RateLimitIP, Burst: Config.RateLimitIPBurst},
+			server.RateLimit{Rate: Config.RateLimitUser, Burst: Config.RateLimitUserBurst},
+		),
+		server.WithAuthTransports(authTransports),
+		server.WithRefreshTokens(tokenRepo, Config.AccessTokenTTL, Config.RefreshTokenTTL),
+		server.WithDenylist(denylistStore),
+		server.WithKeyring(keyring),
+		server.WithReadinessChecks(Config.ReadinessTimeout,
+			server.ReadinessCheck{Name: "database", Check: db.PingContext},
+			server.ReadinessCheck{Name: "migrations", Check: func(ctx context.Context) error {
+				return migrations.CheckVersion(ctx, db)
+			}},
+			server.ReadinessCheck{Name: "accrual", Check: bonusSystem.Ready},
+		),
+	}
+	switch {
+	case Config.InternalAddress != "":
+		serverOpts = append(serverOpts, server.WithInternalListener())
+	case Config.InternalOnPublic:
+		log.Warn("Serving the admin API and metrics on the public address")
+		serverOpts = append(serverOpts, server.WithPublicInternalRoutes())
+	default:
+		log.Info("No internal address, the admin API and metrics are not served")
+	}
+	if Config.DevMode {
+		validator, err := openapi.NewValidator()
+		if err != nil {
+			log.Fatal("could not load openapi spec", zap.Error(err))
+		}
+		serverOpts = append(serverOpts, server.WithAPIValidation(validator))
+	}
+
+	var certReloader *tlsconfig.CertReloader
+	var minTLSVersion uint16
+	if Config.TLSCertFile != "" {
+		certReloader, err = tlsconfig.NewCertReloader(Config.TLSCertFile, Config.TLSKeyFile, log)
+		if err != nil {
+			log.Fatal("could not load tls certificate", zap.Error(err))
+		}
+		// validated with the config
+		minTLSVersion, _ = tlsconfig.ParseVersion(Config.TLSMinVersion)
+	}
+
+	handler := server.NewServer(log, userRepo, orderRepo, Config.Salt, serverOpts...)
 	srv := &http.Server{Addr: Config.RunAddress, Handler: handler,
 		BaseContext: func(listener net.Listener) context.Context {
 			return ctx
 		}}
+	if certReloader != nil {
+		srv.TLSConfig = tlsconfig.Server(certReloader, minTLSVersion)
+	}
 
-	bonusSystem := bonussystem.NewBonusSystem(Config.AccrualSystemAddress, orderRepo, log)
+	webhookDispatcher := webhook.NewDispatcher(webhookRepo, log)
 	g, gCtx := errgroup.WithContext(ctx)
+	if certReloader != nil {
+		g.Go(func() error {
+			return certReloader.Run(gCtx)
+		})
+	}
+	if keyReloader != nil {
+		g.Go(func() error {
+			return keyReloader.Run(gCtx)
+		})
+	}
 	g.Go(func() error {
 		return bonusSystem.Run(gCtx)
 	})
 	g.Go(func() error {
-		log.Info("Serving", zap.String("addr", srv.Addr))
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
-			return err
-		}
-		return nil
+		return webhookDispatcher.Run(gCtx)
+	})
+	g.Go(func() error {
+		return serve(srv, log)
 	})
 	g.Go(func() error {
 		<-gCtx.Done()
 		return srv.Shutdown(context.Background())
 	})
+	if Config.InternalAddress != "" {
+		internalSrv := &http.Server{Addr: Config.InternalAddress, Handler: handler.Internal(),
+			BaseContext: func(listener net.Listener) context.Context {
+				return ctx
+			}}
+		switch {
+		case Config.InternalClientCAFile != "":
+			internalSrv.TLSConfig, err = tlsconfig.MutualServer(certReloader, minTLSVersion, Config.InternalClientCAFile)
+			if err != nil {
+				log.Fatal("could not load client ca", zap.Error(err))
+			}
+		case certReloader != nil:
+			internalSrv.TLSConfig = tlsconfig.Server(certReloader, minTLSVersion)
+		}
+		g.Go(func() error {
+			return serve(internalSrv, log)
+		})
+		g.Go(func() error {
+			<-gCtx.Done()
+			return internalSrv.Shutdown(context.Background())
+		})
+	}
+	if Config.GRPCAddress != "" {
+		var grpcOpts []grpc.ServerOption
+		if certReloader != nil {
+			grpcOpts = append(grpcOpts, grpc.Creds(credentials.NewTLS(tlsconfig.Server(certReloader, minTLSVersion))))
+		}
+		grpcSrv := grpcserver.NewServer(log, userRepo, orderRepo, Config.Salt,
+			jwt.WithTTL(Config.AccessTokenTTL), jwt.WithDenylist(denylistStore), jwt.WithKeyring(keyring)).NewGRPCServer(grpcOpts...)
+		g.Go(func() error {
+			lis, err := net.Listen("tcp", Config.GRPCAddress)
+			if err != nil {
+				return err
+			}
+			log.Info("Serving grpc", zap.String("addr", Config.GRPCAddress))
+			return grpcSrv.Serve(lis)
+		})
+		g.Go(func() error {
+			<-gCtx.Done()
+			grpcSrv.GracefulStop()
+			return nil
+		})
+	}
+	g.Go(func() error {
+		purgeIdempotencyKeys(gCtx, idempotencyRepo, Config.IdempotencyTTL, log)
+		return nil
+	})
+	g.Go(func() error {
+		purgeRefreshTokens(gCtx, tokenRepo, log)
+		return nil
+	})
 	if err := g.Wait(); err != nil {
 		log.Fatal(err.Error())
 	}
 
 }
+
+// serve listens with TLS when the server has a TLS config.
+func serve(srv *http.Server, log *zap.Logger) error {
+	log.Info("Serving", zap.String("addr", srv.Addr), zap.Bool("tls", srv.TLSConfig != nil))
+
+	var err error
+	if srv.TLSConfig != nil {
+		// the certificate comes from TLSConfig.GetCertificate
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func purgeIdempotencyKeys(ctx context.Context, idempotencyRepo repo.IdempotencyRepository, ttl time.Duration, log *zap.Logger) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			deleted, err := idempotencyRepo.DeleteExpired(ctx, time.Now().Add(-ttl))
+			if err != nil {
+				log.Error("Could not purge idempotency keys", zap.Error(err))
+				continue
+			}
+			log.Debug("Purged idempotency keys", zap.Int64("deleted", deleted))
+		}
+	}
+}
+
+// loadJWTKeys builds the keyring tokens are signed with. Without a signing
+// key file tokens are signed with the salt. With one the salt is not
+// trusted at all, unless legacy HMAC verification is enabled: then it
+// keeps verifying previously issued tokens for the grace period.
+func loadJWTKeys(log *zap.Logger) (*jwt.Keyring, *jwt.KeyReloader, error) {
+	var verifying []jwt.Key
+	for _, f := range Config.JWTVerificationKeys {
+		key, err := jwt.LoadKeyFile(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		verifying = append(verifying, key)
+	}
+
+	signing := jwt.HMACKey([]byte(Config.Salt))
+	if Config.JWTSigningKeyFile != "" && !Config.JWTLegacyHMAC {
+		var err error
+		signing, err = jwt.LoadKeyFile(Config.JWTSigningKeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	keyring, err := jwt.NewKeyring(signing, verifying...)
+	if err != nil {
+		return nil, nil, err
+	}
+	if Config.JWTSigningKeyFile == "" {
+		if Config.Salt == defaultSalt {
+			log.Warn("Signing tokens with the default salt, anyone can forge them: set a salt or a jwt signing key")
+		} else {
+			log.Warn("Signing tokens with the salt, set a jwt signing key to publish verifiable keys")
+		}
+		return keyring, nil, nil
+	}
+
+	reloader, err := jwt.NewKeyReloader(Config.JWTSigningKeyFile, keyring, Config.JWTKeyGracePeriod, log)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Info("Signing tokens with key file", zap.String("kid", keyring.SigningKey().ID))
+	return keyring, reloader, nil
+}
+
+// purgeRefreshTokens deletes expired refresh tokens. Used up tokens are
+// kept until they expire so their reuse can still be detected.
+func purgeRefreshTokens(ctx context.Context, tokenRepo repo.TokenRepository, log *zap.Logger) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			deleted, err := tokenRepo.DeleteExpired(ctx, time.Now())
+			if err != nil {
+				log.Error("Could not purge refresh tokens", zap.Error(err))
+				continue
+			}
+			log.Debug("Purged refresh tokens", zap.Int64("deleted", deleted))
+		}
+	}
+}
+
+// syncAdmins makes exactly the configured logins admins and revokes the
+// role from anyone no longer listed. Logins no user is registered with
+// are logged, they are granted the role on the first start after the user
+// registers.
+func syncAdmins(ctx context.Context, adminRepo repo.AdminRepository, logins []string, log *zap.Logger) {
+	revoked, missing, err := adminRepo.SyncAdmins(ctx, logins)
+	if err != nil {
+		log.Fatal("could not sync admin roles", zap.Error(err))
+	}
+	for _, login := range missing {
+		log.Error("Admin user does not exist", zap.String("user", login))
+	}
+	for _, login := range revoked {
+		log.Info("Revoked admin role", zap.String("user", login))
+	}
+}
@@ -0,0 +1,59 @@
+package controllers
+
+import (
+	"time"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
+)
+
+type AdminUser struct {
+	ID          int    `json:"id"`
+	Login       string `json:"login"`
+	IsAdmin     bool   `json:"is_admin"`
+	CreatedAt   string `json:"created_at"`
+	LastLoginAt string `json:"last_login_at,omitempty"`
+}
+
+func UserModelToAdmin(mu models.User) AdminUser {
+	u := AdminUser{
+		ID:        mu.UserID,
+		Login:     mu.Login,
+		IsAdmin:   mu.IsAdmin,
+		CreatedAt: mu.CreatedAt.Format(time.RFC3339),
+	}
+	if !mu.LastLoginAt.IsZero() {
+		u.LastLoginAt = mu.LastLoginAt.Format(time.RFC3339)
+	}
+	return u
+}
+
+type BalanceAdjustmentRequest struct {
+	Amount string `json:"amount"`
+	Reason string `json:"reason"`
+}
+
+type BalanceAdjustment struct {
+	ID        int64  `json:"id"`
+	UserID    int    `json:"user_id"`
+	AdminID   int    `json:"admin_id"`
+	Amount    string `json:"amount"`
+	Reason    string `json:"reason"`
+	CreatedAt string `json:"created_at"`
+}
+
+func BalanceAdjustmentModelToController(ma models.BalanceAdjustment) BalanceAdjustment {
+	return BalanceAdjustment{
+		ID:        ma.ID,
+		UserID:    ma.UserID,
+		AdminID:   ma.AdminID,
+		Amount:    FormatAmount(ma.Amount),
+		Reason:    ma.Reason,
+		CreatedAt: ma.CreatedAt.Format(time.RFC3339),
+	}
+}
+
+type OrderStatusRequest struct {
+	Status  models.OrderStatus `json:"status"`
+	Accrual string             `json:"accrual"`
+	Reason  string             `json:"reason"`
+}
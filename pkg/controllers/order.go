@@ -1,9 +1,14 @@
 package controllers
 
 import (
+	"encoding/base64"
+	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/shopspring/decimal"
+
 	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
 )
 
@@ -22,12 +27,43 @@ func OrderModelToController(mo models.Order) Order {
 	}
 
 	if mo.Status != models.InvalidStatus {
-		o.Accrual = mo.Accrual
+		o.Accrual = mo.Accrual.InexactFloat64()
 	}
 
 	return o
 }
 
+type OrderTransition struct {
+	Status    models.OrderStatus `json:"status"`
+	Accrual   float64            `json:"accrual,omitempty"`
+	ChangedAt string             `json:"changed_at"`
+}
+
+// OrderDetail is an order with its status timeline. The timeline starts
+// with the upload, when every order is NEW.
+type OrderDetail struct {
+	Order
+	History []OrderTransition `json:"history"`
+}
+
+func OrderDetailModelToController(mo models.Order, history []*models.OrderTransition) OrderDetail {
+	d := OrderDetail{
+		Order:   OrderModelToController(mo),
+		History: []OrderTransition{},
+	}
+	for _, t := range history {
+		transition := OrderTransition{
+			Status:    t.Status,
+			ChangedAt: t.ChangedAt.Format(time.RFC3339),
+		}
+		if t.Status != models.InvalidStatus {
+			transition.Accrual = t.Accrual.InexactFloat64()
+		}
+		d.History = append(d.History, transition)
+	}
+	return d
+}
+
 type Withdrawal struct {
 	Order       string    `json:"order"`
 	Sum         float64   `json:"sum"`
@@ -43,7 +79,170 @@ func (w Withdrawal) ToOrder(userID int) (models.Order, error) {
 		OrderID:    orderID,
 		Status:     models.NewStatus,
 		TXType:     models.WithdrawalOrder,
-		Accrual:    w.Sum,
+		Accrual:    decimal.NewFromFloat(w.Sum),
 		UserID:     userID,
 		UploadedAt: time.Now()}, nil
 }
+
+type WithdrawalInfo struct {
+	Order       string  `json:"order"`
+	Sum         float64 `json:"sum"`
+	ProcessedAt string  `json:"processed_at"`
+}
+
+func WithdrawalModelToController(mo models.Order) WithdrawalInfo {
+	return WithdrawalInfo{
+		Order:       strconv.Itoa(mo.OrderID),
+		Sum:         mo.Accrual.InexactFloat64(),
+		ProcessedAt: mo.ProcessedAt.Format(time.RFC3339),
+	}
+}
+
+// Balance keeps the field names v1 has always returned, models.Balance used
+// to be encoded as is.
+type Balance struct {
+	Current   float64
+	Withdrawn float64
+}
+
+func BalanceModelToController(mb models.Balance) Balance {
+	return Balance{
+		Current:   mb.Current.InexactFloat64(),
+		Withdrawn: mb.Withdrawn.InexactFloat64(),
+	}
+}
+
+// LedgerEntry is a line of the balance history. Order is set for deposits
+// and withdrawals, AdjustmentID for admin adjustments.
+type LedgerEntry struct {
+	Type         models.LedgerEntryType `json:"type"`
+	Order        string                 `json:"order,omitempty"`
+	AdjustmentID int64                  `json:"adjustment_id,omitempty"`
+	Amount       float64                `json:"amount"`
+	Balance      float64                `json:"balance"`
+	OccurredAt   string                 `json:"occurred_at"`
+}
+
+func LedgerEntryModelToController(me models.LedgerEntry) LedgerEntry {
+	e := LedgerEntry{
+		Type:       me.Type,
+		Amount:     me.Amount.InexactFloat64(),
+		Balance:    me.Balance.InexactFloat64(),
+		OccurredAt: me.OccurredAt.Format(time.RFC3339),
+	}
+	if me.Type == models.LedgerAdjustment {
+		e.AdjustmentID = me.Reference
+	} else {
+		e.Order = strconv.FormatInt(me.Reference, 10)
+	}
+	return e
+}
+
+type LedgerPage struct {
+	Entries    []LedgerEntry `json:"entries"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// EncodeLedgerCursor turns the position of the last ledger entry on a page
+// into an opaque string, like EncodeOrderCursor.
+func EncodeLedgerCursor(c models.LedgerCursor) string {
+	raw := fmt.Sprintf("%d:%s:%d", c.OccurredAt.UnixNano(), c.Type, c.Reference)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func DecodeLedgerCursor(cursor string) (models.LedgerCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return models.LedgerCursor{}, fmt.Errorf("malformed cursor: %w", err)
+	}
+
+	parts := strings.SplitN(string(raw), ":", 3)
+	if len(parts) != 3 {
+		return models.LedgerCursor{}, fmt.Errorf("malformed cursor")
+	}
+
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return models.LedgerCursor{}, fmt.Errorf("malformed cursor: %w", err)
+	}
+	reference, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return models.LedgerCursor{}, fmt.Errorf("malformed cursor: %w", err)
+	}
+
+	return models.LedgerCursor{
+		OccurredAt: time.Unix(0, nanos).UTC(),
+		Type:       models.LedgerEntryType(parts[1]),
+		Reference:  reference,
+	}, nil
+}
+
+type BatchOrderStatus string
+
+var (
+	BatchOrderAccepted        BatchOrderStatus = "accepted"
+	BatchOrderAlreadyUploaded BatchOrderStatus = "already_uploaded"
+	BatchOrderConflict        BatchOrderStatus = "uploaded_by_another_user"
+	BatchOrderInvalid         BatchOrderStatus = "invalid"
+)
+
+type BatchOrderResult struct {
+	Number string           `json:"number"`
+	Result BatchOrderStatus `json:"result"`
+}
+
+type OrderPage struct {
+	Orders     []Order `json:"orders"`
+	NextCursor string  `json:"next_cursor,omitempty"`
+}
+
+// EncodeOrderCursor turns the position of the last order on a page into an
+// opaque string clients pass back to fetch the next page.
+func EncodeOrderCursor(c models.OrderCursor) string {
+	raw := fmt.Sprintf("%d:%d", c.UploadedAt.UnixNano(), c.OrderID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func DecodeOrderCursor(cursor string) (models.OrderCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return models.OrderCursor{}, fmt.Errorf("malformed cursor: %w", err)
+	}
+
+	parts := strings.SplitN(string(raw), ":", 2)
+	if len(parts) != 2 {
+		return models.OrderCursor{}, fmt.Errorf("malformed cursor")
+	}
+
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return models.OrderCursor{}, fmt.Errorf("malformed cursor: %w", err)
+	}
+	orderID, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return models.OrderCursor{}, fmt.Errorf("malformed cursor: %w", err)
+	}
+
+	return models.OrderCursor{UploadedAt: time.Unix(0, nanos).UTC(), OrderID: orderID}, nil
+}
+
+type OrderEvent struct {
+	Number    string             `json:"number"`
+	Status    models.OrderStatus `json:"status"`
+	Accrual   float64            `json:"accrual,omitempty"`
+	UpdatedAt string             `json:"updated_at"`
+}
+
+func OrderEventModelToController(me models.OrderEvent) OrderEvent {
+	e := OrderEvent{
+		Number:    strconv.Itoa(me.OrderID),
+		Status:    me.Status,
+		UpdatedAt: me.CreatedAt.Format(time.RFC3339),
+	}
+
+	if me.Status != models.InvalidStatus {
+		e.Accrual = me.Accrual.InexactFloat64()
+	}
+
+	return e
+}
@@ -3,6 +3,9 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"time"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
 )
 
 type Credentials struct {
@@ -22,3 +25,48 @@ func UserIDFromContext(ctx context.Context) (int, error) {
 
 	return userID, nil
 }
+
+// Session is returned on register, login and refresh. Clients not keeping
+// cookies send Token back in an "Authorization: Bearer" header and
+// RefreshToken to the refresh endpoint.
+type Session struct {
+	Token            string `json:"token"`
+	TokenType        string `json:"token_type"`
+	ExpiresAt        string `json:"expires_at"`
+	RefreshToken     string `json:"refresh_token,omitempty"`
+	RefreshExpiresAt string `json:"refresh_expires_at,omitempty"`
+}
+
+// RefreshRequest may be omitted by clients keeping the refresh token
+// cookie.
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+func NewSession(token string, expiresAt time.Time) Session {
+	return Session{
+		Token:     token,
+		TokenType: "Bearer",
+		ExpiresAt: expiresAt.UTC().Format(time.RFC3339),
+	}
+}
+
+// UserSession is an active login of the user. Current marks the session
+// the request was made from.
+type UserSession struct {
+	ID         string `json:"id"`
+	CreatedAt  string `json:"created_at"`
+	LastUsedAt string `json:"last_used_at"`
+	ExpiresAt  string `json:"expires_at"`
+	Current    bool   `json:"current"`
+}
+
+func SessionModelToController(ms models.Session, current string) UserSession {
+	return UserSession{
+		ID:         ms.ID,
+		CreatedAt:  ms.CreatedAt.Format(time.RFC3339),
+		LastUsedAt: ms.LastUsedAt.Format(time.RFC3339),
+		ExpiresAt:  ms.ExpiresAt.Format(time.RFC3339),
+		Current:    ms.ID == current,
+	}
+}
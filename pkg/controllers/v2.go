@@ -0,0 +1,80 @@
+package controllers
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/shopspring/decimal"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
+)
+
+// AmountPlaces is the number of fraction digits of amounts returned and
+// accepted by /api/v2.
+const AmountPlaces = 2
+
+// Envelope wraps every successful /api/v2 response. Errors are returned as
+// problem details like in v1.
+type Envelope struct {
+	Data interface{} `json:"data"`
+	Meta *Meta       `json:"meta,omitempty"`
+}
+
+type Meta struct {
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+func FormatAmount(d decimal.Decimal) string {
+	return d.StringFixed(AmountPlaces)
+}
+
+type OrderRequestV2 struct {
+	Number string `json:"number"`
+}
+
+type OrderV2 struct {
+	Number     string             `json:"number"`
+	Status     models.OrderStatus `json:"status"`
+	Accrual    string             `json:"accrual"`
+	UploadedAt string             `json:"uploaded_at"`
+}
+
+func OrderModelToV2(mo models.Order) OrderV2 {
+	return OrderV2{
+		Number:     strconv.Itoa(mo.OrderID),
+		Status:     mo.Status,
+		Accrual:    FormatAmount(mo.Accrual),
+		UploadedAt: mo.UploadedAt.Format(time.RFC3339),
+	}
+}
+
+type BalanceV2 struct {
+	Current   string `json:"current"`
+	Withdrawn string `json:"withdrawn"`
+}
+
+func BalanceModelToV2(mb models.Balance) BalanceV2 {
+	return BalanceV2{
+		Current:   FormatAmount(mb.Current),
+		Withdrawn: FormatAmount(mb.Withdrawn),
+	}
+}
+
+type WithdrawRequestV2 struct {
+	Order string `json:"order"`
+	Sum   string `json:"sum"`
+}
+
+type WithdrawalV2 struct {
+	Order       string `json:"order"`
+	Sum         string `json:"sum"`
+	ProcessedAt string `json:"processed_at"`
+}
+
+func WithdrawalModelToV2(mo models.Order) WithdrawalV2 {
+	return WithdrawalV2{
+		Order:       strconv.Itoa(mo.OrderID),
+		Sum:         FormatAmount(mo.Accrual),
+		ProcessedAt: mo.ProcessedAt.Format(time.RFC3339),
+	}
+}
@@ -0,0 +1,67 @@
+package controllers
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
+)
+
+type WebhookRequest struct {
+	URL    string                    `json:"url"`
+	Events []models.WebhookEventType `json:"events,omitempty"`
+}
+
+type Webhook struct {
+	ID        int                       `json:"id"`
+	URL       string                    `json:"url"`
+	Events    []models.WebhookEventType `json:"events,omitempty"`
+	Secret    string                    `json:"secret,omitempty"`
+	CreatedAt string                    `json:"created_at"`
+}
+
+// WebhookModelToController converts a webhook leaving out its secret,
+// which is shown only once after the webhook is created.
+func WebhookModelToController(mw models.Webhook) Webhook {
+	return Webhook{
+		ID:        mw.ID,
+		URL:       mw.URL,
+		Events:    mw.EventTypes,
+		CreatedAt: mw.CreatedAt.Format(time.RFC3339),
+	}
+}
+
+type WebhookDelivery struct {
+	ID             int                     `json:"id"`
+	Event          models.WebhookEventType `json:"event"`
+	Payload        json.RawMessage         `json:"payload"`
+	Status         models.DeliveryStatus   `json:"status"`
+	Attempts       int                     `json:"attempts"`
+	LastStatusCode int                     `json:"last_status_code,omitempty"`
+	LastError      string                  `json:"last_error,omitempty"`
+	CreatedAt      string                  `json:"created_at"`
+	NextAttemptAt  string                  `json:"next_attempt_at,omitempty"`
+	DeliveredAt    string                  `json:"delivered_at,omitempty"`
+}
+
+func WebhookDeliveryModelToController(md models.WebhookDelivery) WebhookDelivery {
+	d := WebhookDelivery{
+		ID:             md.ID,
+		Event:          md.EventType,
+		Payload:        md.Payload,
+		Status:         md.Status,
+		Attempts:       md.Attempts,
+		LastStatusCode: md.LastStatusCode,
+		LastError:      md.LastError,
+		CreatedAt:      md.CreatedAt.Format(time.RFC3339),
+	}
+
+	switch md.Status {
+	case models.DeliveryPending:
+		d.NextAttemptAt = md.NextAttemptAt.Format(time.RFC3339)
+	case models.DeliveryDelivered:
+		d.DeliveredAt = md.DeliveredAt.Format(time.RFC3339)
+	}
+
+	return d
+}
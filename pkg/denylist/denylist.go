@@ -0,0 +1,90 @@
+// Package denylist keeps track of revoked access tokens and sessions. It
+// caches answers of the token repository in memory, so authenticating a
+// request does not query the database every time.
+package denylist
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/jwt"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/repo"
+)
+
+var _ jwt.Denylist = (*Store)(nil)
+
+// maxEntries is the cache size at which expired entries are dropped.
+const maxEntries = 10000
+
+type entry struct {
+	revoked bool
+	until   time.Time
+}
+
+// Store answers whether an id is revoked. Revoked ids are cached until
+// they expire, ids that are not revoked for missTTL: an id revoked by
+// another instance is picked up within missTTL.
+type Store struct {
+	tokenRepo repo.TokenRepository
+	missTTL   time.Duration
+	now       func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]entry
+}
+
+func NewStore(tokenRepo repo.TokenRepository, missTTL time.Duration) *Store {
+	return &Store{
+		tokenRepo: tokenRepo,
+		missTTL:   missTTL,
+		now:       time.Now,
+		entries:   make(map[string]entry),
+	}
+}
+
+func (s *Store) IsRevoked(ctx context.Context, id string) (bool, error) {
+	now := s.now()
+	s.mu.Lock()
+	e, ok := s.entries[id]
+	s.mu.Unlock()
+	if ok && now.Before(e.until) {
+		return e.revoked, nil
+	}
+
+	deniedUntil, err := s.tokenRepo.DeniedUntil(ctx, id)
+	if err != nil {
+		return false, err
+	}
+
+	e = entry{until: now.Add(s.missTTL)}
+	if now.Before(deniedUntil) {
+		e = entry{revoked: true, until: deniedUntil}
+	}
+	s.set(id, e, now)
+	return e.revoked, nil
+}
+
+// Revoke denies id until expiresAt, when tokens carrying it are no longer
+// valid anyway.
+func (s *Store) Revoke(ctx context.Context, id string, expiresAt time.Time) error {
+	if err := s.tokenRepo.DenyToken(ctx, id, expiresAt); err != nil {
+		return err
+	}
+	s.set(id, entry{revoked: true, until: expiresAt}, s.now())
+	return nil
+}
+
+func (s *Store) set(id string, e entry, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.entries) >= maxEntries {
+		for k, v := range s.entries {
+			if !now.Before(v.until) {
+				delete(s.entries, k)
+			}
+		}
+	}
+	s.entries[id] = e
+}
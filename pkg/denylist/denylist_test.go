@@ -0,0 +1,79 @@
+package denylist
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/repo"
+)
+
+type fakeTokenRepo struct {
+	repo.TokenRepository
+	denied  map[string]time.Time
+	queries int
+	err     error
+}
+
+func (f *fakeTokenRepo) DenyToken(_ context.Context, id string, expiresAt time.Time) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.denied[id] = expiresAt
+	return nil
+}
+
+func (f *fakeTokenRepo) DeniedUntil(_ context.Context, id string) (time.Time, error) {
+	f.queries++
+	return f.denied[id], f.err
+}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2022, time.August, 1, 10, 0, 0, 0, time.UTC)
+	tokenRepo := &fakeTokenRepo{denied: map[string]time.Time{"other": now.Add(time.Hour)}}
+	store := NewStore(tokenRepo, time.Minute)
+	store.now = func() time.Time { return now }
+
+	revoked, err := store.IsRevoked(ctx, "jti")
+	require.NoError(t, err)
+	require.False(t, revoked)
+
+	// a miss is cached for missTTL
+	tokenRepo.denied["jti"] = now.Add(time.Hour)
+	revoked, err = store.IsRevoked(ctx, "jti")
+	require.NoError(t, err)
+	require.False(t, revoked)
+	require.Equal(t, 1, tokenRepo.queries)
+
+	now = now.Add(2 * time.Minute)
+	revoked, err = store.IsRevoked(ctx, "jti")
+	require.NoError(t, err)
+	require.True(t, revoked)
+	require.Equal(t, 2, tokenRepo.queries)
+
+	// ids revoked by another instance are cached until they expire
+	revoked, err = store.IsRevoked(ctx, "other")
+	require.NoError(t, err)
+	require.True(t, revoked)
+	revoked, err = store.IsRevoked(ctx, "other")
+	require.NoError(t, err)
+	require.True(t, revoked)
+	require.Equal(t, 3, tokenRepo.queries)
+
+	// revoking updates the cache right away
+	require.NoError(t, store.Revoke(ctx, "session", now.Add(time.Minute)))
+	revoked, err = store.IsRevoked(ctx, "session")
+	require.NoError(t, err)
+	require.True(t, revoked)
+	require.Equal(t, 3, tokenRepo.queries)
+	require.Equal(t, now.Add(time.Minute), tokenRepo.denied["session"])
+
+	tokenRepo.err = errors.New("db is down")
+	_, err = store.IsRevoked(ctx, "unknown")
+	require.Error(t, err)
+	require.Error(t, store.Revoke(ctx, "unknown", now))
+}
@@ -0,0 +1,49 @@
+// Package events notifies subscribers within the process that data of a
+// user has changed.
+package events
+
+import "sync"
+
+type Broker struct {
+	mu   sync.Mutex
+	subs map[int]map[chan struct{}]struct{}
+}
+
+func NewBroker() *Broker {
+	return &Broker{subs: map[int]map[chan struct{}]struct{}{}}
+}
+
+// Subscribe returns a channel signalled after the user data changes and a
+// function releasing the subscription. Notifications are coalesced, so a
+// subscriber has to fetch everything that changed since it last looked.
+func (b *Broker) Subscribe(userID int) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+
+	b.mu.Lock()
+	if b.subs[userID] == nil {
+		b.subs[userID] = map[chan struct{}]struct{}{}
+	}
+	b.subs[userID][ch] = struct{}{}
+	b.mu.Unlock()
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subs[userID], ch)
+		if len(b.subs[userID]) == 0 {
+			delete(b.subs, userID)
+		}
+	}
+}
+
+// Notify signals every subscriber of the user without blocking.
+func (b *Broker) Notify(userID int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs[userID] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
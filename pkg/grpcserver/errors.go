@@ -0,0 +1,45 @@
+package grpcserver
+
+import (
+	"net/http"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/problem"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/repo"
+)
+
+// httpCodes translates the HTTP statuses of problem.FromError to gRPC
+// status codes so both APIs classify repository errors the same way.
+var httpCodes = map[int]codes.Code{
+	http.StatusBadRequest:          codes.InvalidArgument,
+	http.StatusUnauthorized:        codes.Unauthenticated,
+	http.StatusPaymentRequired:     codes.FailedPrecondition,
+	http.StatusForbidden:           codes.PermissionDenied,
+	http.StatusNotFound:            codes.NotFound,
+	http.StatusConflict:            codes.AlreadyExists,
+	http.StatusUnprocessableEntity: codes.InvalidArgument,
+	http.StatusTooManyRequests:     codes.ResourceExhausted,
+}
+
+// problemCodes overrides httpCodes where the HTTP status alone does not
+// tell which gRPC code fits. An order uploaded again by its owner is not
+// an error over HTTP, and a conflict about the order state is not about an
+// existing entity.
+var problemCodes = map[problem.Code]codes.Code{
+	problem.CodeOrderAlreadyUploaded: codes.AlreadyExists,
+	problem.CodeOrderNotCancellable:  codes.FailedPrecondition,
+}
+
+func statusFromError(err error) error {
+	httpStatus, code := problem.FromError(err)
+	c, ok := problemCodes[code]
+	if !ok {
+		c, ok = httpCodes[httpStatus]
+	}
+	if !ok {
+		return status.Error(codes.Internal, repo.ErrInternalError.Error())
+	}
+	return status.Error(c, problem.Title(code))
+}
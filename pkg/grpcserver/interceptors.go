@@ -0,0 +1,93 @@
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/controllers"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/jwt"
+	logger2 "github.com/OmAsana/go-yapraktikum-final/pkg/logger"
+)
+
+const (
+	authorizationKey = "authorization"
+	bearerPrefix     = "bearer "
+	requestIDKey     = "x-request-id"
+)
+
+// publicMethods can be called without a token.
+var publicMethods = map[string]bool{
+	"/gophermart.v1.Gophermart/Register": true,
+	"/gophermart.v1.Gophermart/Login":    true,
+}
+
+// logRequest tags the context with the request id sent by the client, or a
+// new one, so logger.FromContext works the same way as in HTTP handlers.
+func (s *Server) logRequest(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	reqID := firstValue(ctx, requestIDKey)
+	if reqID == "" {
+		reqID = fmt.Sprintf("grpc-%06d", middleware.NextRequestID())
+	}
+	ctx = context.WithValue(ctx, middleware.RequestIDKey, reqID)
+
+	t1 := time.Now()
+	resp, err := handler(ctx, req)
+	logger2.FromContext(ctx).Info(
+		"Served",
+		zap.String("proto", "grpc"),
+		zap.String("method", info.FullMethod),
+		zap.Duration("took", time.Since(t1)),
+		zap.String("code", status.Code(err).String()),
+	)
+	return resp, err
+}
+
+// authenticate puts the user of the "authorization: Bearer <token>"
+// metadata into the context.
+func (s *Server) authenticate(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if publicMethods[info.FullMethod] {
+		return handler(ctx, req)
+	}
+
+	auth := firstValue(ctx, authorizationKey)
+	if auth == "" {
+		return nil, status.Error(codes.Unauthenticated, "authorization metadata is required")
+	}
+	if len(auth) < len(bearerPrefix) || !strings.EqualFold(auth[:len(bearerPrefix)], bearerPrefix) {
+		return nil, status.Error(codes.Unauthenticated, "authorization must be a bearer token")
+	}
+
+	claims, err := s.jwtAuth.Verify(ctx, auth[len(bearerPrefix):])
+	if err != nil {
+		if errors.Is(err, jwt.ErrTokenInvalid) || errors.Is(err, jwt.ErrTokenRevoked) {
+			logger2.FromContext(ctx).Info("User token is invalid", zap.Error(err))
+			return nil, status.Error(codes.Unauthenticated, "token is invalid")
+		}
+		logger2.FromContext(ctx).Error("Error verifying jwt token", zap.Error(err))
+		return nil, status.Error(codes.Internal, "could not verify token")
+	}
+
+	ctx = context.WithValue(ctx, controllers.UserCTXKey, claims.UserID)
+	return handler(ctx, req)
+}
+
+func firstValue(ctx context.Context, key string) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if v := md.Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
@@ -0,0 +1,211 @@
+// Package grpcserver exposes the user API over gRPC for internal services.
+// It is backed by the same repositories as the REST server.
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/controllers"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/jwt"
+	logger2 "github.com/OmAsana/go-yapraktikum-final/pkg/logger"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/pb"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/repo"
+)
+
+type Server struct {
+	pb.UnimplementedGophermartServer
+
+	logger    *zap.Logger
+	userRepo  repo.UserRepository
+	orderRepo repo.OrderRepository
+	jwtAuth   *jwt.Authentication
+}
+
+var _ pb.GophermartServer = (*Server)(nil)
+
+func NewServer(logger *zap.Logger, userRepo repo.UserRepository, orderRepo repo.OrderRepository, salt string, authOpts ...jwt.Option) *Server {
+	return &Server{
+		logger:    logger,
+		userRepo:  userRepo,
+		orderRepo: orderRepo,
+		jwtAuth:   jwt.NewAuthentication(salt, authOpts...),
+	}
+}
+
+// NewGRPCServer returns a grpc.Server with the Gophermart service and the
+// logging and authentication interceptors registered.
+func (s *Server) NewGRPCServer(opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts, grpc.ChainUnaryInterceptor(s.logRequest, s.authenticate))
+	srv := grpc.NewServer(opts...)
+	pb.RegisterGophermartServer(srv, s)
+	return srv
+}
+
+func (s *Server) Register(ctx context.Context, req *pb.Credentials) (*pb.AuthResponse, error) {
+	log := logger2.FromContext(ctx)
+	if req.GetLogin() == "" || req.GetPassword() == "" {
+		return nil, status.Error(codes.InvalidArgument, "login and password are required")
+	}
+	log.Info("Registering new user", zap.String("user", req.GetLogin()))
+
+	userID, err := s.userRepo.Create(ctx, req.GetLogin(), req.GetPassword())
+	if err != nil {
+		log.Error("Could not create user", zap.Error(err), zap.String("user", req.GetLogin()))
+		return nil, statusFromError(err)
+	}
+	return s.authResponse(ctx, userID)
+}
+
+func (s *Server) Login(ctx context.Context, req *pb.Credentials) (*pb.AuthResponse, error) {
+	log := logger2.FromContext(ctx)
+	userID, err := s.userRepo.Authenticate(ctx, req.GetLogin(), req.GetPassword())
+	if err != nil {
+		log.Error("Error authenticating user", zap.Error(err))
+		return nil, statusFromError(err)
+	}
+	return s.authResponse(ctx, userID)
+}
+
+// authResponse issues an access token only. Refresh tokens are not
+// supported over gRPC, so the token is not part of a session either.
+func (s *Server) authResponse(ctx context.Context, userID int) (*pb.AuthResponse, error) {
+	token, expiresAt, err := s.jwtAuth.CreateToken(userID)
+	if err != nil {
+		logger2.FromContext(ctx).Error("could not create jwt token", zap.Error(err))
+		return nil, status.Error(codes.Internal, "could not create token")
+	}
+	return &pb.AuthResponse{Token: token, ExpiresAt: timestamppb.New(expiresAt)}, nil
+}
+
+func (s *Server) UploadOrder(ctx context.Context, req *pb.UploadOrderRequest) (*pb.UploadOrderResponse, error) {
+	log := logger2.FromContext(ctx)
+	userID, err := controllers.UserIDFromContext(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	orderID, err := strconv.Atoi(req.GetNumber())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "order number is not a number")
+	}
+	o := models.NewOrder(orderID, userID)
+	if !o.Valid() {
+		return nil, status.Error(codes.InvalidArgument, "order number fails the Luhn check")
+	}
+
+	err = s.orderRepo.CreateNewOrder(ctx, o)
+	switch {
+	case err == nil:
+		return &pb.UploadOrderResponse{}, nil
+	case errors.Is(err, repo.ErrOrderAlreadyUploadedByCurrentUser):
+		return &pb.UploadOrderResponse{AlreadyUploaded: true}, nil
+	default:
+		log.Error("Error creating order", zap.Error(err))
+		return nil, statusFromError(err)
+	}
+}
+
+func (s *Server) ListOrders(ctx context.Context, _ *pb.ListOrdersRequest) (*pb.ListOrdersResponse, error) {
+	log := logger2.FromContext(ctx)
+	userID, err := controllers.UserIDFromContext(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	orders, err := s.orderRepo.ListOrders(ctx, userID)
+	if err != nil {
+		log.Error("Could not retrieve orders", zap.Error(err))
+		return nil, statusFromError(err)
+	}
+
+	resp := &pb.ListOrdersResponse{}
+	for _, v := range orders {
+		o := &pb.Order{
+			Number:     strconv.Itoa(v.OrderID),
+			Status:     string(v.Status),
+			UploadedAt: timestamppb.New(v.UploadedAt),
+		}
+		if v.Status != models.InvalidStatus {
+			o.Accrual = v.Accrual.InexactFloat64()
+		}
+		resp.Orders = append(resp.Orders, o)
+	}
+	return resp, nil
+}
+
+func (s *Server) GetBalance(ctx context.Context, _ *pb.GetBalanceRequest) (*pb.Balance, error) {
+	log := logger2.FromContext(ctx)
+	userID, err := controllers.UserIDFromContext(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	balance, err := s.orderRepo.CurrentBalance(ctx, userID)
+	if err != nil {
+		log.Error("Internal error", zap.Error(err))
+		return nil, statusFromError(err)
+	}
+	return &pb.Balance{Current: balance.Current.InexactFloat64(), Withdrawn: balance.Withdrawn.InexactFloat64()}, nil
+}
+
+func (s *Server) Withdraw(ctx context.Context, req *pb.WithdrawRequest) (*pb.WithdrawResponse, error) {
+	log := logger2.FromContext(ctx)
+	userID, err := controllers.UserIDFromContext(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	withdrawal := controllers.Withdrawal{Order: req.GetOrder(), Sum: req.GetSum(), ProcessedAt: time.Now()}
+	order, err := withdrawal.ToOrder(userID)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "order number is not a number")
+	}
+	if !order.Valid() {
+		return nil, status.Error(codes.InvalidArgument, "order number fails the Luhn check")
+	}
+
+	if err := s.orderRepo.Withdraw(ctx, order); err != nil {
+		log.Info("Could not withdraw", zap.Error(err))
+		return nil, statusFromError(err)
+	}
+	return &pb.WithdrawResponse{}, nil
+}
+
+func (s *Server) ListWithdrawals(ctx context.Context, _ *pb.ListWithdrawalsRequest) (*pb.ListWithdrawalsResponse, error) {
+	log := logger2.FromContext(ctx)
+	userID, err := controllers.UserIDFromContext(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	withdrawals, err := s.orderRepo.ListWithdrawals(ctx, userID)
+	if err != nil {
+		log.Error("Could not retrieve withdrawals", zap.Error(err))
+		return nil, statusFromError(err)
+	}
+
+	sort.Slice(withdrawals, func(i, j int) bool {
+		return withdrawals[i].ProcessedAt.After(withdrawals[j].ProcessedAt)
+	})
+
+	resp := &pb.ListWithdrawalsResponse{}
+	for _, v := range withdrawals {
+		resp.Withdrawals = append(resp.Withdrawals, &pb.Withdrawal{
+			Order:       strconv.Itoa(v.OrderID),
+			Sum:         v.Accrual.InexactFloat64(),
+			ProcessedAt: timestamppb.New(v.ProcessedAt),
+		})
+	}
+	return resp, nil
+}
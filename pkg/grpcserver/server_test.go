@@ -0,0 +1,187 @@
+package grpcserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/jwt"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/logger"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/pb"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/repo"
+)
+
+type fakeUserRepo struct {
+	repo.UserRepository
+	users map[string]string
+}
+
+func (f *fakeUserRepo) Create(_ context.Context, username string, password string) (int, error) {
+	if _, ok := f.users[username]; ok {
+		return -1, repo.ErrUserAlreadyExists
+	}
+	f.users[username] = password
+	return len(f.users), nil
+}
+
+func (f *fakeUserRepo) Authenticate(_ context.Context, username string, password string) (int, error) {
+	if f.users[username] != password {
+		return -1, repo.ErrUserAuthFailed
+	}
+	return 1, nil
+}
+
+type fakeOrderRepo struct {
+	repo.OrderRepository
+	orders []*models.Order
+}
+
+func (f *fakeOrderRepo) CreateNewOrder(_ context.Context, order models.Order) error {
+	for _, v := range f.orders {
+		if v.OrderID == order.OrderID {
+			return repo.ErrOrderAlreadyUploadedByCurrentUser
+		}
+	}
+	order.UploadedAt = time.Now()
+	f.orders = append(f.orders, &order)
+	return nil
+}
+
+func (f *fakeOrderRepo) ListOrders(_ context.Context, userID int) ([]*models.Order, error) {
+	var res []*models.Order
+	for _, v := range f.orders {
+		if v.UserID == userID {
+			res = append(res, v)
+		}
+	}
+	return res, nil
+}
+
+func (f *fakeOrderRepo) CurrentBalance(_ context.Context, _ int) (models.Balance, error) {
+	return models.Balance{Current: decimal.NewFromInt(100)}, nil
+}
+
+func (f *fakeOrderRepo) Withdraw(_ context.Context, order models.Order) error {
+	if order.Accrual.GreaterThan(decimal.NewFromInt(100)) {
+		return repo.ErrNotEnoughFunds
+	}
+	return nil
+}
+
+func newTestClient(t *testing.T, authOpts ...jwt.Option) pb.GophermartClient {
+	lis := bufconn.Listen(1 << 20)
+	srv := NewServer(logger.NewNoop(), &fakeUserRepo{users: map[string]string{}}, &fakeOrderRepo{}, "salt", authOpts...).NewGRPCServer()
+	go func() {
+		_ = srv.Serve(lis)
+	}()
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return pb.NewGophermartClient(conn)
+}
+
+func TestServer(t *testing.T) {
+	client := newTestClient(t, jwt.WithTTL(time.Minute))
+	ctx := context.Background()
+
+	_, err := client.ListOrders(ctx, &pb.ListOrdersRequest{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	badCtx := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer garbage")
+	_, err = client.ListOrders(badCtx, &pb.ListOrdersRequest{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	auth, err := client.Register(ctx, &pb.Credentials{Login: "user", Password: "pass"})
+	require.NoError(t, err)
+	require.NotEmpty(t, auth.GetToken())
+
+	_, err = client.Register(ctx, &pb.Credentials{Login: "user", Password: "pass"})
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	_, err = client.Login(ctx, &pb.Credentials{Login: "user", Password: "wrong"})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	auth, err = client.Login(ctx, &pb.Credentials{Login: "user", Password: "pass"})
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now().Add(time.Minute), auth.GetExpiresAt().AsTime(), 5*time.Second)
+	authCtx := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+auth.GetToken())
+
+	resp, err := client.UploadOrder(authCtx, &pb.UploadOrderRequest{Number: "12345678903"})
+	require.NoError(t, err)
+	require.False(t, resp.GetAlreadyUploaded())
+
+	resp, err = client.UploadOrder(authCtx, &pb.UploadOrderRequest{Number: "12345678903"})
+	require.NoError(t, err)
+	require.True(t, resp.GetAlreadyUploaded())
+
+	_, err = client.UploadOrder(authCtx, &pb.UploadOrderRequest{Number: "12345678904"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	orders, err := client.ListOrders(authCtx, &pb.ListOrdersRequest{})
+	require.NoError(t, err)
+	require.Len(t, orders.GetOrders(), 1)
+	require.Equal(t, "12345678903", orders.GetOrders()[0].GetNumber())
+	require.Equal(t, string(models.NewStatus), orders.GetOrders()[0].GetStatus())
+
+	balance, err := client.GetBalance(authCtx, &pb.GetBalanceRequest{})
+	require.NoError(t, err)
+	require.Equal(t, float64(100), balance.GetCurrent())
+
+	_, err = client.Withdraw(authCtx, &pb.WithdrawRequest{Order: "2377225624", Sum: 500})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	_, err = client.Withdraw(authCtx, &pb.WithdrawRequest{Order: "2377225624", Sum: 50})
+	require.NoError(t, err)
+}
+
+func Test_statusFromError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want codes.Code
+	}{
+		{repo.ErrUserNotFound, codes.Unauthenticated},
+		{repo.ErrUserAuthFailed, codes.Unauthenticated},
+		{repo.ErrUserAlreadyExists, codes.AlreadyExists},
+		{repo.ErrOrderNotFound, codes.NotFound},
+		{repo.ErrDuplicateOrder, codes.AlreadyExists},
+		{repo.ErrOrderAlreadyUploadedByCurrentUser, codes.AlreadyExists},
+		{repo.ErrOrderCreatedByAnotherUser, codes.AlreadyExists},
+		{repo.ErrOrderNotCancellable, codes.FailedPrecondition},
+		{repo.ErrNotEnoughFunds, codes.FailedPrecondition},
+		{repo.ErrWebhookNotFound, codes.NotFound},
+		{repo.ErrRefreshTokenInvalid, codes.Unauthenticated},
+		{repo.ErrRefreshTokenReused, codes.Unauthenticated},
+		{repo.ErrSessionNotFound, codes.NotFound},
+		{repo.ErrInternalError, codes.Internal},
+		{fmt.Errorf("query orders: %w", repo.ErrOrderNotFound), codes.NotFound},
+		{errors.New("connection reset"), codes.Internal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			st := status.Convert(statusFromError(tt.err))
+			require.Equal(t, tt.want, st.Code())
+			// the message never carries the text of the underlying error
+			require.NotContains(t, st.Message(), "connection reset")
+		})
+	}
+}
@@ -3,6 +3,7 @@ package jwt
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net/http"
 	"time"
 
@@ -11,86 +12,262 @@ import (
 
 	"github.com/OmAsana/go-yapraktikum-final/pkg/controllers"
 	"github.com/OmAsana/go-yapraktikum-final/pkg/logger"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/problem"
 )
 
 var cookieKey = "token"
 
+var (
+	ErrTokenInvalid = errors.New("token is invalid")
+	ErrTokenRevoked = errors.New("token was revoked")
+)
+
 type Claims struct {
 	UserID int `json:"user_id"`
+	// SessionID is the refresh token family the token was issued for.
+	SessionID string `json:"sid,omitempty"`
 	jwtgo.StandardClaims
 }
 
+// Expires is the time the token stops being valid.
+func (c *Claims) Expires() time.Time {
+	return time.Unix(c.ExpiresAt, 0)
+}
+
+// Denylist tells whether a token or a whole session was revoked before
+// the token expired.
+type Denylist interface {
+	IsRevoked(ctx context.Context, id string) (bool, error)
+}
+
+// DefaultTTL is how long tokens are valid unless WithTTL says otherwise.
+const DefaultTTL = 10 * time.Hour
+
 type Authentication struct {
-	salt []byte
+	keys     *Keyring
+	ttl      time.Duration
+	denylist Denylist
 }
 
-func NewAuthentication(salt string) *Authentication {
-	return &Authentication{salt: []byte(salt)}
+type Option func(a *Authentication)
+
+// WithTTL sets how long created tokens are valid.
+func WithTTL(ttl time.Duration) Option {
+	return func(a *Authentication) {
+		a.ttl = ttl
+	}
 }
 
-func (a *Authentication) CreateClaim(userID int) (*http.Cookie, error) {
-	expirationTime := time.Now().Add(10 * time.Hour)
+// WithDenylist rejects tokens whose id or session is on the denylist.
+func WithDenylist(denylist Denylist) Option {
+	return func(a *Authentication) {
+		a.denylist = denylist
+	}
+}
+
+// WithKeyring signs and verifies tokens with the keys of keyring instead
+// of the salt.
+func WithKeyring(keyring *Keyring) Option {
+	return func(a *Authentication) {
+		a.keys = keyring
+	}
+}
+
+func NewAuthentication(salt string, opts ...Option) *Authentication {
+	a := &Authentication{ttl: DefaultTTL}
+	for _, v := range opts {
+		v(a)
+	}
+	if a.keys == nil {
+		// an HMAC key can always sign
+		a.keys, _ = NewKeyring(HMACKey([]byte(salt)))
+	}
+	return a
+}
+
+// JWKS returns the public keys tokens are verified with.
+func (a *Authentication) JWKS() JWKSet {
+	return a.keys.JWKS()
+}
+
+// CreateToken signs a token for userID that does not belong to a session
+// and returns it with its expiration time.
+func (a *Authentication) CreateToken(userID int) (string, time.Time, error) {
+	return a.CreateSessionToken(userID, "")
+}
+
+// CreateSessionToken signs a token for userID issued for sessionID. Every
+// token gets a random id so it can be revoked on its own.
+func (a *Authentication) CreateSessionToken(userID int, sessionID string) (string, time.Time, error) {
+	tokenID, err := randomString(16)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	now := time.Now()
+	expirationTime := now.Add(a.ttl)
 	claims := &Claims{
-		UserID: userID,
+		UserID:    userID,
+		SessionID: sessionID,
 		StandardClaims: jwtgo.StandardClaims{
+			Id:        tokenID,
+			IssuedAt:  now.Unix(),
 			ExpiresAt: expirationTime.Unix(),
 		},
 	}
 
-	token := jwtgo.NewWithClaims(jwtgo.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(a.salt)
+	key := a.keys.SigningKey()
+	token := jwtgo.NewWithClaims(key.Method, claims)
+	if key.ID != "" {
+		token.Header["kid"] = key.ID
+	}
+	tokenString, err := token.SignedString(key.private)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return tokenString, expirationTime, nil
+}
+
+// Parse returns the claims of a token. ErrTokenInvalid is returned for
+// expired tokens or tokens with a wrong signature or an unknown key. The
+// denylist is not consulted, see Verify.
+func (a *Authentication) Parse(tokenStr string) (*Claims, error) {
+	claim := &Claims{}
+	tkn, err := jwtgo.ParseWithClaims(tokenStr, claim, a.verificationKey)
 	if err != nil {
+		if tkn == nil || !tkn.Valid {
+			return nil, fmt.Errorf("%w: %v", ErrTokenInvalid, err)
+		}
 		return nil, err
 	}
+	if !tkn.Valid {
+		return nil, ErrTokenInvalid
+	}
+	return claim, nil
+}
 
-	return &http.Cookie{
-		Name:    cookieKey,
-		Value:   tokenString,
-		Expires: expirationTime,
-	}, nil
+// verificationKey picks the key by the kid header. The algorithm has to
+// match the key, or a public key could be used as an HMAC secret.
+func (a *Authentication) verificationKey(token *jwtgo.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := a.keys.Lookup(kid)
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %s for key %q", token.Method.Alg(), kid)
+	}
+	return key.public, nil
 }
 
-func (a *Authentication) CheckAuthentication(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log := logger.FromContext(r.Context())
-		c, err := r.Cookie(cookieKey)
+// ParseToken returns the user the token was issued to.
+func (a *Authentication) ParseToken(tokenStr string) (int, error) {
+	claim, err := a.Parse(tokenStr)
+	if err != nil {
+		return -1, err
+	}
+	return claim.UserID, nil
+}
+
+// Verify parses the token and checks that neither the token nor its
+// session was revoked. ErrTokenRevoked is returned for revoked tokens.
+func (a *Authentication) Verify(ctx context.Context, tokenStr string) (*Claims, error) {
+	claim, err := a.Parse(tokenStr)
+	if err != nil {
+		return nil, err
+	}
+	if a.denylist == nil {
+		return claim, nil
+	}
+
+	for _, id := range []string{claim.Id, claim.SessionID} {
+		if id == "" {
+			continue
+		}
+		revoked, err := a.denylist.IsRevoked(ctx, id)
 		if err != nil {
-			log.Error("Can not find cookie", zap.Error(err))
-			if errors.Is(err, http.ErrNoCookie) {
-				w.WriteHeader(http.StatusUnauthorized)
-				return
-			}
-			w.WriteHeader(http.StatusBadRequest)
-			return
+			return nil, fmt.Errorf("checking denylist: %w", err)
 		}
+		if revoked {
+			return nil, ErrTokenRevoked
+		}
+	}
+	return claim, nil
+}
 
-		tokenStr := c.Value
-		claim := &Claims{}
+func (a *Authentication) CreateClaim(userID int) (*http.Cookie, error) {
+	tokenString, expirationTime, err := a.CreateToken(userID)
+	if err != nil {
+		return nil, err
+	}
 
-		tkn, err := jwtgo.ParseWithClaims(tokenStr, claim, func(token *jwtgo.Token) (interface{}, error) {
-			return a.salt, nil
-		})
+	return Cookie(tokenString, expirationTime), nil
+}
 
-		if err != nil {
+// Cookie carries token to clients using TransportCookie.
+func Cookie(token string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:    cookieKey,
+		Value:   token,
+		Expires: expires,
+	}
+}
+
+// ClearCookies makes the client drop the token and refresh token cookies.
+func ClearCookies(w http.ResponseWriter) {
+	for _, c := range []*http.Cookie{Cookie("", time.Unix(0, 0)), RefreshCookie("", time.Unix(0, 0))} {
+		c.MaxAge = -1
+		http.SetCookie(w, c)
+	}
+}
+
+type claimsCtxKey struct{}
+
+// ClaimsFromContext returns the claims of the token the request was
+// authenticated with.
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	claim, ok := ctx.Value(claimsCtxKey{}).(*Claims)
+	return claim, ok
+}
 
-			if !tkn.Valid {
-				log.Info("User token is invalid", zap.Error(err))
-				w.WriteHeader(http.StatusUnauthorized)
+// CheckAuthentication accepts tokens sent with any transport.
+func (a *Authentication) CheckAuthentication(next http.Handler) http.Handler {
+	return a.Middleware(AnyTransport)(next)
+}
+
+// Middleware puts the user of the request token and the token claims into
+// the context. Only tokens sent with one of transports are accepted, an
+// Authorization header takes precedence over the cookie.
+func (a *Authentication) Middleware(transports Transport) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			log := logger.FromContext(r.Context())
+			tokenStr, err := tokenFromRequest(r, transports)
+			if err != nil {
+				log.Info("Can not find token", zap.Error(err))
+				if errors.Is(err, errNoToken) {
+					problem.Write(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "")
+					return
+				}
+				problem.Write(w, r, http.StatusBadRequest, problem.CodeMalformedRequest, err.Error())
 				return
 			}
-			log.Error("Error parsing jwt token", zap.Error(err))
-			w.WriteHeader(http.StatusBadRequest)
-			return
-
-		}
 
-		if !tkn.Valid {
-			log.Info("User token is invalid")
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
+			claim, err := a.Verify(r.Context(), tokenStr)
+			if err != nil {
+				if errors.Is(err, ErrTokenInvalid) || errors.Is(err, ErrTokenRevoked) {
+					log.Info("User token is invalid", zap.Error(err))
+					problem.Write(w, r, http.StatusUnauthorized, problem.CodeTokenInvalid, "")
+					return
+				}
+				log.Error("Error verifying jwt token", zap.Error(err))
+				problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternalError, "")
+				return
+			}
 
-		ctx := context.WithValue(r.Context(), controllers.UserCTXKey, claim.UserID)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+			ctx := context.WithValue(r.Context(), controllers.UserCTXKey, claim.UserID)
+			ctx = context.WithValue(ctx, claimsCtxKey{}, claim)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
 }
@@ -0,0 +1,189 @@
+package jwt
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// keyReloadInterval is how often the signing key file is checked for
+// changes.
+const keyReloadInterval = 10 * time.Second
+
+// Keyring holds the key new tokens are signed with and the keys tokens
+// are still verified with. A rotated out signing key verifies tokens
+// until its grace period ends, tokens it signed stay valid meanwhile.
+type Keyring struct {
+	now func() time.Time
+
+	mu        sync.RWMutex
+	signing   Key
+	verifying []verificationKey
+}
+
+type verificationKey struct {
+	Key
+	// until is when the key stops verifying, zero for keys kept until
+	// the process stops.
+	until time.Time
+}
+
+// NewKeyring signs with signing and additionally verifies with
+// verifying, e.g. keys other instances may already sign with.
+func NewKeyring(signing Key, verifying ...Key) (*Keyring, error) {
+	if !signing.CanSign() {
+		return nil, errors.New("signing key has no private key")
+	}
+	k := &Keyring{now: time.Now, signing: signing}
+	for _, v := range verifying {
+		k.verifying = append(k.verifying, verificationKey{Key: v})
+	}
+	return k, nil
+}
+
+// SigningKey returns the key new tokens are signed with.
+func (k *Keyring) SigningKey() Key {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.signing
+}
+
+// Rotate signs with next from now on. The previous signing key keeps
+// verifying for grace, a grace of zero drops it right away.
+func (k *Keyring) Rotate(next Key, grace time.Duration) error {
+	if !next.CanSign() {
+		return errors.New("signing key has no private key")
+	}
+
+	now := k.now()
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if next.ID == k.signing.ID && next.Method == k.signing.Method {
+		k.signing = next
+		return nil
+	}
+
+	verifying := k.verifying[:0]
+	for _, v := range k.verifying {
+		if v.ID == next.ID || !v.valid(now) {
+			continue
+		}
+		verifying = append(verifying, v)
+	}
+	if grace > 0 {
+		verifying = append(verifying, verificationKey{Key: k.signing, until: now.Add(grace)})
+	}
+	k.verifying = verifying
+	k.signing = next
+	return nil
+}
+
+// Lookup returns the key with id tokens may be verified with.
+func (k *Keyring) Lookup(id string) (Key, bool) {
+	now := k.now()
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if k.signing.ID == id {
+		return k.signing, true
+	}
+	for _, v := range k.verifying {
+		if v.ID == id && v.valid(now) {
+			return v.Key, true
+		}
+	}
+	return Key{}, false
+}
+
+// JWKS returns the public keys tokens may be verified with, the signing
+// key first. HMAC keys are secret and left out.
+func (k *Keyring) JWKS() JWKSet {
+	now := k.now()
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	set := JWKSet{Keys: []JWK{}}
+	if !k.signing.Symmetric() {
+		set.Keys = append(set.Keys, k.signing.JWK())
+	}
+	for _, v := range k.verifying {
+		if !v.Symmetric() && v.valid(now) {
+			set.Keys = append(set.Keys, v.JWK())
+		}
+	}
+	return set
+}
+
+func (v verificationKey) valid(now time.Time) bool {
+	return v.until.IsZero() || now.Before(v.until)
+}
+
+// KeyReloader rotates the keyring to the key in a file whenever the file
+// changes, so keys can be rotated without a restart.
+type KeyReloader struct {
+	file    string
+	keyring *Keyring
+	grace   time.Duration
+	log     *zap.Logger
+
+	modTime time.Time
+}
+
+// NewKeyReloader rotates keyring to the key in file right away and fails
+// if it can not be loaded.
+func NewKeyReloader(file string, keyring *Keyring, grace time.Duration, log *zap.Logger) (*KeyReloader, error) {
+	r := &KeyReloader{file: file, keyring: keyring, grace: grace, log: log}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Run checks the file until ctx is done. A broken key is logged and the
+// previous one stays in use.
+func (r *KeyReloader) Run(ctx context.Context) error {
+	ticker := time.NewTicker(keyReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			reloaded, err := r.reload()
+			if err != nil {
+				r.log.Error("Could not reload jwt signing key", zap.Error(err), zap.String("file", r.file))
+				continue
+			}
+			if reloaded {
+				r.log.Info("Rotated jwt signing key", zap.String("file", r.file),
+					zap.String("kid", r.keyring.SigningKey().ID))
+			}
+		}
+	}
+}
+
+// reload rotates the keyring if the file changed since the last load.
+func (r *KeyReloader) reload() (bool, error) {
+	info, err := os.Stat(r.file)
+	if err != nil {
+		return false, err
+	}
+	if !r.modTime.IsZero() && info.ModTime().Equal(r.modTime) {
+		return false, nil
+	}
+
+	key, err := LoadKeyFile(r.file)
+	if err != nil {
+		return false, err
+	}
+	if err := r.keyring.Rotate(key, r.grace); err != nil {
+		return false, err
+	}
+	r.modTime = info.ModTime()
+	return true, nil
+}
@@ -0,0 +1,187 @@
+package jwt
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jwtgo "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/logger"
+)
+
+func rsaKeyPEM(t *testing.T) []byte {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+func ed25519KeyPEM(t *testing.T) []byte {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func publicKeyPEM(t *testing.T, pub interface{}) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func TestParseKey(t *testing.T) {
+	t.Run("rfc 7638 thumbprint", func(t *testing.T) {
+		n, err := base64.RawURLEncoding.DecodeString("0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw")
+		require.NoError(t, err)
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: 65537}
+
+		key, err := ParseKey(publicKeyPEM(t, pub))
+		require.NoError(t, err)
+		require.Equal(t, "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs", key.ID)
+		require.Equal(t, jwtgo.SigningMethodRS256, key.Method)
+		require.False(t, key.CanSign())
+		require.Equal(t, "AQAB", key.JWK().E)
+	})
+
+	t.Run("ed25519", func(t *testing.T) {
+		key, err := ParseKey(ed25519KeyPEM(t))
+		require.NoError(t, err)
+		require.True(t, key.CanSign())
+		require.Equal(t, SigningMethodEdDSA, key.Method)
+
+		jwk := key.JWK()
+		require.Equal(t, "OKP", jwk.Kty)
+		require.Equal(t, "Ed25519", jwk.Crv)
+		require.Equal(t, key.ID, jwk.Kid)
+	})
+
+	t.Run("unsupported keys", func(t *testing.T) {
+		ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		_, err = ParseKey(publicKeyPEM(t, &ecKey.PublicKey))
+		require.ErrorIs(t, err, ErrUnsupportedKey)
+
+		small, err := rsa.GenerateKey(rand.Reader, 1024)
+		require.NoError(t, err)
+		_, err = ParseKey(publicKeyPEM(t, &small.PublicKey))
+		require.ErrorIs(t, err, ErrUnsupportedKey)
+
+		_, err = ParseKey([]byte("not a key"))
+		require.Error(t, err)
+	})
+}
+
+func TestKeyring(t *testing.T) {
+	rsaKey, err := ParseKey(rsaKeyPEM(t))
+	require.NoError(t, err)
+	edKey, err := ParseKey(ed25519KeyPEM(t))
+	require.NoError(t, err)
+
+	now := time.Now()
+	keyring, err := NewKeyring(HMACKey([]byte("salt")))
+	require.NoError(t, err)
+	keyring.now = func() time.Time { return now }
+	auth := NewAuthentication("", WithKeyring(keyring))
+
+	legacy, _, err := auth.CreateToken(1)
+	require.NoError(t, err)
+	require.Empty(t, keyring.JWKS().Keys)
+
+	// rotating to an asymmetric key keeps the salt verifying for the grace
+	require.NoError(t, keyring.Rotate(rsaKey, time.Hour))
+	signedRSA, _, err := auth.CreateToken(2)
+	require.NoError(t, err)
+	parsed, _ := jwtgo.Parse(signedRSA, nil)
+	require.Equal(t, rsaKey.ID, parsed.Header["kid"])
+	require.Equal(t, "RS256", parsed.Header["alg"])
+
+	require.NoError(t, keyring.Rotate(edKey, 2*time.Hour))
+	signedEd, _, err := auth.CreateToken(3)
+	require.NoError(t, err)
+
+	for token, userID := range map[string]int{legacy: 1, signedRSA: 2, signedEd: 3} {
+		got, err := auth.ParseToken(token)
+		require.NoError(t, err)
+		require.Equal(t, userID, got)
+	}
+	jwks := keyring.JWKS()
+	require.Len(t, jwks.Keys, 2)
+	require.Equal(t, edKey.ID, jwks.Keys[0].Kid)
+	require.Equal(t, rsaKey.ID, jwks.Keys[1].Kid)
+
+	// after the grace period the retired keys no longer verify
+	now = now.Add(90 * time.Minute)
+	_, err = auth.ParseToken(legacy)
+	require.ErrorIs(t, err, ErrTokenInvalid)
+	_, err = auth.ParseToken(signedRSA)
+	require.NoError(t, err)
+
+	now = now.Add(time.Hour)
+	_, err = auth.ParseToken(signedRSA)
+	require.ErrorIs(t, err, ErrTokenInvalid)
+	_, err = auth.ParseToken(signedEd)
+	require.NoError(t, err)
+	require.Len(t, keyring.JWKS().Keys, 1)
+
+	// a public key must not be accepted as an HMAC secret
+	forged := jwtgo.NewWithClaims(jwtgo.SigningMethodHS256, &Claims{UserID: 4})
+	forged.Header["kid"] = edKey.ID
+	forgedStr, err := forged.SignedString([]byte(edKey.public.(ed25519.PublicKey)))
+	require.NoError(t, err)
+	_, err = auth.ParseToken(forgedStr)
+	require.ErrorIs(t, err, ErrTokenInvalid)
+
+	publicOnly, err := ParseKey(publicKeyPEM(t, edKey.public))
+	require.NoError(t, err)
+	require.Error(t, keyring.Rotate(publicOnly, time.Hour))
+}
+
+func TestKeyReloader(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "jwt.pem")
+	require.NoError(t, ioutil.WriteFile(file, rsaKeyPEM(t), 0600))
+
+	keyring, err := NewKeyring(HMACKey([]byte("salt")))
+	require.NoError(t, err)
+	reloader, err := NewKeyReloader(file, keyring, time.Hour, logger.NewNoop())
+	require.NoError(t, err)
+	first := keyring.SigningKey()
+	require.Equal(t, jwtgo.SigningMethodRS256, first.Method)
+
+	reloaded, err := reloader.reload()
+	require.NoError(t, err)
+	require.False(t, reloaded)
+
+	require.NoError(t, ioutil.WriteFile(file, ed25519KeyPEM(t), 0600))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(file, later, later))
+	reloaded, err = reloader.reload()
+	require.NoError(t, err)
+	require.True(t, reloaded)
+	require.Equal(t, SigningMethodEdDSA, keyring.SigningKey().Method)
+
+	_, ok := keyring.Lookup(first.ID)
+	require.True(t, ok)
+
+	require.NoError(t, ioutil.WriteFile(file, []byte("broken"), 0600))
+	later = later.Add(time.Minute)
+	require.NoError(t, os.Chtimes(file, later, later))
+	_, err = reloader.reload()
+	require.Error(t, err)
+	require.Equal(t, SigningMethodEdDSA, keyring.SigningKey().Method)
+}
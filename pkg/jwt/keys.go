@@ -0,0 +1,170 @@
+package jwt
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+
+	jwtgo "github.com/dgrijalva/jwt-go"
+)
+
+// minRSABits is the smallest RSA key accepted for RS256.
+const minRSABits = 2048
+
+var ErrUnsupportedKey = errors.New("unsupported key")
+
+// Key signs and verifies tokens. Keys loaded from a public key can only
+// verify.
+type Key struct {
+	// ID is sent as the kid token header. It is the RFC 7638 thumbprint
+	// of asymmetric keys and empty for the HMAC key, tokens signed
+	// before keys had ids carry no kid.
+	ID     string
+	Method jwtgo.SigningMethod
+
+	private interface{}
+	public  interface{}
+}
+
+// CanSign tells whether the key holds a private key.
+func (k Key) CanSign() bool {
+	return k.private != nil
+}
+
+// Symmetric keys are secret and never published.
+func (k Key) Symmetric() bool {
+	return k.Method == jwtgo.SigningMethodHS256
+}
+
+// HMACKey signs with HS256 using a shared secret.
+func HMACKey(secret []byte) Key {
+	return Key{Method: jwtgo.SigningMethodHS256, private: secret, public: secret}
+}
+
+// LoadKeyFile reads a PEM encoded key, see ParseKey.
+func LoadKeyFile(file string) (Key, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return Key{}, err
+	}
+	key, err := ParseKey(data)
+	if err != nil {
+		return Key{}, fmt.Errorf("%s: %w", file, err)
+	}
+	return key, nil
+}
+
+// ParseKey parses a PEM encoded RSA or Ed25519 key. RSA keys sign with
+// RS256 and Ed25519 keys with EdDSA. Private keys may be PKCS #1 or
+// PKCS #8, public keys PKCS #1 or PKIX.
+func ParseKey(data []byte) (Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return Key{}, errors.New("no pem block found")
+	}
+
+	var parsed interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return Key{}, fmt.Errorf("%w: pem block %q", ErrUnsupportedKey, block.Type)
+	}
+	if err != nil {
+		return Key{}, err
+	}
+
+	var key Key
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key = Key{Method: jwtgo.SigningMethodRS256, private: k, public: &k.PublicKey}
+	case *rsa.PublicKey:
+		key = Key{Method: jwtgo.SigningMethodRS256, public: k}
+	case ed25519.PrivateKey:
+		key = Key{Method: SigningMethodEdDSA, private: k, public: k.Public()}
+	case ed25519.PublicKey:
+		key = Key{Method: SigningMethodEdDSA, public: k}
+	default:
+		return Key{}, fmt.Errorf("%w: %T", ErrUnsupportedKey, parsed)
+	}
+
+	if pub, ok := key.public.(*rsa.PublicKey); ok && pub.N.BitLen() < minRSABits {
+		return Key{}, fmt.Errorf("%w: rsa keys need at least %d bits", ErrUnsupportedKey, minRSABits)
+	}
+	key.ID = thumbprint(key.JWK())
+	return key, nil
+}
+
+// JWK is a public key as published in a JSON Web Key Set (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKSet is served on /.well-known/jwks.json.
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK returns the public part of an asymmetric key.
+func (k Key) JWK() JWK {
+	jwk := JWK{Kid: k.ID, Use: "sig", Alg: k.Method.Alg()}
+	switch pub := k.public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+	}
+	return jwk
+}
+
+// thumbprint is the RFC 7638 thumbprint of jwk: the hash of its required
+// members in lexicographic order.
+func thumbprint(jwk JWK) string {
+	var members interface{}
+	switch jwk.Kty {
+	case "RSA":
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.Kty, jwk.N}
+	default:
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Crv, jwk.Kty, jwk.X}
+	}
+	// marshaling strings can not fail
+	data, _ := json.Marshal(members)
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,66 @@
+package jwt
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"time"
+)
+
+const refreshCookieKey = "refresh_token"
+
+// RefreshCookiePath limits the refresh token cookie to the endpoints
+// using it, so it is not sent along with every request.
+const RefreshCookiePath = "/api/user/token"
+
+const refreshTokenBytes = 32
+
+// NewRefreshToken returns a random opaque token. Refresh tokens are not
+// JWTs, they are only valid as long as their hash is stored.
+func NewRefreshToken() (string, error) {
+	return randomString(refreshTokenBytes)
+}
+
+// NewFamilyID returns a random id for a new refresh token family.
+func NewFamilyID() (string, error) {
+	return randomString(16)
+}
+
+// HashRefreshToken is what gets stored instead of the token, so a leaked
+// table can not be used to refresh.
+func HashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// RefreshCookie carries the refresh token to cookie clients.
+func RefreshCookie(token string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     refreshCookieKey,
+		Value:    token,
+		Path:     RefreshCookiePath,
+		Expires:  expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	}
+}
+
+// RefreshTokenFromCookie returns the refresh token cookie value, or an
+// empty string when there is none.
+func RefreshTokenFromCookie(r *http.Request) string {
+	c, err := r.Cookie(refreshCookieKey)
+	if err != nil {
+		return ""
+	}
+	return c.Value
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
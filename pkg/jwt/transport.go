@@ -0,0 +1,77 @@
+package jwt
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-http-utils/headers"
+)
+
+// Transport is a way clients send their token. Transports are combined
+// with |.
+type Transport int
+
+const (
+	// TransportCookie reads the token from the cookie set on login.
+	TransportCookie Transport = 1 << iota
+	// TransportBearer reads the token from an "Authorization: Bearer"
+	// header.
+	TransportBearer
+
+	AnyTransport = TransportCookie | TransportBearer
+)
+
+// BearerPrefix starts the Authorization header carrying a token.
+const BearerPrefix = "Bearer "
+
+var errNoToken = errors.New("no token in request")
+
+var transportNames = map[string]Transport{
+	"cookie": TransportCookie,
+	"bearer": TransportBearer,
+}
+
+// ParseTransports combines transports given by name, "cookie" or "bearer".
+func ParseTransports(names []string) (Transport, error) {
+	var t Transport
+	for _, name := range names {
+		v, ok := transportNames[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return 0, fmt.Errorf("unknown token transport %q", name)
+		}
+		t |= v
+	}
+	if t == 0 {
+		return 0, fmt.Errorf("at least one token transport is required")
+	}
+	return t, nil
+}
+
+// BearerHeader is the Authorization header value carrying token.
+func BearerHeader(token string) string {
+	return BearerPrefix + token
+}
+
+func tokenFromRequest(r *http.Request, transports Transport) (string, error) {
+	if transports&TransportBearer != 0 {
+		if auth := r.Header.Get(headers.Authorization); auth != "" {
+			if len(auth) < len(BearerPrefix) || !strings.EqualFold(auth[:len(BearerPrefix)], BearerPrefix) {
+				return "", fmt.Errorf("authorization must be a bearer token")
+			}
+			return strings.TrimSpace(auth[len(BearerPrefix):]), nil
+		}
+	}
+
+	if transports&TransportCookie != 0 {
+		c, err := r.Cookie(cookieKey)
+		if err == nil {
+			return c.Value, nil
+		}
+		if !errors.Is(err, http.ErrNoCookie) {
+			return "", fmt.Errorf("could not read token cookie")
+		}
+	}
+	return "", errNoToken
+}
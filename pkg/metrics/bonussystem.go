@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/bonussystem"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
+)
+
+var _ bonussystem.Metrics = (*BonusSystem)(nil)
+
+// BonusSystem collects metrics of the accrual poller.
+type BonusSystem struct {
+	pollCycles   prometheus.Counter
+	accrualCalls *prometheus.CounterVec
+	transitions  *prometheus.CounterVec
+	queueDepth   prometheus.Gauge
+}
+
+func NewBonusSystem(reg prometheus.Registerer) *BonusSystem {
+	m := &BonusSystem{
+		pollCycles: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "bonus_system",
+			Name:      "poll_cycles_total",
+			Help:      "Passes over unprocessed orders.",
+		}),
+		accrualCalls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "bonus_system",
+			Name:      "accrual_requests_total",
+			Help:      "Requests to the accrual system by status code, 0 when no response was received.",
+		}, []string{"code"}),
+		transitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "bonus_system",
+			Name:      "order_transitions_total",
+			Help:      "Orders moved to a new status by the poller.",
+		}, []string{"status"}),
+		queueDepth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "bonus_system",
+			Name:      "unprocessed_orders",
+			Help:      "Orders waiting for the accrual system at the start of the last poll cycle.",
+		}),
+	}
+	reg.MustRegister(m.pollCycles, m.accrualCalls, m.transitions, m.queueDepth)
+	return m
+}
+
+func (m *BonusSystem) PollCycle() {
+	m.pollCycles.Inc()
+}
+
+func (m *BonusSystem) AccrualCall(code int) {
+	m.accrualCalls.WithLabelValues(strconv.Itoa(code)).Inc()
+}
+
+func (m *BonusSystem) OrderTransitioned(status models.OrderStatus) {
+	m.transitions.WithLabelValues(string(status)).Inc()
+}
+
+func (m *BonusSystem) QueueDepth(n int) {
+	m.queueDepth.Set(float64(n))
+}
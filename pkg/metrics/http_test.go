@@ -0,0 +1,39 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTP_Middleware(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := NewHTTP(reg)
+
+	r := chi.NewRouter()
+	r.Use(m.Middleware)
+	r.Route("/api/user", func(r chi.Router) {
+		r.Get("/orders/{number}", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+		})
+		r.Get("/balance", func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("{}"))
+		})
+	})
+
+	for _, target := range []string{"/api/user/orders/1", "/api/user/orders/2", "/api/user/balance", "/random", "/other"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+	}
+
+	require.Equal(t, 2.0, testutil.ToFloat64(m.requests.WithLabelValues("/api/user/orders/{number}", http.MethodGet, "202")))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.requests.WithLabelValues("/api/user/balance", http.MethodGet, "200")))
+	require.Equal(t, 2.0, testutil.ToFloat64(m.requests.WithLabelValues(unmatchedRoute, http.MethodGet, "404")))
+	require.Equal(t, 3, testutil.CollectAndCount(m.requests))
+	require.Equal(t, 3, testutil.CollectAndCount(m.duration))
+	require.Equal(t, 0.0, testutil.ToFloat64(m.inFlight))
+}
@@ -0,0 +1,28 @@
+// Package metrics exposes Prometheus metrics of the HTTP server, the
+// database pool and the bonus system poller.
+package metrics
+
+import (
+	"database/sql"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+const namespace = "gophermart"
+
+// NewRegistry returns a registry with the Go runtime and process metrics.
+// A dedicated registry keeps metrics of imported libraries out of /metrics.
+func NewRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return reg
+}
+
+// RegisterDB exports the connection pool stats of db.
+func RegisterDB(reg prometheus.Registerer, db *sql.DB) {
+	reg.MustRegister(collectors.NewDBStatsCollector(db, "postgres"))
+}
@@ -1,6 +1,60 @@
 package models
 
+import (
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
 type Balance struct {
-	Current   float64
-	Withdrawn float64
+	Current   decimal.Decimal
+	Withdrawn decimal.Decimal
+}
+
+// BalanceAdjustment is a manual correction of a user balance made by an
+// admin. Negative amounts take points away.
+type BalanceAdjustment struct {
+	ID        int64
+	UserID    int
+	AdminID   int
+	Amount    decimal.Decimal
+	Reason    string
+	CreatedAt time.Time
+}
+
+type LedgerEntryType string
+
+var (
+	LedgerDeposit    LedgerEntryType = "deposit"
+	LedgerWithdrawal LedgerEntryType = "withdrawal"
+	LedgerAdjustment LedgerEntryType = "adjustment"
+)
+
+// LedgerEntry is a single change of the user balance: a processed order or
+// an admin adjustment. Amount is negative for withdrawals, Balance is the
+// balance right after the entry.
+type LedgerEntry struct {
+	Type       LedgerEntryType
+	Reference  int64
+	Amount     decimal.Decimal
+	Balance    decimal.Decimal
+	OccurredAt time.Time
+}
+
+// LedgerCursor points at the last entry of a previously returned page.
+// Reference is an order number or an adjustment id, so entries are ordered
+// by (OccurredAt, Type, Reference).
+type LedgerCursor struct {
+	OccurredAt time.Time
+	Type       LedgerEntryType
+	Reference  int64
+}
+
+// LedgerFilter narrows down the balance history. Running balances always
+// account for the entries filtered out before From.
+type LedgerFilter struct {
+	From  time.Time
+	To    time.Time
+	After *LedgerCursor
+	Limit int
 }
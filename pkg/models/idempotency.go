@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// IdempotentRequest is the first request made with an idempotency key and
+// the response it got. Status is 0 while the request is still being served.
+type IdempotentRequest struct {
+	UserID      int
+	Key         string
+	RequestHash string
+	Status      int
+	ContentType string
+	Body        []byte
+	CreatedAt   time.Time
+}
+
+func (r IdempotentRequest) Completed() bool {
+	return r.Status != 0
+}
@@ -3,6 +3,7 @@ package models
 import (
 	"time"
 
+	"github.com/shopspring/decimal"
 	"github.com/theplant/luhn"
 )
 
@@ -26,18 +27,46 @@ type Order struct {
 	OrderID     int
 	Status      OrderStatus
 	TXType      OrderType
-	Accrual     float64
+	Accrual     decimal.Decimal
 	UserID      int
 	UploadedAt  time.Time
 	ProcessedAt time.Time
 }
 
+// OrderCursor points at the last order of a previously returned page.
+// Orders are paginated by (UploadedAt, OrderID) so the position is stable
+// even when several orders share the same upload time.
+type OrderCursor struct {
+	UploadedAt time.Time
+	OrderID    int
+}
+
+// OrderFilter narrows down the list of user orders. Zero values mean
+// "no restriction", Limit of 0 returns every matching order.
+type OrderFilter struct {
+	Statuses     []OrderStatus
+	UploadedFrom time.Time
+	UploadedTo   time.Time
+	After        *OrderCursor
+	Limit        int
+}
+
+// OrdersVersion summarises the orders and withdrawals of a user. It changes
+// whenever an order is uploaded or processed, so it is enough to tell
+// whether cached lists and balances are still fresh.
+type OrdersVersion struct {
+	Count           int64
+	LastUploadedAt  time.Time
+	LastProcessedAt time.Time
+	Adjustments     int64
+}
+
 func NewOrder(orderID int, userID int) Order {
 	return Order{
 		OrderID: orderID,
 		Status:  NewStatus,
 		TXType:  DepositOrder,
-		Accrual: 0,
+		Accrual: decimal.Zero,
 		UserID:  userID,
 	}
 }
@@ -45,3 +74,33 @@ func NewOrder(orderID int, userID int) Order {
 func (o Order) Valid() bool {
 	return luhn.Valid(o.OrderID)
 }
+
+func (s OrderStatus) Known() bool {
+	switch s {
+	case NewStatus, ProcessingStatus, InvalidStatus, ProcessedStatus:
+		return true
+	}
+	return false
+}
+
+// OrderTransition is an entry of the order status history.
+type OrderTransition struct {
+	OrderID   int
+	Status    OrderStatus
+	Accrual   decimal.Decimal
+	ChangedAt time.Time
+	// AdminID and Reason are set when an admin forced the status, zero
+	// for changes reported by the bonus system.
+	AdminID int
+	Reason  string
+}
+
+// OrderEvent records a change of order status or accrual.
+type OrderEvent struct {
+	EventID   int64
+	OrderID   int
+	UserID    int
+	Status    OrderStatus
+	Accrual   decimal.Decimal
+	CreatedAt time.Time
+}
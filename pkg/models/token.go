@@ -0,0 +1,34 @@
+package models
+
+import "time"
+
+// RefreshToken is stored by the hash of the token handed to the client.
+// Every refresh uses the token up and issues the next one of the same
+// family, so a family is a single login of the user.
+type RefreshToken struct {
+	ID        int64
+	Hash      string
+	FamilyID  string
+	UserID    int
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    time.Time
+	RevokedAt time.Time
+}
+
+func (t RefreshToken) Used() bool {
+	return !t.UsedAt.IsZero()
+}
+
+func (t RefreshToken) Revoked() bool {
+	return !t.RevokedAt.IsZero()
+}
+
+// Session is an active refresh token family, one login of the user.
+// LastUsedAt is when the session was last refreshed.
+type Session struct {
+	ID         string
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+	ExpiresAt  time.Time
+}
@@ -0,0 +1,11 @@
+package models
+
+import "time"
+
+type User struct {
+	UserID      int
+	Login       string
+	IsAdmin     bool
+	CreatedAt   time.Time
+	LastLoginAt time.Time
+}
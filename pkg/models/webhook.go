@@ -0,0 +1,76 @@
+package models
+
+import "time"
+
+type WebhookEventType string
+
+var (
+	OrderProcessedEvent   WebhookEventType = "order.processed"
+	OrderInvalidEvent     WebhookEventType = "order.invalid"
+	BalanceWithdrawnEvent WebhookEventType = "balance.withdrawn"
+)
+
+func (t WebhookEventType) Known() bool {
+	switch t {
+	case OrderProcessedEvent, OrderInvalidEvent, BalanceWithdrawnEvent:
+		return true
+	}
+	return false
+}
+
+// Webhook is a callback URL registered by a user. An empty EventTypes
+// subscribes to every event.
+type Webhook struct {
+	ID         int
+	UserID     int
+	URL        string
+	Secret     string
+	EventTypes []WebhookEventType
+	CreatedAt  time.Time
+}
+
+// WebhookEvent is emitted when something a merchant may want to know
+// about happens to the user data.
+type WebhookEvent struct {
+	Type      WebhookEventType `json:"type"`
+	CreatedAt time.Time        `json:"created_at"`
+	Data      interface{}      `json:"data"`
+}
+
+type OrderEventData struct {
+	Order   string      `json:"order"`
+	Status  OrderStatus `json:"status"`
+	Accrual float64     `json:"accrual,omitempty"`
+}
+
+type WithdrawalEventData struct {
+	Order string  `json:"order"`
+	Sum   float64 `json:"sum"`
+}
+
+type DeliveryStatus string
+
+var (
+	DeliveryPending   DeliveryStatus = "PENDING"
+	DeliveryDelivered DeliveryStatus = "DELIVERED"
+	DeliveryFailed    DeliveryStatus = "FAILED"
+)
+
+// WebhookDelivery is a single event queued for a webhook. URL and Secret
+// are filled in only for deliveries claimed for sending.
+type WebhookDelivery struct {
+	ID             int
+	WebhookID      int
+	EventType      WebhookEventType
+	Payload        []byte
+	Status         DeliveryStatus
+	Attempts       int
+	NextAttemptAt  time.Time
+	LastStatusCode int
+	LastError      string
+	CreatedAt      time.Time
+	DeliveredAt    time.Time
+
+	URL    string
+	Secret string
+}
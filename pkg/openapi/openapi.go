@@ -0,0 +1,161 @@
+// Package openapi holds the OpenAPI document describing the HTTP API and a
+// middleware validating traffic against it.
+package openapi
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-http-utils/headers"
+	"github.com/ldez/mimetype"
+	"go.uber.org/zap"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/logger"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/problem"
+)
+
+const eventStream = "text/event-stream"
+
+// exportTypes are streamed when the client asks for them in Accept.
+var exportTypes = []string{"text/csv", "application/x-ndjson"}
+
+//go:embed openapi.json
+var spec []byte
+
+// Spec returns the raw OpenAPI document.
+func Spec() []byte {
+	return spec
+}
+
+// Load parses and validates the embedded OpenAPI document.
+func Load() (*openapi3.T, error) {
+	doc, err := openapi3.NewLoader().LoadFromData(spec)
+	if err != nil {
+		return nil, err
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// Handler serves the embedded OpenAPI document.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(headers.ContentType, mimetype.ApplicationJSON)
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(spec); err != nil {
+		logger.FromContext(r.Context()).Error("Error writing openapi spec", zap.Error(err))
+	}
+}
+
+// NewValidator returns a middleware checking requests and responses of
+// documented routes against the embedded document. Requests that do not
+// match are rejected, mismatching responses are only logged since they
+// have already been sent. Routes missing from the document are passed
+// through untouched.
+func NewValidator() (func(http.Handler) http.Handler, error) {
+	doc, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	// authentication is checked by the jwt middleware
+	options := &openapi3filter.Options{AuthenticationFunc: openapi3filter.NoopAuthenticationFunc}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			log := logger.FromContext(r.Context())
+
+			route, pathParams, err := router.FindRoute(r)
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			reqInput := &openapi3filter.RequestValidationInput{
+				Request:    r,
+				PathParams: pathParams,
+				Route:      route,
+				Options:    options,
+			}
+			if err := openapi3filter.ValidateRequest(r.Context(), reqInput); err != nil {
+				log.Info("Request does not match openapi spec", zap.Error(err))
+				problem.Write(w, r, http.StatusBadRequest, problem.CodeSchemaViolation, err.Error())
+				return
+			}
+
+			// streams never end while the client is connected and exports
+			// may be huge, there is nothing to validate them against anyway
+			if streaming(route, r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			var body bytes.Buffer
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			ww.Tee(&body)
+			next.ServeHTTP(ww, r)
+
+			validateResponse(r.Context(), log, reqInput, ww, body.Bytes())
+		})
+	}, nil
+}
+
+func validateResponse(ctx context.Context, log *zap.Logger, reqInput *openapi3filter.RequestValidationInput, ww middleware.WrapResponseWriter, body []byte) {
+	status := ww.Status()
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	respInput := &openapi3filter.ResponseValidationInput{
+		RequestValidationInput: reqInput,
+		Status:                 status,
+		Header:                 ww.Header(),
+		Body:                   ioutil.NopCloser(bytes.NewReader(body)),
+		Options:                reqInput.Options,
+	}
+	if err := openapi3filter.ValidateResponse(ctx, respInput); err != nil {
+		log.Error("Response does not match openapi spec",
+			zap.String("operation", operationID(reqInput.Route)),
+			zap.Int("status", status),
+			zap.Error(err))
+	}
+}
+
+func streaming(route *routers.Route, r *http.Request) bool {
+	resp := route.Operation.Responses.Get(http.StatusOK)
+	if resp == nil || resp.Value == nil {
+		return false
+	}
+	if _, ok := resp.Value.Content[eventStream]; ok {
+		return true
+	}
+
+	accept := r.Header.Get(headers.Accept)
+	for _, v := range exportTypes {
+		if _, ok := resp.Value.Content[v]; ok && strings.Contains(accept, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func operationID(route *routers.Route) string {
+	if route == nil || route.Operation == nil {
+		return ""
+	}
+	return route.Operation.OperationID
+}
@@ -0,0 +1,73 @@
+package openapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-http-utils/headers"
+	"github.com/ldez/mimetype"
+	"github.com/stretchr/testify/require"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/problem"
+)
+
+func TestLoad(t *testing.T) {
+	doc, err := Load()
+	require.NoError(t, err)
+	require.NotNil(t, doc.Paths.Find("/api/user/orders"))
+}
+
+func TestNewValidator(t *testing.T) {
+	validator, err := NewValidator()
+	require.NoError(t, err)
+
+	called := false
+	handler := validator(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		status int
+		called bool
+	}{
+		{"valid request", http.MethodPost, "/api/user/register", `{"login": "user", "password": "pass"}`, http.StatusOK, true},
+		{"missing field", http.MethodPost, "/api/user/register", `{"login": "user"}`, http.StatusBadRequest, false},
+		{"wrong type", http.MethodPost, "/api/user/balance/withdraw", `{"order": "2377225624", "sum": "ten"}`, http.StatusBadRequest, false},
+		{"v2 sum as number", http.MethodPost, "/api/v2/user/balance/withdraw", `{"order": "2377225624", "sum": 10}`, http.StatusBadRequest, false},
+		{"undocumented route", http.MethodPost, "/api/not/documented", `garbage`, http.StatusOK, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called = false
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			req.Header.Set(headers.ContentType, mimetype.ApplicationJSON)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			require.Equal(t, tt.status, rec.Code)
+			require.Equal(t, tt.called, called)
+			if !tt.called {
+				var p problem.Problem
+				require.NoError(t, json.NewDecoder(rec.Body).Decode(&p))
+				require.Equal(t, problem.CodeSchemaViolation, p.Code)
+			}
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	Handler(rec, httptest.NewRequest(http.MethodGet, "/api/openapi.json", nil))
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, string(Spec()), rec.Body.String())
+}
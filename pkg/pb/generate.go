@@ -0,0 +1,4 @@
+// Package pb contains the code generated from api/proto.
+package pb
+
+//go:generate protoc -I ../../api/proto --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative gophermart.proto
@@ -0,0 +1,175 @@
+// Package problem writes error responses as RFC 7807 problem details so
+// clients can tell failures apart by a stable machine-readable code.
+package problem
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-http-utils/headers"
+	"go.uber.org/zap"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/logger"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/repo"
+)
+
+const ContentType = "application/problem+json"
+
+const typeBase = "/problems/"
+
+type Code string
+
+var (
+	CodeMalformedRequest      Code = "malformed_request"
+	CodeUnsupportedMediaType  Code = "unsupported_content_type"
+	CodeInvalidQuery          Code = "invalid_query"
+	CodeSchemaViolation       Code = "schema_violation"
+	CodeOrderNumberMalformed  Code = "order_number_malformed"
+	CodeOrderNumberInvalid    Code = "order_number_invalid"
+	CodeUnsupportedNumber     Code = "order_number_unsupported"
+	CodeBatchTooLarge         Code = "batch_too_large"
+	CodeInvalidAmount         Code = "invalid_amount"
+	CodeInvalidOrderStatus    Code = "invalid_order_status"
+	CodeReasonRequired        Code = "reason_required"
+	CodeUnauthorized          Code = "unauthorized"
+	CodeTokenInvalid          Code = "token_invalid"
+	CodeRefreshTokenInvalid   Code = "refresh_token_invalid"
+	CodeForbidden             Code = "forbidden"
+	CodeNotFound              Code = "not_found"
+	CodeUserNotFound          Code = "user_not_found"
+	CodeOrderNotFound         Code = "order_not_found"
+	CodeMethodNotAllowed      Code = "method_not_allowed"
+	CodeUserAuthFailed        Code = "user_auth_failed"
+	CodeUserAlreadyExists     Code = "user_already_exists"
+	CodeDuplicateOrder        Code = "duplicate_order"
+	CodeOrderAlreadyUploaded  Code = "order_already_uploaded"
+	CodeOrderOwnedByOtherUser Code = "order_uploaded_by_another_user"
+	CodeOrderNotCancellable   Code = "order_not_cancellable"
+	CodeNotEnoughFunds        Code = "not_enough_funds"
+	CodeTooManyRequests       Code = "too_many_requests"
+	CodeIdempotencyKeyReused  Code = "idempotency_key_reused"
+	CodeIdempotencyInProgress Code = "idempotency_request_in_progress"
+	CodeInvalidWebhook        Code = "invalid_webhook"
+	CodeWebhookNotFound       Code = "webhook_not_found"
+	CodeSessionNotFound       Code = "session_not_found"
+	CodeInternalError         Code = "internal_error"
+)
+
+var titles = map[Code]string{
+	CodeMalformedRequest:      "Request body could not be parsed",
+	CodeUnsupportedMediaType:  "Unsupported content type",
+	CodeInvalidQuery:          "Invalid query parameters",
+	CodeSchemaViolation:       "Request does not match the API specification",
+	CodeOrderNumberMalformed:  "Order number is not a number",
+	CodeOrderNumberInvalid:    "Order number fails the Luhn check",
+	CodeUnsupportedNumber:     "Order number is not supported",
+	CodeBatchTooLarge:         "Too many orders in a batch",
+	CodeInvalidAmount:         "Invalid amount",
+	CodeInvalidOrderStatus:    "Invalid order status",
+	CodeReasonRequired:        "Reason is required",
+	CodeUnauthorized:          "Authentication required",
+	CodeTokenInvalid:          "Authentication token is invalid",
+	CodeRefreshTokenInvalid:   "Refresh token is invalid, expired or revoked",
+	CodeForbidden:             "Admin role required",
+	CodeNotFound:              "Resource not found",
+	CodeUserNotFound:          "User not found",
+	CodeOrderNotFound:         "Order not found",
+	CodeMethodNotAllowed:      "Method not allowed",
+	CodeUserAuthFailed:        "Wrong login or password",
+	CodeUserAlreadyExists:     "Login is already taken",
+	CodeDuplicateOrder:        "Duplicate order",
+	CodeOrderAlreadyUploaded:  "Order was already uploaded by this user",
+	CodeOrderOwnedByOtherUser: "Order was already uploaded by another user",
+	CodeOrderNotCancellable:   "Order is already being processed",
+	CodeNotEnoughFunds:        "Not enough funds",
+	CodeTooManyRequests:       "Too many requests",
+	CodeIdempotencyKeyReused:  "Idempotency key was used for a different request",
+	CodeIdempotencyInProgress: "Request with this idempotency key is still in progress",
+	CodeInvalidWebhook:        "Invalid webhook",
+	CodeWebhookNotFound:       "Webhook not found",
+	CodeSessionNotFound:       "Session not found",
+	CodeInternalError:         "Internal server error",
+}
+
+type repoError struct {
+	err    error
+	code   Code
+	status int
+}
+
+// repoErrors maps repository errors to the code and status returned to
+// clients. ErrUserNotFound shares the code of a wrong password so logins
+// can not be enumerated.
+var repoErrors = []repoError{
+	{repo.ErrUserNotFound, CodeUserAuthFailed, http.StatusUnauthorized},
+	{repo.ErrUserAuthFailed, CodeUserAuthFailed, http.StatusUnauthorized},
+	{repo.ErrUserAlreadyExists, CodeUserAlreadyExists, http.StatusConflict},
+	{repo.ErrOrderNotFound, CodeOrderNotFound, http.StatusNotFound},
+	{repo.ErrDuplicateOrder, CodeDuplicateOrder, http.StatusConflict},
+	{repo.ErrOrderAlreadyUploadedByCurrentUser, CodeOrderAlreadyUploaded, http.StatusOK},
+	{repo.ErrOrderCreatedByAnotherUser, CodeOrderOwnedByOtherUser, http.StatusConflict},
+	{repo.ErrOrderNotCancellable, CodeOrderNotCancellable, http.StatusConflict},
+	{repo.ErrNotEnoughFunds, CodeNotEnoughFunds, http.StatusPaymentRequired},
+	{repo.ErrWebhookNotFound, CodeWebhookNotFound, http.StatusNotFound},
+	{repo.ErrRefreshTokenInvalid, CodeRefreshTokenInvalid, http.StatusUnauthorized},
+	{repo.ErrRefreshTokenReused, CodeRefreshTokenInvalid, http.StatusUnauthorized},
+	{repo.ErrSessionNotFound, CodeSessionNotFound, http.StatusNotFound},
+	{repo.ErrInternalError, CodeInternalError, http.StatusInternalServerError},
+}
+
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	Code      Code   `json:"code"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func New(r *http.Request, status int, code Code, detail string) Problem {
+	return Problem{
+		Type:      typeBase + string(code),
+		Title:     titles[code],
+		Status:    status,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		Code:      code,
+		RequestID: middleware.GetReqID(r.Context()),
+	}
+}
+
+// Write sends a problem response with the given status and code.
+func Write(w http.ResponseWriter, r *http.Request, status int, code Code, detail string) {
+	p := New(r, status, code, detail)
+
+	w.Header().Set(headers.ContentType, ContentType)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		logger.FromContext(r.Context()).Error("Error encoding problem", zap.Error(err))
+	}
+}
+
+// FromError returns the status and code for a repository error. Unknown
+// errors are reported as internal errors.
+func FromError(err error) (int, Code) {
+	for _, v := range repoErrors {
+		if errors.Is(err, v.err) {
+			return v.status, v.code
+		}
+	}
+	return http.StatusInternalServerError, CodeInternalError
+}
+
+// Title returns the human-readable summary of a code.
+func Title(code Code) string {
+	return titles[code]
+}
+
+// WriteError sends a problem response derived from a repository error.
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	status, code := FromError(err)
+	Write(w, r, status, code, "")
+}
@@ -0,0 +1,234 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	logr "github.com/OmAsana/go-yapraktikum-final/pkg/logger"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
+)
+
+var _ AdminRepository = (*adminRepo)(nil)
+
+type adminRepo struct {
+	db  *sql.DB
+	log *zap.Logger
+}
+
+func newAdminRepo(db *sql.DB, logger *zap.Logger) *adminRepo {
+	if logger == nil {
+		logger = logr.NewNoop()
+	}
+	return &adminRepo{db: db, log: logger}
+}
+
+func (a *adminRepo) IsAdmin(ctx context.Context, userID int) (bool, error) {
+	l := logr.FromContext(ctx)
+
+	var isAdmin bool
+	err := a.db.QueryRowContext(ctx, `SELECT is_admin FROM users WHERE user_id = $1`, userID).Scan(&isAdmin)
+	switch {
+	case err == sql.ErrNoRows:
+		return false, nil
+	case err != nil:
+		l.Error("Error checking admin role", zap.Error(err))
+		return false, ErrInternalError
+	}
+	return isAdmin, nil
+}
+
+// SyncAdmins makes exactly the users with logins admins, within one
+// transaction. It returns the admins that lost the role and the logins no
+// user is registered with.
+func (a *adminRepo) SyncAdmins(ctx context.Context, logins []string) (revoked, missing []string, err error) {
+	l := logr.FromContext(ctx)
+
+	tx, err := a.db.BeginTx(ctx, nil)
+	if err != nil {
+		l.Error("Could not begin tx", zap.Error(err))
+		return nil, nil, ErrInternalError
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `UPDATE users SET is_admin = false WHERE is_admin RETURNING username`)
+	if err != nil {
+		l.Error("Error revoking admin role", zap.Error(err))
+		return nil, nil, ErrInternalError
+	}
+	previous := map[string]bool{}
+	for rows.Next() {
+		var login string
+		if err := rows.Scan(&login); err != nil {
+			rows.Close()
+			l.Error("Error revoking admin role", zap.Error(err))
+			return nil, nil, ErrInternalError
+		}
+		previous[login] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		l.Error("Error revoking admin role", zap.Error(err))
+		return nil, nil, ErrInternalError
+	}
+
+	granted := map[string]bool{}
+	for _, login := range logins {
+		res, err := tx.ExecContext(ctx, `UPDATE users SET is_admin = true WHERE username = $1`, login)
+		if err != nil {
+			l.Error("Error granting admin role", zap.Error(err))
+			return nil, nil, ErrInternalError
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			l.Error("Error granting admin role", zap.Error(err))
+			return nil, nil, ErrInternalError
+		}
+		if affected == 0 {
+			missing = append(missing, login)
+			continue
+		}
+		granted[login] = true
+	}
+
+	if err := tx.Commit(); err != nil {
+		l.Error("Error commiting admin sync", zap.Error(err))
+		return nil, nil, ErrInternalError
+	}
+
+	for login := range previous {
+		if !granted[login] {
+			revoked = append(revoked, login)
+		}
+	}
+	sort.Strings(revoked)
+	return revoked, missing, nil
+}
+
+// SearchUsers returns users whose login contains query, ignoring case.
+func (a *adminRepo) SearchUsers(ctx context.Context, query string, limit int) ([]*models.User, error) {
+	l := logr.FromContext(ctx)
+
+	sqlStatement := `SELECT user_id, username, is_admin, created_at, last_login_at FROM users
+WHERE username ILIKE $1 ESCAPE '\' ORDER BY username LIMIT $2`
+
+	rows, err := a.db.QueryContext(ctx, sqlStatement, "%"+escapeLike(query)+"%", limit)
+	if err != nil {
+		l.Error("Error searching users", zap.Error(err))
+		return nil, ErrInternalError
+	}
+	defer rows.Close()
+
+	var users []*models.User
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			l.Error("Error searching users", zap.Error(err))
+			return nil, ErrInternalError
+		}
+		users = append(users, &user)
+	}
+	if err := rows.Err(); err != nil {
+		l.Error("Error searching users", zap.Error(err))
+		return nil, ErrInternalError
+	}
+	return users, nil
+}
+
+func (a *adminRepo) GetUser(ctx context.Context, userID int) (models.User, error) {
+	l := logr.FromContext(ctx)
+
+	sqlStatement := `SELECT user_id, username, is_admin, created_at, last_login_at FROM users WHERE user_id = $1`
+
+	rows, err := a.db.QueryContext(ctx, sqlStatement, userID)
+	if err != nil {
+		l.Error("Error querying user", zap.Error(err))
+		return models.User{}, ErrInternalError
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			l.Error("Error querying user", zap.Error(err))
+			return models.User{}, ErrInternalError
+		}
+		return models.User{}, ErrUserNotFound
+	}
+	user, err := scanUser(rows)
+	if err != nil {
+		l.Error("Error querying user", zap.Error(err))
+		return models.User{}, ErrInternalError
+	}
+	return user, nil
+}
+
+func scanUser(rows *sql.Rows) (models.User, error) {
+	var user models.User
+	var lastLogin sql.NullTime
+	if err := rows.Scan(&user.UserID, &user.Login, &user.IsAdmin, &user.CreatedAt, &lastLogin); err != nil {
+		return models.User{}, err
+	}
+	user.LastLoginAt = lastLogin.Time
+	return user, nil
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func (a *adminRepo) AdjustBalance(ctx context.Context, adjustment models.BalanceAdjustment) (models.BalanceAdjustment, error) {
+	l := logr.FromContext(ctx)
+
+	adjustment.CreatedAt = time.Now()
+	sqlStatement := `INSERT INTO balance_adjustments (user_id, admin_id, amount, reason, created_at)
+VALUES ($1, $2, $3, $4, $5) RETURNING adjustment_id`
+
+	err := a.db.QueryRowContext(ctx, sqlStatement,
+		adjustment.UserID,
+		adjustment.AdminID,
+		adjustment.Amount,
+		adjustment.Reason,
+		adjustment.CreatedAt).Scan(&adjustment.ID)
+	if err != nil {
+		l.Error("Error adjusting balance", zap.Error(err), zap.Any("adjustment", adjustment))
+		// foreign key violation
+		if strings.Contains(err.Error(), "SQLSTATE 23503") {
+			return models.BalanceAdjustment{}, ErrUserNotFound
+		}
+		return models.BalanceAdjustment{}, ErrInternalError
+	}
+	return adjustment, nil
+}
+
+func (a *adminRepo) ListAdjustments(ctx context.Context, userID int) ([]*models.BalanceAdjustment, error) {
+	l := logr.FromContext(ctx)
+
+	sqlStatement := `SELECT adjustment_id, user_id, admin_id, amount, reason, created_at
+FROM balance_adjustments WHERE user_id = $1 ORDER BY created_at DESC, adjustment_id DESC`
+
+	rows, err := a.db.QueryContext(ctx, sqlStatement, userID)
+	if err != nil {
+		l.Error("Error querying balance adjustments", zap.Error(err))
+		return nil, ErrInternalError
+	}
+	defer rows.Close()
+
+	var adjustments []*models.BalanceAdjustment
+	for rows.Next() {
+		var adj models.BalanceAdjustment
+		if err := rows.Scan(&adj.ID, &adj.UserID, &adj.AdminID, &adj.Amount, &adj.Reason, &adj.CreatedAt); err != nil {
+			l.Error("Error querying balance adjustments", zap.Error(err))
+			return nil, ErrInternalError
+		}
+		adjustments = append(adjustments, &adj)
+	}
+	if err := rows.Err(); err != nil {
+		l.Error("Error querying balance adjustments", zap.Error(err))
+		return nil, ErrInternalError
+	}
+	return adjustments, nil
+}
@@ -0,0 +1,132 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
+)
+
+func Test_adminRepo_IsAdmin(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	query := regexp.QuoteMeta(`SELECT is_admin FROM users WHERE user_id = $1`)
+	mock.ExpectQuery(query).WithArgs(1).WillReturnRows(sqlmock.NewRows([]string{"is_admin"}).AddRow(true))
+	mock.ExpectQuery(query).WithArgs(2).WillReturnRows(sqlmock.NewRows([]string{"is_admin"}))
+
+	r := newAdminRepo(db, newDevLogger(t))
+
+	isAdmin, err := r.IsAdmin(context.Background(), 1)
+	require.NoError(t, err)
+	require.True(t, isAdmin)
+
+	isAdmin, err = r.IsAdmin(context.Background(), 2)
+	require.NoError(t, err)
+	require.False(t, isAdmin)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_adminRepo_SyncAdmins(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	grant := regexp.QuoteMeta(`UPDATE users SET is_admin = true WHERE username = $1`)
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`UPDATE users SET is_admin = false WHERE is_admin RETURNING username`)).
+		WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow("admin").AddRow("former"))
+	mock.ExpectExec(grant).WithArgs("admin").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(grant).WithArgs("ghost").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(grant).WithArgs("support").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	r := newAdminRepo(db, newDevLogger(t))
+	revoked, missing, err := r.SyncAdmins(context.Background(), []string{"admin", "ghost", "support"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"former"}, revoked)
+	require.Equal(t, []string{"ghost"}, missing)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_adminRepo_SearchUsers(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	createdAt := time.Date(2022, time.July, 1, 10, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(`SELECT user_id, username, is_admin, created_at, last_login_at FROM users`).
+		WithArgs(`%a\_b\%%`, 20).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "username", "is_admin", "created_at", "last_login_at"}).
+			AddRow(1, "a_b%c", false, createdAt, nil))
+
+	r := newAdminRepo(db, newDevLogger(t))
+	users, err := r.SearchUsers(context.Background(), "a_b%", 20)
+	require.NoError(t, err)
+	require.Equal(t, []*models.User{{UserID: 1, Login: "a_b%c", CreatedAt: createdAt}}, users)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_adminRepo_GetUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT user_id, username, is_admin, created_at, last_login_at FROM users WHERE user_id`).
+		WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "username", "is_admin", "created_at", "last_login_at"}))
+
+	r := newAdminRepo(db, newDevLogger(t))
+	_, err = r.GetUser(context.Background(), 1)
+	require.ErrorIs(t, err, ErrUserNotFound)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_adminRepo_AdjustBalance(t *testing.T) {
+	adjustment := models.BalanceAdjustment{
+		UserID:  1,
+		AdminID: 2,
+		Amount:  decimal.RequireFromString("-10.50"),
+		Reason:  "duplicate accrual",
+	}
+	query := regexp.QuoteMeta(`INSERT INTO balance_adjustments (user_id, admin_id, amount, reason, created_at)`)
+
+	t.Run("success", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer db.Close()
+
+		mock.ExpectQuery(query).
+			WithArgs(1, 2, adjustment.Amount, adjustment.Reason, sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows([]string{"adjustment_id"}).AddRow(7))
+
+		r := newAdminRepo(db, newDevLogger(t))
+		got, err := r.AdjustBalance(context.Background(), adjustment)
+		require.NoError(t, err)
+		require.Equal(t, int64(7), got.ID)
+		require.False(t, got.CreatedAt.IsZero())
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("unknown user", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer db.Close()
+
+		mock.ExpectQuery(query).
+			WillReturnError(errors.New("ERROR: insert or update on table violates foreign key constraint (SQLSTATE 23503)"))
+
+		r := newAdminRepo(db, newDevLogger(t))
+		_, err = r.AdjustBalance(context.Background(), adjustment)
+		require.ErrorIs(t, err, ErrUserNotFound)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
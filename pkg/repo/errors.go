@@ -1,17 +1,37 @@
 package repo
 
-import "errors"
+import (
+	"errors"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
+)
 
 var (
 	ErrUserNotFound      = errors.New("user does not exist")
 	ErrUserAuthFailed    = errors.New("user authentication failed")
 	ErrUserAlreadyExists = errors.New("duplicate user name")
 
+	ErrOrderNotFound                     = errors.New("order does not exist")
 	ErrDuplicateOrder                    = errors.New("duplicate order")
 	ErrOrderAlreadyUploadedByCurrentUser = errors.New("order already exist for this user")
 	ErrOrderCreatedByAnotherUser         = errors.New("order already exist for another user")
+	ErrOrderNotCancellable               = errors.New("order is already processed")
 
 	ErrNotEnoughFunds = errors.New("not enough funds")
 
+	ErrWebhookNotFound = errors.New("webhook does not exist")
+
+	ErrRefreshTokenInvalid = errors.New("refresh token is invalid")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used")
+	ErrSessionNotFound     = errors.New("session does not exist")
+
 	ErrInternalError = errors.New("internal error")
 )
+
+// isUniqueViolation tells whether err is a unique constraint violation
+// reported by postgres, however the driver wrapped it.
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == pgerrcode.UniqueViolation
+}
@@ -0,0 +1,124 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"go.uber.org/zap"
+
+	logr "github.com/OmAsana/go-yapraktikum-final/pkg/logger"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
+)
+
+var _ IdempotencyRepository = (*idempotencyRepo)(nil)
+
+type idempotencyRepo struct {
+	db  *sql.DB
+	log *zap.Logger
+}
+
+func newIdempotencyRepo(db *sql.DB, logger *zap.Logger) *idempotencyRepo {
+	if logger == nil {
+		logger = logr.NewNoop()
+	}
+	return &idempotencyRepo{db: db, log: logger}
+}
+
+func (u *idempotencyRepo) Reserve(ctx context.Context, req models.IdempotentRequest, notBefore time.Time) (models.IdempotentRequest, bool, error) {
+	l := logr.FromContext(ctx)
+
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		l.Error("Could not begin tx", zap.Error(err))
+		return models.IdempotentRequest{}, false, ErrInternalError
+	}
+	defer tx.Rollback()
+
+	deleteSQL := `DELETE FROM idempotency_keys WHERE user_id = $1 AND idempotency_key = $2 AND created_at < $3`
+	if _, err := tx.ExecContext(ctx, deleteSQL, req.UserID, req.Key, notBefore); err != nil {
+		l.Error("Error deleting expired idempotency key", zap.Error(err))
+		return models.IdempotentRequest{}, false, ErrInternalError
+	}
+
+	insertSQL := `INSERT INTO idempotency_keys (user_id, idempotency_key, request_hash, created_at)
+	VALUES ($1, $2, $3, $4) ON CONFLICT (user_id, idempotency_key) DO NOTHING`
+	res, err := tx.ExecContext(ctx, insertSQL, req.UserID, req.Key, req.RequestHash, req.CreatedAt)
+	if err != nil {
+		l.Error("Error inserting idempotency key", zap.Error(err))
+		return models.IdempotentRequest{}, false, ErrInternalError
+	}
+
+	inserts, err := res.RowsAffected()
+	if err != nil {
+		l.Error("Error inserting idempotency key", zap.Error(err))
+		return models.IdempotentRequest{}, false, ErrInternalError
+	}
+
+	stored := req
+	if inserts == 0 {
+		selectSQL := `SELECT request_hash, status, content_type, body, created_at
+FROM idempotency_keys
+WHERE user_id = $1 AND idempotency_key = $2`
+		err = tx.QueryRowContext(ctx, selectSQL, req.UserID, req.Key).Scan(
+			&stored.RequestHash,
+			&stored.Status,
+			&stored.ContentType,
+			&stored.Body,
+			&stored.CreatedAt,
+		)
+		if err != nil {
+			l.Error("Error querying idempotency key", zap.Error(err))
+			return models.IdempotentRequest{}, false, ErrInternalError
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		l.Error("Error commiting idempotency key", zap.Error(err))
+		return models.IdempotentRequest{}, false, ErrInternalError
+	}
+
+	return stored, inserts == 1, nil
+}
+
+func (u *idempotencyRepo) Complete(ctx context.Context, req models.IdempotentRequest) error {
+	l := logr.FromContext(ctx)
+
+	sqlStatement := `UPDATE idempotency_keys SET status = $1, content_type = $2, body = $3
+WHERE user_id = $4 AND idempotency_key = $5`
+	_, err := u.db.ExecContext(ctx, sqlStatement, req.Status, req.ContentType, req.Body, req.UserID, req.Key)
+	if err != nil {
+		l.Error("Error storing idempotent response", zap.Error(err))
+		return ErrInternalError
+	}
+	return nil
+}
+
+func (u *idempotencyRepo) Release(ctx context.Context, userID int, key string) error {
+	l := logr.FromContext(ctx)
+
+	sqlStatement := `DELETE FROM idempotency_keys WHERE user_id = $1 AND idempotency_key = $2`
+	_, err := u.db.ExecContext(ctx, sqlStatement, userID, key)
+	if err != nil {
+		l.Error("Error releasing idempotency key", zap.Error(err))
+		return ErrInternalError
+	}
+	return nil
+}
+
+func (u *idempotencyRepo) DeleteExpired(ctx context.Context, before time.Time) (int64, error) {
+	l := logr.FromContext(ctx)
+
+	sqlStatement := `DELETE FROM idempotency_keys WHERE created_at < $1`
+	res, err := u.db.ExecContext(ctx, sqlStatement, before)
+	if err != nil {
+		l.Error("Error deleting expired idempotency keys", zap.Error(err))
+		return 0, ErrInternalError
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		l.Error("Error deleting expired idempotency keys", zap.Error(err))
+		return 0, ErrInternalError
+	}
+	return deleted, nil
+}
@@ -0,0 +1,75 @@
+package repo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
+)
+
+func Test_idempotencyRepo_Reserve(t *testing.T) {
+	deleteSQL := `DELETE FROM idempotency_keys WHERE user_id = \$1 AND idempotency_key = \$2 AND created_at < \$3`
+	insertSQL := `INSERT INTO idempotency_keys \(user_id, idempotency_key, request_hash, created_at\)
+	VALUES \(\$1, \$2, \$3, \$4\) ON CONFLICT \(user_id, idempotency_key\) DO NOTHING`
+	selectSQL := `SELECT request_hash, status, content_type, body, created_at
+FROM idempotency_keys
+WHERE user_id = \$1 AND idempotency_key = \$2`
+
+	now := time.Date(2022, time.May, 15, 9, 0, 0, 0, time.UTC)
+	notBefore := now.Add(-time.Hour)
+	req := models.IdempotentRequest{UserID: 3, Key: "key", RequestHash: "hash", CreatedAt: now}
+
+	t.Run("new key", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer db.Close()
+
+		mock.ExpectBegin()
+		mock.ExpectExec(deleteSQL).WithArgs(3, "key", notBefore).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(insertSQL).WithArgs(3, "key", "hash", now).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		repo := newIdempotencyRepo(db, newDevLogger(t))
+		stored, created, err := repo.Reserve(context.Background(), req, notBefore)
+		require.NoError(t, err)
+		require.True(t, created)
+		require.Equal(t, req, stored)
+		require.False(t, stored.Completed())
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("existing key", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer db.Close()
+
+		created := now.Add(-time.Minute)
+		mock.ExpectBegin()
+		mock.ExpectExec(deleteSQL).WithArgs(3, "key", notBefore).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(insertSQL).WithArgs(3, "key", "hash", now).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(selectSQL).WithArgs(3, "key").WillReturnRows(
+			sqlmock.NewRows([]string{"request_hash", "status", "content_type", "body", "created_at"}).
+				AddRow("other", 402, "application/problem+json", []byte(`{}`), created))
+		mock.ExpectCommit()
+
+		repo := newIdempotencyRepo(db, newDevLogger(t))
+		stored, isNew, err := repo.Reserve(context.Background(), req, notBefore)
+		require.NoError(t, err)
+		require.False(t, isNew)
+		require.Equal(t, models.IdempotentRequest{
+			UserID:      3,
+			Key:         "key",
+			RequestHash: "other",
+			Status:      402,
+			ContentType: "application/problem+json",
+			Body:        []byte(`{}`),
+			CreatedAt:   created,
+		}, stored)
+		require.True(t, stored.Completed())
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
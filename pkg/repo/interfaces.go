@@ -2,6 +2,7 @@ package repo
 
 import (
 	"context"
+	"time"
 
 	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
 )
@@ -12,13 +13,86 @@ type UserRepository interface {
 }
 type OrderRepository interface {
 	CreateNewOrder(ctx context.Context, order models.Order) error
+	GetOrder(ctx context.Context, orderID int) (models.Order, error)
+	OrderHistory(ctx context.Context, orderID int) ([]*models.OrderTransition, error)
+	CreateNewOrders(ctx context.Context, orders []models.Order) ([]error, error)
+	CancelOrder(ctx context.Context, userID int, orderID int) error
 	ListOrders(ctx context.Context, userID int) ([]*models.Order, error)
+	FindOrders(ctx context.Context, userID int, filter models.OrderFilter) ([]*models.Order, error)
 	ListWithdrawals(ctx context.Context, userID int) ([]*models.Order, error)
+	StreamOrders(ctx context.Context, userID int, orderType models.OrderType, filter models.OrderFilter, fn func(models.Order) error) error
 
 	CurrentBalance(ctx context.Context, userID int) (models.Balance, error)
+	OrdersVersion(ctx context.Context, userID int) (models.OrdersVersion, error)
+	BalanceHistory(ctx context.Context, userID int, filter models.LedgerFilter) ([]*models.LedgerEntry, error)
 
 	Withdraw(ctx context.Context, order models.Order) error
 
 	ListUnprocessedOrders(ctx context.Context, limit, offset int) ([]*models.Order, error)
+	CountUnprocessedOrders(ctx context.Context) (int, error)
+	ClaimOrder(ctx context.Context, order models.Order) error
 	UpdateOrder(ctx context.Context, order models.Order) error
+	ForceOrderStatus(ctx context.Context, order models.Order, adminID int, reason string) error
+
+	ListOrderEvents(ctx context.Context, userID int, afterID int64, limit int) ([]*models.OrderEvent, error)
+	LastOrderEventID(ctx context.Context, userID int) (int64, error)
+}
+
+// IdempotencyRepository keeps responses of requests made with an
+// idempotency key so retries can be answered without repeating them.
+type IdempotencyRepository interface {
+	// Reserve stores req as in flight unless the key was already used after
+	// notBefore. It returns the stored request and whether req was stored.
+	Reserve(ctx context.Context, req models.IdempotentRequest, notBefore time.Time) (models.IdempotentRequest, bool, error)
+	Complete(ctx context.Context, req models.IdempotentRequest) error
+	Release(ctx context.Context, userID int, key string) error
+	DeleteExpired(ctx context.Context, before time.Time) (int64, error)
+}
+
+// WebhookRepository stores user webhooks and the queue of their deliveries.
+// Deliveries are queued by the repositories changing user data.
+type WebhookRepository interface {
+	CreateWebhook(ctx context.Context, webhook models.Webhook) (models.Webhook, error)
+	ListWebhooks(ctx context.Context, userID int) ([]*models.Webhook, error)
+	DeleteWebhook(ctx context.Context, userID int, webhookID int) error
+	ListDeliveries(ctx context.Context, userID int, webhookID int, limit int) ([]*models.WebhookDelivery, error)
+
+	ClaimDueDeliveries(ctx context.Context, now time.Time, limit int, leaseUntil time.Time) ([]*models.WebhookDelivery, error)
+	SaveAttempt(ctx context.Context, delivery models.WebhookDelivery) error
+}
+
+// AdminRepository backs the support staff API. Orders, withdrawals and
+// balances of users are read through OrderRepository.
+type AdminRepository interface {
+	IsAdmin(ctx context.Context, userID int) (bool, error)
+	SyncAdmins(ctx context.Context, logins []string) (revoked, missing []string, err error)
+
+	SearchUsers(ctx context.Context, query string, limit int) ([]*models.User, error)
+	GetUser(ctx context.Context, userID int) (models.User, error)
+
+	AdjustBalance(ctx context.Context, adjustment models.BalanceAdjustment) (models.BalanceAdjustment, error)
+	ListAdjustments(ctx context.Context, userID int) ([]*models.BalanceAdjustment, error)
+}
+
+// TokenRepository stores refresh tokens by their hash and the denylist of
+// revoked access tokens. Tokens replacing one another on refresh form a
+// family, which is a session of the user.
+type TokenRepository interface {
+	CreateRefreshToken(ctx context.Context, token models.RefreshToken) error
+	// RotateRefreshToken uses up the token with hash and stores next in
+	// its family, filling in the user and family of next.
+	RotateRefreshToken(ctx context.Context, hash string, next models.RefreshToken) (models.RefreshToken, error)
+
+	ListSessions(ctx context.Context, userID int, now time.Time) ([]*models.Session, error)
+	RevokeSession(ctx context.Context, userID int, sessionID string, at time.Time) error
+
+	// DenyToken puts the id of an access token or a session on the
+	// denylist until expiresAt.
+	DenyToken(ctx context.Context, id string, expiresAt time.Time) error
+	// DeniedUntil returns the zero time for ids that are not denied.
+	DeniedUntil(ctx context.Context, id string) (time.Time, error)
+
+	// DeleteExpired drops refresh tokens and denylist entries that expired
+	// before.
+	DeleteExpired(ctx context.Context, before time.Time) (int64, error)
 }
@@ -3,8 +3,13 @@ package repo
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/shopspring/decimal"
 	"go.uber.org/zap"
 
 	logr "github.com/OmAsana/go-yapraktikum-final/pkg/logger"
@@ -13,37 +18,52 @@ import (
 
 var _ OrderRepository = (*orderRepo)(nil)
 
+// adjustmentsSumSQL adds manual admin corrections to the balance computed
+// from orders.
+const adjustmentsSumSQL = `SELECT COALESCE(SUM(amount),0) FROM balance_adjustments WHERE user_id = $1`
+
 type orderRepo struct {
 	db  *sql.DB
 	log *zap.Logger
 }
 
 func (u *orderRepo) Withdraw(ctx context.Context, order models.Order) error {
+	ctx, span := tracer.Start(ctx, "orderRepo.Withdraw")
+	defer span.End()
+
 	l := logr.FromContext(ctx)
 
 	tx, err := u.db.BeginTx(ctx, nil)
 	if err != nil {
 		l.Error("Could not begin tx", zap.Error(err))
+		return ErrInternalError
 	}
 	defer tx.Rollback()
 
 	sqlStatement := `SELECT COALESCE(SUM(accrual),0) AS total FROM orders WHERE user_id = $1 and tx_type = $2`
 
-	var depositSum float64
+	var depositSum decimal.Decimal
 	err = tx.QueryRowContext(ctx, sqlStatement, order.UserID, models.DepositOrder).Scan(&depositSum)
 	if err != nil {
 		l.Error("Error querying db", zap.Error(err))
 		return ErrInternalError
 	}
 
-	var withdrawSum float64
+	var withdrawSum decimal.Decimal
 	err = tx.QueryRowContext(ctx, sqlStatement, order.UserID, models.WithdrawalOrder).Scan(&withdrawSum)
 	if err != nil {
 		l.Error("Error querying db", zap.Error(err))
 		return ErrInternalError
 	}
 
-	if depositSum-withdrawSum > order.Accrual {
+	var adjustmentSum decimal.Decimal
+	err = tx.QueryRowContext(ctx, adjustmentsSumSQL, order.UserID).Scan(&adjustmentSum)
+	if err != nil {
+		l.Error("Error querying db", zap.Error(err))
+		return ErrInternalError
+	}
+
+	if depositSum.Sub(withdrawSum).Add(adjustmentSum).GreaterThan(order.Accrual) {
 		sqlStatement := `INSERT INTO orders (order_id, status, tx_type, accrual, user_id, uploaded_at, processed_at)
 	VALUES ($1, $2, $3, $4, $5, $6, $7)`
 		_, err := tx.ExecContext(ctx, sqlStatement,
@@ -56,8 +76,25 @@ func (u *orderRepo) Withdraw(ctx context.Context, order models.Order) error {
 			time.Now())
 		if err != nil {
 			l.Error("Error processing withdrawal", zap.Error(err))
+			if isUniqueViolation(err) {
+				return ErrDuplicateOrder
+			}
 			return ErrInternalError
 		}
+
+		err = enqueueWebhookEvent(ctx, tx, order.UserID, models.WebhookEvent{
+			Type:      models.BalanceWithdrawnEvent,
+			CreatedAt: time.Now(),
+			Data: models.WithdrawalEventData{
+				Order: strconv.Itoa(order.OrderID),
+				Sum:   order.Accrual.InexactFloat64(),
+			},
+		})
+		if err != nil {
+			l.Error("Error queueing webhook event", zap.Error(err))
+			return ErrInternalError
+		}
+
 		err = tx.Commit()
 		if err != nil {
 			l.Error("Error commiting withdrawal", zap.Error(err))
@@ -71,20 +108,187 @@ func (u *orderRepo) Withdraw(ctx context.Context, order models.Order) error {
 	return nil
 }
 
+var orderWebhookEvents = map[models.OrderStatus]models.WebhookEventType{
+	models.ProcessedStatus: models.OrderProcessedEvent,
+	models.InvalidStatus:   models.OrderInvalidEvent,
+}
+
+// UpdateOrder stores the new order status and accrual and records the
+// change in order_status_history and order_events within the same
+// transaction. Final statuses set by the bonus system also queue webhook
+// events.
 func (u *orderRepo) UpdateOrder(ctx context.Context, order models.Order) error {
+	ctx, span := tracer.Start(ctx, "orderRepo.UpdateOrder")
+	defer span.End()
+
+	return u.updateOrder(ctx, order, "", sql.NullInt64{}, sql.NullString{})
+}
+
+// ClaimOrder moves a NEW order to PROCESSING when the bonus system picks
+// it up, before asking the accrual system about it. The order is only
+// updated while it is NEW: CancelOrder locks the row first, so either the
+// claim commits before and the order can no longer be cancelled, or the
+// order is gone and ErrOrderNotFound is returned. ErrOrderNotFound is also
+// returned when an admin changed the status meanwhile.
+func (u *orderRepo) ClaimOrder(ctx context.Context, order models.Order) error {
+	ctx, span := tracer.Start(ctx, "orderRepo.ClaimOrder")
+	defer span.End()
+
+	order.Status = models.ProcessingStatus
+	order.ProcessedAt = time.Time{}
+	return u.updateOrder(ctx, order, models.NewStatus, sql.NullInt64{}, sql.NullString{})
+}
+
+// ForceOrderStatus is UpdateOrder on behalf of an admin. The admin and the
+// reason are stored with the status history entry for audits.
+func (u *orderRepo) ForceOrderStatus(ctx context.Context, order models.Order, adminID int, reason string) error {
+	ctx, span := tracer.Start(ctx, "orderRepo.ForceOrderStatus")
+	defer span.End()
+
+	return u.updateOrder(ctx, order, "",
+		sql.NullInt64{Int64: int64(adminID), Valid: true},
+		sql.NullString{String: reason, Valid: true})
+}
+
+// updateOrder stores the order status. A non-empty from only updates the
+// order while it still has that status.
+func (u *orderRepo) updateOrder(ctx context.Context, order models.Order, from models.OrderStatus, adminID sql.NullInt64, reason sql.NullString) error {
 	l := logr.FromContext(ctx)
 
-	sqlStatement := `UPDATE orders SET status = $1, accrual = $2, processed_at = $3 WHERE order_id = ($4)`
-	_, err := u.db.ExecContext(ctx, sqlStatement, order.Status, order.Accrual, order.ProcessedAt, order.OrderID)
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		l.Error("Could not begin tx", zap.Error(err))
+		return err
+	}
+	defer tx.Rollback()
+
+	// orders still being processed have no processed_at
+	processedAt := sql.NullTime{Time: order.ProcessedAt, Valid: !order.ProcessedAt.IsZero()}
+
+	sqlStatement := `UPDATE orders SET status = $1, accrual = $2, processed_at = $3 WHERE order_id = ($4) RETURNING user_id`
+	args := []interface{}{order.Status, order.Accrual, processedAt, order.OrderID}
+	if from != "" {
+		sqlStatement = `UPDATE orders SET status = $1, accrual = $2, processed_at = $3 WHERE order_id = ($4) AND status = $5 RETURNING user_id`
+		args = append(args, from)
+	}
+	var userID int
+	err = tx.QueryRowContext(ctx, sqlStatement, args...).Scan(&userID)
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			// cancelled by the user while the bonus system was polling,
+			// or no longer in the from status
+			return ErrOrderNotFound
+		}
 		l.Error("Error updating order", zap.Error(err), zap.Any("order", order))
 		return err
 	}
 
+	now := time.Now()
+	historySQL := `INSERT INTO order_status_history (order_id, status, accrual, changed_at, admin_id, reason) VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err = tx.ExecContext(ctx, historySQL, order.OrderID, order.Status, order.Accrual, now, adminID, reason)
+	if err != nil {
+		l.Error("Error recording order status history", zap.Error(err), zap.Any("order", order))
+		return err
+	}
+
+	eventSQL := `INSERT INTO order_events (order_id, user_id, status, accrual, created_at) VALUES ($1, $2, $3, $4, $5)`
+	_, err = tx.ExecContext(ctx, eventSQL, order.OrderID, userID, order.Status, order.Accrual, now)
+	if err != nil {
+		l.Error("Error recording order event", zap.Error(err), zap.Any("order", order))
+		return err
+	}
+
+	if eventType, ok := orderWebhookEvents[order.Status]; ok {
+		err = enqueueWebhookEvent(ctx, tx, userID, models.WebhookEvent{
+			Type:      eventType,
+			CreatedAt: time.Now(),
+			Data: models.OrderEventData{
+				Order:   strconv.Itoa(order.OrderID),
+				Status:  order.Status,
+				Accrual: order.Accrual.InexactFloat64(),
+			},
+		})
+		if err != nil {
+			l.Error("Error queueing webhook event", zap.Error(err), zap.Any("order", order))
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		l.Error("Error commiting order update", zap.Error(err))
+		return err
+	}
+
 	return nil
 }
 
+// ListOrderEvents returns up to limit events of user orders with ids
+// greater than afterID, oldest first.
+func (u *orderRepo) ListOrderEvents(ctx context.Context, userID int, afterID int64, limit int) ([]*models.OrderEvent, error) {
+	ctx, span := tracer.Start(ctx, "orderRepo.ListOrderEvents")
+	defer span.End()
+
+	l := logr.FromContext(ctx)
+
+	sqlStatement := `SELECT event_id, order_id, user_id, status, accrual, created_at
+FROM order_events
+WHERE user_id = $1 AND event_id > $2
+ORDER BY event_id LIMIT $3`
+
+	rows, err := u.db.QueryContext(ctx, sqlStatement, userID, afterID, limit)
+	if err != nil {
+		l.Error("Error querying order events", zap.Error(err))
+		return nil, ErrInternalError
+	}
+	defer rows.Close()
+
+	var events []*models.OrderEvent
+	for rows.Next() {
+		var event models.OrderEvent
+		err = rows.Scan(
+			&event.EventID,
+			&event.OrderID,
+			&event.UserID,
+			&event.Status,
+			&event.Accrual,
+			&event.CreatedAt,
+		)
+		if err != nil {
+			l.Error("Error scanning order event", zap.Error(err))
+			return nil, ErrInternalError
+		}
+		events = append(events, &event)
+	}
+
+	if err := rows.Err(); err != nil {
+		l.Error("Error querying order events", zap.Error(err))
+		return nil, ErrInternalError
+	}
+	return events, nil
+}
+
+// LastOrderEventID returns the id of the latest event of user orders or
+// 0 when there are none.
+func (u *orderRepo) LastOrderEventID(ctx context.Context, userID int) (int64, error) {
+	ctx, span := tracer.Start(ctx, "orderRepo.LastOrderEventID")
+	defer span.End()
+
+	l := logr.FromContext(ctx)
+
+	sqlStatement := `SELECT COALESCE(MAX(event_id), 0) FROM order_events WHERE user_id = $1`
+
+	var id int64
+	if err := u.db.QueryRowContext(ctx, sqlStatement, userID).Scan(&id); err != nil {
+		l.Error("Error querying last order event", zap.Error(err))
+		return 0, ErrInternalError
+	}
+	return id, nil
+}
+
 func (u *orderRepo) ListUnprocessedOrders(ctx context.Context, limit, offset int) ([]*models.Order, error) {
+	ctx, span := tracer.Start(ctx, "orderRepo.ListUnprocessedOrders")
+	defer span.End()
+
 	l := logr.FromContext(ctx)
 
 	sqlStatement := `SELECT order_id, status, tx_type, accrual, user_id, uploaded_at, processed_at
@@ -99,51 +303,42 @@ WHERE tx_type = $1 AND status not in ($2, $3) LIMIT $4 OFFSET $5`
 		offset)
 
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return []*models.Order{}, nil
-		}
-
 		l.Error("Error querying for orders", zap.Error(err))
 		return nil, ErrInternalError
 	}
-	err = rows.Err()
+	defer rows.Close()
+
+	orders, err := scanOrders(rows)
 	if err != nil {
-		l.Error("Error querying for orders", zap.Error(err))
+		l.Error("Error scanning orders into object", zap.Error(err))
 		return nil, ErrInternalError
 	}
+	return orders, nil
+}
 
-	defer rows.Close()
-
-	var orders []*models.Order
-	for rows.Next() {
-		var order models.Order
-		var t sql.NullTime
-
-		err = rows.Scan(
-			&order.OrderID,
-			&order.Status,
-			&order.TXType,
-			&order.Accrual,
-			&order.UserID,
-			&order.UploadedAt,
-			&t,
-		)
+// CountUnprocessedOrders returns how many deposit orders wait for a final
+// status from the accrual system.
+func (u *orderRepo) CountUnprocessedOrders(ctx context.Context) (int, error) {
+	ctx, span := tracer.Start(ctx, "orderRepo.CountUnprocessedOrders")
+	defer span.End()
 
-		if t.Valid {
-			order.ProcessedAt = t.Time
-		}
+	l := logr.FromContext(ctx)
 
-		if err != nil {
-			l.Error("Error scanning orders into object", zap.Error(err))
-			return nil, ErrInternalError
-		}
+	sqlStatement := `SELECT COUNT(*) FROM orders WHERE tx_type = $1 AND status not in ($2, $3)`
 
-		orders = append(orders, &order)
+	var count int
+	err := u.db.QueryRowContext(ctx, sqlStatement, models.DepositOrder, models.InvalidStatus, models.ProcessedStatus).Scan(&count)
+	if err != nil {
+		l.Error("Error counting unprocessed orders", zap.Error(err))
+		return 0, ErrInternalError
 	}
-
-	return orders, nil
+	return count, nil
 }
 
+// newOrderHistorySQL records the NEW status an order is uploaded with, so
+// the status history starts with the upload.
+const newOrderHistorySQL = `INSERT INTO order_status_history (order_id, status, accrual, changed_at) VALUES ($1, $2, 0, $3)`
+
 func newOrderRepo(db *sql.DB, logger *zap.Logger) *orderRepo {
 	if logger == nil {
 		logger = logr.NewNoop()
@@ -152,6 +347,9 @@ func newOrderRepo(db *sql.DB, logger *zap.Logger) *orderRepo {
 }
 
 func (u *orderRepo) CreateNewOrder(ctx context.Context, order models.Order) error {
+	ctx, span := tracer.Start(ctx, "orderRepo.CreateNewOrder")
+	defer span.End()
+
 	l := logr.FromContext(ctx)
 
 	findOrderSQL := `SELECT user_id FROM orders WHERE order_id = $1`
@@ -160,16 +358,24 @@ func (u *orderRepo) CreateNewOrder(ctx context.Context, order models.Order) erro
 	switch {
 	// Create new order if it does not exist in the db
 	case err == sql.ErrNoRows:
+		tx, err := u.db.BeginTx(ctx, nil)
+		if err != nil {
+			l.Error("Could not begin tx", zap.Error(err))
+			return ErrInternalError
+		}
+		defer tx.Rollback()
+
 		sqlStatement := `INSERT INTO orders (order_id, status, tx_type, accrual, user_id, uploaded_at)
 	VALUES ($1, $2, $3, $4, $5, $6)`
 
-		res, err := u.db.ExecContext(ctx, sqlStatement,
+		now := time.Now()
+		res, err := tx.ExecContext(ctx, sqlStatement,
 			order.OrderID,
 			models.NewStatus,
 			order.TXType,
 			order.Accrual,
 			order.UserID,
-			time.Now())
+			now)
 		if err != nil {
 			l.Error("Error inserting order", zap.Error(err))
 			return ErrInternalError
@@ -187,6 +393,16 @@ func (u *orderRepo) CreateNewOrder(ctx context.Context, order models.Order) erro
 			l.Debug("Did not create order", zap.Reflect("order", order))
 			return ErrInternalError
 		}
+
+		if _, err := tx.ExecContext(ctx, newOrderHistorySQL, order.OrderID, models.NewStatus, now); err != nil {
+			l.Error("Error recording order status history", zap.Error(err))
+			return ErrInternalError
+		}
+
+		if err := tx.Commit(); err != nil {
+			l.Error("Error commiting order", zap.Error(err))
+			return ErrInternalError
+		}
 		return nil
 	case err != nil:
 		l.Error("Error creating order", zap.Error(err))
@@ -202,74 +418,263 @@ func (u *orderRepo) CreateNewOrder(ctx context.Context, order models.Order) erro
 	}
 }
 
+// CreateNewOrders inserts all orders in a single transaction. The returned
+// slice holds the outcome of every order in the same order as the input:
+// nil for created orders, ErrOrderAlreadyUploadedByCurrentUser or
+// ErrOrderCreatedByAnotherUser for existing ones. Any other failure rolls
+// back the whole batch and is returned as the second value.
+func (u *orderRepo) CreateNewOrders(ctx context.Context, orders []models.Order) ([]error, error) {
+	ctx, span := tracer.Start(ctx, "orderRepo.CreateNewOrders")
+	defer span.End()
+
+	l := logr.FromContext(ctx)
+
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		l.Error("Could not begin tx", zap.Error(err))
+		return nil, ErrInternalError
+	}
+	defer tx.Rollback()
+
+	insertSQL := `INSERT INTO orders (order_id, status, tx_type, accrual, user_id, uploaded_at)
+	VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (order_id) DO NOTHING`
+	findOrderSQL := `SELECT user_id FROM orders WHERE order_id = $1`
+
+	now := time.Now()
+	results := make([]error, len(orders))
+	for i, order := range orders {
+		res, err := tx.ExecContext(ctx, insertSQL,
+			order.OrderID,
+			models.NewStatus,
+			order.TXType,
+			order.Accrual,
+			order.UserID,
+			now)
+		if err != nil {
+			l.Error("Error inserting order", zap.Error(err))
+			return nil, ErrInternalError
+		}
+
+		inserts, err := res.RowsAffected()
+		if err != nil {
+			l.Error("Error creating order", zap.Error(err))
+			return nil, ErrInternalError
+		}
+		if inserts == 1 {
+			if _, err := tx.ExecContext(ctx, newOrderHistorySQL, order.OrderID, models.NewStatus, now); err != nil {
+				l.Error("Error recording order status history", zap.Error(err))
+				return nil, ErrInternalError
+			}
+			continue
+		}
+
+		var userID int
+		err = tx.QueryRowContext(ctx, findOrderSQL, order.OrderID).Scan(&userID)
+		if err != nil {
+			l.Error("Error looking up existing order", zap.Error(err))
+			return nil, ErrInternalError
+		}
+
+		if userID == order.UserID {
+			results[i] = ErrOrderAlreadyUploadedByCurrentUser
+		} else {
+			results[i] = ErrOrderCreatedByAnotherUser
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		l.Error("Error commiting orders", zap.Error(err))
+		return nil, ErrInternalError
+	}
+
+	return results, nil
+}
+
 func (u *orderRepo) ListOrders(ctx context.Context, userID int) ([]*models.Order, error) {
+	ctx, span := tracer.Start(ctx, "orderRepo.ListOrders")
+	defer span.End()
+
 	return u.queryOrders(ctx, userID, models.DepositOrder)
 }
 
 func (u *orderRepo) ListWithdrawals(ctx context.Context, userID int) ([]*models.Order, error) {
+	ctx, span := tracer.Start(ctx, "orderRepo.ListWithdrawals")
+	defer span.End()
+
 	return u.queryOrders(ctx, userID, models.WithdrawalOrder)
 }
 
-func (u *orderRepo) queryOrders(ctx context.Context, userID int, orderType models.OrderType) ([]*models.Order, error) {
+// FindOrders returns user deposit orders matching the filter sorted by
+// upload time. Sorting and pagination are done by the database so only
+// the requested page is loaded.
+func (u *orderRepo) FindOrders(ctx context.Context, userID int, filter models.OrderFilter) ([]*models.Order, error) {
+	ctx, span := tracer.Start(ctx, "orderRepo.FindOrders")
+	defer span.End()
+
 	var err error
 	l := logr.FromContext(ctx)
 	defer func() {
 		if err != nil {
-			l.Error("error getting user orders", zap.Error(err))
+			l.Error("error finding user orders", zap.Error(err))
 		}
 	}()
 
-	sqlStatement := `SELECT order_id, status, tx_type, accrual, user_id, uploaded_at, processed_at
-FROM orders 
-WHERE user_id = $1 AND tx_type = $2`
-
-	rows, err := u.db.QueryContext(ctx, sqlStatement, userID, orderType)
+	query, args := ordersQuery(userID, models.DepositOrder, filter)
+	rows, err := u.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, ErrInternalError
 	}
-	err = rows.Err()
+	defer rows.Close()
+
+	orders, err := scanOrders(rows)
 	if err != nil {
 		return nil, ErrInternalError
 	}
+	return orders, nil
+}
 
+// StreamOrders calls fn for every matching order of orderType as rows are
+// read, so exports do not hold the whole history in memory. An error
+// returned by fn stops the iteration and is returned as is.
+func (u *orderRepo) StreamOrders(ctx context.Context, userID int, orderType models.OrderType, filter models.OrderFilter, fn func(models.Order) error) error {
+	ctx, span := tracer.Start(ctx, "orderRepo.StreamOrders")
+	defer span.End()
+
+	l := logr.FromContext(ctx)
+
+	query, args := ordersQuery(userID, orderType, filter)
+	rows, err := u.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		l.Error("error streaming user orders", zap.Error(err))
+		return ErrInternalError
+	}
 	defer rows.Close()
 
-	var orders []*models.Order
 	for rows.Next() {
-		var order models.Order
-		var t sql.NullTime
+		order, err := scanOrder(rows)
+		if err != nil {
+			l.Error("error streaming user orders", zap.Error(err))
+			return ErrInternalError
+		}
+		if err := fn(order); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		l.Error("error streaming user orders", zap.Error(err))
+		return ErrInternalError
+	}
+	return nil
+}
 
-		err = rows.Scan(
-			&order.OrderID,
-			&order.Status,
-			&order.TXType,
-			&order.Accrual,
-			&order.UserID,
-			&order.UploadedAt,
-			&t,
-		)
+func ordersQuery(userID int, orderType models.OrderType, filter models.OrderFilter) (string, []interface{}) {
+	args := []interface{}{userID, orderType}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	var sb strings.Builder
+	sb.WriteString(`SELECT order_id, status, tx_type, accrual, user_id, uploaded_at, processed_at
+FROM orders 
+WHERE user_id = $1 AND tx_type = $2`)
 
-		if t.Valid {
-			order.ProcessedAt = t.Time
+	if len(filter.Statuses) > 0 {
+		placeholders := make([]string, 0, len(filter.Statuses))
+		for _, status := range filter.Statuses {
+			placeholders = append(placeholders, arg(status))
 		}
+		sb.WriteString(" AND status IN (" + strings.Join(placeholders, ", ") + ")")
+	}
+	if !filter.UploadedFrom.IsZero() {
+		sb.WriteString(" AND uploaded_at >= " + arg(filter.UploadedFrom))
+	}
+	if !filter.UploadedTo.IsZero() {
+		sb.WriteString(" AND uploaded_at < " + arg(filter.UploadedTo))
+	}
+	if filter.After != nil {
+		sb.WriteString(" AND (uploaded_at, order_id) > (" + arg(filter.After.UploadedAt) + ", " + arg(filter.After.OrderID) + ")")
+	}
+	sb.WriteString(" ORDER BY uploaded_at, order_id")
+	if filter.Limit > 0 {
+		sb.WriteString(" LIMIT " + arg(filter.Limit))
+	}
+	return sb.String(), args
+}
 
+func scanOrders(rows *sql.Rows) ([]*models.Order, error) {
+	var orders []*models.Order
+	for rows.Next() {
+		order, err := scanOrder(rows)
 		if err != nil {
 			return nil, err
 		}
-
 		orders = append(orders, &order)
 	}
 
+	return orders, rows.Err()
+}
+
+func scanOrder(rows *sql.Rows) (models.Order, error) {
+	var order models.Order
+	var t sql.NullTime
+
+	err := rows.Scan(
+		&order.OrderID,
+		&order.Status,
+		&order.TXType,
+		&order.Accrual,
+		&order.UserID,
+		&order.UploadedAt,
+		&t,
+	)
+	if err != nil {
+		return models.Order{}, err
+	}
+
+	if t.Valid {
+		order.ProcessedAt = t.Time
+	}
+	return order, nil
+}
+
+func (u *orderRepo) queryOrders(ctx context.Context, userID int, orderType models.OrderType) ([]*models.Order, error) {
+	var err error
+	l := logr.FromContext(ctx)
+	defer func() {
+		if err != nil {
+			l.Error("error getting user orders", zap.Error(err))
+		}
+	}()
+
+	sqlStatement := `SELECT order_id, status, tx_type, accrual, user_id, uploaded_at, processed_at
+FROM orders 
+WHERE user_id = $1 AND tx_type = $2`
+
+	rows, err := u.db.QueryContext(ctx, sqlStatement, userID, orderType)
+	if err != nil {
+		return nil, ErrInternalError
+	}
+	defer rows.Close()
+
+	orders, err := scanOrders(rows)
+	if err != nil {
+		return nil, ErrInternalError
+	}
 	return orders, nil
 }
 
 func (u *orderRepo) CurrentBalance(ctx context.Context, userID int) (models.Balance, error) {
+	ctx, span := tracer.Start(ctx, "orderRepo.CurrentBalance")
+	defer span.End()
+
 	var err error
 	l := logr.FromContext(ctx)
 
 	tx, err := u.db.BeginTx(ctx, nil)
 	if err != nil {
 		l.Error("Could not begin tx", zap.Error(err))
+		return models.Balance{}, ErrInternalError
 	}
 	defer tx.Rollback()
 
@@ -277,23 +682,246 @@ func (u *orderRepo) CurrentBalance(ctx context.Context, userID int) (models.Bala
 AS total FROM orders 
 WHERE user_id = $1 AND tx_type = $2 AND status = $3`
 
-	var deposit float64
+	var deposit decimal.Decimal
 	err = tx.QueryRowContext(ctx, sqlStatement, userID, models.DepositOrder, models.ProcessedStatus).Scan(&deposit)
 	if err != nil {
 		l.Error("Error quering deposit", zap.Error(err))
 		return models.Balance{}, ErrInternalError
 	}
 
-	var withdrawal float64
+	var withdrawal decimal.Decimal
 	err = tx.QueryRowContext(ctx, sqlStatement, userID, models.WithdrawalOrder, models.ProcessedStatus).Scan(&withdrawal)
 	if err != nil {
 		l.Error("Error withdrawal deposit", zap.Error(err))
 		return models.Balance{}, ErrInternalError
 	}
 
+	var adjustments decimal.Decimal
+	err = tx.QueryRowContext(ctx, adjustmentsSumSQL, userID).Scan(&adjustments)
+	if err != nil {
+		l.Error("Error querying balance adjustments", zap.Error(err))
+		return models.Balance{}, ErrInternalError
+	}
+
 	tx.Commit()
 	return models.Balance{
-		Current:   deposit - withdrawal,
+		Current:   deposit.Sub(withdrawal).Add(adjustments),
 		Withdrawn: withdrawal,
 	}, nil
 }
+
+// OrdersVersion aggregates over the user index without loading any orders.
+func (u *orderRepo) OrdersVersion(ctx context.Context, userID int) (models.OrdersVersion, error) {
+	ctx, span := tracer.Start(ctx, "orderRepo.OrdersVersion")
+	defer span.End()
+
+	l := logr.FromContext(ctx)
+
+	sqlStatement := `SELECT COUNT(*), MAX(uploaded_at), MAX(processed_at),
+(SELECT COUNT(*) FROM balance_adjustments WHERE user_id = $1)
+FROM orders WHERE user_id = $1`
+
+	var version models.OrdersVersion
+	var uploadedAt, processedAt sql.NullTime
+	err := u.db.QueryRowContext(ctx, sqlStatement, userID).Scan(&version.Count, &uploadedAt, &processedAt, &version.Adjustments)
+	if err != nil {
+		l.Error("Error querying orders version", zap.Error(err))
+		return models.OrdersVersion{}, ErrInternalError
+	}
+	version.LastUploadedAt = uploadedAt.Time
+	version.LastProcessedAt = processedAt.Time
+	return version, nil
+}
+
+func (u *orderRepo) GetOrder(ctx context.Context, orderID int) (models.Order, error) {
+	ctx, span := tracer.Start(ctx, "orderRepo.GetOrder")
+	defer span.End()
+
+	l := logr.FromContext(ctx)
+
+	sqlStatement := `SELECT order_id, status, tx_type, accrual, user_id, uploaded_at, processed_at
+FROM orders WHERE order_id = $1`
+
+	rows, err := u.db.QueryContext(ctx, sqlStatement, orderID)
+	if err != nil {
+		l.Error("Error querying order", zap.Error(err))
+		return models.Order{}, ErrInternalError
+	}
+	defer rows.Close()
+
+	orders, err := scanOrders(rows)
+	if err != nil {
+		l.Error("Error querying order", zap.Error(err))
+		return models.Order{}, ErrInternalError
+	}
+	if len(orders) == 0 {
+		return models.Order{}, ErrOrderNotFound
+	}
+	return *orders[0], nil
+}
+
+// OrderHistory returns the status transitions of an order, oldest first,
+// starting with the NEW status recorded on upload.
+func (u *orderRepo) OrderHistory(ctx context.Context, orderID int) ([]*models.OrderTransition, error) {
+	ctx, span := tracer.Start(ctx, "orderRepo.OrderHistory")
+	defer span.End()
+
+	l := logr.FromContext(ctx)
+
+	sqlStatement := `SELECT order_id, status, accrual, changed_at, admin_id, reason FROM order_status_history
+WHERE order_id = $1 ORDER BY changed_at, history_id`
+
+	rows, err := u.db.QueryContext(ctx, sqlStatement, orderID)
+	if err != nil {
+		l.Error("Error querying order history", zap.Error(err))
+		return nil, ErrInternalError
+	}
+	defer rows.Close()
+
+	var history []*models.OrderTransition
+	for rows.Next() {
+		var t models.OrderTransition
+		var adminID sql.NullInt64
+		var reason sql.NullString
+		if err := rows.Scan(&t.OrderID, &t.Status, &t.Accrual, &t.ChangedAt, &adminID, &reason); err != nil {
+			l.Error("Error querying order history", zap.Error(err))
+			return nil, ErrInternalError
+		}
+		t.AdminID = int(adminID.Int64)
+		t.Reason = reason.String
+		history = append(history, &t)
+	}
+	if err := rows.Err(); err != nil {
+		l.Error("Error querying order history", zap.Error(err))
+		return nil, ErrInternalError
+	}
+	return history, nil
+}
+
+// CancelOrder deletes a deposit order of the user that the bonus system has
+// not picked up yet, so its number can be uploaded again. The row is locked
+// first: a concurrent ClaimOrder or UpdateOrder either commits before and
+// the order is no longer NEW, or finds the order gone and reports
+// ErrOrderNotFound. Events and status history of the order reference it
+// and are deleted with it.
+func (u *orderRepo) CancelOrder(ctx context.Context, userID int, orderID int) error {
+	ctx, span := tracer.Start(ctx, "orderRepo.CancelOrder")
+	defer span.End()
+
+	l := logr.FromContext(ctx)
+
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		l.Error("Could not begin tx", zap.Error(err))
+		return ErrInternalError
+	}
+	defer tx.Rollback()
+
+	var owner int
+	var txType models.OrderType
+	var status models.OrderStatus
+	sqlStatement := `SELECT user_id, tx_type, status FROM orders WHERE order_id = $1 FOR UPDATE`
+	err = tx.QueryRowContext(ctx, sqlStatement, orderID).Scan(&owner, &txType, &status)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrOrderNotFound
+		}
+		l.Error("Error locking order", zap.Error(err))
+		return ErrInternalError
+	}
+	if owner != userID || txType != models.DepositOrder {
+		return ErrOrderNotFound
+	}
+	if status != models.NewStatus {
+		return ErrOrderNotCancellable
+	}
+
+	for _, sqlStatement := range []string{
+		`DELETE FROM order_events WHERE order_id = $1`,
+		`DELETE FROM order_status_history WHERE order_id = $1`,
+		`DELETE FROM orders WHERE order_id = $1`,
+	} {
+		if _, err := tx.ExecContext(ctx, sqlStatement, orderID); err != nil {
+			l.Error("Error deleting order", zap.Error(err))
+			return ErrInternalError
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		l.Error("Error commiting order cancellation", zap.Error(err))
+		return ErrInternalError
+	}
+	return nil
+}
+
+// BalanceHistory returns processed orders and balance adjustments of the
+// user, oldest first, each with the balance right after it. The running
+// balance is computed over the whole history before the filter applies.
+func (u *orderRepo) BalanceHistory(ctx context.Context, userID int, filter models.LedgerFilter) ([]*models.LedgerEntry, error) {
+	ctx, span := tracer.Start(ctx, "orderRepo.BalanceHistory")
+	defer span.End()
+
+	l := logr.FromContext(ctx)
+
+	sqlStatement, args := balanceHistoryQuery(userID, filter)
+	rows, err := u.db.QueryContext(ctx, sqlStatement, args...)
+	if err != nil {
+		l.Error("Error querying balance history", zap.Error(err))
+		return nil, ErrInternalError
+	}
+	defer rows.Close()
+
+	var entries []*models.LedgerEntry
+	for rows.Next() {
+		var e models.LedgerEntry
+		if err := rows.Scan(&e.OccurredAt, &e.Type, &e.Reference, &e.Amount, &e.Balance); err != nil {
+			l.Error("Error querying balance history", zap.Error(err))
+			return nil, ErrInternalError
+		}
+		entries = append(entries, &e)
+	}
+	if err := rows.Err(); err != nil {
+		l.Error("Error querying balance history", zap.Error(err))
+		return nil, ErrInternalError
+	}
+	return entries, nil
+}
+
+func balanceHistoryQuery(userID int, filter models.LedgerFilter) (string, []interface{}) {
+	args := []interface{}{userID, models.LedgerWithdrawal, models.ProcessedStatus, models.LedgerAdjustment}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	var sb strings.Builder
+	sb.WriteString(`WITH ledger AS (
+SELECT occurred_at, entry_type, reference, amount,
+SUM(amount) OVER (ORDER BY occurred_at, entry_type, reference ROWS BETWEEN UNBOUNDED PRECEDING AND CURRENT ROW) AS balance
+FROM (
+SELECT processed_at AS occurred_at, tx_type AS entry_type, order_id AS reference,
+CASE WHEN tx_type = $2 THEN -accrual ELSE accrual END AS amount
+FROM orders WHERE user_id = $1 AND status = $3
+UNION ALL
+SELECT created_at, $4::VARCHAR, adjustment_id, amount
+FROM balance_adjustments WHERE user_id = $1
+) entries
+)
+SELECT occurred_at, entry_type, reference, amount, balance FROM ledger WHERE true`)
+
+	if !filter.From.IsZero() {
+		sb.WriteString(" AND occurred_at >= " + arg(filter.From))
+	}
+	if !filter.To.IsZero() {
+		sb.WriteString(" AND occurred_at < " + arg(filter.To))
+	}
+	if filter.After != nil {
+		sb.WriteString(" AND (occurred_at, entry_type, reference) > (" +
+			arg(filter.After.OccurredAt) + ", " + arg(filter.After.Type) + ", " + arg(filter.After.Reference) + ")")
+	}
+	sb.WriteString(" ORDER BY occurred_at, entry_type, reference")
+	if filter.Limit > 0 {
+		sb.WriteString(" LIMIT " + arg(filter.Limit))
+	}
+	return sb.String(), args
+}
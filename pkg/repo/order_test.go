@@ -3,11 +3,17 @@ package repo
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
 	"testing"
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
 	_ "github.com/jackc/pgx/v4/stdlib"
+	"github.com/shopspring/decimal"
 	"github.com/stretchr/testify/require"
 
 	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
@@ -19,12 +25,13 @@ func Test_orderRepo_CreateNewOrder(t *testing.T) {
 	selectSQL := `SELECT user_id FROM orders WHERE order_id = \$1`
 	insertSQL := `INSERT INTO orders \(order_id, status, tx_type, accrual, user_id, uploaded_at\)
 		VALUES \(\$1, \$2, \$3, \$4, \$5, \$6\)`
+	historySQL := `INSERT INTO order_status_history \(order_id, status, accrual, changed_at\) VALUES \(\$1, \$2, 0, \$3\)`
 
 	order := models.Order{
 		OrderID: 12345,
 		Status:  "someStatus",
 		TXType:  "someType",
-		Accrual: 0,
+		Accrual: decimal.Zero,
 		UserID:  8,
 	}
 
@@ -35,6 +42,7 @@ func Test_orderRepo_CreateNewOrder(t *testing.T) {
 		s := mock.ExpectQuery(selectSQL).WithArgs(order.OrderID)
 		s.WillReturnError(sql.ErrNoRows)
 
+		mock.ExpectBegin()
 		q := mock.ExpectExec(insertSQL).
 			WithArgs(
 				order.OrderID,
@@ -46,11 +54,16 @@ func Test_orderRepo_CreateNewOrder(t *testing.T) {
 			)
 		q.WillReturnError(nil)
 		q.WillReturnResult(sqlmock.NewResult(123, 1))
+		mock.ExpectExec(historySQL).
+			WithArgs(order.OrderID, models.NewStatus, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
 
 		repo, err := OrderRepo(db, newDevLogger(t))
 		require.NoError(t, err)
 		err = repo.CreateNewOrder(context.Background(), order)
 		require.NoError(t, err)
+		require.NoError(t, mock.ExpectationsWereMet())
 	})
 
 	t.Run("insert duplicate for current user", func(t *testing.T) {
@@ -91,14 +104,24 @@ func Test_orderRepo_CurrentBalance(t *testing.T) {
 	repo := orderRepo{db, log}
 
 	uID := 3
-	sum := 20
-	q := mock.ExpectQuery(`SELECT COALESCE\(SUM\(accrual\),0\) AS total FROM orders WHERE user_id = \$1`).WithArgs(uID)
-	q.WillReturnRows(mock.NewRows([]string{"total"}).AddRow(sum))
-	q.WillReturnError(nil)
+	query := `SELECT COALESCE\(SUM\(accrual\),0\)\s+AS total FROM orders\s+WHERE user_id = \$1 AND tx_type = \$2 AND status = \$3`
+	mock.ExpectBegin()
+	mock.ExpectQuery(query).
+		WithArgs(uID, models.DepositOrder, models.ProcessedStatus).
+		WillReturnRows(mock.NewRows([]string{"total"}).AddRow("100.3"))
+	mock.ExpectQuery(query).
+		WithArgs(uID, models.WithdrawalOrder, models.ProcessedStatus).
+		WillReturnRows(mock.NewRows([]string{"total"}).AddRow("0.1"))
+	mock.ExpectQuery(`SELECT COALESCE\(SUM\(amount\),0\) FROM balance_adjustments WHERE user_id = \$1`).
+		WithArgs(uID).
+		WillReturnRows(mock.NewRows([]string{"total"}).AddRow("-0.05"))
+	mock.ExpectCommit()
 
 	balance, err := repo.CurrentBalance(context.Background(), uID)
 	require.NoError(t, err)
-	require.Equal(t, sum, balance)
+	require.Equal(t, "100.15", balance.Current.String())
+	require.Equal(t, "0.1", balance.Withdrawn.String())
+	require.NoError(t, mock.ExpectationsWereMet())
 }
 
 func Test_orderRepo_queryOrders(t *testing.T) {
@@ -139,7 +162,7 @@ func Test_orderRepo_queryOrders(t *testing.T) {
 				OrderID:     1,
 				Status:      models.NewStatus,
 				TXType:      models.WithdrawalOrder,
-				Accrual:     10,
+				Accrual:     decimal.NewFromInt(10),
 				UserID:      5,
 				UploadedAt:  time.Date(1988, time.May, 10, 9, 0, 0, 0, time.UTC),
 				ProcessedAt: time.Date(1988, time.May, 10, 9, 0, 0, 0, time.UTC),
@@ -164,12 +187,24 @@ func Test_orderRepo_queryOrders(t *testing.T) {
 				OrderID:     1,
 				Status:      models.NewStatus,
 				TXType:      models.DepositOrder,
-				Accrual:     10,
+				Accrual:     decimal.NewFromInt(10),
 				UserID:      5,
 				UploadedAt:  time.Date(1988, time.May, 10, 9, 0, 0, 0, time.UTC),
 				ProcessedAt: time.Date(1988, time.May, 10, 9, 0, 0, 0, time.UTC),
 			}},
 		},
+		{
+			"error while iterating",
+			models.DepositOrder,
+			true,
+			ErrInternalError,
+			2,
+			sqlmock.NewRows(columns).
+				AddRow(1, models.NewStatus, models.DepositOrder, 10, 5, time.Date(1988, time.May, 10, 9, 0, 0, 0, time.UTC), nil).
+				AddRow(2, models.NewStatus, models.DepositOrder, 10, 5, time.Date(1988, time.May, 10, 9, 0, 0, 0, time.UTC), nil).
+				RowError(1, errors.New("connection reset")),
+			nil,
+		},
 	}
 
 	for _, tt := range tests {
@@ -188,9 +223,530 @@ WHERE user_id = \$1 AND tx_type = \$2`
 			mock.ExpectQuery(sqlQuery).WithArgs(tt.userID, tt.TXtype).WillReturnRows(tt.rows)
 
 			orders, err := repo.queryOrders(context.Background(), tt.userID, tt.TXtype)
+			if tt.wantErr {
+				require.ErrorIs(t, err, tt.err)
+				return
+			}
 			require.NoError(t, err)
 			require.Equal(t, orders[0], tt.orders[0])
 
 		})
 	}
 }
+
+func Test_orderRepo_ListUnprocessedOrders(t *testing.T) {
+	columns := []string{"order_id", "status", "tx_type", "accrual", "user_id", "uploaded_at", "processed_at"}
+	uploadedAt := time.Date(2022, time.July, 1, 9, 0, 0, 0, time.UTC)
+	query := `WHERE tx_type = \$1 AND status not in \(\$2, \$3\) LIMIT \$4 OFFSET \$5`
+	args := []driver.Value{models.DepositOrder, models.InvalidStatus, models.ProcessedStatus, 10, 0}
+
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectQuery(query).WithArgs(args...).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(1, models.NewStatus, models.DepositOrder, "0", 5, uploadedAt, nil).
+			AddRow(2, models.ProcessingStatus, models.DepositOrder, "0", 5, uploadedAt, nil))
+	mock.ExpectQuery(query).WithArgs(args...).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(1, models.NewStatus, models.DepositOrder, "0", 5, uploadedAt, nil).
+			AddRow(2, models.ProcessingStatus, models.DepositOrder, "0", 5, uploadedAt, nil).
+			RowError(1, errors.New("connection reset")))
+
+	repo := orderRepo{db, newDevLogger(t)}
+	orders, err := repo.ListUnprocessedOrders(context.Background(), 10, 0)
+	require.NoError(t, err)
+	require.Equal(t, []*models.Order{
+		{OrderID: 1, Status: models.NewStatus, TXType: models.DepositOrder, Accrual: decimal.NewFromInt(0), UserID: 5, UploadedAt: uploadedAt},
+		{OrderID: 2, Status: models.ProcessingStatus, TXType: models.DepositOrder, Accrual: decimal.NewFromInt(0), UserID: 5, UploadedAt: uploadedAt},
+	}, orders)
+
+	// an error after the first rows must not pass for a short page
+	_, err = repo.ListUnprocessedOrders(context.Background(), 10, 0)
+	require.ErrorIs(t, err, ErrInternalError)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_orderRepo_CountUnprocessedOrders(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM orders WHERE tx_type = \$1 AND status not in \(\$2, \$3\)`).
+		WithArgs(models.DepositOrder, models.InvalidStatus, models.ProcessedStatus).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(42))
+
+	repo := orderRepo{db, newDevLogger(t)}
+	count, err := repo.CountUnprocessedOrders(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 42, count)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_orderRepo_FindOrders(t *testing.T) {
+	columns := []string{
+		"order_id",
+		"status",
+		"tx_type",
+		"accrual",
+		"user_id",
+		"uploaded_at",
+		"processed_at",
+	}
+	uploadedAt := time.Date(1988, time.May, 10, 9, 0, 0, 0, time.UTC)
+
+	t.Run("no filter", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer db.Close()
+
+		repo := orderRepo{db, newDevLogger(t)}
+
+		mock.ExpectQuery(`WHERE user_id = \$1 AND tx_type = \$2 ORDER BY uploaded_at, order_id$`).
+			WithArgs(5, models.DepositOrder).
+			WillReturnRows(sqlmock.NewRows(columns).AddRow(1, models.NewStatus, models.DepositOrder, 0, 5, uploadedAt, nil))
+
+		orders, err := repo.FindOrders(context.Background(), 5, models.OrderFilter{})
+		require.NoError(t, err)
+		require.Equal(t, []*models.Order{{
+			OrderID:    1,
+			Status:     models.NewStatus,
+			TXType:     models.DepositOrder,
+			Accrual:    decimal.NewFromInt(0),
+			UserID:     5,
+			UploadedAt: uploadedAt,
+		}}, orders)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("all filters", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer db.Close()
+
+		repo := orderRepo{db, newDevLogger(t)}
+
+		from := uploadedAt.Add(-time.Hour)
+		to := uploadedAt.Add(time.Hour)
+		filter := models.OrderFilter{
+			Statuses:     []models.OrderStatus{models.NewStatus, models.ProcessingStatus},
+			UploadedFrom: from,
+			UploadedTo:   to,
+			After:        &models.OrderCursor{UploadedAt: uploadedAt, OrderID: 42},
+			Limit:        11,
+		}
+
+		mock.ExpectQuery(`WHERE user_id = \$1 AND tx_type = \$2 AND status IN \(\$3, \$4\) AND uploaded_at >= \$5 AND uploaded_at < \$6 AND \(uploaded_at, order_id\) > \(\$7, \$8\) ORDER BY uploaded_at, order_id LIMIT \$9`).
+			WithArgs(5, models.DepositOrder, models.NewStatus, models.ProcessingStatus, from, to, uploadedAt, 42, 11).
+			WillReturnRows(sqlmock.NewRows(columns))
+
+		orders, err := repo.FindOrders(context.Background(), 5, filter)
+		require.NoError(t, err)
+		require.Empty(t, orders)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func Test_orderRepo_CreateNewOrders(t *testing.T) {
+	insertSQL := `INSERT INTO orders \(order_id, status, tx_type, accrual, user_id, uploaded_at\)
+	VALUES \(\$1, \$2, \$3, \$4, \$5, \$6\) ON CONFLICT \(order_id\) DO NOTHING`
+	selectSQL := `SELECT user_id FROM orders WHERE order_id = \$1`
+	historySQL := `INSERT INTO order_status_history \(order_id, status, accrual, changed_at\) VALUES \(\$1, \$2, 0, \$3\)`
+
+	orders := []models.Order{
+		models.NewOrder(12345, 8),
+		models.NewOrder(23456, 8),
+		models.NewOrder(34567, 8),
+	}
+
+	t.Run("mixed batch", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer db.Close()
+
+		mock.ExpectBegin()
+		mock.ExpectExec(insertSQL).
+			WithArgs(12345, models.NewStatus, models.DepositOrder, decimal.Zero, 8, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(historySQL).WithArgs(12345, models.NewStatus, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(insertSQL).
+			WithArgs(23456, models.NewStatus, models.DepositOrder, decimal.Zero, 8, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(selectSQL).WithArgs(23456).
+			WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(8))
+		mock.ExpectExec(insertSQL).
+			WithArgs(34567, models.NewStatus, models.DepositOrder, decimal.Zero, 8, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(selectSQL).WithArgs(34567).
+			WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(9))
+		mock.ExpectCommit()
+
+		repo := orderRepo{db, newDevLogger(t)}
+		results, err := repo.CreateNewOrders(context.Background(), orders)
+		require.NoError(t, err)
+		require.Len(t, results, 3)
+		require.NoError(t, results[0])
+		require.ErrorIs(t, results[1], ErrOrderAlreadyUploadedByCurrentUser)
+		require.ErrorIs(t, results[2], ErrOrderCreatedByAnotherUser)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("rollback on error", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer db.Close()
+
+		mock.ExpectBegin()
+		mock.ExpectExec(insertSQL).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(historySQL).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(insertSQL).WillReturnError(sql.ErrConnDone)
+		mock.ExpectRollback()
+
+		repo := orderRepo{db, newDevLogger(t)}
+		_, err = repo.CreateNewOrders(context.Background(), orders)
+		require.ErrorIs(t, err, ErrInternalError)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func Test_orderRepo_Withdraw(t *testing.T) {
+	sumSQL := `SELECT COALESCE\(SUM\(accrual\),0\) AS total FROM orders WHERE user_id = \$1 and tx_type = \$2`
+	order := models.Order{OrderID: 2377225624, TXType: models.WithdrawalOrder, Accrual: decimal.NewFromInt(100), UserID: 8}
+
+	tests := []struct {
+		name      string
+		insertErr error
+		want      error
+	}{
+		{"withdrawn", nil, nil},
+		{"duplicate order", fmt.Errorf("exec: %w", &pgconn.PgError{Code: pgerrcode.UniqueViolation}), ErrDuplicateOrder},
+		// other constraints must not pass for duplicates
+		{"foreign key violation", &pgconn.PgError{Code: pgerrcode.ForeignKeyViolation}, ErrInternalError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			require.NoError(t, err)
+			defer db.Close()
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(sumSQL).WithArgs(8, models.DepositOrder).
+				WillReturnRows(sqlmock.NewRows([]string{"total"}).AddRow("500"))
+			mock.ExpectQuery(sumSQL).WithArgs(8, models.WithdrawalOrder).
+				WillReturnRows(sqlmock.NewRows([]string{"total"}).AddRow("0"))
+			mock.ExpectQuery(`SELECT COALESCE\(SUM\(amount\),0\) FROM balance_adjustments WHERE user_id = \$1`).WithArgs(8).
+				WillReturnRows(sqlmock.NewRows([]string{"sum"}).AddRow("0"))
+			insert := mock.ExpectExec(`INSERT INTO orders`)
+			if tt.insertErr != nil {
+				insert.WillReturnError(tt.insertErr)
+				mock.ExpectRollback()
+			} else {
+				insert.WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectExec(`INSERT INTO webhook_deliveries`).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectCommit()
+			}
+
+			repo := orderRepo{db, newDevLogger(t)}
+			err = repo.Withdraw(context.Background(), order)
+			if tt.want == nil {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, tt.want)
+			}
+			require.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func Test_orderRepo_UpdateOrder(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	order := models.Order{
+		OrderID:     12345,
+		Status:      models.ProcessedStatus,
+		Accrual:     decimal.NewFromInt(500),
+		ProcessedAt: time.Date(1988, time.May, 10, 9, 0, 0, 0, time.UTC),
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`UPDATE orders SET status = \$1, accrual = \$2, processed_at = \$3 WHERE order_id = \(\$4\) RETURNING user_id`).
+		WithArgs(order.Status, order.Accrual, order.ProcessedAt, order.OrderID).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(8))
+	mock.ExpectExec(`INSERT INTO order_status_history \(order_id, status, accrual, changed_at, admin_id, reason\) VALUES \(\$1, \$2, \$3, \$4, \$5, \$6\)`).
+		WithArgs(order.OrderID, order.Status, order.Accrual, sqlmock.AnyArg(), nil, nil).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO order_events \(order_id, user_id, status, accrual, created_at\) VALUES \(\$1, \$2, \$3, \$4, \$5\)`).
+		WithArgs(order.OrderID, 8, order.Status, order.Accrual, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO webhook_deliveries`).
+		WithArgs(8, models.OrderProcessedEvent, sqlmock.AnyArg(), models.DeliveryPending, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	repo := orderRepo{db, newDevLogger(t)}
+	require.NoError(t, repo.UpdateOrder(context.Background(), order))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_orderRepo_ForceOrderStatus(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	order := models.Order{OrderID: 12345, Status: models.NewStatus, ProcessedAt: time.Date(2022, time.August, 5, 9, 0, 0, 0, time.UTC)}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`UPDATE orders SET status`).
+		WithArgs(order.Status, order.Accrual, order.ProcessedAt, order.OrderID).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(8))
+	mock.ExpectExec(`INSERT INTO order_status_history`).
+		WithArgs(order.OrderID, order.Status, order.Accrual, sqlmock.AnyArg(), 100, "stuck in processing").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`INSERT INTO order_events`).
+		WithArgs(order.OrderID, 8, order.Status, order.Accrual, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	repo := orderRepo{db, newDevLogger(t)}
+	require.NoError(t, repo.ForceOrderStatus(context.Background(), order, 100, "stuck in processing"))
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_orderRepo_ClaimOrder(t *testing.T) {
+	claimSQL := `UPDATE orders SET status = \$1, accrual = \$2, processed_at = \$3 WHERE order_id = \(\$4\) AND status = \$5 RETURNING user_id`
+	order := models.Order{OrderID: 12345, Status: models.NewStatus, Accrual: decimal.Zero}
+
+	t.Run("new order", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer db.Close()
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(claimSQL).
+			WithArgs(models.ProcessingStatus, order.Accrual, nil, order.OrderID, models.NewStatus).
+			WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(8))
+		mock.ExpectExec(`INSERT INTO order_status_history`).
+			WithArgs(order.OrderID, models.ProcessingStatus, order.Accrual, sqlmock.AnyArg(), nil, nil).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec(`INSERT INTO order_events`).
+			WithArgs(order.OrderID, 8, models.ProcessingStatus, order.Accrual, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+
+		repo := orderRepo{db, newDevLogger(t)}
+		require.NoError(t, repo.ClaimOrder(context.Background(), order))
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("cancelled or no longer new", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer db.Close()
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(claimSQL).WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+		mock.ExpectRollback()
+
+		repo := orderRepo{db, newDevLogger(t)}
+		require.ErrorIs(t, repo.ClaimOrder(context.Background(), order), ErrOrderNotFound)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func Test_orderRepo_OrdersVersion(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	repo := orderRepo{db, newDevLogger(t)}
+	uploadedAt := time.Date(2022, time.June, 25, 9, 0, 0, 0, time.UTC)
+
+	query := `SELECT COUNT\(\*\), MAX\(uploaded_at\), MAX\(processed_at\),
+\(SELECT COUNT\(\*\) FROM balance_adjustments WHERE user_id = \$1\)
+FROM orders WHERE user_id = \$1`
+	mock.ExpectQuery(query).WithArgs(3).
+		WillReturnRows(sqlmock.NewRows([]string{"count", "max", "max", "count"}).AddRow(2, uploadedAt, nil, 1))
+	mock.ExpectQuery(query).WithArgs(4).
+		WillReturnRows(sqlmock.NewRows([]string{"count", "max", "max", "count"}).AddRow(0, nil, nil, 0))
+
+	version, err := repo.OrdersVersion(context.Background(), 3)
+	require.NoError(t, err)
+	require.Equal(t, models.OrdersVersion{Count: 2, LastUploadedAt: uploadedAt, Adjustments: 1}, version)
+
+	version, err = repo.OrdersVersion(context.Background(), 4)
+	require.NoError(t, err)
+	require.Equal(t, models.OrdersVersion{}, version)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_orderRepo_StreamOrders(t *testing.T) {
+	columns := []string{"order_id", "status", "tx_type", "accrual", "user_id", "uploaded_at", "processed_at"}
+	uploadedAt := time.Date(2022, time.July, 1, 9, 0, 0, 0, time.UTC)
+	query := `WHERE user_id = \$1 AND tx_type = \$2 ORDER BY uploaded_at, order_id$`
+
+	newRows := func() *sqlmock.Rows {
+		return sqlmock.NewRows(columns).
+			AddRow(1, models.ProcessedStatus, models.WithdrawalOrder, "10.5", 5, uploadedAt, uploadedAt).
+			AddRow(2, models.ProcessedStatus, models.WithdrawalOrder, "1", 5, uploadedAt, uploadedAt)
+	}
+
+	t.Run("all rows", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer db.Close()
+
+		repo := orderRepo{db, newDevLogger(t)}
+		mock.ExpectQuery(query).WithArgs(5, models.WithdrawalOrder).WillReturnRows(newRows())
+
+		var ids []int
+		err = repo.StreamOrders(context.Background(), 5, models.WithdrawalOrder, models.OrderFilter{}, func(o models.Order) error {
+			ids = append(ids, o.OrderID)
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, []int{1, 2}, ids)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("callback error stops", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer db.Close()
+
+		repo := orderRepo{db, newDevLogger(t)}
+		mock.ExpectQuery(query).WithArgs(5, models.WithdrawalOrder).WillReturnRows(newRows())
+
+		stop := errors.New("client went away")
+		calls := 0
+		err = repo.StreamOrders(context.Background(), 5, models.WithdrawalOrder, models.OrderFilter{}, func(o models.Order) error {
+			calls++
+			return stop
+		})
+		require.ErrorIs(t, err, stop)
+		require.Equal(t, 1, calls)
+	})
+}
+
+func Test_orderRepo_OrderHistory(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	changedAt := time.Date(2022, time.July, 15, 9, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(`SELECT order_id, status, accrual, changed_at, admin_id, reason FROM order_status_history
+WHERE order_id = \$1 ORDER BY changed_at, history_id`).
+		WithArgs(12345).
+		WillReturnRows(sqlmock.NewRows([]string{"order_id", "status", "accrual", "changed_at", "admin_id", "reason"}).
+			AddRow(12345, models.ProcessingStatus, "0", changedAt, nil, nil).
+			AddRow(12345, models.ProcessedStatus, "120.5", changedAt.Add(time.Minute), 100, "accrual system outage"))
+
+	repo := orderRepo{db, newDevLogger(t)}
+	history, err := repo.OrderHistory(context.Background(), 12345)
+	require.NoError(t, err)
+	require.Equal(t, []*models.OrderTransition{
+		{OrderID: 12345, Status: models.ProcessingStatus, Accrual: decimal.NewFromInt(0), ChangedAt: changedAt},
+		{OrderID: 12345, Status: models.ProcessedStatus, Accrual: decimal.RequireFromString("120.5"), ChangedAt: changedAt.Add(time.Minute),
+			AdminID: 100, Reason: "accrual system outage"},
+	}, history)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func Test_orderRepo_CancelOrder(t *testing.T) {
+	lockQuery := `SELECT user_id, tx_type, status FROM orders WHERE order_id = \$1 FOR UPDATE`
+	columns := []string{"user_id", "tx_type", "status"}
+
+	cancelled := []struct {
+		name    string
+		history int64
+	}{
+		{"new order", 0},
+		// e.g. reset to NEW by an admin, its history references the order
+		{"new order with history", 2},
+	}
+	for _, tt := range cancelled {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			require.NoError(t, err)
+			defer db.Close()
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(lockQuery).WithArgs(12345).
+				WillReturnRows(sqlmock.NewRows(columns).AddRow(3, models.DepositOrder, models.NewStatus))
+			mock.ExpectExec(`DELETE FROM order_events WHERE order_id = \$1`).WithArgs(12345).
+				WillReturnResult(sqlmock.NewResult(0, tt.history))
+			mock.ExpectExec(`DELETE FROM order_status_history WHERE order_id = \$1`).WithArgs(12345).
+				WillReturnResult(sqlmock.NewResult(0, tt.history))
+			mock.ExpectExec(`DELETE FROM orders WHERE order_id = \$1`).WithArgs(12345).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+
+			repo := orderRepo{db, newDevLogger(t)}
+			require.NoError(t, repo.CancelOrder(context.Background(), 3, 12345))
+			require.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+
+	tests := []struct {
+		name string
+		rows *sqlmock.Rows
+		want error
+	}{
+		{"unknown order", sqlmock.NewRows(columns), ErrOrderNotFound},
+		{"another user's order", sqlmock.NewRows(columns).AddRow(4, models.DepositOrder, models.NewStatus), ErrOrderNotFound},
+		{"withdrawal", sqlmock.NewRows(columns).AddRow(3, models.WithdrawalOrder, models.ProcessedStatus), ErrOrderNotFound},
+		{"processed order", sqlmock.NewRows(columns).AddRow(3, models.DepositOrder, models.ProcessedStatus), ErrOrderNotCancellable},
+		// claimed by the bonus system and being scored by the accrual system
+		{"picked up order", sqlmock.NewRows(columns).AddRow(3, models.DepositOrder, models.ProcessingStatus), ErrOrderNotCancellable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			require.NoError(t, err)
+			defer db.Close()
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(lockQuery).WithArgs(12345).WillReturnRows(tt.rows)
+			mock.ExpectRollback()
+
+			repo := orderRepo{db, newDevLogger(t)}
+			require.ErrorIs(t, repo.CancelOrder(context.Background(), 3, 12345), tt.want)
+			require.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func Test_orderRepo_BalanceHistory(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	at := time.Date(2022, time.July, 20, 9, 0, 0, 0, time.UTC)
+	after := models.LedgerCursor{OccurredAt: at, Type: models.LedgerDeposit, Reference: 79927398713}
+
+	mock.ExpectQuery(`SUM\(amount\) OVER \(ORDER BY occurred_at, entry_type, reference ROWS BETWEEN UNBOUNDED PRECEDING AND CURRENT ROW\) AS balance.*`+
+		`WHERE true AND occurred_at >= \$5 AND occurred_at < \$6 AND \(occurred_at, entry_type, reference\) > \(\$7, \$8, \$9\) `+
+		`ORDER BY occurred_at, entry_type, reference LIMIT \$10$`).
+		WithArgs(5, models.LedgerWithdrawal, models.ProcessedStatus, models.LedgerAdjustment,
+			at.Add(-time.Hour), at.Add(24*time.Hour), after.OccurredAt, after.Type, after.Reference, 2).
+		WillReturnRows(sqlmock.NewRows([]string{"occurred_at", "entry_type", "reference", "amount", "balance"}).
+			AddRow(at.Add(time.Hour), models.LedgerWithdrawal, 2377225624, "-200", "300").
+			AddRow(at.Add(2*time.Hour), models.LedgerAdjustment, 7, "12.5", "312.5"))
+
+	repo := orderRepo{db, newDevLogger(t)}
+	entries, err := repo.BalanceHistory(context.Background(), 5, models.LedgerFilter{
+		From:  at.Add(-time.Hour),
+		To:    at.Add(24 * time.Hour),
+		After: &after,
+		Limit: 2,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []*models.LedgerEntry{
+		{Type: models.LedgerWithdrawal, Reference: 2377225624, Amount: decimal.RequireFromString("-200"), Balance: decimal.RequireFromString("300"), OccurredAt: at.Add(time.Hour)},
+		{Type: models.LedgerAdjustment, Reference: 7, Amount: decimal.RequireFromString("12.5"), Balance: decimal.RequireFromString("312.5"), OccurredAt: at.Add(2 * time.Hour)},
+	}, entries)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
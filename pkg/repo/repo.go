@@ -3,9 +3,12 @@ package repo
 import (
 	"database/sql"
 
+	"go.opentelemetry.io/otel"
 	"go.uber.org/zap"
 )
 
+var tracer = otel.Tracer("github.com/OmAsana/go-yapraktikum-final/pkg/repo")
+
 func UserRepo(db *sql.DB, log *zap.Logger) (UserRepository, error) {
 	if err := db.Ping(); err != nil {
 		return nil, err
@@ -19,3 +22,31 @@ func OrderRepo(db *sql.DB, log *zap.Logger) (OrderRepository, error) {
 	}
 	return newOrderRepo(db, log), nil
 }
+
+func IdempotencyRepo(db *sql.DB, log *zap.Logger) (IdempotencyRepository, error) {
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+	return newIdempotencyRepo(db, log), nil
+}
+
+func WebhookRepo(db *sql.DB, log *zap.Logger) (WebhookRepository, error) {
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+	return newWebhookRepo(db, log), nil
+}
+
+func AdminRepo(db *sql.DB, log *zap.Logger) (AdminRepository, error) {
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+	return newAdminRepo(db, log), nil
+}
+
+func TokenRepo(db *sql.DB, log *zap.Logger) (TokenRepository, error) {
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+	return newTokenRepo(db, log), nil
+}
@@ -0,0 +1,253 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+
+	logr "github.com/OmAsana/go-yapraktikum-final/pkg/logger"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
+)
+
+var _ TokenRepository = (*tokenRepo)(nil)
+
+const insertRefreshTokenSQL = `INSERT INTO refresh_tokens (token_hash, family_id, user_id, created_at, expires_at)
+VALUES ($1, $2, $3, $4, $5)`
+
+type tokenRepo struct {
+	db  *sql.DB
+	log *zap.Logger
+}
+
+func newTokenRepo(db *sql.DB, logger *zap.Logger) *tokenRepo {
+	if logger == nil {
+		logger = logr.NewNoop()
+	}
+	return &tokenRepo{db: db, log: logger}
+}
+
+func (u *tokenRepo) CreateRefreshToken(ctx context.Context, token models.RefreshToken) error {
+	ctx, span := tracer.Start(ctx, "tokenRepo.CreateRefreshToken")
+	defer span.End()
+
+	l := logr.FromContext(ctx)
+
+	_, err := u.db.ExecContext(ctx, insertRefreshTokenSQL, token.Hash, token.FamilyID, token.UserID, token.CreatedAt, token.ExpiresAt)
+	if err != nil {
+		l.Error("Error inserting refresh token", zap.Error(err))
+		return ErrInternalError
+	}
+	return nil
+}
+
+// RotateRefreshToken uses up the token with hash and stores next in its
+// family. Presenting a token that was already used means it leaked: the
+// whole family is revoked and ErrRefreshTokenReused returned along with
+// the reused token, so callers can revoke the session's access tokens too.
+func (u *tokenRepo) RotateRefreshToken(ctx context.Context, hash string, next models.RefreshToken) (models.RefreshToken, error) {
+	ctx, span := tracer.Start(ctx, "tokenRepo.RotateRefreshToken")
+	defer span.End()
+
+	l := logr.FromContext(ctx)
+
+	tx, err := u.db.BeginTx(ctx, nil)
+	if err != nil {
+		l.Error("Could not begin tx", zap.Error(err))
+		return models.RefreshToken{}, ErrInternalError
+	}
+	defer tx.Rollback()
+
+	var current models.RefreshToken
+	var usedAt, revokedAt sql.NullTime
+	selectSQL := `SELECT token_id, family_id, user_id, expires_at, used_at, revoked_at
+FROM refresh_tokens WHERE token_hash = $1 FOR UPDATE`
+	err = tx.QueryRowContext(ctx, selectSQL, hash).Scan(
+		&current.ID,
+		&current.FamilyID,
+		&current.UserID,
+		&current.ExpiresAt,
+		&usedAt,
+		&revokedAt,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return models.RefreshToken{}, ErrRefreshTokenInvalid
+		}
+		l.Error("Error querying refresh token", zap.Error(err))
+		return models.RefreshToken{}, ErrInternalError
+	}
+	current.UsedAt = usedAt.Time
+	current.RevokedAt = revokedAt.Time
+
+	if current.Revoked() {
+		return models.RefreshToken{}, ErrRefreshTokenInvalid
+	}
+	if current.Used() {
+		if err := revokeFamily(ctx, tx, current.FamilyID, next.CreatedAt); err != nil {
+			l.Error("Error revoking refresh token family", zap.Error(err))
+			return models.RefreshToken{}, ErrInternalError
+		}
+		if err := tx.Commit(); err != nil {
+			l.Error("Error commiting refresh token family revocation", zap.Error(err))
+			return models.RefreshToken{}, ErrInternalError
+		}
+		l.Warn("Refresh token reused, family revoked",
+			zap.String("family", current.FamilyID), zap.Int("user", current.UserID))
+		return current, ErrRefreshTokenReused
+	}
+	if !next.CreatedAt.Before(current.ExpiresAt) {
+		return models.RefreshToken{}, ErrRefreshTokenInvalid
+	}
+
+	updateSQL := `UPDATE refresh_tokens SET used_at = $1 WHERE token_id = $2`
+	if _, err := tx.ExecContext(ctx, updateSQL, next.CreatedAt, current.ID); err != nil {
+		l.Error("Error using up refresh token", zap.Error(err))
+		return models.RefreshToken{}, ErrInternalError
+	}
+
+	next.FamilyID = current.FamilyID
+	next.UserID = current.UserID
+	_, err = tx.ExecContext(ctx, insertRefreshTokenSQL, next.Hash, next.FamilyID, next.UserID, next.CreatedAt, next.ExpiresAt)
+	if err != nil {
+		l.Error("Error inserting refresh token", zap.Error(err))
+		return models.RefreshToken{}, ErrInternalError
+	}
+
+	if err := tx.Commit(); err != nil {
+		l.Error("Error commiting refresh token rotation", zap.Error(err))
+		return models.RefreshToken{}, ErrInternalError
+	}
+	return next, nil
+}
+
+// ListSessions returns the refresh token families of the user that are
+// neither revoked nor expired, oldest first.
+func (u *tokenRepo) ListSessions(ctx context.Context, userID int, now time.Time) ([]*models.Session, error) {
+	ctx, span := tracer.Start(ctx, "tokenRepo.ListSessions")
+	defer span.End()
+
+	l := logr.FromContext(ctx)
+
+	sqlStatement := `SELECT family_id, MIN(created_at), MAX(created_at), MAX(expires_at)
+FROM refresh_tokens WHERE user_id = $1
+GROUP BY family_id
+HAVING COUNT(revoked_at) = 0 AND MAX(expires_at) > $2
+ORDER BY MIN(created_at), family_id`
+
+	rows, err := u.db.QueryContext(ctx, sqlStatement, userID, now)
+	if err != nil {
+		l.Error("Error querying sessions", zap.Error(err))
+		return nil, ErrInternalError
+	}
+	defer rows.Close()
+
+	var sessions []*models.Session
+	for rows.Next() {
+		var s models.Session
+		if err := rows.Scan(&s.ID, &s.CreatedAt, &s.LastUsedAt, &s.ExpiresAt); err != nil {
+			l.Error("Error querying sessions", zap.Error(err))
+			return nil, ErrInternalError
+		}
+		sessions = append(sessions, &s)
+	}
+	if err := rows.Err(); err != nil {
+		l.Error("Error querying sessions", zap.Error(err))
+		return nil, ErrInternalError
+	}
+	return sessions, nil
+}
+
+// RevokeSession revokes every refresh token of a session of the user.
+// ErrSessionNotFound is returned unless the session was still active.
+func (u *tokenRepo) RevokeSession(ctx context.Context, userID int, sessionID string, at time.Time) error {
+	ctx, span := tracer.Start(ctx, "tokenRepo.RevokeSession")
+	defer span.End()
+
+	l := logr.FromContext(ctx)
+
+	sqlStatement := `UPDATE refresh_tokens SET revoked_at = $1
+WHERE family_id = $2 AND user_id = $3 AND revoked_at IS NULL`
+	res, err := u.db.ExecContext(ctx, sqlStatement, at, sessionID, userID)
+	if err != nil {
+		l.Error("Error revoking session", zap.Error(err))
+		return ErrInternalError
+	}
+	revoked, err := res.RowsAffected()
+	if err != nil {
+		l.Error("Error revoking session", zap.Error(err))
+		return ErrInternalError
+	}
+	if revoked == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+func (u *tokenRepo) DenyToken(ctx context.Context, id string, expiresAt time.Time) error {
+	ctx, span := tracer.Start(ctx, "tokenRepo.DenyToken")
+	defer span.End()
+
+	l := logr.FromContext(ctx)
+
+	sqlStatement := `INSERT INTO denied_tokens (token_id, expires_at) VALUES ($1, $2)
+ON CONFLICT (token_id) DO UPDATE SET expires_at = GREATEST(denied_tokens.expires_at, EXCLUDED.expires_at)`
+	if _, err := u.db.ExecContext(ctx, sqlStatement, id, expiresAt); err != nil {
+		l.Error("Error denying token", zap.Error(err))
+		return ErrInternalError
+	}
+	return nil
+}
+
+func (u *tokenRepo) DeniedUntil(ctx context.Context, id string) (time.Time, error) {
+	ctx, span := tracer.Start(ctx, "tokenRepo.DeniedUntil")
+	defer span.End()
+
+	l := logr.FromContext(ctx)
+
+	var expiresAt time.Time
+	err := u.db.QueryRowContext(ctx, `SELECT expires_at FROM denied_tokens WHERE token_id = $1`, id).Scan(&expiresAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return time.Time{}, nil
+		}
+		l.Error("Error querying denied token", zap.Error(err))
+		return time.Time{}, ErrInternalError
+	}
+	return expiresAt, nil
+}
+
+func (u *tokenRepo) DeleteExpired(ctx context.Context, before time.Time) (int64, error) {
+	ctx, span := tracer.Start(ctx, "tokenRepo.DeleteExpired")
+	defer span.End()
+
+	l := logr.FromContext(ctx)
+
+	var deleted int64
+	for _, sqlStatement := range []string{
+		`DELETE FROM refresh_tokens WHERE expires_at < $1`,
+		`DELETE FROM denied_tokens WHERE expires_at < $1`,
+	} {
+		res, err := u.db.ExecContext(ctx, sqlStatement, before)
+		if err != nil {
+			l.Error("Error deleting expired tokens", zap.Error(err))
+			return 0, ErrInternalError
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			l.Error("Error deleting expired tokens", zap.Error(err))
+			return 0, ErrInternalError
+		}
+		deleted += n
+	}
+	return deleted, nil
+}
+
+// revokeFamily revokes every token of the family that is not revoked yet.
+func revokeFamily(ctx context.Context, tx *sql.Tx, familyID string, at time.Time) error {
+	revokeSQL := `UPDATE refresh_tokens SET revoked_at = $1 WHERE family_id = $2 AND revoked_at IS NULL`
+	_, err := tx.ExecContext(ctx, revokeSQL, at, familyID)
+	return err
+}
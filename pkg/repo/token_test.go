@@ -0,0 +1,170 @@
+package repo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
+)
+
+func Test_tokenRepo_RotateRefreshToken(t *testing.T) {
+	selectSQL := `SELECT token_id, family_id, user_id, expires_at, used_at, revoked_at
+FROM refresh_tokens WHERE token_hash = \$1 FOR UPDATE`
+	columns := []string{"token_id", "family_id", "user_id", "expires_at", "used_at", "revoked_at"}
+
+	now := time.Date(2022, time.July, 25, 9, 0, 0, 0, time.UTC)
+	next := models.RefreshToken{Hash: "next", CreatedAt: now, ExpiresAt: now.Add(24 * time.Hour)}
+
+	t.Run("unused token", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer db.Close()
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(selectSQL).WithArgs("current").
+			WillReturnRows(sqlmock.NewRows(columns).AddRow(1, "family", 3, now.Add(time.Hour), nil, nil))
+		mock.ExpectExec(`UPDATE refresh_tokens SET used_at = \$1 WHERE token_id = \$2`).WithArgs(now, 1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(`INSERT INTO refresh_tokens \(token_hash, family_id, user_id, created_at, expires_at\)`).
+			WithArgs("next", "family", 3, now, next.ExpiresAt).
+			WillReturnResult(sqlmock.NewResult(2, 1))
+		mock.ExpectCommit()
+
+		repo := newTokenRepo(db, newDevLogger(t))
+		stored, err := repo.RotateRefreshToken(context.Background(), "current", next)
+		require.NoError(t, err)
+		require.Equal(t, "family", stored.FamilyID)
+		require.Equal(t, 3, stored.UserID)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("reused token revokes the family", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer db.Close()
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(selectSQL).WithArgs("current").
+			WillReturnRows(sqlmock.NewRows(columns).AddRow(1, "family", 3, now.Add(time.Hour), now.Add(-time.Minute), nil))
+		mock.ExpectExec(`UPDATE refresh_tokens SET revoked_at = \$1 WHERE family_id = \$2 AND revoked_at IS NULL`).
+			WithArgs(now, "family").
+			WillReturnResult(sqlmock.NewResult(0, 2))
+		mock.ExpectCommit()
+
+		repo := newTokenRepo(db, newDevLogger(t))
+		reused, err := repo.RotateRefreshToken(context.Background(), "current", next)
+		require.ErrorIs(t, err, ErrRefreshTokenReused)
+		require.Equal(t, "family", reused.FamilyID)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	tests := []struct {
+		name string
+		rows *sqlmock.Rows
+	}{
+		{"unknown token", sqlmock.NewRows(columns)},
+		{"revoked token", sqlmock.NewRows(columns).AddRow(1, "family", 3, now.Add(time.Hour), now.Add(-time.Minute), now.Add(-time.Minute))},
+		{"expired token", sqlmock.NewRows(columns).AddRow(1, "family", 3, now, nil, nil)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			require.NoError(t, err)
+			defer db.Close()
+
+			mock.ExpectBegin()
+			mock.ExpectQuery(selectSQL).WithArgs("current").WillReturnRows(tt.rows)
+			mock.ExpectRollback()
+
+			repo := newTokenRepo(db, newDevLogger(t))
+			_, err = repo.RotateRefreshToken(context.Background(), "current", next)
+			require.ErrorIs(t, err, ErrRefreshTokenInvalid)
+			require.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func Test_tokenRepo_Sessions(t *testing.T) {
+	now := time.Date(2022, time.August, 1, 10, 0, 0, 0, time.UTC)
+
+	t.Run("list", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer db.Close()
+
+		mock.ExpectQuery(`SELECT family_id, MIN\(created_at\), MAX\(created_at\), MAX\(expires_at\)
+FROM refresh_tokens WHERE user_id = \$1`).WithArgs(3, now).
+			WillReturnRows(sqlmock.NewRows([]string{"family_id", "min", "max", "expires_at"}).
+				AddRow("family", now.Add(-time.Hour), now.Add(-time.Minute), now.Add(time.Hour)))
+
+		repo := newTokenRepo(db, newDevLogger(t))
+		sessions, err := repo.ListSessions(context.Background(), 3, now)
+		require.NoError(t, err)
+		require.Equal(t, []*models.Session{{
+			ID:         "family",
+			CreatedAt:  now.Add(-time.Hour),
+			LastUsedAt: now.Add(-time.Minute),
+			ExpiresAt:  now.Add(time.Hour),
+		}}, sessions)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	revokeSQL := `UPDATE refresh_tokens SET revoked_at = \$1
+WHERE family_id = \$2 AND user_id = \$3 AND revoked_at IS NULL`
+
+	t.Run("revoke", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer db.Close()
+
+		mock.ExpectExec(revokeSQL).WithArgs(now, "family", 3).WillReturnResult(sqlmock.NewResult(0, 2))
+
+		repo := newTokenRepo(db, newDevLogger(t))
+		require.NoError(t, repo.RevokeSession(context.Background(), 3, "family", now))
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("revoke foreign or revoked session", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer db.Close()
+
+		mock.ExpectExec(revokeSQL).WithArgs(now, "family", 4).WillReturnResult(sqlmock.NewResult(0, 0))
+
+		repo := newTokenRepo(db, newDevLogger(t))
+		require.ErrorIs(t, repo.RevokeSession(context.Background(), 4, "family", now), ErrSessionNotFound)
+		require.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+func Test_tokenRepo_DeniedTokens(t *testing.T) {
+	now := time.Date(2022, time.August, 1, 10, 0, 0, 0, time.UTC)
+
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	selectSQL := `SELECT expires_at FROM denied_tokens WHERE token_id = \$1`
+	mock.ExpectExec(`INSERT INTO denied_tokens \(token_id, expires_at\) VALUES \(\$1, \$2\)`).
+		WithArgs("jti", now).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(selectSQL).WithArgs("jti").
+		WillReturnRows(sqlmock.NewRows([]string{"expires_at"}).AddRow(now))
+	mock.ExpectQuery(selectSQL).WithArgs("other").
+		WillReturnRows(sqlmock.NewRows([]string{"expires_at"}))
+
+	repo := newTokenRepo(db, newDevLogger(t))
+	require.NoError(t, repo.DenyToken(context.Background(), "jti", now))
+
+	until, err := repo.DeniedUntil(context.Background(), "jti")
+	require.NoError(t, err)
+	require.Equal(t, now, until)
+
+	until, err = repo.DeniedUntil(context.Background(), "other")
+	require.NoError(t, err)
+	require.True(t, until.IsZero())
+	require.NoError(t, mock.ExpectationsWereMet())
+}
@@ -3,7 +3,6 @@ package repo
 import (
 	"context"
 	"database/sql"
-	"strings"
 	"time"
 
 	"go.uber.org/zap"
@@ -27,6 +26,9 @@ func newUserRepo(db *sql.DB, logger *zap.Logger) *userRepo {
 }
 
 func (u *userRepo) Create(ctx context.Context, username string, password string) (int, error) {
+	ctx, span := tracer.Start(ctx, "userRepo.Create")
+	defer span.End()
+
 	var err error
 	l := logr.FromContext(ctx)
 	defer func() {
@@ -51,8 +53,7 @@ func (u *userRepo) Create(ctx context.Context, username string, password string)
 	var id int
 	err = prepareContext.QueryRowContext(ctx, username, string(hash), now).Scan(&id)
 	if err != nil {
-		// duplicate key error
-		if strings.Contains(err.Error(), "SQLSTATE 23505") {
+		if isUniqueViolation(err) {
 			return -1, ErrUserAlreadyExists
 		}
 
@@ -62,6 +63,9 @@ func (u *userRepo) Create(ctx context.Context, username string, password string)
 }
 
 func (u *userRepo) Authenticate(ctx context.Context, username string, password string) (int, error) {
+	ctx, span := tracer.Start(ctx, "userRepo.Authenticate")
+	defer span.End()
+
 	var err error
 	l := logr.FromContext(ctx)
 	defer func() {
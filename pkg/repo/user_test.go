@@ -2,10 +2,12 @@ package repo
 
 import (
 	"context"
-	"errors"
+	"fmt"
 	"testing"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgerrcode"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
@@ -69,7 +71,7 @@ func TestCreateUser(t *testing.T) {
 				WithArgs(tt.args.username, sqlmock.AnyArg(), sqlmock.AnyArg())
 
 			if tt.wantErr {
-				q.WillReturnError(errors.New("SQLSTATE 23505"))
+				q.WillReturnError(fmt.Errorf("insert user: %w", &pgconn.PgError{Code: pgerrcode.UniqueViolation}))
 				//q.WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow())
 			} else {
 				q.WillReturnError(nil)
@@ -0,0 +1,273 @@
+package repo
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	logr "github.com/OmAsana/go-yapraktikum-final/pkg/logger"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
+)
+
+var _ WebhookRepository = (*webhookRepo)(nil)
+
+type webhookRepo struct {
+	db  *sql.DB
+	log *zap.Logger
+}
+
+func newWebhookRepo(db *sql.DB, logger *zap.Logger) *webhookRepo {
+	if logger == nil {
+		logger = logr.NewNoop()
+	}
+	return &webhookRepo{db: db, log: logger}
+}
+
+// enqueueWebhookEvent queues the event for every webhook of the user
+// subscribed to it. It runs in the transaction changing the data so an
+// event is stored if and only if the change is.
+func enqueueWebhookEvent(ctx context.Context, tx *sql.Tx, userID int, event models.WebhookEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	sqlStatement := `INSERT INTO webhook_deliveries (webhook_id, event_type, payload, status, next_attempt_at, created_at)
+SELECT webhook_id, $2, $3, $4, $5, $5 FROM webhooks
+WHERE user_id = $1 AND (event_types = '' OR $2 = ANY(string_to_array(event_types, ',')))`
+	_, err = tx.ExecContext(ctx, sqlStatement, userID, event.Type, string(payload), models.DeliveryPending, event.CreatedAt)
+	return err
+}
+
+func joinEventTypes(types []models.WebhookEventType) string {
+	s := make([]string, 0, len(types))
+	for _, t := range types {
+		s = append(s, string(t))
+	}
+	return strings.Join(s, ",")
+}
+
+func splitEventTypes(s string) []models.WebhookEventType {
+	if s == "" {
+		return nil
+	}
+	var types []models.WebhookEventType
+	for _, t := range strings.Split(s, ",") {
+		types = append(types, models.WebhookEventType(t))
+	}
+	return types
+}
+
+func (u *webhookRepo) CreateWebhook(ctx context.Context, webhook models.Webhook) (models.Webhook, error) {
+	l := logr.FromContext(ctx)
+
+	sqlStatement := `INSERT INTO webhooks (user_id, url, secret, event_types, created_at) VALUES ($1, $2, $3, $4, $5) RETURNING webhook_id`
+	err := u.db.QueryRowContext(ctx, sqlStatement,
+		webhook.UserID,
+		webhook.URL,
+		webhook.Secret,
+		joinEventTypes(webhook.EventTypes),
+		webhook.CreatedAt).Scan(&webhook.ID)
+	if err != nil {
+		l.Error("Error creating webhook", zap.Error(err))
+		return models.Webhook{}, ErrInternalError
+	}
+	return webhook, nil
+}
+
+func (u *webhookRepo) ListWebhooks(ctx context.Context, userID int) ([]*models.Webhook, error) {
+	l := logr.FromContext(ctx)
+
+	sqlStatement := `SELECT webhook_id, user_id, url, event_types, created_at
+FROM webhooks
+WHERE user_id = $1
+ORDER BY webhook_id`
+	rows, err := u.db.QueryContext(ctx, sqlStatement, userID)
+	if err != nil {
+		l.Error("Error querying webhooks", zap.Error(err))
+		return nil, ErrInternalError
+	}
+	defer rows.Close()
+
+	var webhooks []*models.Webhook
+	for rows.Next() {
+		var webhook models.Webhook
+		var types string
+		if err := rows.Scan(&webhook.ID, &webhook.UserID, &webhook.URL, &types, &webhook.CreatedAt); err != nil {
+			l.Error("Error scanning webhook", zap.Error(err))
+			return nil, ErrInternalError
+		}
+		webhook.EventTypes = splitEventTypes(types)
+		webhooks = append(webhooks, &webhook)
+	}
+
+	if err := rows.Err(); err != nil {
+		l.Error("Error querying webhooks", zap.Error(err))
+		return nil, ErrInternalError
+	}
+	return webhooks, nil
+}
+
+func (u *webhookRepo) DeleteWebhook(ctx context.Context, userID int, webhookID int) error {
+	l := logr.FromContext(ctx)
+
+	sqlStatement := `DELETE FROM webhooks WHERE webhook_id = $1 AND user_id = $2`
+	res, err := u.db.ExecContext(ctx, sqlStatement, webhookID, userID)
+	if err != nil {
+		l.Error("Error deleting webhook", zap.Error(err))
+		return ErrInternalError
+	}
+
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		l.Error("Error deleting webhook", zap.Error(err))
+		return ErrInternalError
+	}
+	if deleted == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// ListDeliveries returns up to limit latest deliveries of the user webhook.
+func (u *webhookRepo) ListDeliveries(ctx context.Context, userID int, webhookID int, limit int) ([]*models.WebhookDelivery, error) {
+	l := logr.FromContext(ctx)
+
+	var owner int
+	err := u.db.QueryRowContext(ctx, `SELECT user_id FROM webhooks WHERE webhook_id = $1`, webhookID).Scan(&owner)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, ErrWebhookNotFound
+	case err != nil:
+		l.Error("Error querying webhook", zap.Error(err))
+		return nil, ErrInternalError
+	case owner != userID:
+		return nil, ErrWebhookNotFound
+	}
+
+	sqlStatement := `SELECT delivery_id, webhook_id, event_type, payload, status, attempts, next_attempt_at,
+       last_status_code, last_error, created_at, delivered_at
+FROM webhook_deliveries
+WHERE webhook_id = $1
+ORDER BY delivery_id DESC LIMIT $2`
+	rows, err := u.db.QueryContext(ctx, sqlStatement, webhookID, limit)
+	if err != nil {
+		l.Error("Error querying webhook deliveries", zap.Error(err))
+		return nil, ErrInternalError
+	}
+	defer rows.Close()
+
+	var deliveries []*models.WebhookDelivery
+	for rows.Next() {
+		var d models.WebhookDelivery
+		var payload string
+		var statusCode sql.NullInt64
+		var lastError sql.NullString
+		var deliveredAt sql.NullTime
+		err := rows.Scan(
+			&d.ID,
+			&d.WebhookID,
+			&d.EventType,
+			&payload,
+			&d.Status,
+			&d.Attempts,
+			&d.NextAttemptAt,
+			&statusCode,
+			&lastError,
+			&d.CreatedAt,
+			&deliveredAt,
+		)
+		if err != nil {
+			l.Error("Error scanning webhook delivery", zap.Error(err))
+			return nil, ErrInternalError
+		}
+		d.Payload = []byte(payload)
+		d.LastStatusCode = int(statusCode.Int64)
+		d.LastError = lastError.String
+		if deliveredAt.Valid {
+			d.DeliveredAt = deliveredAt.Time
+		}
+		deliveries = append(deliveries, &d)
+	}
+
+	if err := rows.Err(); err != nil {
+		l.Error("Error querying webhook deliveries", zap.Error(err))
+		return nil, ErrInternalError
+	}
+	return deliveries, nil
+}
+
+// ClaimDueDeliveries picks up to limit pending deliveries due at now and
+// postpones them until leaseUntil, so other instances skip them while they
+// are being sent.
+func (u *webhookRepo) ClaimDueDeliveries(ctx context.Context, now time.Time, limit int, leaseUntil time.Time) ([]*models.WebhookDelivery, error) {
+	l := logr.FromContext(ctx)
+
+	sqlStatement := `WITH due AS (
+    SELECT delivery_id FROM webhook_deliveries
+    WHERE status = $1 AND next_attempt_at <= $2
+    ORDER BY next_attempt_at
+    LIMIT $3
+    FOR UPDATE SKIP LOCKED
+)
+UPDATE webhook_deliveries d SET next_attempt_at = $4
+FROM due, webhooks w
+WHERE d.delivery_id = due.delivery_id AND w.webhook_id = d.webhook_id
+RETURNING d.delivery_id, d.webhook_id, d.event_type, d.payload, d.attempts, d.created_at, w.url, w.secret`
+	rows, err := u.db.QueryContext(ctx, sqlStatement, models.DeliveryPending, now, limit, leaseUntil)
+	if err != nil {
+		l.Error("Error claiming webhook deliveries", zap.Error(err))
+		return nil, ErrInternalError
+	}
+	defer rows.Close()
+
+	var deliveries []*models.WebhookDelivery
+	for rows.Next() {
+		d := models.WebhookDelivery{Status: models.DeliveryPending, NextAttemptAt: leaseUntil}
+		var payload string
+		err := rows.Scan(&d.ID, &d.WebhookID, &d.EventType, &payload, &d.Attempts, &d.CreatedAt, &d.URL, &d.Secret)
+		if err != nil {
+			l.Error("Error scanning webhook delivery", zap.Error(err))
+			return nil, ErrInternalError
+		}
+		d.Payload = []byte(payload)
+		deliveries = append(deliveries, &d)
+	}
+
+	if err := rows.Err(); err != nil {
+		l.Error("Error claiming webhook deliveries", zap.Error(err))
+		return nil, ErrInternalError
+	}
+	return deliveries, nil
+}
+
+// SaveAttempt stores the outcome of a delivery attempt.
+func (u *webhookRepo) SaveAttempt(ctx context.Context, d models.WebhookDelivery) error {
+	l := logr.FromContext(ctx)
+
+	var deliveredAt sql.NullTime
+	if !d.DeliveredAt.IsZero() {
+		deliveredAt = sql.NullTime{Time: d.DeliveredAt, Valid: true}
+	}
+
+	sqlStatement := `UPDATE webhook_deliveries
+SET status = $1, attempts = $2, next_attempt_at = $3, last_status_code = $4, last_error = $5, delivered_at = $6
+WHERE delivery_id = $7`
+	_, err := u.db.ExecContext(ctx, sqlStatement,
+		d.Status,
+		d.Attempts,
+		d.NextAttemptAt,
+		d.LastStatusCode,
+		d.LastError,
+		deliveredAt,
+		d.ID)
+	if err != nil {
+		l.Error("Error saving webhook delivery attempt", zap.Error(err))
+		return ErrInternalError
+	}
+	return nil
+}
@@ -0,0 +1,349 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/ldez/mimetype"
+	"github.com/shopspring/decimal"
+	"go.uber.org/zap"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/controllers"
+	logger2 "github.com/OmAsana/go-yapraktikum-final/pkg/logger"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/problem"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/repo"
+)
+
+const (
+	defaultUserSearchLimit = 20
+	maxUserSearchLimit     = 100
+)
+
+// routeAdmin mounts the support staff API. Responses use the /api/v2
+// conventions: envelopes and amounts as decimal strings.
+func (s *Server) routeAdmin(r chi.Router) {
+	r.Use(s.jwtAuth.Middleware(s.authTransports.Admin))
+	r.Use(s.limitByUser)
+	r.Use(s.requireAdmin)
+
+	r.Get("/users", s.adminSearchUsers)
+	r.Route("/users/{userID}", func(r chi.Router) {
+		r.Get("/", s.adminGetUser)
+		r.Get("/orders", s.adminListOrders)
+		r.Get("/withdrawals", s.adminListWithdrawals)
+		r.Get("/balance", s.adminBalance)
+		r.Get("/adjustments", s.adminListAdjustments)
+		r.With(withContentType(mimetype.ApplicationJSON)).Post("/adjustments", s.adminAdjustBalance)
+	})
+	r.With(withContentType(mimetype.ApplicationJSON)).Post("/orders/{number}/status", s.adminSetOrderStatus)
+}
+
+// requireAdmin checks the role on every request, so revoking it takes
+// effect without waiting for the token to expire.
+func (s *Server) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log := logger2.FromContext(r.Context())
+		userID, err := controllers.UserIDFromContext(r.Context())
+		if err != nil {
+			log.Error("admin", zap.Error(err))
+			problem.WriteError(w, r, err)
+			return
+		}
+
+		isAdmin, err := s.adminRepo.IsAdmin(r.Context(), userID)
+		if err != nil {
+			problem.WriteError(w, r, err)
+			return
+		}
+		if !isAdmin {
+			log.Info("Admin API called by a regular user", zap.Int("user", userID))
+			problem.Write(w, r, http.StatusForbidden, problem.CodeForbidden, "")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) adminSearchUsers(w http.ResponseWriter, r *http.Request) {
+	log := logger2.FromContext(r.Context())
+
+	limit := defaultUserSearchLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxUserSearchLimit {
+			problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidQuery,
+				"limit must be between 1 and "+strconv.Itoa(maxUserSearchLimit))
+			return
+		}
+	}
+
+	users, err := s.adminRepo.SearchUsers(r.Context(), r.URL.Query().Get("login"), limit)
+	if err != nil {
+		log.Error("Could not search users", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	res := make([]controllers.AdminUser, 0, len(users))
+	for _, v := range users {
+		res = append(res, controllers.UserModelToAdmin(*v))
+	}
+	writeEnvelope(w, r, http.StatusOK, res, nil)
+}
+
+// adminUser loads the user from the URL and writes a problem if there is
+// no such user.
+func (s *Server) adminUser(w http.ResponseWriter, r *http.Request) (models.User, bool) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeUserNotFound, "")
+		return models.User{}, false
+	}
+
+	user, err := s.adminRepo.GetUser(r.Context(), userID)
+	switch {
+	case errors.Is(err, repo.ErrUserNotFound):
+		problem.Write(w, r, http.StatusNotFound, problem.CodeUserNotFound, "")
+		return models.User{}, false
+	case err != nil:
+		logger2.FromContext(r.Context()).Error("Could not get user", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return models.User{}, false
+	}
+	return user, true
+}
+
+func (s *Server) adminGetUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.adminUser(w, r)
+	if !ok {
+		return
+	}
+	writeEnvelope(w, r, http.StatusOK, controllers.UserModelToAdmin(user), nil)
+}
+
+func (s *Server) adminListOrders(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.adminUser(w, r)
+	if !ok {
+		return
+	}
+
+	orders, err := s.orderRepo.ListOrders(r.Context(), user.UserID)
+	if err != nil {
+		logger2.FromContext(r.Context()).Error("Could not retrieve orders", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	sort.Slice(orders, func(i, j int) bool {
+		return orders[i].UploadedAt.Before(orders[j].UploadedAt)
+	})
+
+	res := make([]controllers.OrderV2, 0, len(orders))
+	for _, v := range orders {
+		res = append(res, controllers.OrderModelToV2(*v))
+	}
+	writeEnvelope(w, r, http.StatusOK, res, nil)
+}
+
+func (s *Server) adminListWithdrawals(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.adminUser(w, r)
+	if !ok {
+		return
+	}
+
+	withdrawals, err := s.orderRepo.ListWithdrawals(r.Context(), user.UserID)
+	if err != nil {
+		logger2.FromContext(r.Context()).Error("Could not retrieve withdrawals", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	sort.Slice(withdrawals, func(i, j int) bool {
+		return withdrawals[i].ProcessedAt.After(withdrawals[j].ProcessedAt)
+	})
+
+	res := make([]controllers.WithdrawalV2, 0, len(withdrawals))
+	for _, v := range withdrawals {
+		res = append(res, controllers.WithdrawalModelToV2(*v))
+	}
+	writeEnvelope(w, r, http.StatusOK, res, nil)
+}
+
+func (s *Server) adminBalance(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.adminUser(w, r)
+	if !ok {
+		return
+	}
+
+	balance, err := s.orderRepo.CurrentBalance(r.Context(), user.UserID)
+	if err != nil {
+		logger2.FromContext(r.Context()).Error("Could not get balance", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+	writeEnvelope(w, r, http.StatusOK, controllers.BalanceModelToV2(balance), nil)
+}
+
+func (s *Server) adminListAdjustments(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.adminUser(w, r)
+	if !ok {
+		return
+	}
+
+	adjustments, err := s.adminRepo.ListAdjustments(r.Context(), user.UserID)
+	if err != nil {
+		logger2.FromContext(r.Context()).Error("Could not retrieve balance adjustments", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	res := make([]controllers.BalanceAdjustment, 0, len(adjustments))
+	for _, v := range adjustments {
+		res = append(res, controllers.BalanceAdjustmentModelToController(*v))
+	}
+	writeEnvelope(w, r, http.StatusOK, res, nil)
+}
+
+func (s *Server) adminAdjustBalance(w http.ResponseWriter, r *http.Request) {
+	log := logger2.FromContext(r.Context())
+	adminID, err := controllers.UserIDFromContext(r.Context())
+	if err != nil {
+		log.Error("admin", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	user, ok := s.adminUser(w, r)
+	if !ok {
+		return
+	}
+
+	var req controllers.BalanceAdjustmentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Info("Error decoding balance adjustment", zap.Error(err))
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeMalformedRequest, "could not decode balance adjustment")
+		return
+	}
+
+	amount, err := decimal.NewFromString(req.Amount)
+	if err != nil || amount.IsZero() || !amount.Equal(amount.Truncate(controllers.AmountPlaces)) {
+		problem.Write(w, r, http.StatusUnprocessableEntity, problem.CodeInvalidAmount,
+			"amount must be a non-zero decimal with at most "+strconv.Itoa(controllers.AmountPlaces)+" fraction digits")
+		return
+	}
+	reason := strings.TrimSpace(req.Reason)
+	if reason == "" {
+		problem.Write(w, r, http.StatusUnprocessableEntity, problem.CodeReasonRequired, "")
+		return
+	}
+
+	adjustment, err := s.adminRepo.AdjustBalance(r.Context(), models.BalanceAdjustment{
+		UserID:  user.UserID,
+		AdminID: adminID,
+		Amount:  amount,
+		Reason:  reason,
+	})
+	if err != nil {
+		log.Error("Could not adjust balance", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	log.Info("Balance adjusted",
+		zap.Int("admin", adminID),
+		zap.Int("user", user.UserID),
+		zap.String("amount", amount.String()),
+		zap.String("reason", reason))
+	writeEnvelope(w, r, http.StatusCreated, controllers.BalanceAdjustmentModelToController(adjustment), nil)
+}
+
+// adminSetOrderStatus overrides the status the accrual system gave to a
+// deposit. Orders set back to NEW or PROCESSING are polled again.
+func (s *Server) adminSetOrderStatus(w http.ResponseWriter, r *http.Request) {
+	log := logger2.FromContext(r.Context())
+	adminID, err := controllers.UserIDFromContext(r.Context())
+	if err != nil {
+		log.Error("admin", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	orderID, err := strconv.Atoi(chi.URLParam(r, "number"))
+	if err != nil {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeOrderNotFound, "")
+		return
+	}
+
+	var req controllers.OrderStatusRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Info("Error decoding order status", zap.Error(err))
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeMalformedRequest, "could not decode order status")
+		return
+	}
+
+	status := models.OrderStatus(strings.ToUpper(string(req.Status)))
+	if !status.Known() {
+		problem.Write(w, r, http.StatusUnprocessableEntity, problem.CodeInvalidOrderStatus, "unknown order status")
+		return
+	}
+
+	accrual := decimal.Zero
+	if req.Accrual != "" {
+		if status != models.ProcessedStatus {
+			problem.Write(w, r, http.StatusUnprocessableEntity, problem.CodeInvalidAmount, "accrual can only be set on processed orders")
+			return
+		}
+		accrual, err = decimal.NewFromString(req.Accrual)
+		if err != nil || accrual.IsNegative() || !accrual.Equal(accrual.Truncate(controllers.AmountPlaces)) {
+			problem.Write(w, r, http.StatusUnprocessableEntity, problem.CodeInvalidAmount,
+				"accrual must be a non-negative decimal with at most "+strconv.Itoa(controllers.AmountPlaces)+" fraction digits")
+			return
+		}
+	}
+
+	reason := strings.TrimSpace(req.Reason)
+	if reason == "" {
+		problem.Write(w, r, http.StatusUnprocessableEntity, problem.CodeReasonRequired, "")
+		return
+	}
+
+	order, err := s.orderRepo.GetOrder(r.Context(), orderID)
+	if err != nil {
+		log.Info("Could not get order", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+	if order.TXType != models.DepositOrder {
+		problem.Write(w, r, http.StatusUnprocessableEntity, problem.CodeInvalidOrderStatus, "only the status of deposits can be changed")
+		return
+	}
+
+	previous := order.Status
+	order.Status = status
+	order.Accrual = accrual
+	order.ProcessedAt = time.Now()
+	if err := s.orderRepo.ForceOrderStatus(r.Context(), order, adminID, reason); err != nil {
+		log.Error("Could not update order", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+	if s.broker != nil {
+		s.broker.Notify(order.UserID)
+	}
+
+	log.Info("Order status forced",
+		zap.Int("admin", adminID),
+		zap.Int("order", order.OrderID),
+		zap.String("from", string(previous)),
+		zap.String("to", string(status)),
+		zap.String("accrual", accrual.String()),
+		zap.String("reason", reason))
+	writeEnvelope(w, r, http.StatusOK, controllers.OrderModelToV2(order), nil)
+}
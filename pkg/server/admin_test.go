@@ -0,0 +1,224 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-http-utils/headers"
+	"github.com/ldez/mimetype"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/controllers"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/logger"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/problem"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/repo"
+)
+
+const testAdminID = 100
+
+type fakeAdminRepo struct {
+	repo.AdminRepository
+	users       map[int]models.User
+	adjustments []models.BalanceAdjustment
+}
+
+func (f *fakeAdminRepo) IsAdmin(_ context.Context, userID int) (bool, error) {
+	return f.users[userID].IsAdmin, nil
+}
+
+func (f *fakeAdminRepo) SearchUsers(_ context.Context, query string, limit int) ([]*models.User, error) {
+	var res []*models.User
+	for _, u := range f.users {
+		u := u
+		if strings.Contains(strings.ToLower(u.Login), strings.ToLower(query)) && len(res) < limit {
+			res = append(res, &u)
+		}
+	}
+	return res, nil
+}
+
+func (f *fakeAdminRepo) GetUser(_ context.Context, userID int) (models.User, error) {
+	u, ok := f.users[userID]
+	if !ok {
+		return models.User{}, repo.ErrUserNotFound
+	}
+	return u, nil
+}
+
+func (f *fakeAdminRepo) AdjustBalance(_ context.Context, adjustment models.BalanceAdjustment) (models.BalanceAdjustment, error) {
+	adjustment.ID = int64(len(f.adjustments) + 1)
+	adjustment.CreatedAt = time.Now()
+	f.adjustments = append(f.adjustments, adjustment)
+	return adjustment, nil
+}
+
+func newAdminTestServer(orderRepo repo.OrderRepository) (*Server, *fakeAdminRepo) {
+	createdAt := time.Date(2022, time.July, 1, 10, 0, 0, 0, time.UTC)
+	adminRepo := &fakeAdminRepo{users: map[int]models.User{
+		1:           {UserID: 1, Login: "customer", CreatedAt: createdAt},
+		testAdminID: {UserID: testAdminID, Login: "support", IsAdmin: true, CreatedAt: createdAt},
+	}}
+	return NewServer(logger.NewNoop(), nil, orderRepo, testSalt, WithAdmin(adminRepo), WithPublicInternalRoutes()), adminRepo
+}
+
+func TestServer_adminRequiresRole(t *testing.T) {
+	srv, _ := newAdminTestServer(&fakeOrderRepo{})
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, authenticatedRequest(t, srv, http.MethodGet, "/api/admin/users", 1))
+	require.Equal(t, http.StatusForbidden, rec.Code)
+
+	var p problem.Problem
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&p))
+	require.Equal(t, problem.CodeForbidden, p.Code)
+
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/admin/users", nil))
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestServer_adminSearchUsers(t *testing.T) {
+	srv, _ := newAdminTestServer(&fakeOrderRepo{})
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, authenticatedRequest(t, srv, http.MethodGet, "/api/admin/users?login=CUST", testAdminID))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var got struct {
+		Data []controllers.AdminUser `json:"data"`
+	}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&got))
+	require.Equal(t, []controllers.AdminUser{{ID: 1, Login: "customer", CreatedAt: "2022-07-01T10:00:00Z"}}, got.Data)
+
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, authenticatedRequest(t, srv, http.MethodGet, "/api/admin/users?limit=1000", testAdminID))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, authenticatedRequest(t, srv, http.MethodGet, "/api/admin/users/42", testAdminID))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestServer_adminAdjustBalance(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		wantCode int
+		problem  problem.Code
+	}{
+		{"credit", `{"amount":"25.50","reason":"compensation"}`, http.StatusCreated, ""},
+		{"debit", `{"amount":"-10","reason":"duplicate accrual"}`, http.StatusCreated, ""},
+		{"zero amount", `{"amount":"0","reason":"nothing"}`, http.StatusUnprocessableEntity, problem.CodeInvalidAmount},
+		{"too precise", `{"amount":"1.005","reason":"rounding"}`, http.StatusUnprocessableEntity, problem.CodeInvalidAmount},
+		{"missing reason", `{"amount":"5","reason":"  "}`, http.StatusUnprocessableEntity, problem.CodeReasonRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, adminRepo := newAdminTestServer(&fakeOrderRepo{})
+
+			req := authenticatedRequestWithBody(t, srv, http.MethodPost, "/api/admin/users/1/adjustments", testAdminID, strings.NewReader(tt.body))
+			req.Header.Set(headers.ContentType, mimetype.ApplicationJSON)
+			rec := httptest.NewRecorder()
+			srv.ServeHTTP(rec, req)
+			require.Equal(t, tt.wantCode, rec.Code)
+
+			if tt.problem != "" {
+				var p problem.Problem
+				require.NoError(t, json.NewDecoder(rec.Body).Decode(&p))
+				require.Equal(t, tt.problem, p.Code)
+				require.Empty(t, adminRepo.adjustments)
+				return
+			}
+			require.Len(t, adminRepo.adjustments, 1)
+			require.Equal(t, 1, adminRepo.adjustments[0].UserID)
+			require.Equal(t, testAdminID, adminRepo.adjustments[0].AdminID)
+		})
+	}
+}
+
+func TestServer_adminSetOrderStatus(t *testing.T) {
+	uploadedAt := time.Date(2022, time.July, 1, 10, 0, 0, 0, time.UTC)
+	newOrderRepo := func() *fakeOrderRepo {
+		return &fakeOrderRepo{orders: map[int][]*models.Order{
+			1: {
+				{OrderID: 79927398713, UserID: 1, Status: models.InvalidStatus, TXType: models.DepositOrder, UploadedAt: uploadedAt},
+				{OrderID: 2377225624, UserID: 1, Status: models.ProcessedStatus, TXType: models.WithdrawalOrder, UploadedAt: uploadedAt},
+			},
+		}}
+	}
+
+	tests := []struct {
+		name     string
+		number   string
+		body     string
+		wantCode int
+	}{
+		{"processed with accrual", "79927398713", `{"status":"PROCESSED","accrual":"120.50","reason":"accrual system outage"}`, http.StatusOK},
+		{"back to polling", "79927398713", `{"status":"new","reason":"retry"}`, http.StatusOK},
+		{"accrual on invalid", "79927398713", `{"status":"INVALID","accrual":"1","reason":"oops"}`, http.StatusUnprocessableEntity},
+		{"unknown status", "79927398713", `{"status":"DONE","reason":"oops"}`, http.StatusUnprocessableEntity},
+		{"missing reason", "79927398713", `{"status":"PROCESSED"}`, http.StatusUnprocessableEntity},
+		{"withdrawal", "2377225624", `{"status":"NEW","reason":"oops"}`, http.StatusUnprocessableEntity},
+		{"unknown order", "12345678903", `{"status":"NEW","reason":"oops"}`, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orderRepo := newOrderRepo()
+			srv, _ := newAdminTestServer(orderRepo)
+
+			req := authenticatedRequestWithBody(t, srv, http.MethodPost, "/api/admin/orders/"+tt.number+"/status", testAdminID, strings.NewReader(tt.body))
+			req.Header.Set(headers.ContentType, mimetype.ApplicationJSON)
+			rec := httptest.NewRecorder()
+			srv.ServeHTTP(rec, req)
+			require.Equal(t, tt.wantCode, rec.Code, rec.Body.String())
+
+			if tt.wantCode != http.StatusOK {
+				require.Equal(t, models.InvalidStatus, orderRepo.orders[1][0].Status)
+				require.Empty(t, orderRepo.history)
+				return
+			}
+			history := orderRepo.history[79927398713]
+			require.Len(t, history, 1)
+			require.Equal(t, testAdminID, history[0].AdminID)
+			require.NotEmpty(t, history[0].Reason)
+			var got struct {
+				Data controllers.OrderV2 `json:"data"`
+			}
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&got))
+			require.Equal(t, orderRepo.orders[1][0].Status, got.Data.Status)
+			if tt.name == "processed with accrual" {
+				require.True(t, decimal.RequireFromString("120.50").Equal(orderRepo.orders[1][0].Accrual))
+			}
+		})
+	}
+}
+
+func TestServer_adminOnInternalListener(t *testing.T) {
+	adminRepo := &fakeAdminRepo{users: map[int]models.User{
+		testAdminID: {UserID: testAdminID, Login: "support", IsAdmin: true},
+	}}
+	srv := NewServer(logger.NewNoop(), nil, &fakeOrderRepo{}, testSalt, WithAdmin(adminRepo), WithInternalListener())
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, authenticatedRequest(t, srv, http.MethodGet, "/api/admin/users", testAdminID))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = httptest.NewRecorder()
+	srv.Internal().ServeHTTP(rec, authenticatedRequest(t, srv, http.MethodGet, "/api/admin/users", testAdminID))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	srv.Internal().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	srv.Internal().ServeHTTP(rec, authenticatedRequest(t, srv, http.MethodGet, "/api/user/balance", 1))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -0,0 +1,268 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-http-utils/headers"
+	"github.com/ldez/mimetype"
+	"go.uber.org/zap"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/controllers"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/jwt"
+	logger2 "github.com/OmAsana/go-yapraktikum-final/pkg/logger"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/problem"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/repo"
+)
+
+// startSession issues a token for userID and sends it both as the cookie
+// and in the Authorization header, so cookie and bearer clients can share
+// the same login. With refresh tokens enabled it also starts a new refresh
+// token family.
+func (s *Server) startSession(ctx context.Context, w http.ResponseWriter, userID int) (controllers.Session, error) {
+	if s.tokenRepo == nil {
+		return s.issueAccessToken(w, userID, "")
+	}
+
+	familyID, err := jwt.NewFamilyID()
+	if err != nil {
+		return controllers.Session{}, err
+	}
+	session, err := s.issueAccessToken(w, userID, familyID)
+	if err != nil {
+		return controllers.Session{}, err
+	}
+	refresh, token, err := s.newRefreshToken()
+	if err != nil {
+		return controllers.Session{}, err
+	}
+	refresh.FamilyID = familyID
+	refresh.UserID = userID
+	if err := s.tokenRepo.CreateRefreshToken(ctx, refresh); err != nil {
+		return controllers.Session{}, err
+	}
+
+	setRefreshToken(w, &session, token, refresh.ExpiresAt)
+	return session, nil
+}
+
+func (s *Server) issueAccessToken(w http.ResponseWriter, userID int, sessionID string) (controllers.Session, error) {
+	token, expiresAt, err := s.jwtAuth.CreateSessionToken(userID, sessionID)
+	if err != nil {
+		return controllers.Session{}, err
+	}
+	http.SetCookie(w, jwt.Cookie(token, expiresAt))
+	w.Header().Set(headers.Authorization, jwt.BearerHeader(token))
+	return controllers.NewSession(token, expiresAt), nil
+}
+
+// newRefreshToken returns a refresh token to store and the token itself,
+// which is only ever given to the client.
+func (s *Server) newRefreshToken() (models.RefreshToken, string, error) {
+	token, err := jwt.NewRefreshToken()
+	if err != nil {
+		return models.RefreshToken{}, "", err
+	}
+	now := time.Now()
+	return models.RefreshToken{
+		Hash:      jwt.HashRefreshToken(token),
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.refreshTTL),
+	}, token, nil
+}
+
+func setRefreshToken(w http.ResponseWriter, session *controllers.Session, token string, expiresAt time.Time) {
+	http.SetCookie(w, jwt.RefreshCookie(token, expiresAt))
+	session.RefreshToken = token
+	session.RefreshExpiresAt = expiresAt.UTC().Format(time.RFC3339)
+}
+
+// refreshToken exchanges a refresh token for a new access token and the
+// next refresh token. The token is read from the body and, when the body is
+// empty, from the refresh token cookie.
+func (s *Server) refreshToken(w http.ResponseWriter, r *http.Request) {
+	log := logger2.FromContext(r.Context())
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Error("Error reading body", zap.Error(err))
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeMalformedRequest, "could not read request body")
+		return
+	}
+
+	var req controllers.RefreshRequest
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			log.Info("Error decoding refresh request", zap.Error(err))
+			problem.Write(w, r, http.StatusBadRequest, problem.CodeMalformedRequest, "could not decode refresh request")
+			return
+		}
+	} else {
+		req.RefreshToken = jwt.RefreshTokenFromCookie(r)
+	}
+	if req.RefreshToken == "" {
+		problem.Write(w, r, http.StatusUnauthorized, problem.CodeUnauthorized, "refresh token is required")
+		return
+	}
+
+	next, token, err := s.newRefreshToken()
+	if err != nil {
+		log.Error("Could not create refresh token", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+	rotated, err := s.tokenRepo.RotateRefreshToken(r.Context(), jwt.HashRefreshToken(req.RefreshToken), next)
+	if err != nil {
+		log.Info("Could not rotate refresh token", zap.Error(err))
+		if errors.Is(err, repo.ErrRefreshTokenReused) {
+			s.revokeReusedSession(r.Context(), log, rotated.FamilyID)
+		}
+		problem.WriteError(w, r, err)
+		return
+	}
+	next = rotated
+
+	session, err := s.issueAccessToken(w, next.UserID, next.FamilyID)
+	if err != nil {
+		log.Error("could not create jwt claim", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+	setRefreshToken(w, &session, token, next.ExpiresAt)
+
+	w.Header().Set(headers.ContentType, mimetype.ApplicationJSON)
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(session); err != nil {
+		log.Error("Error encoding session", zap.Error(err))
+	}
+}
+
+// revokeReusedSession denylists a session whose refresh token leaked.
+// Its refresh tokens are already revoked, but access tokens issued to
+// whoever used the leaked token would work until they expire.
+func (s *Server) revokeReusedSession(ctx context.Context, log *zap.Logger, familyID string) {
+	if s.denylist == nil || familyID == "" {
+		return
+	}
+	if err := s.denylist.Revoke(ctx, familyID, time.Now().Add(s.accessTokenTTL)); err != nil {
+		log.Error("Could not revoke session of reused refresh token", zap.Error(err))
+	}
+}
+
+// logout revokes the token the request was made with and, for tokens
+// issued with a refresh token, the refresh tokens of its session.
+func (s *Server) logout(w http.ResponseWriter, r *http.Request) {
+	log := logger2.FromContext(r.Context())
+	claims, ok := jwt.ClaimsFromContext(r.Context())
+	if !ok {
+		log.Error("logout", zap.String("err", "no token claims in context"))
+		problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternalError, "")
+		return
+	}
+
+	// tokens issued before token ids were introduced expire on their own
+	if claims.Id != "" {
+		if err := s.denylist.Revoke(r.Context(), claims.Id, claims.Expires()); err != nil {
+			log.Error("Could not revoke token", zap.Error(err))
+			problem.WriteError(w, r, err)
+			return
+		}
+	}
+	if claims.SessionID != "" && s.tokenRepo != nil {
+		err := s.tokenRepo.RevokeSession(r.Context(), claims.UserID, claims.SessionID, time.Now())
+		if err != nil && !errors.Is(err, repo.ErrSessionNotFound) {
+			log.Error("Could not revoke session", zap.Error(err))
+			problem.WriteError(w, r, err)
+			return
+		}
+	}
+
+	jwt.ClearCookies(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listSessions(w http.ResponseWriter, r *http.Request) {
+	log := logger2.FromContext(r.Context())
+	userID, err := controllers.UserIDFromContext(r.Context())
+	if err != nil {
+		log.Error("sessions", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	sessions, err := s.tokenRepo.ListSessions(r.Context(), userID, time.Now())
+	if err != nil {
+		log.Error("Could not retrieve sessions", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+	if len(sessions) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var current string
+	if claims, ok := jwt.ClaimsFromContext(r.Context()); ok {
+		current = claims.SessionID
+	}
+	resp := make([]controllers.UserSession, 0, len(sessions))
+	for _, v := range sessions {
+		resp = append(resp, controllers.SessionModelToController(*v, current))
+	}
+
+	w.Header().Set(headers.ContentType, mimetype.ApplicationJSON)
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Error("Error encoding sessions", zap.Error(err))
+	}
+}
+
+// revokeSession signs a session of the user out. Its refresh tokens are
+// revoked and the session is denylisted for as long as access tokens
+// issued for it may still be valid.
+func (s *Server) revokeSession(w http.ResponseWriter, r *http.Request) {
+	log := logger2.FromContext(r.Context())
+	userID, err := controllers.UserIDFromContext(r.Context())
+	if err != nil {
+		log.Error("sessions", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	sessionID := chi.URLParam(r, "sessionID")
+	now := time.Now()
+	if err := s.tokenRepo.RevokeSession(r.Context(), userID, sessionID, now); err != nil {
+		log.Info("Could not revoke session", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+	if err := s.denylist.Revoke(r.Context(), sessionID, now.Add(s.accessTokenTTL)); err != nil {
+		log.Error("Could not revoke session tokens", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// jwksMaxAge is how long clients may cache the key set. Verifiers should
+// refetch it when they see an unknown kid anyway.
+const jwksMaxAge = 5 * time.Minute
+
+// jwks publishes the keys tokens are verified with, so other services can
+// verify tokens without sharing a secret.
+func (s *Server) jwks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(headers.ContentType, mimetype.ApplicationJSON)
+	w.Header().Set(headers.CacheControl, fmt.Sprintf("public, max-age=%d", int(jwksMaxAge.Seconds())))
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(s.jwtAuth.JWKS()); err != nil {
+		logger2.FromContext(r.Context()).Error("Error encoding jwks", zap.Error(err))
+	}
+}
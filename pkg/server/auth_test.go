@@ -0,0 +1,450 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-http-utils/headers"
+	"github.com/ldez/mimetype"
+	"github.com/stretchr/testify/require"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/controllers"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/denylist"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/jwt"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/logger"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/problem"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/repo"
+)
+
+type fakeTokenRepo struct {
+	repo.TokenRepository
+	tokens map[string]*models.RefreshToken
+	denied map[string]time.Time
+}
+
+func newFakeTokenRepo() *fakeTokenRepo {
+	return &fakeTokenRepo{tokens: map[string]*models.RefreshToken{}, denied: map[string]time.Time{}}
+}
+
+func (f *fakeTokenRepo) CreateRefreshToken(_ context.Context, token models.RefreshToken) error {
+	f.tokens[token.Hash] = &token
+	return nil
+}
+
+func (f *fakeTokenRepo) RotateRefreshToken(_ context.Context, hash string, next models.RefreshToken) (models.RefreshToken, error) {
+	current, ok := f.tokens[hash]
+	if !ok || current.Revoked() || !next.CreatedAt.Before(current.ExpiresAt) {
+		return models.RefreshToken{}, repo.ErrRefreshTokenInvalid
+	}
+	if current.Used() {
+		for _, t := range f.tokens {
+			if t.FamilyID == current.FamilyID {
+				t.RevokedAt = next.CreatedAt
+			}
+		}
+		return *current, repo.ErrRefreshTokenReused
+	}
+	current.UsedAt = next.CreatedAt
+	next.FamilyID = current.FamilyID
+	next.UserID = current.UserID
+	f.tokens[next.Hash] = &next
+	return next, nil
+}
+
+func (f *fakeTokenRepo) ListSessions(_ context.Context, userID int, now time.Time) ([]*models.Session, error) {
+	sessions := map[string]*models.Session{}
+	var order []string
+	for _, t := range f.tokens {
+		if t.UserID != userID || t.Revoked() || !now.Before(t.ExpiresAt) {
+			continue
+		}
+		s, ok := sessions[t.FamilyID]
+		if !ok {
+			s = &models.Session{ID: t.FamilyID, CreatedAt: t.CreatedAt}
+			sessions[t.FamilyID] = s
+			order = append(order, t.FamilyID)
+		}
+		if t.CreatedAt.After(s.LastUsedAt) {
+			s.LastUsedAt = t.CreatedAt
+		}
+		if t.ExpiresAt.After(s.ExpiresAt) {
+			s.ExpiresAt = t.ExpiresAt
+		}
+	}
+	sort.Strings(order)
+	var res []*models.Session
+	for _, id := range order {
+		res = append(res, sessions[id])
+	}
+	return res, nil
+}
+
+func (f *fakeTokenRepo) RevokeSession(_ context.Context, userID int, sessionID string, at time.Time) error {
+	var revoked bool
+	for _, t := range f.tokens {
+		if t.UserID == userID && t.FamilyID == sessionID && !t.Revoked() {
+			t.RevokedAt = at
+			revoked = true
+		}
+	}
+	if !revoked {
+		return repo.ErrSessionNotFound
+	}
+	return nil
+}
+
+func (f *fakeTokenRepo) DenyToken(_ context.Context, id string, expiresAt time.Time) error {
+	f.denied[id] = expiresAt
+	return nil
+}
+
+func (f *fakeTokenRepo) DeniedUntil(_ context.Context, id string) (time.Time, error) {
+	return f.denied[id], nil
+}
+
+func TestServer_loginReturnsToken(t *testing.T) {
+	userRepo := &fakeUserRepo{users: map[string]string{}}
+	srv := NewServer(logger.NewNoop(), userRepo, &fakeOrderRepo{}, testSalt)
+
+	for _, target := range []string{"/api/user/register", "/api/user/login"} {
+		t.Run(target, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(`{"login":"user","password":"secret"}`))
+			req.Header.Set(headers.ContentType, mimetype.ApplicationJSON)
+			rec := httptest.NewRecorder()
+			srv.ServeHTTP(rec, req)
+			require.Equal(t, http.StatusOK, rec.Code)
+
+			var session controllers.Session
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &session))
+			require.NotEmpty(t, session.Token)
+			require.Equal(t, "Bearer", session.TokenType)
+			require.Equal(t, jwt.BearerHeader(session.Token), rec.Header().Get(headers.Authorization))
+
+			cookies := rec.Result().Cookies()
+			require.Len(t, cookies, 1)
+			require.Equal(t, session.Token, cookies[0].Value)
+
+			userID, err := srv.jwtAuth.ParseToken(session.Token)
+			require.NoError(t, err)
+			require.Equal(t, 1, userID)
+		})
+	}
+}
+
+func TestServer_authTransports(t *testing.T) {
+	srv := NewServer(logger.NewNoop(), nil, &fakeOrderRepo{}, testSalt,
+		WithAuthTransports(AuthTransports{V2: jwt.TransportBearer}))
+
+	token, _, err := srv.jwtAuth.CreateToken(1)
+	require.NoError(t, err)
+
+	bearer := func(r *http.Request) { r.Header.Set(headers.Authorization, jwt.BearerHeader(token)) }
+	cookie := func(r *http.Request) { r.AddCookie(jwt.Cookie(token, time.Now().Add(time.Hour))) }
+
+	tests := []struct {
+		name        string
+		target      string
+		auth        func(r *http.Request)
+		wantCode    int
+		wantProblem problem.Code
+	}{
+		{"v1 bearer", "/api/user/withdrawals", bearer, http.StatusNoContent, ""},
+		{"v1 lowercase scheme", "/api/user/withdrawals", func(r *http.Request) {
+			r.Header.Set(headers.Authorization, "bearer "+token)
+		}, http.StatusNoContent, ""},
+		{"v1 cookie", "/api/user/withdrawals", cookie, http.StatusNoContent, ""},
+		{"v1 basic auth", "/api/user/withdrawals", func(r *http.Request) {
+			r.SetBasicAuth("user", "secret")
+		}, http.StatusBadRequest, problem.CodeMalformedRequest},
+		{"v1 bearer with a bad token", "/api/user/withdrawals", func(r *http.Request) {
+			r.Header.Set(headers.Authorization, jwt.BearerHeader("abc"))
+		}, http.StatusUnauthorized, problem.CodeTokenInvalid},
+		{"v2 bearer", "/api/v2/user/withdrawals", bearer, http.StatusOK, ""},
+		{"v2 cookie", "/api/v2/user/withdrawals", cookie, http.StatusUnauthorized, problem.CodeUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			tt.auth(req)
+			rec := httptest.NewRecorder()
+			srv.ServeHTTP(rec, req)
+			require.Equal(t, tt.wantCode, rec.Code)
+			if tt.wantProblem != "" {
+				var p problem.Problem
+				require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &p))
+				require.Equal(t, tt.wantProblem, p.Code)
+			}
+		})
+	}
+}
+
+func TestServer_refreshToken(t *testing.T) {
+	userRepo := &fakeUserRepo{users: map[string]string{}}
+	tokenRepo := newFakeTokenRepo()
+	srv := NewServer(logger.NewNoop(), userRepo, &fakeOrderRepo{}, testSalt,
+		WithRefreshTokens(tokenRepo, time.Minute, time.Hour))
+
+	post := func(target, body string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		req.Header.Set(headers.ContentType, mimetype.ApplicationJSON)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec
+	}
+	session := func(rec *httptest.ResponseRecorder) controllers.Session {
+		require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		var s controllers.Session
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &s))
+		require.NotEmpty(t, s.Token)
+		require.NotEmpty(t, s.RefreshToken)
+		return s
+	}
+
+	first := session(post("/api/user/register", `{"login":"user","password":"secret"}`))
+	expiresAt, err := time.Parse(time.RFC3339, first.ExpiresAt)
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now().Add(time.Minute), expiresAt, 5*time.Second)
+	require.Len(t, tokenRepo.tokens, 1)
+	for hash := range tokenRepo.tokens {
+		require.Equal(t, jwt.HashRefreshToken(first.RefreshToken), hash)
+	}
+
+	// refresh with the token in the body
+	second := session(post("/api/user/token/refresh", `{"refresh_token":"`+first.RefreshToken+`"}`))
+	require.NotEqual(t, first.RefreshToken, second.RefreshToken)
+	userID, err := srv.jwtAuth.ParseToken(second.Token)
+	require.NoError(t, err)
+	require.Equal(t, 1, userID)
+
+	// refresh with the cookie set on the previous refresh
+	rec := post("/api/user/token/refresh", "", jwt.RefreshCookie(second.RefreshToken, time.Now().Add(time.Hour)))
+	third := session(rec)
+	var refreshCookie *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Path == jwt.RefreshCookiePath {
+			refreshCookie = c
+		}
+	}
+	require.NotNil(t, refreshCookie)
+	require.True(t, refreshCookie.HttpOnly)
+	require.Equal(t, third.RefreshToken, refreshCookie.Value)
+
+	// reusing a rotated token revokes the whole family
+	rec = post("/api/user/token/refresh", `{"refresh_token":"`+first.RefreshToken+`"}`)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	var p problem.Problem
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &p))
+	require.Equal(t, problem.CodeRefreshTokenInvalid, p.Code)
+
+	rec = post("/api/user/token/refresh", `{"refresh_token":"`+third.RefreshToken+`"}`)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec = post("/api/user/token/refresh", "")
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	rec = post("/api/user/token/refresh", `{"refresh_token":"unknown"}`)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestServer_logout(t *testing.T) {
+	userRepo := &fakeUserRepo{users: map[string]string{}}
+	tokenRepo := newFakeTokenRepo()
+	srv := NewServer(logger.NewNoop(), userRepo, &fakeOrderRepo{}, testSalt,
+		WithRefreshTokens(tokenRepo, time.Minute, time.Hour),
+		WithDenylist(denylist.NewStore(tokenRepo, time.Minute)))
+
+	do := func(method, target, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set(headers.ContentType, mimetype.ApplicationJSON)
+		if token != "" {
+			req.Header.Set(headers.Authorization, jwt.BearerHeader(token))
+		}
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodPost, "/api/user/register", "", `{"login":"user","password":"secret"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var session controllers.Session
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &session))
+
+	require.Equal(t, http.StatusNoContent, do(http.MethodGet, "/api/user/withdrawals", session.Token, "").Code)
+
+	rec = do(http.MethodPost, "/api/user/logout", session.Token, "")
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	cookies := rec.Result().Cookies()
+	require.Len(t, cookies, 2)
+	for _, c := range cookies {
+		require.Empty(t, c.Value)
+		require.Equal(t, -1, c.MaxAge)
+	}
+
+	// neither the access token nor the refresh token work anymore
+	rec = do(http.MethodGet, "/api/user/withdrawals", session.Token, "")
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	var p problem.Problem
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &p))
+	require.Equal(t, problem.CodeTokenInvalid, p.Code)
+
+	rec = do(http.MethodPost, "/api/user/token/refresh", "", `{"refresh_token":"`+session.RefreshToken+`"}`)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	require.Equal(t, http.StatusUnauthorized, do(http.MethodPost, "/api/user/logout", session.Token, "").Code)
+}
+
+func TestServer_sessions(t *testing.T) {
+	userRepo := &fakeUserRepo{users: map[string]string{}}
+	tokenRepo := newFakeTokenRepo()
+	srv := NewServer(logger.NewNoop(), userRepo, &fakeOrderRepo{}, testSalt,
+		WithRefreshTokens(tokenRepo, time.Minute, time.Hour),
+		WithDenylist(denylist.NewStore(tokenRepo, time.Minute)))
+
+	do := func(method, target, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set(headers.ContentType, mimetype.ApplicationJSON)
+		if token != "" {
+			req.Header.Set(headers.Authorization, jwt.BearerHeader(token))
+		}
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec
+	}
+	login := func(target string) controllers.Session {
+		rec := do(http.MethodPost, target, "", `{"login":"user","password":"secret"}`)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var s controllers.Session
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &s))
+		return s
+	}
+	list := func(token string) []controllers.UserSession {
+		rec := do(http.MethodGet, "/api/user/sessions", token, "")
+		require.Equal(t, http.StatusOK, rec.Code)
+		var sessions []controllers.UserSession
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &sessions))
+		return sessions
+	}
+
+	first := login("/api/user/register")
+	second := login("/api/user/login")
+
+	sessions := list(first.Token)
+	require.Len(t, sessions, 2)
+	var other string
+	var current int
+	for _, v := range sessions {
+		if v.Current {
+			current++
+			continue
+		}
+		other = v.ID
+	}
+	require.Equal(t, 1, current)
+	require.NotEmpty(t, other)
+
+	// revoking the other session signs its access token out
+	rec := do(http.MethodDelete, "/api/user/sessions/"+other, first.Token, "")
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	require.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/api/user/withdrawals", second.Token, "").Code)
+	require.Equal(t, http.StatusNoContent, do(http.MethodGet, "/api/user/withdrawals", first.Token, "").Code)
+
+	sessions = list(first.Token)
+	require.Len(t, sessions, 1)
+	require.True(t, sessions[0].Current)
+
+	rec = do(http.MethodDelete, "/api/user/sessions/"+other, first.Token, "")
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	var p problem.Problem
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &p))
+	require.Equal(t, problem.CodeSessionNotFound, p.Code)
+}
+
+func TestServer_jwks(t *testing.T) {
+	get := func(srv *Server) jwt.JWKSet {
+		req := httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil)
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Contains(t, rec.Header().Get(headers.CacheControl), "max-age")
+		var set jwt.JWKSet
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &set))
+		return set
+	}
+
+	// the salt is secret and never published
+	require.Empty(t, get(NewServer(logger.NewNoop(), nil, &fakeOrderRepo{}, testSalt)).Keys)
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	require.NoError(t, err)
+	key, err := jwt.ParseKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	require.NoError(t, err)
+	keyring, err := jwt.NewKeyring(key)
+	require.NoError(t, err)
+
+	srv := NewServer(logger.NewNoop(), nil, &fakeOrderRepo{}, testSalt, WithKeyring(keyring))
+	set := get(srv)
+	require.Len(t, set.Keys, 1)
+	require.Equal(t, key.ID, set.Keys[0].Kid)
+	require.Equal(t, "EdDSA", set.Keys[0].Alg)
+
+	token, _, err := srv.jwtAuth.CreateToken(1)
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodGet, "/api/user/withdrawals", nil)
+	req.Header.Set(headers.Authorization, jwt.BearerHeader(token))
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+}
+
+func TestServer_refreshTokenReuseRevokesSession(t *testing.T) {
+	userRepo := &fakeUserRepo{users: map[string]string{}}
+	tokenRepo := newFakeTokenRepo()
+	srv := NewServer(logger.NewNoop(), userRepo, &fakeOrderRepo{}, testSalt,
+		WithRefreshTokens(tokenRepo, time.Minute, time.Hour),
+		WithDenylist(denylist.NewStore(tokenRepo, time.Minute)))
+
+	post := func(target, body string) controllers.Session {
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		req.Header.Set(headers.ContentType, mimetype.ApplicationJSON)
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		var s controllers.Session
+		if rec.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &s))
+		}
+		return s
+	}
+	withdrawals := func(token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/user/withdrawals", nil)
+		req.Header.Set(headers.Authorization, jwt.BearerHeader(token))
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	first := post("/api/user/register", `{"login":"user","password":"secret"}`)
+	// whoever stole the refresh token uses it first
+	stolen := post("/api/user/token/refresh", `{"refresh_token":"`+first.RefreshToken+`"}`)
+	require.NotEmpty(t, stolen.Token)
+	require.Equal(t, http.StatusNoContent, withdrawals(stolen.Token))
+
+	// the owner presents it again, the whole session is revoked
+	require.Empty(t, post("/api/user/token/refresh", `{"refresh_token":"`+first.RefreshToken+`"}`).Token)
+	require.Equal(t, http.StatusUnauthorized, withdrawals(stolen.Token))
+	require.Equal(t, http.StatusUnauthorized, withdrawals(first.Token))
+}
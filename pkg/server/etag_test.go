@@ -0,0 +1,74 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-http-utils/headers"
+	"github.com/stretchr/testify/require"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
+)
+
+func TestServer_ordersETag(t *testing.T) {
+	base := time.Date(2022, time.June, 25, 9, 0, 0, 0, time.UTC)
+	orderRepo := &fakeOrderRepo{
+		orders: map[int][]*models.Order{
+			1: {{OrderID: 79927398713, Status: models.NewStatus, UserID: 1, UploadedAt: base}},
+		},
+	}
+	srv := newTestServer(t, orderRepo)
+
+	get := func(target string, etag string) *httptest.ResponseRecorder {
+		req := authenticatedRequest(t, srv, http.MethodGet, target, 1)
+		if etag != "" {
+			req.Header.Set(headers.IfNoneMatch, etag)
+		}
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, target := range []string{"/api/user/orders", "/api/user/balance", "/api/v2/user/orders"} {
+		t.Run(target, func(t *testing.T) {
+			rec := get(target, "")
+			require.Equal(t, http.StatusOK, rec.Code)
+			etag := rec.Header().Get(headers.ETag)
+			require.NotEmpty(t, etag)
+
+			rec = get(target, etag)
+			require.Equal(t, http.StatusNotModified, rec.Code)
+			require.Empty(t, rec.Body.String())
+
+			rec = get(target, `"other", `+etag)
+			require.Equal(t, http.StatusNotModified, rec.Code)
+
+			rec = get(target, `"other"`)
+			require.Equal(t, http.StatusOK, rec.Code)
+		})
+	}
+
+	ordersTag := get("/api/user/orders", "").Header().Get(headers.ETag)
+	require.NotEqual(t, ordersTag, get("/api/user/orders?status=NEW", "").Header().Get(headers.ETag))
+	require.NotEqual(t, ordersTag, get("/api/user/balance", "").Header().Get(headers.ETag))
+
+	orderRepo.orders[1][0].Status = models.ProcessedStatus
+	orderRepo.orders[1][0].ProcessedAt = base.Add(time.Minute)
+
+	rec := get("/api/user/orders", ordersTag)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NotEqual(t, ordersTag, rec.Header().Get(headers.ETag))
+
+	// a balance adjustment changes the balance without touching any order
+	for _, target := range []string{"/api/user/balance", "/api/v2/user/balance"} {
+		balanceTag := get(target, "").Header().Get(headers.ETag)
+		require.NotEmpty(t, balanceTag)
+		orderRepo.adjustments = map[int]int64{1: orderRepo.adjustments[1] + 1}
+
+		rec = get(target, balanceTag)
+		require.Equal(t, http.StatusOK, rec.Code, target)
+		require.NotEqual(t, balanceTag, rec.Header().Get(headers.ETag))
+	}
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-http-utils/headers"
+	"go.uber.org/zap"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/controllers"
+	logger2 "github.com/OmAsana/go-yapraktikum-final/pkg/logger"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/problem"
+)
+
+const (
+	lastEventIDHeader = "Last-Event-ID"
+
+	orderEventsBatchSize    = 100
+	orderEventsPollInterval = 5 * time.Second
+	sseHeartbeatInterval    = 15 * time.Second
+	sseRetry                = 3 * time.Second
+)
+
+// orderEvents streams changes of user orders as server-sent events. Events
+// are read from the database, so a client reconnecting with Last-Event-ID
+// gets everything it missed. The broker only tells the stream when to look;
+// the database is also polled for updates made by other instances.
+func (s *Server) orderEvents(w http.ResponseWriter, r *http.Request) {
+	log := logger2.FromContext(r.Context())
+	userID, err := controllers.UserIDFromContext(r.Context())
+	if err != nil {
+		log.Error("order events", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Error("Streaming is not supported by response writer")
+		problem.Write(w, r, http.StatusInternalServerError, problem.CodeInternalError, "streaming is not supported")
+		return
+	}
+
+	lastID, resumed, err := lastEventID(r)
+	if err != nil {
+		log.Info("Invalid last event id", zap.Error(err))
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeMalformedRequest, err.Error())
+		return
+	}
+
+	var notify <-chan struct{}
+	if s.broker != nil {
+		ch, unsubscribe := s.broker.Subscribe(userID)
+		defer unsubscribe()
+		notify = ch
+	}
+
+	if !resumed {
+		lastID, err = s.orderRepo.LastOrderEventID(r.Context(), userID)
+		if err != nil {
+			log.Error("Could not get last order event", zap.Error(err))
+			problem.WriteError(w, r, err)
+			return
+		}
+	}
+
+	w.Header().Set(headers.ContentType, "text/event-stream")
+	w.Header().Set(headers.CacheControl, "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetry.Milliseconds())
+	flusher.Flush()
+
+	send := func() error {
+		for {
+			events, err := s.orderRepo.ListOrderEvents(r.Context(), userID, lastID, orderEventsBatchSize)
+			if err != nil {
+				return err
+			}
+			for _, e := range events {
+				data, err := json.Marshal(controllers.OrderEventModelToController(*e))
+				if err != nil {
+					return err
+				}
+				if _, err := fmt.Fprintf(w, "id: %d\nevent: order\ndata: %s\n\n", e.EventID, data); err != nil {
+					return err
+				}
+				lastID = e.EventID
+			}
+			flusher.Flush()
+			if len(events) < orderEventsBatchSize {
+				return nil
+			}
+		}
+	}
+
+	poll := time.NewTicker(s.orderEventsPollInterval)
+	defer poll.Stop()
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		if err := send(); err != nil {
+			if r.Context().Err() == nil {
+				log.Error("Error sending order events", zap.Error(err))
+			}
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-notify:
+		case <-poll.C:
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// lastEventID reads the id of the last event seen by a reconnecting
+// client. EventSource sends it as a header, polyfills often can only use
+// the query string.
+func lastEventID(r *http.Request) (int64, bool, error) {
+	v := r.Header.Get(lastEventIDHeader)
+	if v == "" {
+		v = r.URL.Query().Get("last_event_id")
+	}
+	if v == "" {
+		return 0, false, nil
+	}
+
+	id, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || id < 0 {
+		return 0, false, fmt.Errorf("invalid last event id %q", v)
+	}
+	return id, true, nil
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-http-utils/headers"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/controllers"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/events"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/logger"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
+)
+
+type sseEvent struct {
+	id   string
+	name string
+	data string
+}
+
+func readSSEEvent(t *testing.T, scanner *bufio.Scanner) sseEvent {
+	t.Helper()
+	var e sseEvent
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if e.data != "" {
+				return e
+			}
+		case strings.HasPrefix(line, "id: "):
+			e.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			e.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			e.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+	require.NoError(t, scanner.Err())
+	t.Fatal("stream closed")
+	return e
+}
+
+func TestServer_orderEvents(t *testing.T) {
+	updatedAt := time.Date(2022, time.June, 1, 10, 0, 0, 0, time.UTC)
+	orderRepo := &fakeOrderRepo{events: []*models.OrderEvent{
+		{EventID: 1, OrderID: 79927398713, UserID: 1, Status: models.InvalidStatus, CreatedAt: updatedAt},
+		{EventID: 2, OrderID: 2377225624, UserID: 1, Status: models.ProcessedStatus, Accrual: decimal.NewFromInt(500), CreatedAt: updatedAt},
+		{EventID: 3, OrderID: 12345678903, UserID: 2, Status: models.ProcessedStatus, Accrual: decimal.NewFromInt(10), CreatedAt: updatedAt},
+	}}
+	broker := events.NewBroker()
+	srv := NewServer(logger.NewNoop(), nil, orderRepo, testSalt, WithOrderEvents(broker))
+	// rely on the broker only
+	srv.orderEventsPollInterval = time.Hour
+
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	req := authenticatedRequest(t, srv, http.MethodGet, ts.URL+"/api/user/orders/events", 1)
+	req.RequestURI = ""
+	req.Header.Set(lastEventIDHeader, "1")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/event-stream", resp.Header.Get(headers.ContentType))
+
+	scanner := bufio.NewScanner(resp.Body)
+
+	e := readSSEEvent(t, scanner)
+	require.Equal(t, "2", e.id)
+	require.Equal(t, "order", e.name)
+	var got controllers.OrderEvent
+	require.NoError(t, json.Unmarshal([]byte(e.data), &got))
+	require.Equal(t, controllers.OrderEvent{
+		Number:    "2377225624",
+		Status:    models.ProcessedStatus,
+		Accrual:   500,
+		UpdatedAt: updatedAt.Format(time.RFC3339),
+	}, got)
+
+	orderRepo.addEvent(&models.OrderEvent{EventID: 4, OrderID: 12345678903, UserID: 2, Status: models.InvalidStatus, CreatedAt: updatedAt})
+	orderRepo.addEvent(&models.OrderEvent{EventID: 5, OrderID: 4561261212345467, UserID: 1, Status: models.InvalidStatus, CreatedAt: updatedAt})
+	broker.Notify(1)
+
+	e = readSSEEvent(t, scanner)
+	require.Equal(t, "5", e.id)
+	require.Contains(t, e.data, `"number":"4561261212345467"`)
+}
+
+func TestServer_orderEventsInvalidLastEventID(t *testing.T) {
+	srv := newTestServer(t, &fakeOrderRepo{})
+	req := authenticatedRequest(t, srv, http.MethodGet, "/api/user/orders/events?last_event_id=abc", 1)
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-http-utils/headers"
+	"go.uber.org/zap"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/controllers"
+	logger2 "github.com/OmAsana/go-yapraktikum-final/pkg/logger"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/problem"
+)
+
+const (
+	mimeCSV    = "text/csv"
+	mimeNDJSON = "application/x-ndjson"
+
+	// exportFlushEvery is the number of rows written between flushes, so
+	// clients see progress on long exports.
+	exportFlushEvery = 100
+)
+
+// exportFormat returns the export media type asked for in Accept, or an
+// empty string when the regular JSON response should be sent. Media ranges
+// are taken in the order given, quality values are ignored.
+func exportFormat(r *http.Request) string {
+	for _, v := range strings.Split(r.Header.Get(headers.Accept), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(v))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case mimeCSV, mimeNDJSON:
+			return mediaType
+		case "application/json":
+			return ""
+		}
+	}
+	return ""
+}
+
+// exporter writes rows as they are read from the repository. The status
+// and headers are sent with the first row, errors after that can only
+// truncate the response.
+type exporter struct {
+	w        http.ResponseWriter
+	r        *http.Request
+	format   string
+	filename string
+	header   []string
+
+	csv     *csv.Writer
+	json    *json.Encoder
+	started bool
+	rows    int
+}
+
+func newExporter(w http.ResponseWriter, r *http.Request, format string, filename string, header []string) *exporter {
+	return &exporter{
+		w:        w,
+		r:        r,
+		format:   format,
+		filename: filename,
+		header:   header,
+		csv:      csv.NewWriter(w),
+		json:     json.NewEncoder(w),
+	}
+}
+
+func (e *exporter) start() error {
+	e.started = true
+
+	ext := ".csv"
+	contentType := mimeCSV + "; charset=utf-8"
+	if e.format == mimeNDJSON {
+		ext = ".ndjson"
+		contentType = mimeNDJSON
+	}
+	e.w.Header().Set(headers.ContentType, contentType)
+	e.w.Header().Set(headers.ContentDisposition, `attachment; filename="`+e.filename+ext+`"`)
+	e.w.WriteHeader(http.StatusOK)
+
+	if e.format == mimeCSV {
+		return e.csv.Write(e.header)
+	}
+	return nil
+}
+
+// write sends record as a CSV row or v as a JSON line.
+func (e *exporter) write(record []string, v interface{}) error {
+	if !e.started {
+		if err := e.start(); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if e.format == mimeCSV {
+		err = e.csv.Write(record)
+	} else {
+		err = e.json.Encode(v)
+	}
+	if err != nil {
+		return err
+	}
+
+	e.rows++
+	if e.rows%exportFlushEvery == 0 {
+		return e.flush()
+	}
+	return nil
+}
+
+func (e *exporter) flush() error {
+	e.csv.Flush()
+	if err := e.csv.Error(); err != nil {
+		return err
+	}
+	if f, ok := e.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// finish completes the export, or reports err if nothing was sent yet.
+func (e *exporter) finish(err error) {
+	log := logger2.FromContext(e.r.Context())
+	if err != nil {
+		if !e.started {
+			log.Error("Could not export", zap.Error(err))
+			problem.WriteError(e.w, e.r, err)
+			return
+		}
+		log.Error("Export aborted", zap.Error(err), zap.Int("rows", e.rows))
+		return
+	}
+
+	if !e.started {
+		if err := e.start(); err != nil {
+			log.Error("Could not export", zap.Error(err))
+			return
+		}
+	}
+	if err := e.flush(); err != nil {
+		log.Error("Could not export", zap.Error(err))
+	}
+}
+
+func (s *Server) exportOrders(w http.ResponseWriter, r *http.Request, userID int, filter models.OrderFilter, format string) {
+	e := newExporter(w, r, format, "orders", []string{"number", "status", "accrual", "uploaded_at"})
+	err := s.orderRepo.StreamOrders(r.Context(), userID, models.DepositOrder, filter, func(o models.Order) error {
+		return e.write([]string{
+			strconv.Itoa(o.OrderID),
+			string(o.Status),
+			controllers.FormatAmount(o.Accrual),
+			o.UploadedAt.Format(time.RFC3339),
+		}, controllers.OrderModelToController(o))
+	})
+	e.finish(err)
+}
+
+func (s *Server) exportWithdrawals(w http.ResponseWriter, r *http.Request, userID int, format string) {
+	e := newExporter(w, r, format, "withdrawals", []string{"order", "sum", "processed_at"})
+	err := s.orderRepo.StreamOrders(r.Context(), userID, models.WithdrawalOrder, models.OrderFilter{}, func(o models.Order) error {
+		return e.write([]string{
+			strconv.Itoa(o.OrderID),
+			controllers.FormatAmount(o.Accrual),
+			o.ProcessedAt.Format(time.RFC3339),
+		}, controllers.WithdrawalModelToController(o))
+	})
+	e.finish(err)
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-http-utils/headers"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/controllers"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/problem"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/repo"
+)
+
+func TestExportFormat(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"*/*", ""},
+		{"text/csv", mimeCSV},
+		{"text/csv; charset=utf-8", mimeCSV},
+		{"application/x-ndjson", mimeNDJSON},
+		{"application/json, text/csv", ""},
+		{"text/html, application/x-ndjson;q=0.9", mimeNDJSON},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(headers.Accept, tt.accept)
+		require.Equal(t, tt.want, exportFormat(r), tt.accept)
+	}
+}
+
+func TestServer_export(t *testing.T) {
+	base := time.Date(2022, time.July, 1, 9, 0, 0, 0, time.UTC)
+	orderRepo := &fakeOrderRepo{
+		orders: map[int][]*models.Order{
+			1: {
+				{OrderID: 79927398713, Status: models.ProcessedStatus, Accrual: decimal.RequireFromString("0.3"), UserID: 1, UploadedAt: base},
+				{OrderID: 2377225624, Status: models.NewStatus, UserID: 1, UploadedAt: base.Add(time.Minute)},
+			},
+		},
+		withdrawals: map[int][]*models.Order{
+			1: {{OrderID: 12345678903, TXType: models.WithdrawalOrder, Accrual: decimal.NewFromInt(10), UserID: 1, ProcessedAt: base}},
+		},
+	}
+	srv := newTestServer(t, orderRepo)
+
+	get := func(target string, accept string) *httptest.ResponseRecorder {
+		req := authenticatedRequest(t, srv, http.MethodGet, target, 1)
+		req.Header.Set(headers.Accept, accept)
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("orders csv", func(t *testing.T) {
+		rec := get("/api/user/orders?status=PROCESSED", mimeCSV)
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, "text/csv; charset=utf-8", rec.Header().Get(headers.ContentType))
+		require.Contains(t, rec.Header().Get(headers.ContentDisposition), `filename="orders.csv"`)
+
+		records, err := csv.NewReader(rec.Body).ReadAll()
+		require.NoError(t, err)
+		require.Equal(t, [][]string{
+			{"number", "status", "accrual", "uploaded_at"},
+			{"79927398713", "PROCESSED", "0.30", "2022-07-01T09:00:00Z"},
+		}, records)
+	})
+
+	t.Run("orders ndjson", func(t *testing.T) {
+		rec := get("/api/user/orders", mimeNDJSON)
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, mimeNDJSON, rec.Header().Get(headers.ContentType))
+
+		lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+		require.Len(t, lines, 2)
+		var o controllers.Order
+		require.NoError(t, json.Unmarshal([]byte(lines[1]), &o))
+		require.Equal(t, "2377225624", o.Number)
+	})
+
+	t.Run("withdrawals csv", func(t *testing.T) {
+		rec := get("/api/user/withdrawals", mimeCSV)
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		records, err := csv.NewReader(rec.Body).ReadAll()
+		require.NoError(t, err)
+		require.Equal(t, [][]string{
+			{"order", "sum", "processed_at"},
+			{"12345678903", "10.00", "2022-07-01T09:00:00Z"},
+		}, records)
+	})
+
+	t.Run("empty export", func(t *testing.T) {
+		req := authenticatedRequest(t, srv, http.MethodGet, "/api/user/withdrawals", 2)
+		req.Header.Set(headers.Accept, mimeCSV)
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, "order,sum,processed_at\n", rec.Body.String())
+	})
+
+	t.Run("json by default", func(t *testing.T) {
+		rec := get("/api/user/orders", "application/json")
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, "application/json", rec.Header().Get(headers.ContentType))
+	})
+
+	t.Run("error before first row", func(t *testing.T) {
+		orderRepo.err = repo.ErrInternalError
+		defer func() { orderRepo.err = nil }()
+
+		rec := get("/api/user/orders", mimeCSV)
+		require.Equal(t, http.StatusInternalServerError, rec.Code)
+		require.Equal(t, problem.ContentType, rec.Header().Get(headers.ContentType))
+	})
+}
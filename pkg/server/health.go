@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-http-utils/headers"
+	"github.com/ldez/mimetype"
+	"go.uber.org/zap"
+
+	logger2 "github.com/OmAsana/go-yapraktikum-final/pkg/logger"
+)
+
+const (
+	defaultReadinessTimeout = 2 * time.Second
+
+	statusOK          = "ok"
+	statusUnavailable = "unavailable"
+)
+
+// ReadinessCheck is a dependency that has to work for the server to
+// handle requests.
+type ReadinessCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+type checkResult struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+type health struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+// healthz tells that the process is alive, it does not look at
+// dependencies so a database outage does not get the server restarted.
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, r, http.StatusOK, health{Status: statusOK})
+}
+
+// readyz runs every readiness check concurrently, each one limited by
+// readinessTimeout.
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	res := health{Status: statusOK, Checks: make(map[string]checkResult, len(s.readinessChecks))}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range s.readinessChecks {
+		wg.Add(1)
+		go func(c ReadinessCheck) {
+			defer wg.Done()
+			result := runCheck(r.Context(), c, s.readinessTimeout)
+
+			mu.Lock()
+			defer mu.Unlock()
+			res.Checks[c.Name] = result
+			if result.Status != statusOK {
+				res.Status = statusUnavailable
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	if res.Status != statusOK {
+		logger2.FromContext(r.Context()).Warn("Not ready", zap.Any("checks", res.Checks))
+		status = http.StatusServiceUnavailable
+	}
+	writeHealth(w, r, status, res)
+}
+
+func runCheck(ctx context.Context, c ReadinessCheck, timeout time.Duration) checkResult {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.Check(ctx)
+	}()
+
+	// do not rely on checks honoring the context
+	var err error
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	res := checkResult{Status: statusOK, Duration: time.Since(start).String()}
+	if err != nil {
+		res.Status = statusUnavailable
+		res.Error = err.Error()
+	}
+	return res
+}
+
+func writeHealth(w http.ResponseWriter, r *http.Request, status int, h health) {
+	w.Header().Set(headers.ContentType, mimetype.ApplicationJSON)
+	w.Header().Set(headers.CacheControl, "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(h); err != nil {
+		logger2.FromContext(r.Context()).Error("Error encoding health", zap.Error(err))
+	}
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/logger"
+)
+
+func TestServer_healthz(t *testing.T) {
+	srv := NewServer(logger.NewNoop(), nil, &fakeOrderRepo{}, testSalt, WithReadinessChecks(time.Second,
+		ReadinessCheck{Name: "database", Check: func(context.Context) error { return errors.New("connection refused") }},
+	))
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `{"status":"ok"}`, rec.Body.String())
+}
+
+func TestServer_readyz(t *testing.T) {
+	ok := ReadinessCheck{Name: "database", Check: func(context.Context) error { return nil }}
+	failing := ReadinessCheck{Name: "migrations", Check: func(context.Context) error {
+		return errors.New("database is at version 1, expected 2")
+	}}
+	// ignores the context, the server must not wait for it
+	stuck := ReadinessCheck{Name: "accrual", Check: func(context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	}}
+
+	tests := []struct {
+		name       string
+		checks     []ReadinessCheck
+		wantCode   int
+		wantStatus map[string]string
+	}{
+		{"ready", []ReadinessCheck{ok}, http.StatusOK, map[string]string{"database": statusOK}},
+		{"failing check", []ReadinessCheck{ok, failing}, http.StatusServiceUnavailable,
+			map[string]string{"database": statusOK, "migrations": statusUnavailable}},
+		{"timeout", []ReadinessCheck{ok, stuck}, http.StatusServiceUnavailable,
+			map[string]string{"database": statusOK, "accrual": statusUnavailable}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := NewServer(logger.NewNoop(), nil, &fakeOrderRepo{}, testSalt, WithReadinessChecks(50*time.Millisecond, tt.checks...))
+
+			start := time.Now()
+			rec := httptest.NewRecorder()
+			srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			require.Less(t, time.Since(start), 500*time.Millisecond)
+			require.Equal(t, tt.wantCode, rec.Code)
+
+			var got health
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&got))
+			statuses := map[string]string{}
+			for name, c := range got.Checks {
+				statuses[name] = c.Status
+				if c.Status != statusOK {
+					require.NotEmpty(t, c.Error)
+				}
+			}
+			require.Equal(t, tt.wantStatus, statuses)
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-http-utils/headers"
+	"go.uber.org/zap"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/controllers"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/logger"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/problem"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotentReplayedHeader  = "Idempotent-Replayed"
+	maxIdempotencyKeyLength   = 255
+	defaultIdempotencyKeysTTL = 24 * time.Hour
+
+	// idempotencyWriteTimeout bounds storing the response or releasing the
+	// key, both happen even when the client is gone.
+	idempotencyWriteTimeout = 5 * time.Second
+)
+
+// idempotent replays the stored response when a request is retried with
+// the same Idempotency-Key. Reusing a key with a different body is
+// rejected. Requests without the header are served as usual.
+func (s *Server) idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if s.idempotencyRepo == nil || key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		log := logger.FromContext(r.Context()).With(zap.String("idempotencyKey", key))
+		if len(key) > maxIdempotencyKeyLength {
+			problem.Write(w, r, http.StatusBadRequest, problem.CodeMalformedRequest, "Idempotency-Key is too long")
+			return
+		}
+
+		userID, err := controllers.UserIDFromContext(r.Context())
+		if err != nil {
+			log.Error("idempotency", zap.Error(err))
+			problem.WriteError(w, r, err)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Error("Error reading body", zap.Error(err))
+			problem.Write(w, r, http.StatusBadRequest, problem.CodeMalformedRequest, "could not read request body")
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		hash := sha256.Sum256(body)
+		now := time.Now()
+		stored, created, err := s.idempotencyRepo.Reserve(r.Context(), models.IdempotentRequest{
+			UserID:      userID,
+			Key:         key,
+			RequestHash: hex.EncodeToString(hash[:]),
+			CreatedAt:   now,
+		}, now.Add(-s.idempotencyTTL))
+		if err != nil {
+			log.Error("Could not reserve idempotency key", zap.Error(err))
+			problem.WriteError(w, r, err)
+			return
+		}
+
+		if !created {
+			switch {
+			case stored.RequestHash != hex.EncodeToString(hash[:]):
+				log.Info("Idempotency key reused with a different body")
+				problem.Write(w, r, http.StatusUnprocessableEntity, problem.CodeIdempotencyKeyReused, "")
+			case !stored.Completed():
+				log.Info("Request with the same idempotency key is in progress")
+				problem.Write(w, r, http.StatusConflict, problem.CodeIdempotencyInProgress, "")
+			default:
+				log.Info("Replaying stored response")
+				if stored.ContentType != "" {
+					w.Header().Set(headers.ContentType, stored.ContentType)
+				}
+				w.Header().Set(idempotentReplayedHeader, "true")
+				w.WriteHeader(stored.Status)
+				if _, err := w.Write(stored.Body); err != nil {
+					log.Error("Error writing stored response", zap.Error(err))
+				}
+			}
+			return
+		}
+
+		// a panicking handler is answered with 500 by the recoverer, let
+		// clients retry like any other failure
+		defer func() {
+			if rvr := recover(); rvr != nil {
+				s.releaseIdempotencyKey(r.Context(), log, userID, key)
+				panic(rvr)
+			}
+		}()
+
+		var resp bytes.Buffer
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		ww.Tee(&resp)
+		next.ServeHTTP(ww, r)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		// let clients retry requests that failed on our side
+		if status >= http.StatusInternalServerError {
+			s.releaseIdempotencyKey(r.Context(), log, userID, key)
+			return
+		}
+
+		stored.Status = status
+		stored.ContentType = ww.Header().Get(headers.ContentType)
+		stored.Body = resp.Bytes()
+		ctx, cancel := detachedContext(r.Context(), idempotencyWriteTimeout)
+		defer cancel()
+		if err := s.idempotencyRepo.Complete(ctx, stored); err != nil {
+			log.Error("Could not store idempotent response", zap.Error(err))
+		}
+	})
+}
+
+func (s *Server) releaseIdempotencyKey(ctx context.Context, log *zap.Logger, userID int, key string) {
+	ctx, cancel := detachedContext(ctx, idempotencyWriteTimeout)
+	defer cancel()
+	if err := s.idempotencyRepo.Release(ctx, userID, key); err != nil {
+		log.Error("Could not release idempotency key", zap.Error(err))
+	}
+}
+
+// detachedContext keeps the values of ctx, like its logger and span, but
+// is not cancelled with it. A reserved key is written even when the client
+// disconnected, otherwise it would stay in progress until it expires.
+func detachedContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(valuesContext{ctx}, timeout)
+}
+
+type valuesContext struct {
+	context.Context
+}
+
+func (valuesContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (valuesContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (valuesContext) Err() error {
+	return nil
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/stretchr/testify/require"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/controllers"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/logger"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
+)
+
+func TestServer_idempotentDetachedWrites(t *testing.T) {
+	idempotencyRepo := &fakeIdempotencyRepo{requests: map[string]models.IdempotentRequest{}}
+	srv := NewServer(logger.NewNoop(), nil, &fakeOrderRepo{}, testSalt, WithIdempotency(idempotencyRepo, defaultIdempotencyKeysTTL))
+
+	serve := func(key string, handler http.HandlerFunc) {
+		ctx, cancel := context.WithCancel(context.WithValue(context.Background(), controllers.UserCTXKey, 1))
+		defer cancel()
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("{}")).WithContext(ctx)
+		req.Header.Set(idempotencyKeyHeader, key)
+		h := middleware.Recoverer(srv.idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// the client goes away while the request is handled
+			cancel()
+			handler(w, r)
+		})))
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	serve("completed", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+	stored, ok := idempotencyRepo.requests[idempotencyRepo.id(1, "completed")]
+	require.True(t, ok)
+	require.True(t, stored.Completed())
+	require.Equal(t, http.StatusAccepted, stored.Status)
+
+	serve("failed", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	require.NotContains(t, idempotencyRepo.requests, idempotencyRepo.id(1, "failed"))
+
+	serve("panicked", func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+	require.NotContains(t, idempotencyRepo.requests, idempotencyRepo.id(1, "panicked"))
+}
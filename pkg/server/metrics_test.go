@@ -0,0 +1,43 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/logger"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/metrics"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
+)
+
+func TestServer_metrics(t *testing.T) {
+	srv := NewServer(logger.NewNoop(), nil, &fakeOrderRepo{}, testSalt, WithMetrics(metrics.NewRegistry()), WithPublicInternalRoutes())
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, authenticatedRequest(t, srv, http.MethodGet, "/api/user/balance", 1))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `gophermart_http_requests_total{code="200",method="GET",route="/api/user/balance/"} 1`)
+	require.Contains(t, rec.Body.String(), "go_goroutines")
+}
+
+func TestServer_internalRoutesNotPublicByDefault(t *testing.T) {
+	adminRepo := &fakeAdminRepo{users: map[int]models.User{
+		testAdminID: {UserID: testAdminID, Login: "support", IsAdmin: true},
+	}}
+	srv := NewServer(logger.NewNoop(), nil, &fakeOrderRepo{}, testSalt, WithMetrics(metrics.NewRegistry()), WithAdmin(adminRepo))
+	require.Nil(t, srv.Internal())
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, authenticatedRequest(t, srv, http.MethodGet, "/api/admin/users", testAdminID))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -3,23 +3,28 @@ package server
 import (
 	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/go-http-utils/headers"
 
 	"github.com/OmAsana/go-yapraktikum-final/pkg/logger"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/problem"
 )
 
-func withContentType(mimeType string) func(http.Handler) http.Handler {
+func withContentType(mimeTypes ...string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			log := logger.FromContext(r.Context())
 			ct := r.Header.Values(headers.ContentType)
-			if !Contains(ct, mimeType) {
-				log.Error(fmt.Sprintf("Wrong content type. Want: %s. Got: %s", mimeType, ct))
-				w.WriteHeader(http.StatusBadRequest)
-				return
+			for _, mimeType := range mimeTypes {
+				if Contains(ct, mimeType) {
+					next.ServeHTTP(w, r)
+					return
+				}
 			}
-			next.ServeHTTP(w, r)
+			log.Error(fmt.Sprintf("Wrong content type. Want: %s. Got: %s", mimeTypes, ct))
+			problem.Write(w, r, http.StatusBadRequest, problem.CodeUnsupportedMediaType,
+				fmt.Sprintf("expected one of: %s", strings.Join(mimeTypes, ", ")))
 		})
 	}
 }
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/denylist"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/events"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/jwt"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/metrics"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/repo"
+)
+
+type Option func(s *Server)
+
+// WithAPIValidation checks requests and responses against the OpenAPI
+// document. It is meant for development since it buffers every response.
+func WithAPIValidation(validator func(http.Handler) http.Handler) Option {
+	return func(s *Server) {
+		s.apiValidator = validator
+	}
+}
+
+// WithIdempotency enables the Idempotency-Key header on withdrawals.
+// Responses are kept for ttl.
+func WithIdempotency(idempotencyRepo repo.IdempotencyRepository, ttl time.Duration) Option {
+	return func(s *Server) {
+		s.idempotencyRepo = idempotencyRepo
+		s.idempotencyTTL = ttl
+	}
+}
+
+// WithOrderEvents wakes up order event streams as soon as the broker is
+// notified instead of waiting for the next poll.
+func WithOrderEvents(broker *events.Broker) Option {
+	return func(s *Server) {
+		s.broker = broker
+	}
+}
+
+// WithWebhooks enables the API managing user webhooks.
+func WithWebhooks(webhookRepo repo.WebhookRepository) Option {
+	return func(s *Server) {
+		s.webhookRepo = webhookRepo
+	}
+}
+
+// WithRateLimits limits requests to unauthenticated routes per client IP
+// and to authenticated routes per user. A zero RateLimit turns the
+// respective limit off.
+func WithRateLimits(byIP, byUser RateLimit) Option {
+	return func(s *Server) {
+		if byIP.enabled() {
+			s.ipLimiter = newKeyedLimiter(byIP)
+		}
+		if byUser.enabled() {
+			s.userLimiter = newKeyedLimiter(byUser)
+		}
+	}
+}
+
+// WithReadinessChecks makes /readyz report unavailable while any of the
+// checks fails or takes longer than timeout.
+func WithReadinessChecks(timeout time.Duration, checks ...ReadinessCheck) Option {
+	return func(s *Server) {
+		s.readinessTimeout = timeout
+		s.readinessChecks = checks
+	}
+}
+
+// WithMetrics records HTTP metrics in reg and serves everything
+// registered there on /metrics.
+func WithMetrics(reg *prometheus.Registry) Option {
+	return func(s *Server) {
+		s.httpMetrics = metrics.NewHTTP(reg)
+		s.metricsHandler = promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+	}
+}
+
+// WithTracing starts a span for every request using the global tracer
+// provider.
+func WithTracing() Option {
+	return func(s *Server) {
+		s.tracing = true
+	}
+}
+
+// WithInternalListener serves the admin API and /metrics on Internal, so
+// they can be served on a separate listener that is not exposed to
+// customers. Without it and WithPublicInternalRoutes they are not served.
+func WithInternalListener() Option {
+	return func(s *Server) {
+		s.internal = chi.NewMux()
+	}
+}
+
+// WithPublicInternalRoutes serves the admin API and /metrics on the public
+// router when there is no internal listener, e.g. for local development.
+func WithPublicInternalRoutes() Option {
+	return func(s *Server) {
+		s.publicInternal = true
+	}
+}
+
+// WithAdmin enables the support staff API under /api/admin.
+func WithAdmin(adminRepo repo.AdminRepository) Option {
+	return func(s *Server) {
+		s.adminRepo = adminRepo
+	}
+}
+
+// AuthTransports selects how clients of each API send their token. Both
+// the cookie and the Authorization header are accepted by default.
+type AuthTransports struct {
+	V1    jwt.Transport
+	V2    jwt.Transport
+	Admin jwt.Transport
+}
+
+// WithAuthTransports restricts the token transports per API. A zero
+// transport keeps the default for that API.
+func WithAuthTransports(t AuthTransports) Option {
+	return func(s *Server) {
+		if t.V1 != 0 {
+			s.authTransports.V1 = t.V1
+		}
+		if t.V2 != 0 {
+			s.authTransports.V2 = t.V2
+		}
+		if t.Admin != 0 {
+			s.authTransports.Admin = t.Admin
+		}
+	}
+}
+
+// WithRefreshTokens makes access tokens live accessTTL and hands out
+// refresh tokens valid for refreshTTL along with them.
+func WithRefreshTokens(tokenRepo repo.TokenRepository, accessTTL, refreshTTL time.Duration) Option {
+	return func(s *Server) {
+		s.tokenRepo = tokenRepo
+		s.accessTokenTTL = accessTTL
+		s.refreshTTL = refreshTTL
+	}
+}
+
+// WithDenylist rejects revoked tokens and enables logout. Together with
+// WithRefreshTokens it also lets users list and revoke their sessions.
+func WithDenylist(store *denylist.Store) Option {
+	return func(s *Server) {
+		s.denylist = store
+	}
+}
+
+// WithKeyring signs and verifies tokens with the keys of keyring instead
+// of the salt. Its public keys are served on /.well-known/jwks.json.
+func WithKeyring(keyring *jwt.Keyring) Option {
+	return func(s *Server) {
+		s.keyring = keyring
+	}
+}
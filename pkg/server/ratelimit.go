@@ -0,0 +1,150 @@
+package server
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/controllers"
+	logger2 "github.com/OmAsana/go-yapraktikum-final/pkg/logger"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/problem"
+)
+
+// limiterSweepInterval is how often buckets of clients that went quiet
+// are dropped.
+const limiterSweepInterval = time.Minute
+
+// RateLimit describes a token bucket: Rate tokens are added every second
+// up to Burst. A zero RateLimit disables limiting.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+func (l RateLimit) enabled() bool {
+	return l.Rate > 0 && l.Burst > 0
+}
+
+// refillTime is how long an empty bucket takes to fill up again.
+func (l RateLimit) refillTime() time.Duration {
+	return time.Duration(float64(l.Burst) / l.Rate * float64(time.Second))
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// keyedLimiter keeps a token bucket per client key.
+type keyedLimiter struct {
+	limit RateLimit
+	now   func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func newKeyedLimiter(limit RateLimit) *keyedLimiter {
+	return &keyedLimiter{
+		limit:   limit,
+		now:     time.Now,
+		buckets: map[string]*bucket{},
+	}
+}
+
+// reserve takes a token from the bucket of key. When the bucket is empty
+// nothing is taken and the time until the next token is returned.
+func (l *keyedLimiter) reserve(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Sub(l.lastSweep) > limiterSweepInterval {
+		l.sweep(now)
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{limiter: rate.NewLimiter(rate.Limit(l.limit.Rate), l.limit.Burst)}
+		l.buckets[key] = b
+	}
+	b.lastSeen = now
+
+	res := b.limiter.ReserveN(now, 1)
+	delay := res.DelayFrom(now)
+	if delay > 0 {
+		res.CancelAt(now)
+	}
+	return delay
+}
+
+// sweep drops buckets that had time to fill up, a new bucket for the same
+// client behaves exactly the same.
+func (l *keyedLimiter) sweep(now time.Time) {
+	idle := l.limit.refillTime()
+	for key, b := range l.buckets {
+		if now.Sub(b.lastSeen) > idle {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// limitByIP limits unauthenticated routes by the client address set by
+// middleware.RealIP.
+func (s *Server) limitByIP(next http.Handler) http.Handler {
+	if s.ipLimiter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := r.RemoteAddr
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			ip = host
+		}
+		if !allow(w, r, s.ipLimiter, ip) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitByUser limits authenticated routes by user, so clients behind the
+// same NAT do not share a bucket. It must run after CheckAuthentication.
+func (s *Server) limitByUser(next http.Handler) http.Handler {
+	if s.userLimiter == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID, err := controllers.UserIDFromContext(r.Context())
+		if err != nil {
+			logger2.FromContext(r.Context()).Error("rate limit", zap.Error(err))
+			problem.WriteError(w, r, err)
+			return
+		}
+		if !allow(w, r, s.userLimiter, strconv.Itoa(userID)) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allow writes 429 with Retry-After if the bucket of key is empty.
+func allow(w http.ResponseWriter, r *http.Request, limiter *keyedLimiter, key string) bool {
+	delay := limiter.reserve(key)
+	if delay <= 0 {
+		return true
+	}
+
+	logger2.FromContext(r.Context()).Info("Rate limit exceeded", zap.String("client", key), zap.Duration("retry_after", delay))
+	retryAfter := int(math.Ceil(delay.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	problem.Write(w, r, http.StatusTooManyRequests, problem.CodeTooManyRequests, "")
+	return false
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-http-utils/headers"
+	"github.com/ldez/mimetype"
+	"github.com/stretchr/testify/require"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/logger"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/problem"
+)
+
+func Test_keyedLimiter(t *testing.T) {
+	now := time.Date(2022, time.July, 10, 10, 0, 0, 0, time.UTC)
+	limiter := newKeyedLimiter(RateLimit{Rate: 0.5, Burst: 2})
+	limiter.now = func() time.Time { return now }
+
+	require.Zero(t, limiter.reserve("a"))
+	require.Zero(t, limiter.reserve("a"))
+	require.Equal(t, 2*time.Second, limiter.reserve("a"))
+	// rejected requests do not take tokens
+	require.Equal(t, 2*time.Second, limiter.reserve("a"))
+	require.Zero(t, limiter.reserve("b"))
+
+	now = now.Add(2 * time.Second)
+	require.Zero(t, limiter.reserve("a"))
+	require.Equal(t, 2*time.Second, limiter.reserve("a"))
+
+	// buckets are dropped once they are full again
+	now = now.Add(time.Hour)
+	limiter.reserve("c")
+	require.Len(t, limiter.buckets, 1)
+}
+
+func TestServer_limitByIP(t *testing.T) {
+	srv := NewServer(logger.NewNoop(), &fakeUserRepo{users: map[string]string{"user": "pass"}}, &fakeOrderRepo{}, testSalt,
+		WithRateLimits(RateLimit{Rate: 0.1, Burst: 2}, RateLimit{}))
+
+	login := func(ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/user/login", strings.NewReader(`{"login":"user","password":"wrong"}`))
+		req.Header.Set(headers.ContentType, mimetype.ApplicationJSON)
+		req.Header.Set("X-Real-IP", ip)
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec
+	}
+
+	require.Equal(t, http.StatusUnauthorized, login("10.0.0.1").Code)
+	require.Equal(t, http.StatusUnauthorized, login("10.0.0.1").Code)
+
+	rec := login("10.0.0.1")
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+	require.Equal(t, "10", rec.Header().Get("Retry-After"))
+	require.Equal(t, problem.ContentType, rec.Header().Get(headers.ContentType))
+
+	require.Equal(t, http.StatusUnauthorized, login("10.0.0.2").Code)
+}
+
+func TestServer_limitByUser(t *testing.T) {
+	srv := NewServer(logger.NewNoop(), nil, &fakeOrderRepo{}, testSalt,
+		WithRateLimits(RateLimit{}, RateLimit{Rate: 1, Burst: 1}))
+
+	get := func(userID int) int {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, authenticatedRequest(t, srv, http.MethodGet, "/api/user/balance", userID))
+		return rec.Code
+	}
+
+	require.Equal(t, http.StatusOK, get(1))
+	require.Equal(t, http.StatusTooManyRequests, get(1))
+	require.Equal(t, http.StatusOK, get(2))
+
+	// unauthenticated requests are rejected before they take a token
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/user/balance", nil))
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+}
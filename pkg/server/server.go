@@ -3,10 +3,15 @@ package server
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -15,10 +20,17 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/OmAsana/go-yapraktikum-final/pkg/controllers"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/denylist"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/events"
 	"github.com/OmAsana/go-yapraktikum-final/pkg/jwt"
 	logger2 "github.com/OmAsana/go-yapraktikum-final/pkg/logger"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/metrics"
 	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/openapi"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/problem"
 	"github.com/OmAsana/go-yapraktikum-final/pkg/repo"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/tracing"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/webhook"
 )
 
 type Server struct {
@@ -27,48 +39,184 @@ type Server struct {
 	userRepo  repo.UserRepository
 	orderRepo repo.OrderRepository
 	jwtAuth   *jwt.Authentication
+
+	authTransports AuthTransports
+	accessTokenTTL time.Duration
+	tokenRepo      repo.TokenRepository
+	refreshTTL     time.Duration
+	denylist       *denylist.Store
+	keyring        *jwt.Keyring
+
+	apiValidator    func(http.Handler) http.Handler
+	idempotencyRepo repo.IdempotencyRepository
+	idempotencyTTL  time.Duration
+
+	broker                  *events.Broker
+	orderEventsPollInterval time.Duration
+
+	webhookRepo repo.WebhookRepository
+	// lookupIPAddr resolves webhook hosts when they are registered
+	lookupIPAddr webhook.LookupIPAddr
+	adminRepo    repo.AdminRepository
+
+	ipLimiter   *keyedLimiter
+	userLimiter *keyedLimiter
+
+	readinessChecks  []ReadinessCheck
+	readinessTimeout time.Duration
+
+	httpMetrics    *metrics.HTTP
+	metricsHandler http.Handler
+
+	tracing bool
+
+	internal *chi.Mux
+	// publicInternal serves the admin API and /metrics on the public
+	// router when there is no internal listener.
+	publicInternal bool
 }
 
-func NewServer(logger *zap.Logger, userRepo repo.UserRepository, orderRepo repo.OrderRepository, salt string) *Server {
+func NewServer(logger *zap.Logger, userRepo repo.UserRepository, orderRepo repo.OrderRepository, salt string, opts ...Option) *Server {
 	srv := &Server{
 		Mux:       chi.NewMux(),
 		logger:    logger,
 		userRepo:  userRepo,
 		orderRepo: orderRepo,
-		jwtAuth:   jwt.NewAuthentication(salt),
+
+		authTransports: AuthTransports{V1: jwt.AnyTransport, V2: jwt.AnyTransport, Admin: jwt.AnyTransport},
+		accessTokenTTL: jwt.DefaultTTL,
+
+		idempotencyTTL:          defaultIdempotencyKeysTTL,
+		orderEventsPollInterval: orderEventsPollInterval,
+		readinessTimeout:        defaultReadinessTimeout,
+		lookupIPAddr:            net.DefaultResolver.LookupIPAddr,
+	}
+
+	for _, v := range opts {
+		v(srv)
+	}
+	authOpts := []jwt.Option{jwt.WithTTL(srv.accessTokenTTL)}
+	if srv.denylist != nil {
+		authOpts = append(authOpts, jwt.WithDenylist(srv.denylist))
 	}
-	srv.Use(middleware.RequestID)
-	srv.Use(middleware.RealIP)
-	srv.Use(logger2.Logger)
-	srv.Use(middleware.Recoverer)
+	if srv.keyring != nil {
+		authOpts = append(authOpts, jwt.WithKeyring(srv.keyring))
+	}
+	srv.jwtAuth = jwt.NewAuthentication(salt, authOpts...)
+
+	srv.setupRouter(srv.Mux)
 
 	srv.Route("/api/user", func(r chi.Router) {
-		r.With(withContentType(mimetype.ApplicationJSON)).Post("/register", srv.register)
-		r.With(withContentType(mimetype.ApplicationJSON)).Post("/login", srv.login)
+		r.With(srv.limitByIP, withContentType(mimetype.ApplicationJSON)).Post("/register", srv.register)
+		r.With(srv.limitByIP, withContentType(mimetype.ApplicationJSON)).Post("/login", srv.login)
+		if srv.tokenRepo != nil {
+			r.With(srv.limitByIP).Post("/token/refresh", srv.refreshToken)
+		}
 		r.Group(func(r chi.Router) {
-			r.Use(srv.jwtAuth.CheckAuthentication)
+			r.Use(srv.jwtAuth.Middleware(srv.authTransports.V1))
+			r.Use(srv.limitByUser)
 			r.With(withContentType(mimetype.TextPlain)).Post("/orders", srv.createOrder)
-			r.Get("/orders", srv.getOrder)
+			r.With(srv.withOrdersETag).Get("/orders", srv.getOrder)
+			r.Get("/orders/events", srv.orderEvents)
+			r.Get("/orders/{number}", srv.getOrderDetail)
+			r.Delete("/orders/{number}", srv.cancelOrder)
+			r.With(withContentType(mimetype.ApplicationJSON, mimetype.TextPlain)).Post("/orders/batch", srv.createOrdersBatch)
+			r.Get("/withdrawals", srv.listWithdrawals)
+
+			if srv.denylist != nil {
+				r.Post("/logout", srv.logout)
+				if srv.tokenRepo != nil {
+					r.Get("/sessions", srv.listSessions)
+					r.Delete("/sessions/{sessionID}", srv.revokeSession)
+				}
+			}
+
+			if srv.webhookRepo != nil {
+				r.Route("/webhooks", func(r chi.Router) {
+					r.With(withContentType(mimetype.ApplicationJSON)).Post("/", srv.createWebhook)
+					r.Get("/", srv.listWebhooks)
+					r.Delete("/{webhookID}", srv.deleteWebhook)
+					r.Get("/{webhookID}/deliveries", srv.listWebhookDeliveries)
+				})
+			}
 
 			r.Route("/balance", func(r chi.Router) {
-				r.Get("/", srv.currentBalance)
-				r.Post("/withdraw", srv.withdraw)
+				r.With(srv.withOrdersETag).Get("/", srv.currentBalance)
+				r.With(srv.withOrdersETag).Get("/history", srv.balanceHistory)
+				r.With(srv.idempotent).Post("/withdraw", srv.withdraw)
 			})
 		})
 
 	})
 
+	srv.Route("/api/v2/user", srv.routeV2)
+
+	srv.Get("/api/openapi.json", openapi.Handler)
+	srv.Get("/.well-known/jwks.json", srv.jwks)
 	srv.Get("/ping", srv.Ping())
+	srv.Get("/healthz", srv.healthz)
+	srv.Get("/readyz", srv.readyz)
+
+	var internal *chi.Mux
+	switch {
+	case srv.internal != nil:
+		internal = srv.internal
+		srv.setupRouter(internal)
+		internal.Get("/healthz", srv.healthz)
+		internal.Get("/readyz", srv.readyz)
+	case srv.publicInternal:
+		internal = srv.Mux
+	}
+	if internal != nil && srv.adminRepo != nil {
+		internal.Route("/api/admin", srv.routeAdmin)
+	}
+	if internal != nil && srv.metricsHandler != nil {
+		internal.Method(http.MethodGet, "/metrics", srv.metricsHandler)
+	}
 
 	return srv
 }
 
+// setupRouter installs the middlewares and error handlers shared by the
+// public and the internal router.
+func (s *Server) setupRouter(r *chi.Mux) {
+	if s.tracing {
+		r.Use(tracing.Middleware)
+	}
+	r.Use(middleware.RequestID)
+	r.Use(middleware.RealIP)
+	r.Use(logger2.Logger)
+	if s.httpMetrics != nil {
+		r.Use(s.httpMetrics.Middleware)
+	}
+	r.Use(middleware.Recoverer)
+	if s.apiValidator != nil {
+		r.Use(s.apiValidator)
+	}
+
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeNotFound, "")
+	})
+	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		problem.Write(w, r, http.StatusMethodNotAllowed, problem.CodeMethodNotAllowed, "")
+	})
+}
+
+// Internal returns the router of the internal listener. It is nil unless
+// the server was created WithInternalListener.
+func (s *Server) Internal() http.Handler {
+	if s.internal == nil {
+		return nil
+	}
+	return s.internal
+}
+
 func (s *Server) register(w http.ResponseWriter, r *http.Request) {
 	log := logger2.FromContext(r.Context())
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		log.Error("Error validating request", zap.Error(err))
-		w.WriteHeader(http.StatusBadRequest)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeMalformedRequest, "could not read request body")
 		return
 	}
 
@@ -76,42 +224,40 @@ func (s *Server) register(w http.ResponseWriter, r *http.Request) {
 	err = json.Unmarshal(body, &creds)
 	if err != nil {
 		log.Error("Error decoding user", zap.Error(err), zap.ByteString("body", body))
-		w.WriteHeader(http.StatusBadRequest)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeMalformedRequest, "could not decode credentials")
 		return
 	}
 	log.Info("Registering new user", zap.String("user", creds.Login))
 
 	userID, err := s.userRepo.Create(r.Context(), creds.Login, creds.Password)
 	if err != nil {
-		if errors.Is(err, repo.ErrUserAlreadyExists) {
-			log.Error("User already exists", zap.String("user", creds.Login))
-			w.WriteHeader(http.StatusConflict)
-			return
-		}
-		if errors.Is(err, repo.ErrInternalError) {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+		log.Error("Could not create user", zap.Error(err), zap.String("user", creds.Login))
+		problem.WriteError(w, r, err)
+		return
 	}
 
-	claim, err := s.jwtAuth.CreateClaim(userID)
+	session, err := s.startSession(r.Context(), w, userID)
 	if err != nil {
 		log.Error("could not create jwt claim", zap.Error(err))
-		w.WriteHeader(http.StatusInternalServerError)
+		problem.WriteError(w, r, err)
 		return
 	}
-	http.SetCookie(w, claim)
+
+	w.Header().Set(headers.ContentType, mimetype.ApplicationJSON)
 	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(session); err != nil {
+		log.Error("Error encoding session", zap.Error(err))
+	}
 }
 
 func (s *Server) Ping() http.HandlerFunc {
 	return func(writer http.ResponseWriter, request *http.Request) {
-		log := logger2.FromContext(request.Context())
-		log.Info("Blah")
+		writer.Header().Set(headers.ContentType, mimetype.TextPlain)
 		writer.WriteHeader(http.StatusOK)
-		writer.Header().Set(headers.ContentType, "application/text")
 
-		writer.Write([]byte("pong"))
+		if _, err := writer.Write([]byte("pong")); err != nil {
+			logger2.FromContext(request.Context()).Error("Error writing pong", zap.Error(err))
+		}
 	}
 }
 
@@ -120,7 +266,7 @@ func (s *Server) login(w http.ResponseWriter, r *http.Request) {
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		log.Error("Error reading body", zap.Error(err))
-		w.WriteHeader(http.StatusBadRequest)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeMalformedRequest, "could not read request body")
 		return
 	}
 
@@ -128,29 +274,98 @@ func (s *Server) login(w http.ResponseWriter, r *http.Request) {
 	err = json.Unmarshal(body, &creds)
 	if err != nil {
 		log.Error("Error decoding user", zap.Error(err), zap.ByteString("body", body))
-		w.WriteHeader(http.StatusBadRequest)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeMalformedRequest, "could not decode credentials")
 		return
 	}
 
 	userID, err := s.userRepo.Authenticate(r.Context(), creds.Login, creds.Password)
 	if err != nil {
 		log.Error("Error authenticating user", zap.Error(err))
-		if errors.Is(err, repo.ErrUserAuthFailed) {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
-		w.WriteHeader(http.StatusInternalServerError)
+		problem.WriteError(w, r, err)
 		return
 	}
 
-	claim, err := s.jwtAuth.CreateClaim(userID)
+	session, err := s.startSession(r.Context(), w, userID)
 	if err != nil {
 		log.Error("could not create jwt claim", zap.Error(err))
-		w.WriteHeader(http.StatusInternalServerError)
+		problem.WriteError(w, r, err)
 		return
 	}
-	http.SetCookie(w, claim)
+
+	w.Header().Set(headers.ContentType, mimetype.ApplicationJSON)
 	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(session); err != nil {
+		log.Error("Error encoding session", zap.Error(err))
+	}
+}
+
+// getOrderDetail answers 404 for orders of other users and withdrawals, so
+// it can not be used to find out which numbers were uploaded.
+func (s *Server) getOrderDetail(w http.ResponseWriter, r *http.Request) {
+	log := logger2.FromContext(r.Context())
+	userID, err := controllers.UserIDFromContext(r.Context())
+	if err != nil {
+		log.Error("orders", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	orderID, err := strconv.Atoi(chi.URLParam(r, "number"))
+	if err != nil {
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeOrderNumberMalformed, "")
+		return
+	}
+
+	order, err := s.orderRepo.GetOrder(r.Context(), orderID)
+	if err != nil {
+		log.Info("Could not get order", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+	if order.UserID != userID || order.TXType != models.DepositOrder {
+		log.Info("Order detail requested for a foreign order", zap.Int("order", orderID))
+		problem.Write(w, r, http.StatusNotFound, problem.CodeOrderNotFound, "")
+		return
+	}
+
+	history, err := s.orderRepo.OrderHistory(r.Context(), orderID)
+	if err != nil {
+		log.Error("Could not get order history", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	w.Header().Set(headers.ContentType, mimetype.ApplicationJSON)
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(controllers.OrderDetailModelToController(order, history)); err != nil {
+		log.Error("Error encoding order", zap.Error(err))
+	}
+}
+
+// cancelOrder deletes an order the bonus system has not processed yet, so
+// a mistyped number stops blocking its real owner.
+func (s *Server) cancelOrder(w http.ResponseWriter, r *http.Request) {
+	log := logger2.FromContext(r.Context())
+	userID, err := controllers.UserIDFromContext(r.Context())
+	if err != nil {
+		log.Error("orders", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	orderID, err := strconv.Atoi(chi.URLParam(r, "number"))
+	if err != nil {
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeOrderNumberMalformed, "")
+		return
+	}
+
+	if err := s.orderRepo.CancelOrder(r.Context(), userID, orderID); err != nil {
+		log.Info("Could not cancel order", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (s *Server) createOrder(w http.ResponseWriter, r *http.Request) {
@@ -158,28 +373,28 @@ func (s *Server) createOrder(w http.ResponseWriter, r *http.Request) {
 	userID, err := controllers.UserIDFromContext(r.Context())
 	if err != nil {
 		log.Error("orders", zap.Error(err))
-		w.WriteHeader(http.StatusInternalServerError)
+		problem.WriteError(w, r, err)
 		return
 	}
 
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		log.Error("Could not read request body", zap.Error(err))
-		w.WriteHeader(http.StatusUnprocessableEntity)
+		problem.Write(w, r, http.StatusUnprocessableEntity, problem.CodeMalformedRequest, "could not read request body")
 		return
 	}
 
 	orderID, err := orderIDFromBytes(body)
 	if err != nil {
 		log.Error("Could not create orderID", zap.Error(err))
-		w.WriteHeader(http.StatusUnprocessableEntity)
+		problem.Write(w, r, http.StatusUnprocessableEntity, problem.CodeOrderNumberMalformed, "")
 		return
 	}
 
 	o := models.NewOrder(orderID, userID)
 	if !o.Valid() {
 		log.Error("OrderIS is invalid")
-		w.WriteHeader(http.StatusUnprocessableEntity)
+		problem.Write(w, r, http.StatusUnprocessableEntity, problem.CodeOrderNumberInvalid, "")
 		return
 	}
 
@@ -191,14 +406,127 @@ func (s *Server) createOrder(w http.ResponseWriter, r *http.Request) {
 	case errors.Is(err, repo.ErrOrderAlreadyUploadedByCurrentUser):
 		w.WriteHeader(http.StatusOK)
 		return
-	case errors.Is(err, repo.ErrOrderCreatedByAnotherUser):
-		w.WriteHeader(http.StatusConflict)
-		return
-	case errors.Is(err, repo.ErrInternalError):
+	default:
 		log.Error("Error creating order", zap.Error(err))
-		w.WriteHeader(http.StatusInternalServerError)
+		problem.WriteError(w, r, err)
+		return
+	}
+}
+
+const maxBatchSize = 1000
+
+func (s *Server) createOrdersBatch(w http.ResponseWriter, r *http.Request) {
+	log := logger2.FromContext(r.Context())
+	userID, err := controllers.UserIDFromContext(r.Context())
+	if err != nil {
+		log.Error("orders", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Error("Could not read request body", zap.Error(err))
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeMalformedRequest, "could not read request body")
+		return
+	}
+
+	var numbers []string
+	if Contains(r.Header.Values(headers.ContentType), mimetype.ApplicationJSON) {
+		numbers, err = orderNumbersFromJSON(body)
+	} else {
+		numbers = orderNumbersFromText(body)
+	}
+	if err != nil {
+		log.Error("Could not decode order numbers", zap.Error(err), zap.ByteString("body", body))
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeMalformedRequest, "could not decode order numbers")
 		return
 	}
+
+	if len(numbers) == 0 {
+		log.Info("Empty batch")
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeMalformedRequest, "no order numbers in request")
+		return
+	}
+	if len(numbers) > maxBatchSize {
+		log.Info("Batch is too large", zap.Int("size", len(numbers)))
+		problem.Write(w, r, http.StatusRequestEntityTooLarge, problem.CodeBatchTooLarge, fmt.Sprintf("at most %d orders are allowed", maxBatchSize))
+		return
+	}
+
+	results := make([]controllers.BatchOrderResult, len(numbers))
+	var orders []models.Order
+	var positions []int
+	for i, number := range numbers {
+		results[i] = controllers.BatchOrderResult{Number: number, Result: controllers.BatchOrderInvalid}
+
+		orderID, err := orderIDFromBytes([]byte(number))
+		if err != nil {
+			continue
+		}
+		o := models.NewOrder(orderID, userID)
+		if !o.Valid() {
+			continue
+		}
+		orders = append(orders, o)
+		positions = append(positions, i)
+	}
+
+	if len(orders) > 0 {
+		errs, err := s.orderRepo.CreateNewOrders(r.Context(), orders)
+		if err != nil {
+			log.Error("Error creating orders", zap.Error(err))
+			problem.WriteError(w, r, err)
+			return
+		}
+
+		for i, err := range errs {
+			res := &results[positions[i]]
+			switch {
+			case err == nil:
+				res.Result = controllers.BatchOrderAccepted
+			case errors.Is(err, repo.ErrOrderAlreadyUploadedByCurrentUser):
+				res.Result = controllers.BatchOrderAlreadyUploaded
+			case errors.Is(err, repo.ErrOrderCreatedByAnotherUser):
+				res.Result = controllers.BatchOrderConflict
+			}
+		}
+	}
+
+	w.Header().Set(headers.ContentType, mimetype.ApplicationJSON)
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		log.Error("Error encoding batch results", zap.Error(err))
+	}
+}
+
+// orderNumbersFromJSON accepts an array of order numbers written either as
+// JSON strings or as JSON numbers.
+func orderNumbersFromJSON(body []byte) ([]string, error) {
+	var items []json.RawMessage
+	if err := json.Unmarshal(body, &items); err != nil {
+		return nil, err
+	}
+
+	numbers := make([]string, 0, len(items))
+	for _, item := range items {
+		var number string
+		if err := json.Unmarshal(item, &number); err != nil {
+			number = string(item)
+		}
+		numbers = append(numbers, strings.TrimSpace(number))
+	}
+	return numbers, nil
+}
+
+func orderNumbersFromText(body []byte) []string {
+	var numbers []string
+	for _, line := range strings.Split(string(body), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			numbers = append(numbers, line)
+		}
+	}
+	return numbers
 }
 
 func orderIDFromBytes(order []byte) (int, error) {
@@ -209,57 +537,143 @@ func orderIDFromBytes(order []byte) (int, error) {
 	return orderID, nil
 }
 
+const (
+	defaultOrdersPageSize = 50
+	maxOrdersPageSize     = 500
+)
+
 func (s *Server) getOrder(w http.ResponseWriter, r *http.Request) {
 	log := logger2.FromContext(r.Context())
 	userID, err := controllers.UserIDFromContext(r.Context())
 	if err != nil {
 		log.Error("orders", zap.Error(err))
-		w.WriteHeader(http.StatusInternalServerError)
+		problem.WriteError(w, r, err)
 		return
 	}
 
-	orders, err := s.orderRepo.ListOrders(r.Context(), userID)
+	filter, paginated, err := orderFilterFromQuery(r.URL.Query())
+	if err != nil {
+		log.Info("Invalid orders query", zap.Error(err))
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidQuery, err.Error())
+		return
+	}
+
+	if format := exportFormat(r); format != "" {
+		s.exportOrders(w, r, userID, filter, format)
+		return
+	}
+
+	if paginated {
+		// fetch one extra order to find out whether there is a next page
+		filter.Limit++
+	}
+
+	orders, err := s.orderRepo.FindOrders(r.Context(), userID, filter)
 	if err != nil {
 		log.Error("Could not retrieve orders", zap.Error(err))
-		w.WriteHeader(http.StatusInternalServerError)
+		problem.WriteError(w, r, err)
 		return
 	}
 
-	if len(orders) == 0 {
+	if len(orders) == 0 && !paginated {
 		log.Info("No orders to return")
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
-	sort.Slice(orders, func(i, j int) bool {
-		return orders[i].UploadedAt.Before(orders[j].UploadedAt)
-	})
+	// an empty page is still a page, clients read it like any other
+	page := controllers.OrderPage{Orders: []controllers.Order{}}
+	if paginated && len(orders) == filter.Limit {
+		orders = orders[:len(orders)-1]
+		last := orders[len(orders)-1]
+		page.NextCursor = controllers.EncodeOrderCursor(models.OrderCursor{
+			UploadedAt: last.UploadedAt,
+			OrderID:    last.OrderID,
+		})
+	}
 
-	var o []controllers.Order
 	for _, v := range orders {
-		o = append(o, controllers.OrderModelToController(*v))
+		page.Orders = append(page.Orders, controllers.OrderModelToController(*v))
+	}
+
+	var resp interface{} = page.Orders
+	if paginated {
+		resp = page
 	}
 
 	w.Header().Set(headers.ContentType, mimetype.ApplicationJSON)
 	w.WriteHeader(http.StatusOK)
-	if err := json.NewEncoder(w).Encode(o); err != nil {
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
 		log.Error("Error encoding orders", zap.Error(err))
 	}
 }
 
+// orderFilterFromQuery builds an order filter from the GET /api/user/orders
+// query. The response is paginated only when limit or cursor is present,
+// otherwise every matching order is returned as before.
+func orderFilterFromQuery(q url.Values) (models.OrderFilter, bool, error) {
+	var filter models.OrderFilter
+
+	for _, v := range q["status"] {
+		for _, status := range strings.Split(v, ",") {
+			st := models.OrderStatus(strings.ToUpper(strings.TrimSpace(status)))
+			if !st.Known() {
+				return filter, false, fmt.Errorf("unknown order status %q", status)
+			}
+			filter.Statuses = append(filter.Statuses, st)
+		}
+	}
+
+	var err error
+	if v := q.Get("uploaded_from"); v != "" {
+		if filter.UploadedFrom, err = time.Parse(time.RFC3339, v); err != nil {
+			return filter, false, fmt.Errorf("invalid uploaded_from: %w", err)
+		}
+	}
+	if v := q.Get("uploaded_to"); v != "" {
+		if filter.UploadedTo, err = time.Parse(time.RFC3339, v); err != nil {
+			return filter, false, fmt.Errorf("invalid uploaded_to: %w", err)
+		}
+	}
+
+	limit, cursor := q.Get("limit"), q.Get("cursor")
+	if limit == "" && cursor == "" {
+		return filter, false, nil
+	}
+
+	filter.Limit = defaultOrdersPageSize
+	if limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil {
+			return filter, false, fmt.Errorf("invalid limit: %w", err)
+		}
+		if filter.Limit < 1 || filter.Limit > maxOrdersPageSize {
+			return filter, false, fmt.Errorf("limit must be between 1 and %d", maxOrdersPageSize)
+		}
+	}
+	if cursor != "" {
+		after, err := controllers.DecodeOrderCursor(cursor)
+		if err != nil {
+			return filter, false, err
+		}
+		filter.After = &after
+	}
+
+	return filter, true, nil
+}
+
 func (s *Server) withdraw(w http.ResponseWriter, r *http.Request) {
 	log := logger2.FromContext(r.Context())
 	userID, err := controllers.UserIDFromContext(r.Context())
 	if err != nil {
 		log.Error("orders", zap.Error(err))
-		w.WriteHeader(http.StatusInternalServerError)
+		problem.WriteError(w, r, err)
 		return
 	}
 
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		log.Error("Error reading body", zap.Error(err))
-		w.WriteHeader(http.StatusBadRequest)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeMalformedRequest, "could not read request body")
 		return
 	}
 
@@ -267,33 +681,34 @@ func (s *Server) withdraw(w http.ResponseWriter, r *http.Request) {
 	err = json.Unmarshal(body, &withdrawal)
 	if err != nil {
 		log.Error("Error decoding withdrawal", zap.Error(err), zap.ByteString("body", body))
-		w.WriteHeader(http.StatusBadRequest)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeMalformedRequest, "could not decode withdrawal")
 		return
 	}
 	order, err := withdrawal.ToOrder(userID)
 	if err != nil {
 		log.Error("Error creating order", zap.Error(err))
-		w.WriteHeader(http.StatusBadRequest)
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeOrderNumberMalformed, "")
+		return
 	}
 
 	if !order.Valid() {
 		log.Error("Invalid order id")
-		w.WriteHeader(http.StatusUnprocessableEntity)
+		problem.Write(w, r, http.StatusUnprocessableEntity, problem.CodeOrderNumberInvalid, "")
 		return
 	}
 
 	err = s.orderRepo.Withdraw(r.Context(), order)
 	switch {
-	case err == repo.ErrNotEnoughFunds:
-		log.Info("Not enough funds")
-		w.WriteHeader(http.StatusPaymentRequired)
-		return
 	case err == nil:
 		w.WriteHeader(http.StatusOK)
 		return
+	case errors.Is(err, repo.ErrNotEnoughFunds):
+		log.Info("Not enough funds")
+		problem.WriteError(w, r, err)
+		return
 	default:
 		log.Error("Internal error", zap.Error(err))
-		w.WriteHeader(http.StatusInternalServerError)
+		problem.WriteError(w, r, err)
 		return
 	}
 }
@@ -303,20 +718,144 @@ func (s *Server) currentBalance(w http.ResponseWriter, r *http.Request) {
 	userID, err := controllers.UserIDFromContext(r.Context())
 	if err != nil {
 		log.Error("orders", zap.Error(err))
-		w.WriteHeader(http.StatusInternalServerError)
+		problem.WriteError(w, r, err)
 		return
 	}
 	balancer, err := s.orderRepo.CurrentBalance(r.Context(), userID)
 	if err != nil {
 		log.Error("Internal error", zap.Error(err))
-		w.WriteHeader(http.StatusInternalServerError)
+		problem.WriteError(w, r, err)
 		return
 	}
 
 	w.Header().Set(headers.ContentType, mimetype.ApplicationJSON)
 	w.WriteHeader(http.StatusOK)
-	err = json.NewEncoder(w).Encode(balancer)
+	err = json.NewEncoder(w).Encode(controllers.BalanceModelToController(balancer))
 	if err != nil {
 		log.Error("Error encoding response", zap.Error(err))
 	}
 }
+
+// balanceHistory lists processed orders and balance adjustments with the
+// balance after each of them. It is always paginated.
+func (s *Server) balanceHistory(w http.ResponseWriter, r *http.Request) {
+	log := logger2.FromContext(r.Context())
+	userID, err := controllers.UserIDFromContext(r.Context())
+	if err != nil {
+		log.Error("balance history", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	filter, err := ledgerFilterFromQuery(r.URL.Query())
+	if err != nil {
+		log.Info("Invalid balance history query", zap.Error(err))
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidQuery, err.Error())
+		return
+	}
+	// fetch one extra entry to find out whether there is a next page
+	filter.Limit++
+
+	entries, err := s.orderRepo.BalanceHistory(r.Context(), userID, filter)
+	if err != nil {
+		log.Error("Could not retrieve balance history", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	// an empty page is still a page, as for paginated order lists
+	page := controllers.LedgerPage{Entries: []controllers.LedgerEntry{}}
+	if len(entries) == filter.Limit {
+		entries = entries[:len(entries)-1]
+		last := entries[len(entries)-1]
+		page.NextCursor = controllers.EncodeLedgerCursor(models.LedgerCursor{
+			OccurredAt: last.OccurredAt,
+			Type:       last.Type,
+			Reference:  last.Reference,
+		})
+	}
+	for _, v := range entries {
+		page.Entries = append(page.Entries, controllers.LedgerEntryModelToController(*v))
+	}
+
+	w.Header().Set(headers.ContentType, mimetype.ApplicationJSON)
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		log.Error("Error encoding balance history", zap.Error(err))
+	}
+}
+
+func ledgerFilterFromQuery(q url.Values) (models.LedgerFilter, error) {
+	filter := models.LedgerFilter{Limit: defaultOrdersPageSize}
+
+	var err error
+	if v := q.Get("from"); v != "" {
+		if filter.From, err = time.Parse(time.RFC3339, v); err != nil {
+			return filter, fmt.Errorf("invalid from: %w", err)
+		}
+	}
+	if v := q.Get("to"); v != "" {
+		if filter.To, err = time.Parse(time.RFC3339, v); err != nil {
+			return filter, fmt.Errorf("invalid to: %w", err)
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil {
+			return filter, fmt.Errorf("invalid limit: %w", err)
+		}
+		if filter.Limit < 1 || filter.Limit > maxOrdersPageSize {
+			return filter, fmt.Errorf("limit must be between 1 and %d", maxOrdersPageSize)
+		}
+	}
+	if v := q.Get("cursor"); v != "" {
+		after, err := controllers.DecodeLedgerCursor(v)
+		if err != nil {
+			return filter, err
+		}
+		filter.After = &after
+	}
+	return filter, nil
+}
+
+func (s *Server) listWithdrawals(w http.ResponseWriter, r *http.Request) {
+	log := logger2.FromContext(r.Context())
+	userID, err := controllers.UserIDFromContext(r.Context())
+	if err != nil {
+		log.Error("withdrawals", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	if format := exportFormat(r); format != "" {
+		s.exportWithdrawals(w, r, userID, format)
+		return
+	}
+
+	withdrawals, err := s.orderRepo.ListWithdrawals(r.Context(), userID)
+	if err != nil {
+		log.Error("Could not retrieve withdrawals", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	if len(withdrawals) == 0 {
+		log.Info("No withdrawals to return")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	sort.Slice(withdrawals, func(i, j int) bool {
+		return withdrawals[i].ProcessedAt.After(withdrawals[j].ProcessedAt)
+	})
+
+	var res []controllers.WithdrawalInfo
+	for _, v := range withdrawals {
+		res = append(res, controllers.WithdrawalModelToController(*v))
+	}
+
+	w.Header().Set(headers.ContentType, mimetype.ApplicationJSON)
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Error("Error encoding withdrawals", zap.Error(err))
+	}
+}
@@ -0,0 +1,831 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-http-utils/headers"
+	"github.com/ldez/mimetype"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/controllers"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/logger"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/problem"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/repo"
+)
+
+var testSalt = "test_salt"
+
+type fakeUserRepo struct {
+	repo.UserRepository
+	users map[string]string
+}
+
+func (f *fakeUserRepo) Create(_ context.Context, username string, password string) (int, error) {
+	if _, ok := f.users[username]; ok {
+		return -1, repo.ErrUserAlreadyExists
+	}
+	f.users[username] = password
+	return len(f.users), nil
+}
+
+func (f *fakeUserRepo) Authenticate(_ context.Context, username string, password string) (int, error) {
+	if stored, ok := f.users[username]; !ok || stored != password {
+		return -1, repo.ErrUserAuthFailed
+	}
+	return 1, nil
+}
+
+type fakeOrderRepo struct {
+	repo.OrderRepository
+	orders      map[int][]*models.Order
+	withdrawals map[int][]*models.Order
+	owners      map[int]int
+	history     map[int][]*models.OrderTransition
+	ledger      []*models.LedgerEntry
+	balance     models.Balance
+	adjustments map[int]int64
+	err         error
+
+	withdrawCalls int
+
+	mu     sync.Mutex
+	events []*models.OrderEvent
+}
+
+func (f *fakeOrderRepo) addEvent(e *models.OrderEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = append(f.events, e)
+}
+
+func (f *fakeOrderRepo) ListOrderEvents(_ context.Context, userID int, afterID int64, limit int) ([]*models.OrderEvent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var res []*models.OrderEvent
+	for _, e := range f.events {
+		if e.UserID == userID && e.EventID > afterID && len(res) < limit {
+			res = append(res, e)
+		}
+	}
+	return res, nil
+}
+
+func (f *fakeOrderRepo) LastOrderEventID(_ context.Context, userID int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var id int64
+	for _, e := range f.events {
+		if e.UserID == userID && e.EventID > id {
+			id = e.EventID
+		}
+	}
+	return id, nil
+}
+
+func (f *fakeOrderRepo) CreateNewOrders(_ context.Context, orders []models.Order) ([]error, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if f.owners == nil {
+		f.owners = map[int]int{}
+	}
+
+	results := make([]error, len(orders))
+	for i, o := range orders {
+		owner, ok := f.owners[o.OrderID]
+		switch {
+		case !ok:
+			f.owners[o.OrderID] = o.UserID
+		case owner == o.UserID:
+			results[i] = repo.ErrOrderAlreadyUploadedByCurrentUser
+		default:
+			results[i] = repo.ErrOrderCreatedByAnotherUser
+		}
+	}
+	return results, nil
+}
+
+func (f *fakeOrderRepo) CreateNewOrder(ctx context.Context, order models.Order) error {
+	errs, err := f.CreateNewOrders(ctx, []models.Order{order})
+	if err != nil {
+		return err
+	}
+	return errs[0]
+}
+
+func (f *fakeOrderRepo) CurrentBalance(_ context.Context, _ int) (models.Balance, error) {
+	return f.balance, f.err
+}
+
+func (f *fakeOrderRepo) OrdersVersion(_ context.Context, userID int) (models.OrdersVersion, error) {
+	if f.err != nil {
+		return models.OrdersVersion{}, f.err
+	}
+
+	version := models.OrdersVersion{Adjustments: f.adjustments[userID]}
+	orders := append([]*models.Order{}, f.orders[userID]...)
+	for _, o := range append(orders, f.withdrawals[userID]...) {
+		version.Count++
+		if o.UploadedAt.After(version.LastUploadedAt) {
+			version.LastUploadedAt = o.UploadedAt
+		}
+		if o.ProcessedAt.After(version.LastProcessedAt) {
+			version.LastProcessedAt = o.ProcessedAt
+		}
+	}
+	return version, nil
+}
+
+// FindOrders expects orders of each user to be stored sorted by upload time.
+func (f *fakeOrderRepo) FindOrders(_ context.Context, userID int, filter models.OrderFilter) ([]*models.Order, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	var res []*models.Order
+	for _, o := range f.orders[userID] {
+		if len(filter.Statuses) > 0 && !containsStatus(filter.Statuses, o.Status) {
+			continue
+		}
+		if !filter.UploadedFrom.IsZero() && o.UploadedAt.Before(filter.UploadedFrom) {
+			continue
+		}
+		if !filter.UploadedTo.IsZero() && !o.UploadedAt.Before(filter.UploadedTo) {
+			continue
+		}
+		if filter.After != nil && !o.UploadedAt.After(filter.After.UploadedAt) &&
+			!(o.UploadedAt.Equal(filter.After.UploadedAt) && o.OrderID > filter.After.OrderID) {
+			continue
+		}
+		res = append(res, o)
+		if filter.Limit > 0 && len(res) == filter.Limit {
+			break
+		}
+	}
+	return res, nil
+}
+
+func (f *fakeOrderRepo) StreamOrders(ctx context.Context, userID int, orderType models.OrderType, filter models.OrderFilter, fn func(models.Order) error) error {
+	orders := f.withdrawals[userID]
+	if orderType == models.DepositOrder {
+		var err error
+		if orders, err = f.FindOrders(ctx, userID, filter); err != nil {
+			return err
+		}
+	}
+	for _, o := range orders {
+		if err := fn(*o); err != nil {
+			return err
+		}
+	}
+	return f.err
+}
+
+func containsStatus(list []models.OrderStatus, status models.OrderStatus) bool {
+	for _, v := range list {
+		if v == status {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeOrderRepo) Withdraw(_ context.Context, _ models.Order) error {
+	f.withdrawCalls++
+	return f.err
+}
+
+func (f *fakeOrderRepo) ListOrders(_ context.Context, userID int) ([]*models.Order, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.orders[userID], nil
+}
+
+func (f *fakeOrderRepo) GetOrder(_ context.Context, orderID int) (models.Order, error) {
+	if f.err != nil {
+		return models.Order{}, f.err
+	}
+	for _, orders := range f.orders {
+		for _, o := range orders {
+			if o.OrderID == orderID {
+				return *o, nil
+			}
+		}
+	}
+	return models.Order{}, repo.ErrOrderNotFound
+}
+
+func (f *fakeOrderRepo) OrderHistory(_ context.Context, orderID int) ([]*models.OrderTransition, error) {
+	return f.history[orderID], f.err
+}
+
+func (f *fakeOrderRepo) UpdateOrder(_ context.Context, order models.Order) error {
+	if f.err != nil {
+		return f.err
+	}
+	for _, orders := range f.orders {
+		for i, o := range orders {
+			if o.OrderID == order.OrderID {
+				orders[i] = &order
+				return nil
+			}
+		}
+	}
+	return repo.ErrOrderNotFound
+}
+
+func (f *fakeOrderRepo) ForceOrderStatus(ctx context.Context, order models.Order, adminID int, reason string) error {
+	if err := f.UpdateOrder(ctx, order); err != nil {
+		return err
+	}
+	if f.history == nil {
+		f.history = map[int][]*models.OrderTransition{}
+	}
+	f.history[order.OrderID] = append(f.history[order.OrderID], &models.OrderTransition{
+		OrderID:   order.OrderID,
+		Status:    order.Status,
+		Accrual:   order.Accrual,
+		ChangedAt: order.ProcessedAt,
+		AdminID:   adminID,
+		Reason:    reason,
+	})
+	return nil
+}
+
+func (f *fakeOrderRepo) CancelOrder(_ context.Context, userID int, orderID int) error {
+	if f.err != nil {
+		return f.err
+	}
+	orders := f.orders[userID]
+	for i, o := range orders {
+		if o.OrderID != orderID || o.TXType != models.DepositOrder {
+			continue
+		}
+		if o.Status != models.NewStatus {
+			return repo.ErrOrderNotCancellable
+		}
+		f.orders[userID] = append(orders[:i], orders[i+1:]...)
+		return nil
+	}
+	return repo.ErrOrderNotFound
+}
+
+func (f *fakeOrderRepo) BalanceHistory(_ context.Context, _ int, filter models.LedgerFilter) ([]*models.LedgerEntry, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	var entries []*models.LedgerEntry
+	for _, e := range f.ledger {
+		if filter.After != nil && !e.OccurredAt.After(filter.After.OccurredAt) {
+			continue
+		}
+		entries = append(entries, e)
+		if len(entries) == filter.Limit {
+			break
+		}
+	}
+	return entries, nil
+}
+
+func (f *fakeOrderRepo) ListWithdrawals(_ context.Context, userID int) ([]*models.Order, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.withdrawals[userID], nil
+}
+
+func newTestServer(t *testing.T, orderRepo repo.OrderRepository) *Server {
+	t.Helper()
+	return NewServer(logger.NewNoop(), nil, orderRepo, testSalt)
+}
+
+func authenticatedRequest(t *testing.T, srv *Server, method, target string, userID int) *http.Request {
+	t.Helper()
+	return authenticatedRequestWithBody(t, srv, method, target, userID, nil)
+}
+
+func authenticatedRequestWithBody(t *testing.T, srv *Server, method, target string, userID int, body io.Reader) *http.Request {
+	t.Helper()
+	claim, err := srv.jwtAuth.CreateClaim(userID)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(method, target, body)
+	req.AddCookie(claim)
+	return req
+}
+
+func TestServer_listWithdrawals(t *testing.T) {
+	older := time.Date(2022, time.April, 10, 9, 0, 0, 0, time.UTC)
+	newer := time.Date(2022, time.April, 12, 9, 0, 0, 0, time.UTC)
+
+	orderRepo := &fakeOrderRepo{withdrawals: map[int][]*models.Order{
+		1: {
+			{OrderID: 79927398713, TXType: models.WithdrawalOrder, Accrual: decimal.NewFromInt(100), UserID: 1, ProcessedAt: older},
+			{OrderID: 2377225624, TXType: models.WithdrawalOrder, Accrual: decimal.RequireFromString("42.5"), UserID: 1, ProcessedAt: newer},
+		},
+	}}
+
+	t.Run("sorted newest first", func(t *testing.T) {
+		srv := newTestServer(t, orderRepo)
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, authenticatedRequest(t, srv, http.MethodGet, "/api/user/withdrawals", 1))
+
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, mimetype.ApplicationJSON, rec.Header().Get(headers.ContentType))
+
+		var got []controllers.WithdrawalInfo
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&got))
+		require.Equal(t, []controllers.WithdrawalInfo{
+			{Order: "2377225624", Sum: 42.5, ProcessedAt: newer.Format(time.RFC3339)},
+			{Order: "79927398713", Sum: 100, ProcessedAt: older.Format(time.RFC3339)},
+		}, got)
+	})
+
+	t.Run("no withdrawals", func(t *testing.T) {
+		srv := newTestServer(t, orderRepo)
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, authenticatedRequest(t, srv, http.MethodGet, "/api/user/withdrawals", 2))
+
+		require.Equal(t, http.StatusNoContent, rec.Code)
+		require.Empty(t, rec.Body.Bytes())
+	})
+
+	t.Run("repository error", func(t *testing.T) {
+		srv := newTestServer(t, &fakeOrderRepo{err: repo.ErrInternalError})
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, authenticatedRequest(t, srv, http.MethodGet, "/api/user/withdrawals", 1))
+
+		require.Equal(t, http.StatusInternalServerError, rec.Code)
+	})
+
+	t.Run("unauthenticated", func(t *testing.T) {
+		srv := newTestServer(t, orderRepo)
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/user/withdrawals", nil))
+
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+}
+
+func TestServer_getOrder(t *testing.T) {
+	base := time.Date(2022, time.April, 10, 9, 0, 0, 0, time.UTC)
+	orderRepo := &fakeOrderRepo{orders: map[int][]*models.Order{
+		1: {
+			{OrderID: 79927398713, Status: models.ProcessedStatus, Accrual: decimal.NewFromInt(500), UserID: 1, UploadedAt: base},
+			{OrderID: 2377225624, Status: models.NewStatus, UserID: 1, UploadedAt: base.Add(time.Hour)},
+			{OrderID: 12345678903, Status: models.InvalidStatus, UserID: 1, UploadedAt: base.Add(2 * time.Hour)},
+		},
+	}}
+
+	get := func(t *testing.T, query url.Values) *httptest.ResponseRecorder {
+		t.Helper()
+		srv := newTestServer(t, orderRepo)
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, authenticatedRequest(t, srv, http.MethodGet, "/api/user/orders?"+query.Encode(), 1))
+		return rec
+	}
+
+	t.Run("unpaginated", func(t *testing.T) {
+		rec := get(t, nil)
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var got []controllers.Order
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&got))
+		require.Len(t, got, 3)
+		require.Equal(t, "79927398713", got[0].Number)
+		require.Equal(t, "12345678903", got[2].Number)
+	})
+
+	t.Run("paginated", func(t *testing.T) {
+		var numbers []string
+		cursor := ""
+		for i := 0; i < 2; i++ {
+			q := url.Values{"limit": {"2"}}
+			if cursor != "" {
+				q.Set("cursor", cursor)
+			}
+			rec := get(t, q)
+			require.Equal(t, http.StatusOK, rec.Code)
+
+			var page controllers.OrderPage
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&page))
+			for _, o := range page.Orders {
+				numbers = append(numbers, o.Number)
+			}
+			cursor = page.NextCursor
+		}
+
+		require.Empty(t, cursor)
+		require.Equal(t, []string{"79927398713", "2377225624", "12345678903"}, numbers)
+	})
+
+	t.Run("no matches", func(t *testing.T) {
+		query := url.Values{"uploaded_from": {base.Add(24 * time.Hour).Format(time.RFC3339)}}
+		rec := get(t, query)
+		require.Equal(t, http.StatusNoContent, rec.Code)
+		require.Empty(t, rec.Body.Bytes())
+
+		query.Set("limit", "2")
+		rec = get(t, query)
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.JSONEq(t, `{"orders": []}`, rec.Body.String())
+	})
+
+	t.Run("filtered", func(t *testing.T) {
+		rec := get(t, url.Values{
+			"status":        {"new,invalid"},
+			"uploaded_from": {base.Add(90 * time.Minute).Format(time.RFC3339)},
+		})
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var got []controllers.Order
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&got))
+		require.Len(t, got, 1)
+		require.Equal(t, models.InvalidStatus, got[0].Status)
+	})
+
+	t.Run("invalid query", func(t *testing.T) {
+		for _, q := range []url.Values{
+			{"limit": {"0"}},
+			{"limit": {"abc"}},
+			{"cursor": {"%%%"}},
+			{"status": {"DONE"}},
+			{"uploaded_to": {"yesterday"}},
+		} {
+			rec := get(t, q)
+			require.Equal(t, http.StatusBadRequest, rec.Code, q.Encode())
+		}
+	})
+}
+
+func TestServer_createOrdersBatch(t *testing.T) {
+	orderRepo := &fakeOrderRepo{owners: map[int]int{
+		2377225624:  1,
+		12345678903: 2,
+	}}
+
+	post := func(t *testing.T, contentType, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		srv := newTestServer(t, orderRepo)
+		req := authenticatedRequestWithBody(t, srv, http.MethodPost, "/api/user/orders/batch", 1, strings.NewReader(body))
+		req.Header.Set(headers.ContentType, contentType)
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("json", func(t *testing.T) {
+		rec := post(t, mimetype.ApplicationJSON, `["79927398713", 2377225624, "12345678903", "12345", "abc"]`)
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var got []controllers.BatchOrderResult
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&got))
+		require.Equal(t, []controllers.BatchOrderResult{
+			{Number: "79927398713", Result: controllers.BatchOrderAccepted},
+			{Number: "2377225624", Result: controllers.BatchOrderAlreadyUploaded},
+			{Number: "12345678903", Result: controllers.BatchOrderConflict},
+			{Number: "12345", Result: controllers.BatchOrderInvalid},
+			{Number: "abc", Result: controllers.BatchOrderInvalid},
+		}, got)
+	})
+
+	t.Run("text", func(t *testing.T) {
+		rec := post(t, mimetype.TextPlain, "4561261212345467\n\n  79927398713 \n")
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var got []controllers.BatchOrderResult
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&got))
+		require.Equal(t, []controllers.BatchOrderResult{
+			{Number: "4561261212345467", Result: controllers.BatchOrderAccepted},
+			{Number: "79927398713", Result: controllers.BatchOrderAlreadyUploaded},
+		}, got)
+	})
+
+	t.Run("bad requests", func(t *testing.T) {
+		require.Equal(t, http.StatusBadRequest, post(t, mimetype.ApplicationJSON, `{"order": 1}`).Code)
+		require.Equal(t, http.StatusBadRequest, post(t, mimetype.ApplicationJSON, `[]`).Code)
+		require.Equal(t, http.StatusBadRequest, post(t, mimetype.TextPlain, "\n\n").Code)
+		require.Equal(t, http.StatusBadRequest, post(t, mimetype.TextHTML, "79927398713").Code)
+	})
+}
+
+func TestServer_problemResponses(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		contentType string
+		body        string
+		status      int
+		code        problem.Code
+	}{
+		{"unparseable order", http.MethodPost, "/api/user/orders", mimetype.TextPlain, "abc", http.StatusUnprocessableEntity, problem.CodeOrderNumberMalformed},
+		{"luhn invalid order", http.MethodPost, "/api/user/orders", mimetype.TextPlain, "12345", http.StatusUnprocessableEntity, problem.CodeOrderNumberInvalid},
+		{"wrong content type", http.MethodPost, "/api/user/orders", mimetype.ApplicationJSON, "79927398713", http.StatusBadRequest, problem.CodeUnsupportedMediaType},
+		{"not enough funds", http.MethodPost, "/api/user/balance/withdraw", mimetype.ApplicationJSON, `{"order": "2377225624", "sum": 751}`, http.StatusPaymentRequired, problem.CodeNotEnoughFunds},
+		{"invalid query", http.MethodGet, "/api/user/orders?limit=-1", "", "", http.StatusBadRequest, problem.CodeInvalidQuery},
+		{"unknown route", http.MethodGet, "/api/user/unknown", "", "", http.StatusNotFound, problem.CodeNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t, &fakeOrderRepo{err: repo.ErrNotEnoughFunds})
+			req := authenticatedRequestWithBody(t, srv, tt.method, tt.target, 1, strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set(headers.ContentType, tt.contentType)
+			}
+			rec := httptest.NewRecorder()
+			srv.ServeHTTP(rec, req)
+
+			require.Equal(t, tt.status, rec.Code)
+			require.Equal(t, problem.ContentType, rec.Header().Get(headers.ContentType))
+
+			var got problem.Problem
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&got))
+			require.Equal(t, tt.code, got.Code)
+			require.Equal(t, tt.status, got.Status)
+			require.NotEmpty(t, got.Title)
+			require.NotEmpty(t, got.RequestID)
+		})
+	}
+
+	t.Run("unauthenticated", func(t *testing.T) {
+		srv := newTestServer(t, &fakeOrderRepo{})
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/user/orders", nil))
+
+		var got problem.Problem
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&got))
+		require.Equal(t, http.StatusUnauthorized, got.Status)
+		require.Equal(t, problem.CodeUnauthorized, got.Code)
+	})
+}
+
+type fakeIdempotencyRepo struct {
+	requests map[string]models.IdempotentRequest
+}
+
+func (f *fakeIdempotencyRepo) id(userID int, key string) string {
+	return fmt.Sprintf("%d/%s", userID, key)
+}
+
+func (f *fakeIdempotencyRepo) Reserve(_ context.Context, req models.IdempotentRequest, notBefore time.Time) (models.IdempotentRequest, bool, error) {
+	if stored, ok := f.requests[f.id(req.UserID, req.Key)]; ok && !stored.CreatedAt.Before(notBefore) {
+		return stored, false, nil
+	}
+	f.requests[f.id(req.UserID, req.Key)] = req
+	return req, true, nil
+}
+
+func (f *fakeIdempotencyRepo) Complete(ctx context.Context, req models.IdempotentRequest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f.requests[f.id(req.UserID, req.Key)] = req
+	return nil
+}
+
+func (f *fakeIdempotencyRepo) Release(ctx context.Context, userID int, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	delete(f.requests, f.id(userID, key))
+	return nil
+}
+
+func (f *fakeIdempotencyRepo) DeleteExpired(_ context.Context, _ time.Time) (int64, error) {
+	return 0, nil
+}
+
+func TestServer_withdrawIdempotency(t *testing.T) {
+	body := `{"order": "2377225624", "sum": 751}`
+
+	withdraw := func(t *testing.T, srv *Server, key, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := authenticatedRequestWithBody(t, srv, http.MethodPost, "/api/user/balance/withdraw", 1, strings.NewReader(body))
+		req.Header.Set(headers.ContentType, mimetype.ApplicationJSON)
+		if key != "" {
+			req.Header.Set(idempotencyKeyHeader, key)
+		}
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("retry is replayed", func(t *testing.T) {
+		orderRepo := &fakeOrderRepo{err: repo.ErrNotEnoughFunds}
+		srv := NewServer(logger.NewNoop(), nil, orderRepo, testSalt,
+			WithIdempotency(&fakeIdempotencyRepo{requests: map[string]models.IdempotentRequest{}}, time.Hour))
+
+		first := withdraw(t, srv, "key-1", body)
+		require.Equal(t, http.StatusPaymentRequired, first.Code)
+
+		retry := withdraw(t, srv, "key-1", body)
+		require.Equal(t, http.StatusPaymentRequired, retry.Code)
+		require.Equal(t, "true", retry.Header().Get(idempotentReplayedHeader))
+		require.Equal(t, problem.ContentType, retry.Header().Get(headers.ContentType))
+		require.Equal(t, first.Body.String(), retry.Body.String())
+		require.Equal(t, 1, orderRepo.withdrawCalls)
+
+		withdraw(t, srv, "key-2", body)
+		withdraw(t, srv, "", body)
+		require.Equal(t, 3, orderRepo.withdrawCalls)
+	})
+
+	t.Run("different body", func(t *testing.T) {
+		orderRepo := &fakeOrderRepo{}
+		srv := NewServer(logger.NewNoop(), nil, orderRepo, testSalt,
+			WithIdempotency(&fakeIdempotencyRepo{requests: map[string]models.IdempotentRequest{}}, time.Hour))
+
+		require.Equal(t, http.StatusOK, withdraw(t, srv, "key", body).Code)
+
+		rec := withdraw(t, srv, "key", `{"order": "79927398713", "sum": 751}`)
+		require.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+		var got problem.Problem
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&got))
+		require.Equal(t, problem.CodeIdempotencyKeyReused, got.Code)
+		require.Equal(t, 1, orderRepo.withdrawCalls)
+	})
+
+	t.Run("in progress", func(t *testing.T) {
+		orderRepo := &fakeOrderRepo{}
+		idempotencyRepo := &fakeIdempotencyRepo{requests: map[string]models.IdempotentRequest{}}
+		srv := NewServer(logger.NewNoop(), nil, orderRepo, testSalt, WithIdempotency(idempotencyRepo, time.Hour))
+
+		require.Equal(t, http.StatusOK, withdraw(t, srv, "key", body).Code)
+		stored := idempotencyRepo.requests[idempotencyRepo.id(1, "key")]
+		stored.Status = 0
+		idempotencyRepo.requests[idempotencyRepo.id(1, "key")] = stored
+
+		require.Equal(t, http.StatusConflict, withdraw(t, srv, "key", body).Code)
+		require.Equal(t, 1, orderRepo.withdrawCalls)
+	})
+
+	t.Run("server errors are not stored", func(t *testing.T) {
+		orderRepo := &fakeOrderRepo{err: repo.ErrInternalError}
+		srv := NewServer(logger.NewNoop(), nil, orderRepo, testSalt,
+			WithIdempotency(&fakeIdempotencyRepo{requests: map[string]models.IdempotentRequest{}}, time.Hour))
+
+		require.Equal(t, http.StatusInternalServerError, withdraw(t, srv, "key", body).Code)
+		require.Equal(t, http.StatusInternalServerError, withdraw(t, srv, "key", body).Code)
+		require.Equal(t, 2, orderRepo.withdrawCalls)
+	})
+}
+
+func TestServer_getOrderDetail(t *testing.T) {
+	uploadedAt := time.Date(2022, time.July, 15, 9, 0, 0, 0, time.UTC)
+	orderRepo := &fakeOrderRepo{
+		orders: map[int][]*models.Order{
+			1: {
+				{OrderID: 79927398713, UserID: 1, Status: models.ProcessedStatus, TXType: models.DepositOrder, Accrual: decimal.NewFromInt(500), UploadedAt: uploadedAt},
+				{OrderID: 2377225624, UserID: 1, Status: models.ProcessedStatus, TXType: models.WithdrawalOrder, UploadedAt: uploadedAt},
+			},
+			2: {
+				{OrderID: 12345678903, UserID: 2, Status: models.NewStatus, TXType: models.DepositOrder, UploadedAt: uploadedAt},
+			},
+		},
+		history: map[int][]*models.OrderTransition{
+			79927398713: {
+				{OrderID: 79927398713, Status: models.NewStatus, ChangedAt: uploadedAt},
+				{OrderID: 79927398713, Status: models.ProcessingStatus, ChangedAt: uploadedAt.Add(time.Minute)},
+				{OrderID: 79927398713, Status: models.ProcessedStatus, Accrual: decimal.NewFromInt(500), ChangedAt: uploadedAt.Add(time.Hour)},
+			},
+		},
+	}
+	srv := newTestServer(t, orderRepo)
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, authenticatedRequest(t, srv, http.MethodGet, "/api/user/orders/79927398713", 1))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `{
+		"number": "79927398713",
+		"status": "PROCESSED",
+		"accrual": 500,
+		"uploaded_at": "2022-07-15T09:00:00Z",
+		"history": [
+			{"status": "NEW", "changed_at": "2022-07-15T09:00:00Z"},
+			{"status": "PROCESSING", "changed_at": "2022-07-15T09:01:00Z"},
+			{"status": "PROCESSED", "accrual": 500, "changed_at": "2022-07-15T10:00:00Z"}
+		]
+	}`, rec.Body.String())
+
+	tests := []struct {
+		name     string
+		target   string
+		wantCode int
+	}{
+		{"another user's order", "/api/user/orders/12345678903", http.StatusNotFound},
+		{"withdrawal", "/api/user/orders/2377225624", http.StatusNotFound},
+		{"unknown order", "/api/user/orders/4561261212345467", http.StatusNotFound},
+		{"not a number", "/api/user/orders/abc", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			srv.ServeHTTP(rec, authenticatedRequest(t, srv, http.MethodGet, tt.target, 1))
+			require.Equal(t, tt.wantCode, rec.Code)
+		})
+	}
+}
+
+func TestServer_cancelOrder(t *testing.T) {
+	orderRepo := &fakeOrderRepo{
+		orders: map[int][]*models.Order{
+			1: {
+				{OrderID: 79927398713, UserID: 1, Status: models.NewStatus, TXType: models.DepositOrder},
+				{OrderID: 2377225624, UserID: 1, Status: models.ProcessedStatus, TXType: models.DepositOrder},
+			},
+			2: {
+				{OrderID: 12345678903, UserID: 2, Status: models.NewStatus, TXType: models.DepositOrder},
+			},
+		},
+	}
+	srv := newTestServer(t, orderRepo)
+
+	tests := []struct {
+		name        string
+		target      string
+		wantCode    int
+		wantProblem problem.Code
+	}{
+		{"new order", "/api/user/orders/79927398713", http.StatusNoContent, ""},
+		{"already cancelled", "/api/user/orders/79927398713", http.StatusNotFound, problem.CodeOrderNotFound},
+		{"processed order", "/api/user/orders/2377225624", http.StatusConflict, problem.CodeOrderNotCancellable},
+		{"another user's order", "/api/user/orders/12345678903", http.StatusNotFound, problem.CodeOrderNotFound},
+		{"not a number", "/api/user/orders/abc", http.StatusBadRequest, problem.CodeOrderNumberMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			srv.ServeHTTP(rec, authenticatedRequest(t, srv, http.MethodDelete, tt.target, 1))
+			require.Equal(t, tt.wantCode, rec.Code)
+			if tt.wantProblem != "" {
+				var p problem.Problem
+				require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &p))
+				require.Equal(t, tt.wantProblem, p.Code)
+			}
+		})
+	}
+	require.Len(t, orderRepo.orders[1], 1)
+	require.Len(t, orderRepo.orders[2], 1)
+}
+
+func TestServer_balanceHistory(t *testing.T) {
+	at := time.Date(2022, time.July, 20, 9, 0, 0, 0, time.UTC)
+	orderRepo := &fakeOrderRepo{ledger: []*models.LedgerEntry{
+		{Type: models.LedgerDeposit, Reference: 79927398713, Amount: decimal.NewFromInt(500), Balance: decimal.NewFromInt(500), OccurredAt: at},
+		{Type: models.LedgerWithdrawal, Reference: 2377225624, Amount: decimal.NewFromInt(-200), Balance: decimal.NewFromInt(300), OccurredAt: at.Add(time.Hour)},
+		{Type: models.LedgerAdjustment, Reference: 7, Amount: decimal.RequireFromString("12.5"), Balance: decimal.RequireFromString("312.5"), OccurredAt: at.Add(2 * time.Hour)},
+	}}
+	srv := newTestServer(t, orderRepo)
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, authenticatedRequest(t, srv, http.MethodGet, "/api/user/balance/history?limit=2", 1))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var page controllers.LedgerPage
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &page))
+	require.Equal(t, []controllers.LedgerEntry{
+		{Type: models.LedgerDeposit, Order: "79927398713", Amount: 500, Balance: 500, OccurredAt: "2022-07-20T09:00:00Z"},
+		{Type: models.LedgerWithdrawal, Order: "2377225624", Amount: -200, Balance: 300, OccurredAt: "2022-07-20T10:00:00Z"},
+	}, page.Entries)
+	require.NotEmpty(t, page.NextCursor)
+
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, authenticatedRequest(t, srv, http.MethodGet, "/api/user/balance/history?limit=2&cursor="+page.NextCursor, 1))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `{"entries": [
+		{"type": "adjustment", "adjustment_id": 7, "amount": 12.5, "balance": 312.5, "occurred_at": "2022-07-20T11:00:00Z"}
+	]}`, rec.Body.String())
+
+	for _, target := range []string{
+		"/api/user/balance/history?from=yesterday",
+		"/api/user/balance/history?limit=0",
+		"/api/user/balance/history?cursor=bm9wZQ",
+	} {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, authenticatedRequest(t, srv, http.MethodGet, target, 1))
+		require.Equal(t, http.StatusBadRequest, rec.Code, target)
+	}
+
+	srv = newTestServer(t, &fakeOrderRepo{})
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, authenticatedRequest(t, srv, http.MethodGet, "/api/user/balance/history", 1))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `{"entries": []}`, rec.Body.String())
+}
@@ -0,0 +1,310 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-http-utils/headers"
+	"github.com/ldez/mimetype"
+	"github.com/shopspring/decimal"
+	"go.uber.org/zap"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/controllers"
+	logger2 "github.com/OmAsana/go-yapraktikum-final/pkg/logger"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/problem"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/repo"
+)
+
+// maxOrderNumberLength is the longest order number that fits the BIGINT
+// order_id column. Order numbers are still stored as integers, so longer
+// numbers and numbers with leading zeros are rejected with
+// problem.CodeUnsupportedNumber rather than truncated or changed.
+const maxOrderNumberLength = 19
+
+// routeV2 mounts the /api/v2/user tree. It shares the authentication and
+// repositories with v1 but only accepts order numbers as strings, returns
+// amounts as fixed-precision decimal strings and wraps every successful
+// response in controllers.Envelope.
+func (s *Server) routeV2(r chi.Router) {
+	r.With(s.limitByIP, withContentType(mimetype.ApplicationJSON)).Post("/register", s.registerV2)
+	r.With(s.limitByIP, withContentType(mimetype.ApplicationJSON)).Post("/login", s.loginV2)
+	r.Group(func(r chi.Router) {
+		r.Use(s.jwtAuth.Middleware(s.authTransports.V2))
+		r.Use(s.limitByUser)
+		r.With(withContentType(mimetype.ApplicationJSON)).Post("/orders", s.createOrderV2)
+		r.With(s.withOrdersETag).Get("/orders", s.listOrdersV2)
+		r.Get("/withdrawals", s.listWithdrawalsV2)
+		r.Route("/balance", func(r chi.Router) {
+			r.With(s.withOrdersETag).Get("/", s.currentBalanceV2)
+			r.With(withContentType(mimetype.ApplicationJSON), s.idempotent).Post("/withdraw", s.withdrawV2)
+		})
+	})
+}
+
+func writeEnvelope(w http.ResponseWriter, r *http.Request, status int, data interface{}, meta *controllers.Meta) {
+	w.Header().Set(headers.ContentType, mimetype.ApplicationJSON)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(controllers.Envelope{Data: data, Meta: meta}); err != nil {
+		logger2.FromContext(r.Context()).Error("Error encoding response", zap.Error(err))
+	}
+}
+
+func (s *Server) registerV2(w http.ResponseWriter, r *http.Request) {
+	s.authenticateV2(w, r, s.userRepo.Create)
+}
+
+func (s *Server) loginV2(w http.ResponseWriter, r *http.Request) {
+	s.authenticateV2(w, r, s.userRepo.Authenticate)
+}
+
+func (s *Server) authenticateV2(w http.ResponseWriter, r *http.Request, auth func(ctx context.Context, username string, password string) (int, error)) {
+	log := logger2.FromContext(r.Context())
+
+	var creds controllers.Credentials
+	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+		log.Error("Error decoding user", zap.Error(err))
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeMalformedRequest, "could not decode credentials")
+		return
+	}
+
+	userID, err := auth(r.Context(), creds.Login, creds.Password)
+	if err != nil {
+		log.Error("Error authenticating user", zap.Error(err), zap.String("user", creds.Login))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	session, err := s.startSession(r.Context(), w, userID)
+	if err != nil {
+		log.Error("could not create jwt claim", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+	writeEnvelope(w, r, http.StatusOK, session, nil)
+}
+
+// orderNumberV2 parses an order number sent as a string and writes a
+// problem if it is not a valid one or can not be stored as is.
+func orderNumberV2(w http.ResponseWriter, r *http.Request, number string) (int, bool) {
+	if number == "" {
+		problem.Write(w, r, http.StatusUnprocessableEntity, problem.CodeOrderNumberMalformed, "order number is empty")
+		return 0, false
+	}
+	for _, c := range number {
+		if c < '0' || c > '9' {
+			problem.Write(w, r, http.StatusUnprocessableEntity, problem.CodeOrderNumberMalformed, "order number must contain only digits")
+			return 0, false
+		}
+	}
+
+	if len(number) > 1 && number[0] == '0' {
+		problem.Write(w, r, http.StatusUnprocessableEntity, problem.CodeUnsupportedNumber, "order numbers with leading zeros are not supported")
+		return 0, false
+	}
+	orderID, err := strconv.ParseInt(number, 10, 64)
+	if len(number) > maxOrderNumberLength || err != nil {
+		problem.Write(w, r, http.StatusUnprocessableEntity, problem.CodeUnsupportedNumber,
+			"order numbers above "+strconv.FormatInt(math.MaxInt64, 10)+" are not supported")
+		return 0, false
+	}
+	if !models.NewOrder(int(orderID), 0).Valid() {
+		problem.Write(w, r, http.StatusUnprocessableEntity, problem.CodeOrderNumberInvalid, "")
+		return 0, false
+	}
+	return int(orderID), true
+}
+
+// amountV2 parses a positive amount with at most controllers.AmountPlaces
+// fraction digits and writes a problem otherwise.
+func amountV2(w http.ResponseWriter, r *http.Request, amount string) (decimal.Decimal, bool) {
+	d, err := decimal.NewFromString(amount)
+	if err != nil || !d.IsPositive() || !d.Equal(d.Truncate(controllers.AmountPlaces)) {
+		problem.Write(w, r, http.StatusUnprocessableEntity, problem.CodeInvalidAmount,
+			"amount must be a positive decimal with at most "+strconv.Itoa(controllers.AmountPlaces)+" fraction digits")
+		return decimal.Decimal{}, false
+	}
+	return d, true
+}
+
+func (s *Server) createOrderV2(w http.ResponseWriter, r *http.Request) {
+	log := logger2.FromContext(r.Context())
+	userID, err := controllers.UserIDFromContext(r.Context())
+	if err != nil {
+		log.Error("orders", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	var req controllers.OrderRequestV2
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Error("Error decoding order", zap.Error(err))
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeMalformedRequest, "could not decode order")
+		return
+	}
+
+	orderID, ok := orderNumberV2(w, r, req.Number)
+	if !ok {
+		return
+	}
+
+	err = s.orderRepo.CreateNewOrder(r.Context(), models.NewOrder(orderID, userID))
+	switch {
+	case err == nil:
+		writeEnvelope(w, r, http.StatusAccepted, controllers.BatchOrderResult{Number: req.Number, Result: controllers.BatchOrderAccepted}, nil)
+	case errors.Is(err, repo.ErrOrderAlreadyUploadedByCurrentUser):
+		writeEnvelope(w, r, http.StatusOK, controllers.BatchOrderResult{Number: req.Number, Result: controllers.BatchOrderAlreadyUploaded}, nil)
+	default:
+		log.Error("Error creating order", zap.Error(err))
+		problem.WriteError(w, r, err)
+	}
+}
+
+// listOrdersV2 takes the same query as GET /api/user/orders, but the
+// response is always paginated.
+func (s *Server) listOrdersV2(w http.ResponseWriter, r *http.Request) {
+	log := logger2.FromContext(r.Context())
+	userID, err := controllers.UserIDFromContext(r.Context())
+	if err != nil {
+		log.Error("orders", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	filter, paginated, err := orderFilterFromQuery(r.URL.Query())
+	if err != nil {
+		log.Info("Invalid orders query", zap.Error(err))
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeInvalidQuery, err.Error())
+		return
+	}
+	if !paginated {
+		filter.Limit = defaultOrdersPageSize
+	}
+	filter.Limit++
+
+	orders, err := s.orderRepo.FindOrders(r.Context(), userID, filter)
+	if err != nil {
+		log.Error("Could not retrieve orders", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	var meta *controllers.Meta
+	if len(orders) == filter.Limit {
+		orders = orders[:len(orders)-1]
+		last := orders[len(orders)-1]
+		meta = &controllers.Meta{NextCursor: controllers.EncodeOrderCursor(models.OrderCursor{
+			UploadedAt: last.UploadedAt,
+			OrderID:    last.OrderID,
+		})}
+	}
+
+	res := make([]controllers.OrderV2, 0, len(orders))
+	for _, v := range orders {
+		res = append(res, controllers.OrderModelToV2(*v))
+	}
+	writeEnvelope(w, r, http.StatusOK, res, meta)
+}
+
+func (s *Server) currentBalanceV2(w http.ResponseWriter, r *http.Request) {
+	log := logger2.FromContext(r.Context())
+	userID, err := controllers.UserIDFromContext(r.Context())
+	if err != nil {
+		log.Error("balance", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	balance, err := s.orderRepo.CurrentBalance(r.Context(), userID)
+	if err != nil {
+		log.Error("Internal error", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+	writeEnvelope(w, r, http.StatusOK, controllers.BalanceModelToV2(balance), nil)
+}
+
+func (s *Server) withdrawV2(w http.ResponseWriter, r *http.Request) {
+	log := logger2.FromContext(r.Context())
+	userID, err := controllers.UserIDFromContext(r.Context())
+	if err != nil {
+		log.Error("withdraw", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Error("Error reading body", zap.Error(err))
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeMalformedRequest, "could not read request body")
+		return
+	}
+
+	var req controllers.WithdrawRequestV2
+	if err := json.Unmarshal(body, &req); err != nil {
+		log.Error("Error decoding withdrawal", zap.Error(err), zap.ByteString("body", body))
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeMalformedRequest, "could not decode withdrawal")
+		return
+	}
+
+	orderID, ok := orderNumberV2(w, r, req.Order)
+	if !ok {
+		return
+	}
+	sum, ok := amountV2(w, r, req.Sum)
+	if !ok {
+		return
+	}
+
+	order := models.Order{
+		OrderID:    orderID,
+		Status:     models.NewStatus,
+		TXType:     models.WithdrawalOrder,
+		Accrual:    sum,
+		UserID:     userID,
+		UploadedAt: time.Now(),
+	}
+	if err := s.orderRepo.Withdraw(r.Context(), order); err != nil {
+		log.Info("Could not withdraw", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	order.ProcessedAt = order.UploadedAt
+	writeEnvelope(w, r, http.StatusOK, controllers.WithdrawalModelToV2(order), nil)
+}
+
+func (s *Server) listWithdrawalsV2(w http.ResponseWriter, r *http.Request) {
+	log := logger2.FromContext(r.Context())
+	userID, err := controllers.UserIDFromContext(r.Context())
+	if err != nil {
+		log.Error("withdrawals", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	withdrawals, err := s.orderRepo.ListWithdrawals(r.Context(), userID)
+	if err != nil {
+		log.Error("Could not retrieve withdrawals", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	sort.Slice(withdrawals, func(i, j int) bool {
+		return withdrawals[i].ProcessedAt.After(withdrawals[j].ProcessedAt)
+	})
+
+	res := make([]controllers.WithdrawalV2, 0, len(withdrawals))
+	for _, v := range withdrawals {
+		res = append(res, controllers.WithdrawalModelToV2(*v))
+	}
+	writeEnvelope(w, r, http.StatusOK, res, nil)
+}
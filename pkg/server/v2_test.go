@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-http-utils/headers"
+	"github.com/ldez/mimetype"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/require"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/problem"
+)
+
+func TestServer_v2Orders(t *testing.T) {
+	base := time.Date(2022, time.June, 20, 9, 0, 0, 0, time.UTC)
+	orderRepo := &fakeOrderRepo{
+		orders: map[int][]*models.Order{
+			1: {
+				{OrderID: 79927398713, Status: models.ProcessedStatus, Accrual: decimal.RequireFromString("0.3"), UserID: 1, UploadedAt: base},
+				{OrderID: 2377225624, Status: models.NewStatus, UserID: 1, UploadedAt: base.Add(time.Minute)},
+			},
+		},
+	}
+	srv := newTestServer(t, orderRepo)
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, authenticatedRequest(t, srv, http.MethodGet, "/api/v2/user/orders?limit=1", 1))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var page struct {
+		Data []map[string]interface{} `json:"data"`
+		Meta struct {
+			NextCursor string `json:"next_cursor"`
+		} `json:"meta"`
+	}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&page))
+	require.Len(t, page.Data, 1)
+	require.Equal(t, "79927398713", page.Data[0]["number"])
+	require.Equal(t, "0.30", page.Data[0]["accrual"])
+	require.NotEmpty(t, page.Meta.NextCursor)
+
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, authenticatedRequest(t, srv, http.MethodGet, "/api/v2/user/orders", 2))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `{"data": []}`, rec.Body.String())
+
+	upload := func(body string) *httptest.ResponseRecorder {
+		req := authenticatedRequestWithBody(t, srv, http.MethodPost, "/api/v2/user/orders", 1, strings.NewReader(body))
+		req.Header.Set(headers.ContentType, mimetype.ApplicationJSON)
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec = upload(`{"number": "12345678903"}`)
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	require.JSONEq(t, `{"data": {"number": "12345678903", "result": "accepted"}}`, rec.Body.String())
+
+	rec = upload(`{"number": "12345678903"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `{"data": {"number": "12345678903", "result": "already_uploaded"}}`, rec.Body.String())
+
+	for body, code := range map[string]problem.Code{
+		`{"number": 12345678903}`:            problem.CodeMalformedRequest,
+		`{"number": "12345678904"}`:          problem.CodeOrderNumberInvalid,
+		`{"number": "1234-5678"}`:            problem.CodeOrderNumberMalformed,
+		`{"number": "99999999999999999999"}`: problem.CodeUnsupportedNumber,
+		`{"number": "9999999999999999999"}`:  problem.CodeUnsupportedNumber,
+		`{"number": "012345678903"}`:         problem.CodeUnsupportedNumber,
+		`{"number": ""}`:                     problem.CodeOrderNumberMalformed,
+	} {
+		rec := upload(body)
+		var p problem.Problem
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&p), body)
+		require.Equal(t, code, p.Code, body)
+	}
+}
+
+func TestServer_v2Balance(t *testing.T) {
+	orderRepo := &fakeOrderRepo{
+		balance: models.Balance{
+			Current:   decimal.RequireFromString("0.1").Add(decimal.RequireFromString("0.2")),
+			Withdrawn: decimal.NewFromInt(42),
+		},
+	}
+	srv := newTestServer(t, orderRepo)
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, authenticatedRequest(t, srv, http.MethodGet, "/api/v2/user/balance", 1))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `{"data": {"current": "0.30", "withdrawn": "42.00"}}`, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, authenticatedRequest(t, srv, http.MethodGet, "/api/user/balance", 1))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.JSONEq(t, `{"Current": 0.3, "Withdrawn": 42}`, rec.Body.String())
+
+	withdraw := func(body string) *httptest.ResponseRecorder {
+		req := authenticatedRequestWithBody(t, srv, http.MethodPost, "/api/v2/user/balance/withdraw", 1, strings.NewReader(body))
+		req.Header.Set(headers.ContentType, mimetype.ApplicationJSON)
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec = withdraw(`{"order": "2377225624", "sum": "10.5"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	var resp struct {
+		Data struct {
+			Order string `json:"order"`
+			Sum   string `json:"sum"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	require.Equal(t, "2377225624", resp.Data.Order)
+	require.Equal(t, "10.50", resp.Data.Sum)
+
+	for _, sum := range []string{`"0"`, `"-1"`, `"1.005"`, `"ten"`} {
+		rec := withdraw(`{"order": "2377225624", "sum": ` + sum + `}`)
+		require.Equal(t, http.StatusUnprocessableEntity, rec.Code, sum)
+	}
+	require.Equal(t, 1, orderRepo.withdrawCalls)
+}
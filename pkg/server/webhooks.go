@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-http-utils/headers"
+	"github.com/ldez/mimetype"
+	"go.uber.org/zap"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/controllers"
+	logger2 "github.com/OmAsana/go-yapraktikum-final/pkg/logger"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/problem"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/webhook"
+)
+
+const webhookDeliveriesLimit = 100
+
+func (s *Server) createWebhook(w http.ResponseWriter, r *http.Request) {
+	log := logger2.FromContext(r.Context())
+	userID, err := controllers.UserIDFromContext(r.Context())
+	if err != nil {
+		log.Error("webhooks", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Error("Error reading body", zap.Error(err))
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeMalformedRequest, "could not read request body")
+		return
+	}
+
+	var req controllers.WebhookRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		log.Error("Error decoding webhook", zap.Error(err), zap.ByteString("body", body))
+		problem.Write(w, r, http.StatusBadRequest, problem.CodeMalformedRequest, "could not decode webhook")
+		return
+	}
+
+	if err := s.validateWebhook(r.Context(), req); err != nil {
+		log.Info("Invalid webhook", zap.Error(err))
+		problem.Write(w, r, http.StatusUnprocessableEntity, problem.CodeInvalidWebhook, err.Error())
+		return
+	}
+
+	secret, err := webhook.NewSecret()
+	if err != nil {
+		log.Error("Could not generate webhook secret", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	created, err := s.webhookRepo.CreateWebhook(r.Context(), models.Webhook{
+		UserID:     userID,
+		URL:        req.URL,
+		Secret:     secret,
+		EventTypes: req.Events,
+		CreatedAt:  time.Now(),
+	})
+	if err != nil {
+		log.Error("Could not create webhook", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	resp := controllers.WebhookModelToController(created)
+	resp.Secret = created.Secret
+
+	w.Header().Set(headers.ContentType, mimetype.ApplicationJSON)
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Error("Error encoding webhook", zap.Error(err))
+	}
+}
+
+func (s *Server) validateWebhook(ctx context.Context, req controllers.WebhookRequest) error {
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an absolute http or https url")
+	}
+	for _, e := range req.Events {
+		if !e.Known() {
+			return fmt.Errorf("unknown event %q", e)
+		}
+	}
+	return webhook.CheckURL(ctx, s.lookupIPAddr, req.URL)
+}
+
+func (s *Server) listWebhooks(w http.ResponseWriter, r *http.Request) {
+	log := logger2.FromContext(r.Context())
+	userID, err := controllers.UserIDFromContext(r.Context())
+	if err != nil {
+		log.Error("webhooks", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	webhooks, err := s.webhookRepo.ListWebhooks(r.Context(), userID)
+	if err != nil {
+		log.Error("Could not retrieve webhooks", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	if len(webhooks) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var res []controllers.Webhook
+	for _, v := range webhooks {
+		res = append(res, controllers.WebhookModelToController(*v))
+	}
+
+	w.Header().Set(headers.ContentType, mimetype.ApplicationJSON)
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Error("Error encoding webhooks", zap.Error(err))
+	}
+}
+
+func (s *Server) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	log := logger2.FromContext(r.Context())
+	userID, err := controllers.UserIDFromContext(r.Context())
+	if err != nil {
+		log.Error("webhooks", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	webhookID, err := strconv.Atoi(chi.URLParam(r, "webhookID"))
+	if err != nil {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeWebhookNotFound, "")
+		return
+	}
+
+	if err := s.webhookRepo.DeleteWebhook(r.Context(), userID, webhookID); err != nil {
+		log.Info("Could not delete webhook", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	log := logger2.FromContext(r.Context())
+	userID, err := controllers.UserIDFromContext(r.Context())
+	if err != nil {
+		log.Error("webhooks", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	webhookID, err := strconv.Atoi(chi.URLParam(r, "webhookID"))
+	if err != nil {
+		problem.Write(w, r, http.StatusNotFound, problem.CodeWebhookNotFound, "")
+		return
+	}
+
+	deliveries, err := s.webhookRepo.ListDeliveries(r.Context(), userID, webhookID, webhookDeliveriesLimit)
+	if err != nil {
+		log.Info("Could not retrieve webhook deliveries", zap.Error(err))
+		problem.WriteError(w, r, err)
+		return
+	}
+
+	if len(deliveries) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var res []controllers.WebhookDelivery
+	for _, v := range deliveries {
+		res = append(res, controllers.WebhookDeliveryModelToController(*v))
+	}
+
+	w.Header().Set(headers.ContentType, mimetype.ApplicationJSON)
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Error("Error encoding webhook deliveries", zap.Error(err))
+	}
+}
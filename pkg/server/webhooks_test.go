@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-http-utils/headers"
+	"github.com/ldez/mimetype"
+	"github.com/stretchr/testify/require"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/controllers"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/logger"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/problem"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/repo"
+)
+
+type fakeWebhookRepo struct {
+	repo.WebhookRepository
+	webhooks   []*models.Webhook
+	deliveries map[int][]*models.WebhookDelivery
+}
+
+func (f *fakeWebhookRepo) CreateWebhook(_ context.Context, webhook models.Webhook) (models.Webhook, error) {
+	webhook.ID = len(f.webhooks) + 1
+	f.webhooks = append(f.webhooks, &webhook)
+	return webhook, nil
+}
+
+func (f *fakeWebhookRepo) ListWebhooks(_ context.Context, userID int) ([]*models.Webhook, error) {
+	var res []*models.Webhook
+	for _, v := range f.webhooks {
+		if v.UserID == userID {
+			res = append(res, v)
+		}
+	}
+	return res, nil
+}
+
+func (f *fakeWebhookRepo) ListDeliveries(_ context.Context, userID int, webhookID int, _ int) ([]*models.WebhookDelivery, error) {
+	for _, v := range f.webhooks {
+		if v.ID == webhookID && v.UserID == userID {
+			return f.deliveries[webhookID], nil
+		}
+	}
+	return nil, repo.ErrWebhookNotFound
+}
+
+func TestServer_webhooks(t *testing.T) {
+	webhookRepo := &fakeWebhookRepo{deliveries: map[int][]*models.WebhookDelivery{}}
+	srv := NewServer(logger.NewNoop(), nil, &fakeOrderRepo{}, testSalt, WithWebhooks(webhookRepo))
+	srv.lookupIPAddr = func(_ context.Context, host string) ([]net.IPAddr, error) {
+		switch host {
+		case "merchant.example":
+			return []net.IPAddr{{IP: net.ParseIP("93.184.216.34")}}, nil
+		case "intranet.example":
+			return []net.IPAddr{{IP: net.ParseIP("10.0.0.5")}}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	create := func(t *testing.T, userID int, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := authenticatedRequestWithBody(t, srv, http.MethodPost, "/api/user/webhooks", userID, strings.NewReader(body))
+		req.Header.Set(headers.ContentType, mimetype.ApplicationJSON)
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := create(t, 1, `{"url": "https://merchant.example/hook", "events": ["order.processed"]}`)
+	require.Equal(t, http.StatusCreated, rec.Code)
+	var created controllers.Webhook
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&created))
+	require.Equal(t, 1, created.ID)
+	require.True(t, strings.HasPrefix(created.Secret, "whsec_"))
+	require.Equal(t, []models.WebhookEventType{models.OrderProcessedEvent}, created.Events)
+
+	for _, body := range []string{
+		`{"url": "ftp://merchant.example/hook"}`,
+		`{"url": "/relative"}`,
+		`{"url": "https://merchant.example/hook", "events": ["order.deleted"]}`,
+		`{"url": "http://127.0.0.1:8080/hook"}`,
+		`{"url": "http://169.254.169.254/latest/meta-data"}`,
+		`{"url": "http://localhost/hook"}`,
+		`{"url": "https://intranet.example/hook"}`,
+	} {
+		rec := create(t, 1, body)
+		require.Equal(t, http.StatusUnprocessableEntity, rec.Code, body)
+	}
+
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, authenticatedRequest(t, srv, http.MethodGet, "/api/user/webhooks", 1))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var listed []controllers.Webhook
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&listed))
+	require.Len(t, listed, 1)
+	require.Empty(t, listed[0].Secret)
+
+	webhookRepo.deliveries[1] = []*models.WebhookDelivery{{
+		ID:          1,
+		WebhookID:   1,
+		EventType:   models.OrderProcessedEvent,
+		Payload:     []byte(`{"type":"order.processed"}`),
+		Status:      models.DeliveryDelivered,
+		Attempts:    1,
+		CreatedAt:   time.Date(2022, time.June, 15, 10, 0, 0, 0, time.UTC),
+		DeliveredAt: time.Date(2022, time.June, 15, 10, 0, 1, 0, time.UTC),
+	}}
+
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, authenticatedRequest(t, srv, http.MethodGet, "/api/user/webhooks/1/deliveries", 1))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var deliveries []controllers.WebhookDelivery
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&deliveries))
+	require.Len(t, deliveries, 1)
+	require.Equal(t, "2022-06-15T10:00:01Z", deliveries[0].DeliveredAt)
+	require.JSONEq(t, `{"type":"order.processed"}`, string(deliveries[0].Payload))
+
+	rec = httptest.NewRecorder()
+	srv.ServeHTTP(rec, authenticatedRequest(t, srv, http.MethodGet, "/api/user/webhooks/1/deliveries", 2))
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	var p problem.Problem
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&p))
+	require.Equal(t, problem.CodeWebhookNotFound, p.Code)
+}
@@ -0,0 +1,177 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/logger"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert signs with parent, or self-signs when parent is nil.
+func newTestCert(t *testing.T, name string, parent *testCert, isCA bool) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})
+}
+
+func (c *testCert) keyPEM(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func (c *testCert) write(t *testing.T, dir string, modTime time.Time) (string, string) {
+	t.Helper()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	require.NoError(t, ioutil.WriteFile(certFile, c.certPEM(), 0o600))
+	require.NoError(t, ioutil.WriteFile(keyFile, c.keyPEM(t), 0o600))
+	require.NoError(t, os.Chtimes(certFile, modTime, modTime))
+	require.NoError(t, os.Chtimes(keyFile, modTime, modTime))
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.certPEM(), c.keyPEM(t))
+	require.NoError(t, err)
+	return cert
+}
+
+func TestParseVersion(t *testing.T) {
+	v, err := ParseVersion("1.3")
+	require.NoError(t, err)
+	require.Equal(t, uint16(tls.VersionTLS13), v)
+
+	_, err = ParseVersion("TLS1.2")
+	require.Error(t, err)
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	modTime := time.Now().Add(-time.Minute)
+
+	first := newTestCert(t, "first", nil, false)
+	certFile, keyFile := first.write(t, dir, modTime)
+
+	reloader, err := NewCertReloader(certFile, keyFile, logger.NewNoop())
+	require.NoError(t, err)
+
+	served := func() string {
+		cert, err := reloader.GetCertificate(nil)
+		require.NoError(t, err)
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		require.NoError(t, err)
+		return parsed.Subject.CommonName
+	}
+	require.Equal(t, "first", served())
+
+	reloaded, err := reloader.reload()
+	require.NoError(t, err)
+	require.False(t, reloaded)
+
+	second := newTestCert(t, "second", nil, false)
+	second.write(t, dir, modTime.Add(time.Second))
+	reloaded, err = reloader.reload()
+	require.NoError(t, err)
+	require.True(t, reloaded)
+	require.Equal(t, "second", served())
+
+	// a half written pair keeps the previous certificate
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte("garbage"), 0o600))
+	_, err = reloader.reload()
+	require.Error(t, err)
+	require.Equal(t, "second", served())
+}
+
+func TestMutualServer(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil, true)
+	serverCert := newTestCert(t, "server", ca, false)
+	certFile, keyFile := serverCert.write(t, dir, time.Now())
+	caFile := filepath.Join(dir, "ca.crt")
+	require.NoError(t, ioutil.WriteFile(caFile, ca.certPEM(), 0o600))
+
+	reloader, err := NewCertReloader(certFile, keyFile, logger.NewNoop())
+	require.NoError(t, err)
+	cfg, err := MutualServer(reloader, tls.VersionTLS12, caFile)
+	require.NoError(t, err)
+
+	// httptest would add its own certificate to the config
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}),
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	}
+	go func() {
+		_ = srv.Serve(tls.NewListener(lis, cfg))
+	}()
+	defer srv.Close()
+	url := "https://" + lis.Addr().String()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(clientCerts ...tls.Certificate) error {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			Certificates: clientCerts,
+		}}}
+		resp, err := client.Get(url)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	require.Error(t, get())
+	require.Error(t, get(newTestCert(t, "stranger", nil, false).tlsCertificate(t)))
+	require.NoError(t, get(newTestCert(t, "admin", ca, false).tlsCertificate(t)))
+}
@@ -0,0 +1,125 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+// ErrNonPublicAddress is returned for webhook URLs pointing at loopback,
+// private, link-local or otherwise internal addresses. Deliveries report
+// status codes and errors back to users, so such URLs would let them probe
+// internal services.
+var ErrNonPublicAddress = errors.New("webhook address is not public")
+
+// LookupIPAddr resolves hosts, net.DefaultResolver.LookupIPAddr fits.
+type LookupIPAddr func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+// internalSuffixes are names that never resolve to public services.
+var internalSuffixes = []string{".localhost", ".local", ".internal", ".lan", ".home.arpa"}
+
+// nonPublicNets are special purpose ranges not covered by the net.IP
+// predicates used in PublicIP.
+var nonPublicNets = mustParseCIDRs(
+	"0.0.0.0/8",       // this network
+	"100.64.0.0/10",   // carrier-grade NAT
+	"192.0.0.0/24",    // IETF protocol assignments
+	"192.0.2.0/24",    // documentation
+	"198.18.0.0/15",   // benchmarking
+	"198.51.100.0/24", // documentation
+	"203.0.113.0/24",  // documentation
+	"240.0.0.0/4",     // reserved and broadcast
+	"64:ff9b::/96",    // NAT64, embeds any IPv4 address
+	"64:ff9b:1::/48",  // local NAT64
+	"100::/64",        // discard
+	"2001::/32",       // Teredo, embeds any IPv4 address
+	"2001:db8::/32",   // documentation
+	"2002::/16",       // 6to4, embeds any IPv4 address
+	"fec0::/10",       // site-local
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, v := range cidrs {
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// PublicIP tells whether ip is a public unicast address webhooks may be
+// delivered to.
+func PublicIP(ip net.IP) bool {
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, n := range nonPublicNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckURL rejects webhook URLs whose host is internal or resolves to a
+// non-public address. Resolving again on delivery may yield other
+// addresses, the dispatcher checks them once more when dialing.
+func CheckURL(ctx context.Context, lookup LookupIPAddr, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "" {
+		return fmt.Errorf("url has no host")
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if !PublicIP(ip) {
+			return fmt.Errorf("%w: %s", ErrNonPublicAddress, ip)
+		}
+		return nil
+	}
+
+	if host == "localhost" || !strings.Contains(host, ".") {
+		return fmt.Errorf("%w: %s", ErrNonPublicAddress, host)
+	}
+	for _, suffix := range internalSuffixes {
+		if strings.HasSuffix(host, suffix) {
+			return fmt.Errorf("%w: %s", ErrNonPublicAddress, host)
+		}
+	}
+
+	addrs, err := lookup(ctx, host)
+	if err != nil {
+		return fmt.Errorf("could not resolve %s", host)
+	}
+	for _, addr := range addrs {
+		if !PublicIP(addr.IP) {
+			return fmt.Errorf("%w: %s resolves to %s", ErrNonPublicAddress, host, addr.IP)
+		}
+	}
+	return nil
+}
+
+// dialControl refuses connections to non-public addresses. It runs with
+// the resolved address right before connecting, so DNS answers changing
+// after CheckURL can not get around it.
+func dialControl(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); !PublicIP(ip) {
+		return fmt.Errorf("%w: %s", ErrNonPublicAddress, host)
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package webhook
+
+import "time"
+
+type Option func(d *Dispatcher)
+
+func WithUpdateInterval(t time.Duration) Option {
+	return func(d *Dispatcher) {
+		d.updateInterval = t
+	}
+}
+
+// WithRetries sets how many times a delivery is attempted and the delay
+// before the first retry. The delay doubles with every attempt up to max.
+func WithRetries(attempts int, backoff, max time.Duration) Option {
+	return func(d *Dispatcher) {
+		d.maxAttempts = attempts
+		d.backoff = backoff
+		d.maxBackoff = max
+	}
+}
+
+// WithPrivateAddresses allows deliveries to loopback and private
+// addresses, e.g. for receivers on the same host in development.
+func WithPrivateAddresses() Option {
+	return func(d *Dispatcher) {
+		d.allowPrivate = true
+	}
+}
@@ -0,0 +1,207 @@
+// Package webhook delivers queued webhook events to the URLs registered by
+// users.
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-http-utils/headers"
+	"github.com/go-resty/resty/v2"
+	"github.com/ldez/mimetype"
+	"go.uber.org/zap"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/repo"
+)
+
+const (
+	EventHeader     = "X-Gophermart-Event"
+	DeliveryHeader  = "X-Gophermart-Delivery"
+	TimestampHeader = "X-Gophermart-Timestamp"
+	SignatureHeader = "X-Gophermart-Signature"
+
+	signaturePrefix = "sha256="
+	secretPrefix    = "whsec_"
+)
+
+type Dispatcher struct {
+	webhookRepo    repo.WebhookRepository
+	log            *zap.Logger
+	client         *resty.Client
+	updateInterval time.Duration
+	batchSize      int
+	maxAttempts    int
+	backoff        time.Duration
+	maxBackoff     time.Duration
+
+	allowPrivate bool
+}
+
+func NewDispatcher(webhookRepo repo.WebhookRepository, logger *zap.Logger, opts ...Option) *Dispatcher {
+	d := &Dispatcher{
+		webhookRepo:    webhookRepo,
+		log:            logger,
+		updateInterval: 1 * time.Second,
+		batchSize:      20,
+		maxAttempts:    8,
+		backoff:        10 * time.Second,
+		maxBackoff:     1 * time.Hour,
+	}
+
+	for _, v := range opts {
+		v(d)
+	}
+
+	client := resty.New()
+	client.SetTimeout(10 * time.Second)
+	client.SetRedirectPolicy(resty.NoRedirectPolicy())
+	client.SetTransport(d.transport())
+	d.client = client
+
+	return d
+}
+
+// transport connects to public addresses only. Proxies are not used, the
+// address checked would be the one of the proxy.
+func (d *Dispatcher) transport() *http.Transport {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if !d.allowPrivate {
+		dialer.Control = dialControl
+	}
+	return &http.Transport{
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// NewSecret generates a secret used to sign deliveries of a new webhook.
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return secretPrefix + hex.EncodeToString(b), nil
+}
+
+// Sign computes the signature header value for a payload sent at
+// timestamp. The timestamp is signed too so receivers can reject replays.
+func Sign(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(payload)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a signature produced by Sign.
+func Verify(secret string, timestamp string, payload []byte, signature string) bool {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal([]byte(Sign(secret, ts, payload)), []byte(signature))
+}
+
+func (d *Dispatcher) retryDelay(attempts int) time.Duration {
+	delay := d.backoff
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= d.maxBackoff {
+			return d.maxBackoff
+		}
+	}
+	return delay
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, delivery *models.WebhookDelivery) {
+	log := d.log.With(zap.Int("deliveryID", delivery.ID), zap.Int("webhookID", delivery.WebhookID))
+
+	now := time.Now()
+	resp, err := d.client.R().
+		SetContext(ctx).
+		SetHeader(headers.ContentType, mimetype.ApplicationJSON).
+		SetHeader(EventHeader, string(delivery.EventType)).
+		SetHeader(DeliveryHeader, strconv.Itoa(delivery.ID)).
+		SetHeader(TimestampHeader, strconv.FormatInt(now.Unix(), 10)).
+		SetHeader(SignatureHeader, Sign(delivery.Secret, now.Unix(), delivery.Payload)).
+		SetBody(delivery.Payload).
+		Post(delivery.URL)
+
+	delivery.Attempts++
+	delivery.LastError = ""
+	delivery.LastStatusCode = 0
+	switch {
+	case err != nil:
+		delivery.LastError = err.Error()
+	case resp.IsSuccess():
+		delivery.LastStatusCode = resp.StatusCode()
+		delivery.Status = models.DeliveryDelivered
+		delivery.DeliveredAt = time.Now()
+	default:
+		delivery.LastStatusCode = resp.StatusCode()
+		delivery.LastError = resp.Status()
+	}
+
+	if delivery.Status != models.DeliveryDelivered {
+		if delivery.Attempts >= d.maxAttempts {
+			log.Error("Giving up on webhook delivery", zap.String("lastError", delivery.LastError))
+			delivery.Status = models.DeliveryFailed
+		} else {
+			log.Info("Webhook delivery failed, will retry", zap.String("lastError", delivery.LastError))
+			delivery.NextAttemptAt = time.Now().Add(d.retryDelay(delivery.Attempts))
+		}
+	}
+
+	if err := d.webhookRepo.SaveAttempt(ctx, *delivery); err != nil {
+		log.Error("Failed to save webhook delivery attempt", zap.Error(err))
+	}
+}
+
+func (d *Dispatcher) deliverDue(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			// deliveries stay claimed until the slowest of them times out
+			now := time.Now()
+			lease := now.Add(d.client.GetClient().Timeout + time.Minute)
+			deliveries, err := d.webhookRepo.ClaimDueDeliveries(ctx, now, d.batchSize, lease)
+			if err != nil {
+				d.log.Error("Error fetching webhook deliveries", zap.Error(err))
+				return
+			}
+			if len(deliveries) == 0 {
+				return
+			}
+			d.log.Info(fmt.Sprintf("Delivering %d webhook events", len(deliveries)))
+			for _, delivery := range deliveries {
+				d.deliver(ctx, delivery)
+			}
+		}
+	}
+}
+
+func (d *Dispatcher) Run(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			d.log.Info("Shutting down")
+			return nil
+		case <-time.After(d.updateInterval):
+			d.deliverDue(ctx)
+		}
+	}
+}
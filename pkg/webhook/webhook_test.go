@@ -0,0 +1,204 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/OmAsana/go-yapraktikum-final/pkg/logger"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/models"
+	"github.com/OmAsana/go-yapraktikum-final/pkg/repo"
+)
+
+type fakeWebhookRepo struct {
+	repo.WebhookRepository
+	due      []*models.WebhookDelivery
+	attempts []models.WebhookDelivery
+}
+
+func (f *fakeWebhookRepo) ClaimDueDeliveries(_ context.Context, _ time.Time, limit int, _ time.Time) ([]*models.WebhookDelivery, error) {
+	if len(f.due) < limit {
+		limit = len(f.due)
+	}
+	claimed := f.due[:limit]
+	f.due = f.due[limit:]
+	return claimed, nil
+}
+
+func (f *fakeWebhookRepo) SaveAttempt(_ context.Context, d models.WebhookDelivery) error {
+	f.attempts = append(f.attempts, d)
+	return nil
+}
+
+type receivedRequest struct {
+	header http.Header
+	body   []byte
+}
+
+func newReceiver(t *testing.T, status int) (*httptest.Server, *[]receivedRequest) {
+	t.Helper()
+	var received []receivedRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		received = append(received, receivedRequest{header: r.Header.Clone(), body: body})
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &received
+}
+
+func TestDispatcher_deliverDue(t *testing.T) {
+	payload := []byte(`{"type":"order.processed","data":{"order":"79927398713","status":"PROCESSED","accrual":500}}`)
+
+	t.Run("delivered", func(t *testing.T) {
+		receiver, received := newReceiver(t, http.StatusNoContent)
+		webhookRepo := &fakeWebhookRepo{due: []*models.WebhookDelivery{{
+			ID:        7,
+			WebhookID: 3,
+			EventType: models.OrderProcessedEvent,
+			Payload:   payload,
+			Status:    models.DeliveryPending,
+			URL:       receiver.URL + "/hook",
+			Secret:    "whsec_test",
+		}}}
+
+		NewDispatcher(webhookRepo, logger.NewNoop(), WithPrivateAddresses()).deliverDue(context.Background())
+
+		require.Len(t, *received, 1)
+		req := (*received)[0]
+		require.Equal(t, payload, req.body)
+		require.Equal(t, "order.processed", req.header.Get(EventHeader))
+		require.Equal(t, "7", req.header.Get(DeliveryHeader))
+		require.True(t, Verify("whsec_test", req.header.Get(TimestampHeader), req.body, req.header.Get(SignatureHeader)))
+		require.False(t, Verify("whsec_other", req.header.Get(TimestampHeader), req.body, req.header.Get(SignatureHeader)))
+
+		require.Len(t, webhookRepo.attempts, 1)
+		attempt := webhookRepo.attempts[0]
+		require.Equal(t, models.DeliveryDelivered, attempt.Status)
+		require.Equal(t, 1, attempt.Attempts)
+		require.Equal(t, http.StatusNoContent, attempt.LastStatusCode)
+		require.False(t, attempt.DeliveredAt.IsZero())
+	})
+
+	t.Run("retried with backoff", func(t *testing.T) {
+		receiver, received := newReceiver(t, http.StatusServiceUnavailable)
+		webhookRepo := &fakeWebhookRepo{due: []*models.WebhookDelivery{{
+			ID:       8,
+			Payload:  payload,
+			Status:   models.DeliveryPending,
+			Attempts: 2,
+			URL:      receiver.URL,
+			Secret:   "whsec_test",
+		}}}
+
+		before := time.Now()
+		NewDispatcher(webhookRepo, logger.NewNoop(), WithPrivateAddresses(), WithRetries(5, time.Minute, time.Hour)).deliverDue(context.Background())
+
+		require.Len(t, *received, 1)
+		require.Len(t, webhookRepo.attempts, 1)
+		attempt := webhookRepo.attempts[0]
+		require.Equal(t, models.DeliveryPending, attempt.Status)
+		require.Equal(t, 3, attempt.Attempts)
+		require.Equal(t, http.StatusServiceUnavailable, attempt.LastStatusCode)
+		require.NotEmpty(t, attempt.LastError)
+		require.WithinDuration(t, before.Add(4*time.Minute), attempt.NextAttemptAt, 5*time.Second)
+	})
+
+	t.Run("gives up", func(t *testing.T) {
+		receiver, _ := newReceiver(t, http.StatusInternalServerError)
+		webhookRepo := &fakeWebhookRepo{due: []*models.WebhookDelivery{{
+			ID:       9,
+			Payload:  payload,
+			Status:   models.DeliveryPending,
+			Attempts: 4,
+			URL:      receiver.URL,
+		}}}
+
+		NewDispatcher(webhookRepo, logger.NewNoop(), WithPrivateAddresses(), WithRetries(5, time.Minute, time.Hour)).deliverDue(context.Background())
+
+		require.Len(t, webhookRepo.attempts, 1)
+		require.Equal(t, models.DeliveryFailed, webhookRepo.attempts[0].Status)
+		require.Equal(t, 5, webhookRepo.attempts[0].Attempts)
+	})
+
+	t.Run("private address refused", func(t *testing.T) {
+		receiver, received := newReceiver(t, http.StatusNoContent)
+		webhookRepo := &fakeWebhookRepo{due: []*models.WebhookDelivery{{
+			ID:      10,
+			Payload: payload,
+			Status:  models.DeliveryPending,
+			URL:     receiver.URL,
+		}}}
+
+		NewDispatcher(webhookRepo, logger.NewNoop()).deliverDue(context.Background())
+
+		require.Empty(t, *received)
+		require.Len(t, webhookRepo.attempts, 1)
+		require.Equal(t, models.DeliveryPending, webhookRepo.attempts[0].Status)
+		require.Contains(t, webhookRepo.attempts[0].LastError, ErrNonPublicAddress.Error())
+	})
+}
+
+func TestCheckURL(t *testing.T) {
+	lookup := func(_ context.Context, host string) ([]net.IPAddr, error) {
+		switch host {
+		case "merchant.example":
+			return []net.IPAddr{{IP: net.ParseIP("93.184.216.34")}}, nil
+		case "rebind.example":
+			return []net.IPAddr{{IP: net.ParseIP("93.184.216.34")}, {IP: net.ParseIP("10.0.0.5")}}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{"https://merchant.example/hook", false},
+		{"https://93.184.216.34:8443/hook", false},
+		{"https://[2606:2800:220:1:248:1893:25c8:1946]/hook", false},
+		{"http://127.0.0.1/hook", true},
+		{"http://[::1]/hook", true},
+		{"http://[::ffff:127.0.0.1]/hook", true},
+		{"http://10.1.2.3/hook", true},
+		{"http://172.16.0.1/hook", true},
+		{"http://192.168.1.1/hook", true},
+		{"http://169.254.169.254/latest/meta-data", true},
+		{"http://100.64.0.1/hook", true},
+		{"http://0.0.0.0/hook", true},
+		{"http://[fd00::1]/hook", true},
+		{"http://localhost/hook", true},
+		{"http://db/hook", true},
+		{"http://metadata.google.internal/hook", true},
+		{"http://printer.local./hook", true},
+		{"https://rebind.example/hook", true},
+		{"https://unknown.example/hook", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			err := CheckURL(context.Background(), lookup, tt.url)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestDispatcher_retryDelay(t *testing.T) {
+	d := NewDispatcher(nil, logger.NewNoop(), WithRetries(10, time.Second, 10*time.Second))
+	require.Equal(t, time.Second, d.retryDelay(1))
+	require.Equal(t, 2*time.Second, d.retryDelay(2))
+	require.Equal(t, 8*time.Second, d.retryDelay(4))
+	require.Equal(t, 10*time.Second, d.retryDelay(5))
+	require.Equal(t, 10*time.Second, d.retryDelay(9))
+}